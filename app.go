@@ -22,6 +22,7 @@ import (
 	"github.com/mimiro-io/datahub/internal/conf"
 	"github.com/mimiro-io/datahub/internal/content"
 	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/manifests"
 	"github.com/mimiro-io/datahub/internal/security"
 	"github.com/mimiro-io/datahub/internal/server"
 	"github.com/mimiro-io/datahub/internal/service/scheduler"
@@ -43,6 +44,7 @@ type DatahubInstance struct {
 	tokenProviders      *security.TokenProviders
 	runner              *jobs.Runner
 	scheduler           *jobs.Scheduler
+	manifests           *manifests.Service
 	contentService      *content.Service
 	authorizer          func(logger *zap.SugaredLogger, scopes ...string) echo.MiddlewareFunc
 	webService          *web.WebService
@@ -57,6 +59,7 @@ func (dhi *DatahubInstance) Start() error {
 	dhi.logger.Info("Starting data hub instance")
 
 	dhi.updater.Start()
+	dhi.manifests.Start(context.Background())
 	// start web server
 	go func() {
 		err := dhi.webService.Start(context.Background())
@@ -91,6 +94,7 @@ func (dhi *DatahubInstance) Stop(ctx context.Context) error {
 	dhi.webService.Stop(ctx)
 	dhi.gc.Stop(ctx)
 	dhi.updater.Stop(ctx)
+	dhi.manifests.Stop(ctx)
 	dhi.scheduler.Stop(ctx)
 	dhi.store.Close()
 
@@ -131,6 +135,7 @@ func NewDatahubInstance(config *conf.Config) (*DatahubInstance, error) {
 	dhi.tokenProviders = security.NewTokenProviders(dhi.logger, dhi.providerManager, dhi.securityServiceCore)
 	dhi.runner = jobs.NewRunner(dhi.config, dhi.store, dhi.tokenProviders, dhi.eventBus, dhi.metricsClient)
 	dhi.scheduler = jobs.NewScheduler(dhi.config, dhi.store, dhi.dsManager, dhi.runner)
+	dhi.manifests = manifests.NewService(dhi.config, dhi.store, dhi.dsManager, dhi.scheduler)
 
 	dhi.contentService = content.NewContentService(dhi.config, dhi.store, dhi.metricsClient)
 	dhi.authorizer = web.NewAuthorizer(dhi.config, dhi.logger, dhi.securityServiceCore)
@@ -159,6 +164,7 @@ func NewDatahubInstance(config *conf.Config) (*DatahubInstance, error) {
 	serviceContext.Statsd = dhi.metricsClient
 	serviceContext.SecurityCore = dhi.securityServiceCore
 	serviceContext.JobsScheduler = dhi.scheduler
+	serviceContext.Manifests = dhi.manifests
 	serviceContext.DatasetManager = dhi.dsManager
 	serviceContext.EventBus = dhi.eventBus
 	serviceContext.Port = dhi.config.Port
@@ -222,14 +222,17 @@ var _ = Describe("The dataset endpoint", Ordered, Serial, func() {
 			bodyBytes, err := io.ReadAll(res.Body)
 			Expect(err).To(BeNil())
 
-			var jsonLd []interface{}
+			var jsonLd map[string]interface{}
 			err = json.Unmarshal(bodyBytes, &jsonLd)
 			Expect(err).To(BeNil())
 
 			// check that the JSON-LD context is present
-			Expect(jsonLd[0].(map[string]interface{})["@context"]).NotTo(BeZero())
+			Expect(jsonLd["@context"]).NotTo(BeZero())
 
-			Expect(jsonLd[11].(map[string]interface{})["rdf:type"]).NotTo(BeZero())
+			// ten entities and the continuation node
+			graph := jsonLd["@graph"].([]interface{})
+			Expect(graph).To(HaveLen(11))
+			Expect(graph[10].(map[string]interface{})["@type"]).To(Equal("core:continuation"))
 		})
 	})
 	Describe("The /entities and /changes API endpoints for regular datasets", Ordered, func() {
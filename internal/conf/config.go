@@ -89,10 +89,23 @@ func load(basePath string) (*Config, error) {
 		BackupSourceLocation:    viper.GetString("BACKUP_SOURCE_LOCATION"),
 		RunnerConfig: &RunnerConfig{
 			PoolIncremental: viper.GetInt("JOBS_MAX_INCREMENTAL"),
-			PoolFull:        viper.GetInt("JOBS_MAX_FULLSYNC"),
-			Concurrent:      1,
+			PoolFull:          viper.GetInt("JOBS_MAX_FULLSYNC"),
+			Concurrent:        1,
+			RunHistoryMaxRuns: viper.GetInt("JOBS_RUN_HISTORY_MAX_RUNS"),
+			RunHistoryMaxAge:  viper.GetDuration("JOBS_RUN_HISTORY_MAX_AGE"),
+			RunLogMaxEntries:  viper.GetInt("JOBS_RUN_LOG_MAX_ENTRIES"),
+
+			CircuitBreakerThreshold:    viper.GetInt("JOBS_CIRCUIT_BREAKER_THRESHOLD"),
+			CircuitBreakerOpenDuration: viper.GetDuration("JOBS_CIRCUIT_BREAKER_OPEN_DURATION"),
+		},
+		SlowLogThreshold:      viper.GetDuration("SLOW_LOG_THRESHOLD"),
+		MaxDecodedRequestSize: viper.GetInt64("MAX_DECODED_REQUEST_SIZE"),
+		Manifests: &ManifestsConfig{
+			Location:      viper.GetString("MANIFESTS_LOCATION"),
+			PollInterval:  viper.GetDuration("MANIFESTS_POLL_INTERVAL"),
+			PruneDatasets: viper.GetBool("MANIFESTS_PRUNE_DATASETS"),
+			AllowEmpty:    viper.GetBool("MANIFESTS_ALLOW_EMPTY"),
 		},
-		SlowLogThreshold: viper.GetDuration("SLOW_LOG_THRESHOLD"),
 	}, nil
 }
 
@@ -146,7 +159,17 @@ func parse(basePath string, logger *zap.SugaredLogger) error {
 	viper.SetDefault("SECURITY_STORAGE_LOCATION", fmt.Sprintf("%s/%s", home, "datahubsecurity"))
 	viper.SetDefault("JOBS_MAX_INCREMENTAL", 10)
 	viper.SetDefault("JOBS_MAX_FULLSYNC", 10)
+	viper.SetDefault("JOBS_RUN_HISTORY_MAX_RUNS", 100)
+	viper.SetDefault("JOBS_RUN_HISTORY_MAX_AGE", "720h")
+	viper.SetDefault("JOBS_RUN_LOG_MAX_ENTRIES", 1000)
+	viper.SetDefault("JOBS_CIRCUIT_BREAKER_THRESHOLD", 5)
+	viper.SetDefault("JOBS_CIRCUIT_BREAKER_OPEN_DURATION", "1m")
 	viper.SetDefault("SLOW_LOG_THRESHOLD", "1s")
+	viper.SetDefault("MAX_DECODED_REQUEST_SIZE", 1<<30) // 1 GiB
+	viper.SetDefault("MANIFESTS_LOCATION", "")
+	viper.SetDefault("MANIFESTS_POLL_INTERVAL", "30s")
+	viper.SetDefault("MANIFESTS_PRUNE_DATASETS", false)
+	viper.SetDefault("MANIFESTS_ALLOW_EMPTY", false)
 	viper.AutomaticEnv()
 
 	viper.SetConfigType("env")
@@ -44,6 +44,8 @@ type Config struct {
 	BackupSourceLocation    string
 	RunnerConfig            *RunnerConfig
 	SlowLogThreshold        time.Duration
+	MaxDecodedRequestSize   int64
+	Manifests               *ManifestsConfig
 }
 
 type AuthConfig struct {
@@ -64,8 +66,30 @@ type DatalayerJwtConfig struct {
 // RunnerConfig sets the initial config for the underlying job runner.
 // PoolIncremental defines the max number of jobs that can be ran at once
 // Concurrent defines how many of the same EntryID should be allowed, this should always be 0 in the datahub
+// RunHistoryMaxRuns and RunHistoryMaxAge limit how many runs are kept in the history of each job, 0 means no limit
+// RunLogMaxEntries is how many log entries are kept for each run, older entries are dropped first
+// CircuitBreakerThreshold is how many requests to a host can fail in a row before jobs stop sending to it for
+// CircuitBreakerOpenDuration, 0 turns circuit breaking off
 type RunnerConfig struct {
-	PoolIncremental int
-	PoolFull        int
-	Concurrent      int
+	PoolIncremental   int
+	PoolFull          int
+	Concurrent        int
+	RunHistoryMaxRuns int
+	RunHistoryMaxAge  time.Duration
+	RunLogMaxEntries  int
+
+	CircuitBreakerThreshold    int
+	CircuitBreakerOpenDuration time.Duration
+}
+
+// ManifestsConfig configures the desired state sync of jobs and datasets.
+// Location is the directory with the manifests, sync is turned off when it is empty
+// PollInterval is how often the directory is checked for changes
+// PruneDatasets allows datasets removed from the manifests to be deleted, by default they are kept
+// AllowEmpty allows a directory without manifests to remove everything the sync manages
+type ManifestsConfig struct {
+	Location      string
+	PollInterval  time.Duration
+	PruneDatasets bool
+	AllowEmpty    bool
 }
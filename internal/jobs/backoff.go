@@ -0,0 +1,166 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"math/rand"
+	"net/http"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+// Backoff is an exponential backoff with jitter. The delay before retry n, counted from 0, is
+// InitialDelay * Factor^n, at most MaxDelay. A random part of up to Jitter (0 to 1) of the delay is taken off, so that
+// jobs that fail at the same time do not retry in lockstep.
+type Backoff struct {
+	Retries      int
+	InitialDelay time.Duration
+	MaxDelay     time.Duration
+	Factor       float64
+	Jitter       float64
+}
+
+var (
+	// defaultSinkBackoff is used by http sinks without Backoff config
+	defaultSinkBackoff = Backoff{Retries: 3, InitialDelay: 2 * time.Second, MaxDelay: 30 * time.Second, Factor: 2, Jitter: 0.5}
+	// defaultTransformBackoff is used by http transforms without Backoff config, they are not retried by default
+	defaultTransformBackoff = Backoff{Retries: 0, InitialDelay: 2 * time.Second, MaxDelay: 30 * time.Second, Factor: 2, Jitter: 0.5}
+)
+
+// Next returns the delay before the given retry
+func (b Backoff) Next(retry int) time.Duration {
+	factor := b.Factor
+	if factor < 1 {
+		factor = 1
+	}
+	delay := float64(b.InitialDelay) * math.Pow(factor, float64(retry))
+	if b.MaxDelay > 0 && delay > float64(b.MaxDelay) {
+		delay = float64(b.MaxDelay)
+	}
+	if b.Jitter > 0 {
+		delay -= delay * b.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// parseBackoff reads the Backoff config of a sink or transform, with delays in seconds. Values that are left out
+// are taken from the defaults.
+func parseBackoff(config map[string]interface{}, defaults Backoff) (Backoff, error) {
+	backoff := defaults
+	raw, ok := config["Backoff"]
+	if !ok || raw == nil {
+		return backoff, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return backoff, errors.New("Backoff must be an object")
+	}
+	for key, value := range m {
+		f, ok := value.(float64)
+		if !ok || f < 0 {
+			return backoff, fmt.Errorf("Backoff.%s must be a positive number", key)
+		}
+		switch key {
+		case "Retries":
+			backoff.Retries = int(f)
+		case "InitialDelay":
+			backoff.InitialDelay = time.Duration(f * float64(time.Second))
+		case "MaxDelay":
+			backoff.MaxDelay = time.Duration(f * float64(time.Second))
+		case "Factor":
+			if f < 1 {
+				return backoff, errors.New("Backoff.Factor must be 1 or more")
+			}
+			backoff.Factor = f
+		case "Jitter":
+			if f > 1 {
+				return backoff, errors.New("Backoff.Jitter must be between 0 and 1")
+			}
+			backoff.Jitter = f
+		default:
+			return backoff, fmt.Errorf("unknown Backoff option '%s'. must be one of: Retries, InitialDelay, "+
+				"MaxDelay, Factor, Jitter", key)
+		}
+	}
+	return backoff, nil
+}
+
+// retryingClient sends requests through the circuit breaker of their host, and retries requests that could not be
+// sent or got a 5xx response, with backoff. Each attempt waits for the rate limiter, if there is one.
+type retryingClient struct {
+	client   *http.Client
+	backoff  Backoff
+	breaker  *circuitBreaker
+	limiter  *server.RateLimiter
+	entities int // the number of entities in each request, counted by the rate limiter
+}
+
+func (runner *Runner) newRetryingClient(endpoint string, timeout time.Duration, backoff Backoff) *retryingClient {
+	return &retryingClient{
+		client:  &http.Client{Timeout: timeout},
+		backoff: backoff,
+		breaker: runner.circuitBreakers.forURL(endpoint),
+	}
+}
+
+// limitedBy makes the client wait for the given rate limiter before each request
+func (c *retryingClient) limitedBy(limiter *server.RateLimiter, entities int) *retryingClient {
+	c.limiter = limiter
+	c.entities = entities
+	return c
+}
+
+func (c *retryingClient) Do(req *http.Request) (*http.Response, error) {
+	req.Close = true
+	var body []byte
+	if req.Body != nil {
+		var err error
+		if body, err = io.ReadAll(req.Body); err != nil {
+			return nil, err
+		}
+		_ = req.Body.Close()
+	}
+	for retry := 0; ; retry++ {
+		if err := c.breaker.allow(); err != nil {
+			return nil, err
+		}
+		if body != nil {
+			req.Body = io.NopCloser(bytes.NewReader(body))
+		}
+		res, err := c.limiter.Do(c.client, req, c.entities)
+		failure := err
+		if err == nil && res.StatusCode >= http.StatusInternalServerError {
+			failure = fmt.Errorf("received status %d from %s", res.StatusCode, req.URL.Host)
+		}
+		c.breaker.record(failure)
+		if failure == nil || retry >= c.backoff.Retries {
+			return res, err
+		}
+		if res != nil {
+			_ = res.Body.Close()
+		}
+		select {
+		case <-time.After(c.backoff.Next(retry)):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
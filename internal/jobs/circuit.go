@@ -0,0 +1,296 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"go.uber.org/zap"
+)
+
+const (
+	CircuitClosed   = "closed"
+	CircuitOpen     = "open"
+	CircuitHalfOpen = "halfOpen"
+)
+
+// ErrCircuitOpen is returned for requests to a host whose circuit breaker is open. Jobs that get it are put on hold
+// instead of failing.
+var ErrCircuitOpen = errors.New("circuit breaker is open")
+
+// CircuitState is the state of the circuit breaker of a host, and the jobs it holds
+type CircuitState struct {
+	Host                string     `json:"host"`
+	State               string     `json:"state"` // closed, open or halfOpen
+	ConsecutiveFailures int        `json:"consecutiveFailures"`
+	LastError           string     `json:"lastError,omitempty"`
+	OpenedAt            *time.Time `json:"openedAt,omitempty"`
+	RetryAt             *time.Time `json:"retryAt,omitempty"`
+	HeldJobs            []string   `json:"heldJobs"`
+}
+
+// circuitBreakers has a circuit breaker for each host that jobs send requests to, so that all jobs stop sending to
+// a host that keeps failing. After a number of consecutive failures the circuit opens, and requests fail right away
+// with ErrCircuitOpen. When the circuit has been open for a while, a single trial request is let through. If it
+// succeeds the circuit closes, otherwise it opens again.
+type circuitBreakers struct {
+	lock         sync.Mutex
+	threshold    int // 0 turns the circuit breakers off
+	openDuration time.Duration
+	breakers     map[string]*circuitBreaker
+	logger       *zap.SugaredLogger
+	statsdClient statsd.ClientInterface
+}
+
+type circuitBreaker struct {
+	lock      sync.Mutex
+	parent    *circuitBreakers
+	host      string
+	state     string
+	failures  int
+	lastError string
+	openedAt  time.Time
+	trial     bool // the trial request of a half open circuit is underway
+	heldJobs  map[string]bool
+}
+
+func newCircuitBreakers(
+	threshold int,
+	openDuration time.Duration,
+	logger *zap.SugaredLogger,
+	statsdClient statsd.ClientInterface,
+) *circuitBreakers {
+	return &circuitBreakers{
+		threshold:    threshold,
+		openDuration: openDuration,
+		breakers:     make(map[string]*circuitBreaker),
+		logger:       logger,
+		statsdClient: statsdClient,
+	}
+}
+
+// forURL returns the circuit breaker of the host of an url. It returns nil when circuit breakers are turned off,
+// which lets all requests through.
+func (c *circuitBreakers) forURL(rawURL string) *circuitBreaker {
+	if c == nil || c.threshold <= 0 {
+		return nil
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return nil
+	}
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	b, ok := c.breakers[u.Host]
+	if !ok {
+		b = &circuitBreaker{parent: c, host: u.Host, state: CircuitClosed, heldJobs: make(map[string]bool)}
+		c.breakers[u.Host] = b
+	}
+	return b
+}
+
+// open returns the first open circuit breaker of the given urls, or nil if requests can be sent to all of them
+func (c *circuitBreakers) open(urls ...string) *circuitBreaker {
+	for _, u := range urls {
+		if b := c.forURL(u); b != nil && b.isOpen() {
+			return b
+		}
+	}
+	return nil
+}
+
+// states returns the state of all circuit breakers, sorted by host
+func (c *circuitBreakers) states() []CircuitState {
+	if c == nil {
+		return []CircuitState{}
+	}
+	c.lock.Lock()
+	breakers := make([]*circuitBreaker, 0, len(c.breakers))
+	for _, b := range c.breakers {
+		breakers = append(breakers, b)
+	}
+	c.lock.Unlock()
+
+	states := make([]CircuitState, 0, len(breakers))
+	for _, b := range breakers {
+		states = append(states, b.status())
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Host < states[j].Host })
+	return states
+}
+
+// allow returns ErrCircuitOpen if no request should be sent to the host now
+func (b *circuitBreaker) allow() error {
+	if b == nil {
+		return nil
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	switch b.state {
+	case CircuitOpen:
+		if time.Now().Before(b.openedAt.Add(b.parent.openDuration)) {
+			return b.errorLocked()
+		}
+		b.setState(CircuitHalfOpen)
+		b.trial = true
+	case CircuitHalfOpen:
+		if b.trial {
+			return b.errorLocked()
+		}
+		b.trial = true
+	}
+	return nil
+}
+
+// openError returns the error that requests to the host fail with while the circuit is open
+func (b *circuitBreaker) openError() error {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.errorLocked()
+}
+
+func (b *circuitBreaker) errorLocked() error {
+	if b.state == CircuitHalfOpen {
+		return fmt.Errorf("%w for %s, waiting for a trial request: %s", ErrCircuitOpen, b.host, b.lastError)
+	}
+	retryAt := b.openedAt.Add(b.parent.openDuration)
+	return fmt.Errorf("%w for %s until %s: %s", ErrCircuitOpen, b.host, retryAt.Format(time.RFC3339), b.lastError)
+}
+
+// record counts the outcome of a request to the host, nil meaning it succeeded
+func (b *circuitBreaker) record(err error) {
+	if b == nil {
+		return
+	}
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.trial = false
+	if err == nil {
+		b.failures = 0
+		if b.state != CircuitClosed {
+			b.setState(CircuitClosed)
+		}
+		return
+	}
+	b.failures++
+	b.lastError = err.Error()
+	if b.state == CircuitHalfOpen || (b.state == CircuitClosed && b.failures >= b.parent.threshold) {
+		b.openedAt = time.Now()
+		b.setState(CircuitOpen)
+	}
+}
+
+func (b *circuitBreaker) isOpen() bool {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	return b.state == CircuitOpen && time.Now().Before(b.openedAt.Add(b.parent.openDuration)) ||
+		b.state == CircuitHalfOpen && b.trial
+}
+
+// hold registers a job as put on hold by this circuit breaker, until it closes
+func (b *circuitBreaker) hold(jobID string) {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	b.heldJobs[jobID] = true
+}
+
+// setState must be called with the lock held
+func (b *circuitBreaker) setState(state string) {
+	b.state = state
+	tags := []string{"application:datahub", "host:" + b.host}
+	open := 0.0
+	switch state {
+	case CircuitOpen:
+		open = 1
+		b.parent.logger.Warnf("Circuit breaker for %s opened after %v consecutive failures, last error: %s",
+			b.host, b.failures, b.lastError)
+		_ = b.parent.statsdClient.Count("jobs.circuit.opened", 1, tags, 1)
+	case CircuitHalfOpen:
+		b.parent.logger.Infof("Circuit breaker for %s is half open, letting a trial request through", b.host)
+	case CircuitClosed:
+		b.parent.logger.Infof("Circuit breaker for %s closed, %v jobs on hold run again on their next trigger",
+			b.host, len(b.heldJobs))
+		b.heldJobs = make(map[string]bool)
+	}
+	_ = b.parent.statsdClient.Gauge("jobs.circuit.open", open, tags, 1)
+}
+
+func (b *circuitBreaker) status() CircuitState {
+	b.lock.Lock()
+	defer b.lock.Unlock()
+	state := CircuitState{
+		Host:                b.host,
+		State:               b.state,
+		ConsecutiveFailures: b.failures,
+		LastError:           b.lastError,
+		HeldJobs:            make([]string, 0, len(b.heldJobs)),
+	}
+	if b.state != CircuitClosed {
+		openedAt := b.openedAt
+		retryAt := b.openedAt.Add(b.parent.openDuration)
+		state.OpenedAt, state.RetryAt = &openedAt, &retryAt
+	}
+	for id := range b.heldJobs {
+		state.HeldJobs = append(state.HeldJobs, id)
+	}
+	sort.Strings(state.HeldJobs)
+	return state
+}
+
+// circuitEndpoints returns the urls the job sends requests to through circuit breakers
+func (j *job) circuitEndpoints() []string {
+	var urls []string
+	spec := j.pipeline.spec()
+	sink := spec.sink
+	if w, ok := sink.(*wrappedSink); ok {
+		sink = w.s
+	}
+	if s, ok := sink.(*httpDatasetSink); ok {
+		urls = append(urls, s.Endpoint)
+	}
+	transform := spec.transform
+	if w, ok := transform.(*wrappedTransform); ok {
+		transform = w.t
+	}
+	if t, ok := transform.(*HTTPTransform); ok {
+		urls = append(urls, t.URL)
+	}
+	return urls
+}
+
+// hold puts the job on hold, because the circuit breaker of a host it sends to is open. It runs again on its next
+// trigger.
+func (j *job) hold(b *circuitBreaker, reason error) {
+	if b != nil {
+		b.hold(j.id)
+	}
+	_ = j.runner.statsdClient.Count("jobs.onhold", 1,
+		[]string{"application:datahub", fmt.Sprintf("jobs:job-%s", j.title)}, 1)
+	j.runner.logger.Infow(fmt.Sprintf("Job '%s' (%s) is on hold: %v", j.title, j.id, reason),
+		"job.jobId", j.id,
+		"job.jobTitle", j.title,
+		"job.state", "OnHold")
+}
+
+// GetCircuitStates returns the state of the circuit breakers of the hosts that jobs send requests to
+func (s *Scheduler) GetCircuitStates() []CircuitState {
+	return s.Runner.circuitBreakers.states()
+}
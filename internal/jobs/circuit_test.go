@@ -0,0 +1,172 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("Backoff", func() {
+	It("Should grow the delay exponentially up to the max, and take jitter off", func() {
+		b := Backoff{InitialDelay: time.Second, MaxDelay: 5 * time.Second, Factor: 2}
+		Expect([]time.Duration{b.Next(0), b.Next(1), b.Next(2), b.Next(3)}).
+			To(Equal([]time.Duration{time.Second, 2 * time.Second, 4 * time.Second, 5 * time.Second}))
+
+		b.Jitter = 0.5
+		for i := 0; i < 20; i++ {
+			Expect(b.Next(1)).To(And(BeNumerically(">=", time.Second), BeNumerically("<=", 2*time.Second)))
+		}
+
+		eh := &ErrorHandler{RetryDelay: int64(time.Second), MaxRetryDelay: int64(3 * time.Second), BackoffFactor: 2}
+		Expect([]time.Duration{eh.nextRetryDelay(), eh.nextRetryDelay(), eh.nextRetryDelay()}).
+			To(Equal([]time.Duration{time.Second, 2 * time.Second, 3 * time.Second}))
+	})
+
+	It("Should read backoff config with delays in seconds", func() {
+		b, err := parseBackoff(map[string]interface{}{
+			"Backoff": map[string]interface{}{"Retries": float64(5), "InitialDelay": 0.5, "Factor": float64(3)},
+		}, defaultSinkBackoff)
+		Expect(err).To(BeNil())
+		Expect(b.Retries).To(Equal(5))
+		Expect(b.InitialDelay).To(Equal(500 * time.Millisecond))
+		Expect(b.Factor).To(Equal(3.0))
+		Expect(b.MaxDelay).To(Equal(defaultSinkBackoff.MaxDelay))
+
+		for config, message := range map[string]string{
+			"Jitter":  "between 0 and 1",
+			"Factor":  "1 or more",
+			"Retries": "positive number",
+			"Delay":   "unknown Backoff option",
+		} {
+			value := map[string]float64{"Jitter": 2, "Factor": 0.5, "Retries": -1, "Delay": 1}[config]
+			_, err := parseBackoff(map[string]interface{}{"Backoff": map[string]interface{}{config: value}}, Backoff{})
+			Expect(err).To(MatchError(ContainSubstring(message)), config)
+		}
+	})
+})
+
+var _ = Describe("Circuit breakers", func() {
+	testCnt := 0
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	var srv *httptest.Server
+	var requests int32
+	var failing atomic.Bool
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testcircuit_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, _, _ = setupScheduler(storeLocation)
+		runner.circuitBreakers = newCircuitBreakers(2, time.Hour, runner.logger, runner.statsdClient)
+
+		atomic.StoreInt32(&requests, 0)
+		failing.Store(true)
+		srv = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			if failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			w.WriteHeader(http.StatusOK)
+		}))
+	})
+	AfterEach(func() {
+		srv.Close()
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	sinkJob := func(id string, retries int) *JobConfiguration {
+		return &JobConfiguration{
+			ID: id, Title: id, Paused: true,
+			Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(5)},
+			Sink: map[string]interface{}{
+				"Type":    "HttpDatasetSink",
+				"Url":     srv.URL + "/datasets/" + id + "/entities",
+				"Backoff": map[string]interface{}{"Retries": float64(retries), "InitialDelay": 0.01},
+			},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+		}
+	}
+	run := func(config *JobConfiguration) *JobRun {
+		triggered, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		triggered[0].Run()
+		runs, err := scheduler.GetJobRuns(config.ID, 0, 1)
+		Expect(err).To(BeNil())
+		if len(runs.Runs) == 0 {
+			return nil
+		}
+		return runs.Runs[0]
+	}
+
+	It("Should retry failed requests, and hold all jobs sending to the host when the circuit opens", func() {
+		first, second := sinkJob("first", 1), sinkJob("second", 0)
+		Expect(scheduler.AddJob(first)).To(BeNil())
+		Expect(scheduler.AddJob(second)).To(BeNil())
+
+		Expect(run(first).Status).To(Equal(RunStatusFailed))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)), "the failed request is retried once")
+		states := scheduler.GetCircuitStates()
+		Expect(states).To(HaveLen(1))
+		Expect(states[0].State).To(Equal(CircuitOpen))
+		Expect(states[0].ConsecutiveFailures).To(Equal(2))
+		Expect(states[0].LastError).To(ContainSubstring("503"))
+
+		// the circuit is shared, so the second job is held before it sends anything
+		Expect(run(second)).To(BeNil(), "held jobs are not run")
+		Expect(run(first).Status).To(Equal(RunStatusFailed), "the run history is unchanged")
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(2)))
+		Expect(scheduler.GetCircuitStates()[0].HeldJobs).To(Equal([]string{"first", "second"}))
+		Expect(scheduler.GetRunningJobs()).To(BeEmpty())
+
+		// once the host is back and the circuit has been open long enough, a trial request closes it
+		failing.Store(false)
+		runner.circuitBreakers.openDuration = 0
+		Expect(run(second).Status).To(Equal(RunStatusSucceeded))
+		states = scheduler.GetCircuitStates()
+		Expect(states[0].State).To(Equal(CircuitClosed))
+		Expect(states[0].HeldJobs).To(BeEmpty())
+	})
+
+	It("Should put a run on hold instead of failing it when the circuit opens during the run", func() {
+		runner.circuitBreakers.threshold = 1
+		config := sinkJob("onhold", 2)
+		config.Triggers[0].ErrorHandlers = []*ErrorHandler{{Type: "deadLetter"}}
+		Expect(scheduler.AddJob(config)).To(BeNil())
+
+		r := run(config)
+		Expect(r.Status).To(Equal(RunStatusOnHold))
+		Expect(r.Errors[0]).To(ContainSubstring("circuit breaker is open"))
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(1)), "retries are not sent while the circuit is open")
+
+		page, _ := scheduler.GetDeadLetters("onhold", 0, 0)
+		Expect(page.Total).To(Equal(0), "entities are not dead letters when the host is down")
+	})
+})
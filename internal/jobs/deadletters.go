@@ -0,0 +1,312 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var (
+	ErrJobNotFound = errors.New("job not found")
+	ErrJobRunning  = errors.New("job is running")
+	ErrNoTickets   = errors.New("no free job tickets")
+)
+
+// DeadLetter is an entity that a job failed to process, kept until it is replayed or discarded
+type DeadLetter struct {
+	JobID       string         `json:"jobId"`
+	EntityID    string         `json:"entityId"`
+	Stage       string         `json:"stage"` // transform or sink
+	Error       string         `json:"error"`
+	Attempts    int            `json:"attempts"`
+	FirstFailed time.Time      `json:"firstFailed"`
+	LastFailed  time.Time      `json:"lastFailed"`
+	Entity      *server.Entity `json:"entity,omitempty"`
+}
+
+// DeadLetters is a page of the dead letters of a job, most recently failed first. The entities are left out,
+// they are returned when getting a single dead letter.
+type DeadLetters struct {
+	Total       int           `json:"total"`
+	Offset      int           `json:"offset"`
+	Limit       int           `json:"limit"`
+	DeadLetters []*DeadLetter `json:"deadLetters"`
+}
+
+// DeadLetterReplay is the outcome of replaying dead letters. Entities that fail again stay in the dead letters.
+type DeadLetterReplay struct {
+	Replayed  int               `json:"replayed"`
+	Succeeded []string          `json:"succeeded"`
+	Failed    map[string]string `json:"failed"` // entity id -> error
+}
+
+// DeadLetterFailingEntityHandler stores failing entities in the dead letters of the job
+type DeadLetterFailingEntityHandler struct {
+	lock     sync.Mutex
+	count    int
+	MaxItems int
+}
+
+func (d *DeadLetterFailingEntityHandler) reset() {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.count = 0
+}
+
+func (d *DeadLetterFailingEntityHandler) handleFailingEntity(runner *Runner, entity *server.Entity, jobId string) error {
+	return d.handleFailure(runner, entity, jobId, "", nil)
+}
+
+// handleFailure stores a failing entity together with the stage it failed in and the error it failed with
+func (d *DeadLetterFailingEntityHandler) handleFailure(
+	runner *Runner,
+	entity *server.Entity,
+	jobID string,
+	stage string,
+	cause error,
+) error {
+	d.lock.Lock()
+	if d.MaxItems > 0 && d.count >= d.MaxItems {
+		d.lock.Unlock()
+		return MaxItemsExceededError
+	}
+	d.count = d.count + 1
+	d.lock.Unlock()
+	runner.logger.Warnf("entity %v failed to process, storing it as dead letter of job %v", entity.ID, jobID)
+	return runner.storeDeadLetter(jobID, entity, stage, cause)
+}
+
+func deadLetterKey(jobID string, entityID string) string {
+	return jobID + "::" + entityID
+}
+
+func deadLettersPrefix(jobID string) []byte {
+	return append(server.DeadLetterIndexBytes, []byte("::"+jobID+"::")...)
+}
+
+// storeDeadLetter adds an entity to the dead letters of a job. If the entity is there already, its attempts
+// are counted up and the error is replaced.
+func (runner *Runner) storeDeadLetter(jobID string, entity *server.Entity, stage string, cause error) error {
+	runner.deadLetterLock.Lock()
+	defer runner.deadLetterLock.Unlock()
+
+	now := time.Now()
+	letter := &DeadLetter{}
+	if err := runner.store.GetObject(server.DeadLetterIndex, deadLetterKey(jobID, entity.ID), letter); err != nil {
+		return err
+	}
+	if letter.EntityID == "" {
+		letter = &DeadLetter{JobID: jobID, EntityID: entity.ID, FirstFailed: now}
+	}
+	letter.Attempts++
+	letter.LastFailed = now
+	letter.Stage = stage
+	letter.Error = ""
+	if cause != nil {
+		letter.Error = cause.Error()
+	}
+	letter.Entity = entity
+	return runner.store.StoreObject(server.DeadLetterIndex, deadLetterKey(jobID, entity.ID), letter)
+}
+
+func (runner *Runner) loadDeadLetters(jobID string) ([]*DeadLetter, error) {
+	letters := make([]*DeadLetter, 0)
+	err := runner.store.IterateObjectsRaw(deadLettersPrefix(jobID), func(jsonData []byte) error {
+		letter := &DeadLetter{}
+		if err := json.Unmarshal(jsonData, letter); err != nil {
+			return err
+		}
+		letters = append(letters, letter)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.SliceStable(letters, func(i, j int) bool { return letters[i].LastFailed.After(letters[j].LastFailed) })
+	return letters, nil
+}
+
+// deleteDeadLetters removes the given dead letters of a job, or all of them if no entity ids are given.
+// It returns the number of dead letters removed.
+func (runner *Runner) deleteDeadLetters(jobID string, entityIDs []string) (int, error) {
+	runner.deadLetterLock.Lock()
+	defer runner.deadLetterLock.Unlock()
+
+	if len(entityIDs) == 0 {
+		letters, err := runner.loadDeadLetters(jobID)
+		if err != nil {
+			return 0, err
+		}
+		for _, l := range letters {
+			entityIDs = append(entityIDs, l.EntityID)
+		}
+	}
+	deleted := 0
+	for _, id := range entityIDs {
+		letter := &DeadLetter{}
+		if err := runner.store.GetObject(server.DeadLetterIndex, deadLetterKey(jobID, id), letter); err != nil {
+			return deleted, err
+		}
+		if letter.EntityID == "" {
+			continue
+		}
+		if err := runner.store.DeleteObject(server.DeadLetterIndex, deadLetterKey(jobID, id)); err != nil {
+			return deleted, err
+		}
+		deleted++
+	}
+	return deleted, nil
+}
+
+// GetDeadLetters returns a page of the dead letters of a job, most recently failed first
+func (s *Scheduler) GetDeadLetters(jobID string, offset int, limit int) (*DeadLetters, error) {
+	if offset < 0 {
+		return nil, errors.New("offset can not be negative")
+	}
+	if limit <= 0 {
+		limit = DefaultRunsLimit
+	}
+	if limit > MaxRunsLimit {
+		limit = MaxRunsLimit
+	}
+	letters, err := s.Runner.loadDeadLetters(jobID)
+	if err != nil {
+		return nil, err
+	}
+	page := &DeadLetters{Total: len(letters), Offset: offset, Limit: limit, DeadLetters: make([]*DeadLetter, 0)}
+	if offset < len(letters) {
+		end := offset + limit
+		if end > len(letters) {
+			end = len(letters)
+		}
+		for _, l := range letters[offset:end] {
+			l.Entity = nil
+			page.DeadLetters = append(page.DeadLetters, l)
+		}
+	}
+	return page, nil
+}
+
+// GetDeadLetter returns a single dead letter of a job with its entity, or nil if it is not found
+func (s *Scheduler) GetDeadLetter(jobID string, entityID string) (*DeadLetter, error) {
+	letter := &DeadLetter{}
+	if err := s.Store.GetObject(server.DeadLetterIndex, deadLetterKey(jobID, entityID), letter); err != nil {
+		return nil, err
+	}
+	if letter.EntityID == "" {
+		return nil, nil
+	}
+	return letter, nil
+}
+
+// DiscardDeadLetters removes the given dead letters of a job without processing them, or all of them if no entity
+// ids are given. It returns the number of dead letters removed.
+func (s *Scheduler) DiscardDeadLetters(jobID string, entityIDs []string) (int, error) {
+	return s.Runner.deleteDeadLetters(jobID, entityIDs)
+}
+
+// ReplayDeadLetters runs the given dead letters of a job, or all of them if no entity ids are given, through the
+// pipeline of the job again. Entities that failed in the transform are transformed and written to the sink,
+// entities that failed in the sink are only written to the sink. Entities that succeed are removed from the
+// dead letters, entities that fail again get their attempts counted up. The job can not be running while its
+// dead letters are replayed, so the replay holds an incremental ticket of the job like a run does.
+func (s *Scheduler) ReplayDeadLetters(jobID string, entityIDs []string) (*DeadLetterReplay, error) {
+	jobConfig, err := s.LoadJob(jobID)
+	if err != nil {
+		return nil, err
+	}
+	if jobConfig.ID == "" {
+		return nil, fmt.Errorf("%w: %s", ErrJobNotFound, jobID)
+	}
+	pipeline, err := s.toPipeline(jobConfig, JobTypeIncremental)
+	if err != nil {
+		return nil, err
+	}
+
+	ticket := s.Runner.raffle.borrowTicket(&job{id: jobID, title: jobConfig.Title, pipeline: pipeline})
+	if ticket == nil {
+		if s.GetRunningJob(jobID) != nil {
+			return nil, fmt.Errorf("%w: dead letters of %s can be replayed when the run is done", ErrJobRunning, jobID)
+		}
+		return nil, fmt.Errorf("%w: dead letters of %s can be replayed when other jobs are done", ErrNoTickets, jobID)
+	}
+	defer s.Runner.raffle.returnTicket(ticket)
+
+	var letters []*DeadLetter
+	if len(entityIDs) == 0 {
+		letters, err = s.Runner.loadDeadLetters(jobID)
+		if err != nil {
+			return nil, err
+		}
+	} else {
+		for _, id := range entityIDs {
+			letter, err := s.GetDeadLetter(jobID, id)
+			if err != nil {
+				return nil, err
+			}
+			if letter != nil {
+				letters = append(letters, letter)
+			}
+		}
+	}
+
+	spec := pipeline.spec()
+
+	result := &DeadLetterReplay{Succeeded: make([]string, 0), Failed: make(map[string]string)}
+	for _, letter := range letters {
+		if err := ticket.runState.ctx.Err(); err != nil { // the replay was killed like a run
+			break
+		}
+		result.Replayed++
+		if err := replayEntity(s.Runner, spec, jobConfig.Title, letter); err != nil {
+			result.Failed[letter.EntityID] = err.Error()
+			if err := s.Runner.storeDeadLetter(jobID, letter.Entity, letter.Stage, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result.Succeeded = append(result.Succeeded, letter.EntityID)
+		if _, err := s.Runner.deleteDeadLetters(jobID, []string{letter.EntityID}); err != nil {
+			return nil, err
+		}
+	}
+	s.Logger.Infof("Replayed %v dead letters of job %s, %v failed again", result.Replayed, jobID, len(result.Failed))
+	return result, nil
+}
+
+func replayEntity(runner *Runner, spec *PipelineSpec, jobTitle string, letter *DeadLetter) error {
+	if letter.Entity == nil {
+		return errors.New("dead letter has no entity")
+	}
+	entities := []*server.Entity{letter.Entity}
+	if letter.Stage == RunLogSourceTransform && spec.transform != nil {
+		var err error
+		entities, err = spec.transform.transformEntities(runner, entities, jobTitle)
+		if err != nil {
+			return err
+		}
+	}
+	if len(entities) == 0 {
+		return nil
+	}
+	return spec.sink.processEntities(runner, entities)
+}
@@ -0,0 +1,238 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("Dead letters", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testdeadletters_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, dsm, _ = setupScheduler(storeLocation)
+		_, _ = dsm.CreateDataset("out", nil)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	deadLetterJob := func(js string) *JobConfiguration {
+		config := &JobConfiguration{
+			ID: "dl", Title: "dl", Paused: true, BatchSize: 10,
+			Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(10)},
+			Sink:   map[string]interface{}{"Type": "DatasetSink", "Name": "out"},
+			Triggers: []JobTrigger{{
+				TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h",
+				ErrorHandlers: []*ErrorHandler{{Type: "deadLetter"}},
+			}},
+		}
+		if js != "" {
+			config.Transform = map[string]interface{}{
+				"Type": "JavascriptTransform",
+				"Code": base64.StdEncoding.EncodeToString([]byte(js)),
+			}
+		}
+		return config
+	}
+	written := func() int {
+		result, err := dsm.GetDataset("out").GetEntities("", 100)
+		Expect(err).To(BeNil())
+		return len(result.Entities)
+	}
+
+	It("Should keep entities that fail in the sink, and replay and discard them", func() {
+		config := deadLetterJob("")
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		triggered, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		triggered[0].pipeline.(*IncrementalPipeline).sink = &pickySink{}
+		triggered[0].Run()
+
+		page, err := scheduler.GetDeadLetters("dl", 0, 0)
+		Expect(err).To(BeNil())
+		Expect(page.Total).To(Equal(3), "entities 3, 6 and 9 are refused by the sink")
+		for _, l := range page.DeadLetters {
+			Expect(l.Stage).To(Equal(RunLogSourceSink))
+			Expect(l.Error).To(Equal("picky sink"))
+			Expect(l.Attempts).To(Equal(1))
+			Expect(l.LastFailed).NotTo(BeZero())
+			Expect(l.Entity).To(BeNil(), "entities are left out of the list")
+		}
+		runs, _ := scheduler.GetJobRuns("dl", 0, 0)
+		Expect(runs.Runs[0].Counts.Failed).To(Equal(3))
+
+		id := page.DeadLetters[0].EntityID
+		letter, err := scheduler.GetDeadLetter("dl", id)
+		Expect(err).To(BeNil())
+		Expect(letter.Entity.ID).To(Equal(id))
+		missing, err := scheduler.GetDeadLetter("dl", "nope")
+		Expect(err).To(BeNil())
+		Expect(missing).To(BeNil())
+
+		// the stored job writes to a dataset, so the replay succeeds
+		replay, err := scheduler.ReplayDeadLetters("dl", []string{id})
+		Expect(err).To(BeNil())
+		Expect(replay.Replayed).To(Equal(1))
+		Expect(replay.Succeeded).To(Equal([]string{id}))
+		Expect(written()).To(Equal(1))
+
+		discarded, err := scheduler.DiscardDeadLetters("dl", nil)
+		Expect(err).To(BeNil())
+		Expect(discarded).To(Equal(2))
+		page, _ = scheduler.GetDeadLetters("dl", 0, 0)
+		Expect(page.Total).To(Equal(0))
+	})
+
+	It("Should hold a ticket of the job while replaying", func() {
+		config := deadLetterJob("")
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		triggered, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		triggered[0].pipeline.(*IncrementalPipeline).sink = &pickySink{}
+		triggered[0].Run()
+		tickets := runner.raffle.ticketsIncr
+
+		// a run that has started keeps the replay out
+		running := runner.raffle.borrowTicket(triggered[0])
+		Expect(running).NotTo(BeNil())
+		_, err = scheduler.ReplayDeadLetters("dl", nil)
+		Expect(err).To(MatchError(ErrJobRunning))
+		runner.raffle.returnTicket(running)
+
+		runner.raffle.ticketsIncr = 0
+		_, err = scheduler.ReplayDeadLetters("dl", nil)
+		Expect(err).To(MatchError(ErrNoTickets))
+		runner.raffle.ticketsIncr = tickets
+
+		replay, err := scheduler.ReplayDeadLetters("dl", nil)
+		Expect(err).To(BeNil())
+		Expect(replay.Succeeded).To(HaveLen(3))
+		Expect(runner.raffle.ticketsIncr).To(Equal(tickets), "the ticket is returned after the replay")
+		Expect(scheduler.GetRunningJob("dl")).To(BeNil())
+	})
+
+	It("Should transform the entities of a failing batch at most twice", func() {
+		config := deadLetterJob("")
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		triggered, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		counting := &countingTransform{calls: make(map[string]int)}
+		triggered[0].pipeline.(*IncrementalPipeline).transform = counting
+		triggered[0].Run()
+
+		Expect(written()).To(Equal(9))
+		Expect(counting.batches).To(Equal(11), "the batch of 10, and then each entity alone")
+		for id, calls := range counting.calls {
+			Expect(calls).To(Equal(2), id)
+		}
+		page, _ := scheduler.GetDeadLetters("dl", 0, 0)
+		Expect(page.Total).To(Equal(1))
+	})
+
+	It("Should keep entities that fail in the transform, and count attempts when replays fail", func() {
+		failing := `function transform_entities(entities) {
+			for (var e of entities) {
+				if (e.ID.endsWith("-4")) {
+					throw new Error("cannot transform " + e.ID);
+				}
+			}
+			return entities;
+		}`
+		config := deadLetterJob(failing)
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		triggered, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		triggered[0].Run()
+
+		Expect(written()).To(Equal(9), "the rest of the batch goes on to the sink")
+		page, err := scheduler.GetDeadLetters("dl", 0, 0)
+		Expect(err).To(BeNil())
+		Expect(page.Total).To(Equal(1))
+		letter := page.DeadLetters[0]
+		Expect(strings.HasSuffix(letter.EntityID, "-4")).To(BeTrue())
+		Expect(letter.Stage).To(Equal(RunLogSourceTransform))
+		Expect(letter.Error).To(ContainSubstring("cannot transform"))
+
+		runs, _ := scheduler.GetJobRuns("dl", 0, 0)
+		Expect(runs.Runs[0].Status).To(Equal(RunStatusFailed))
+		Expect(runs.Runs[0].Counts.Failed).To(Equal(1))
+
+		replay, err := scheduler.ReplayDeadLetters("dl", nil)
+		Expect(err).To(BeNil())
+		Expect(replay.Failed).To(HaveKey(letter.EntityID))
+		retried, _ := scheduler.GetDeadLetter("dl", letter.EntityID)
+		Expect(retried.Attempts).To(Equal(2))
+		Expect(retried.FirstFailed).To(Equal(letter.FirstFailed))
+
+		// once the transform is fixed, the replay goes through the transform and into the sink
+		Expect(scheduler.AddJob(deadLetterJob(`function transform_entities(entities) { return entities; }`))).To(BeNil())
+		replay, err = scheduler.ReplayDeadLetters("dl", nil)
+		Expect(err).To(BeNil())
+		Expect(replay.Succeeded).To(HaveLen(1))
+		Expect(written()).To(Equal(10))
+		page, _ = scheduler.GetDeadLetters("dl", 0, 0)
+		Expect(page.Total).To(Equal(0))
+
+		_, err = scheduler.ReplayDeadLetters("unknown", nil)
+		Expect(err).To(MatchError(ErrJobNotFound))
+	})
+})
+
+// countingTransform counts how often each entity is transformed, and fails batches with an entity ending in -4
+type countingTransform struct {
+	batches int
+	calls   map[string]int
+}
+
+func (c *countingTransform) GetConfig() map[string]interface{} {
+	return map[string]interface{}{"Type": "test"}
+}
+
+func (c *countingTransform) transformEntities(runner *Runner, entities []*server.Entity, jobTag string) ([]*server.Entity, error) {
+	c.batches++
+	var err error
+	for _, e := range entities {
+		c.calls[e.ID]++
+		if strings.HasSuffix(e.ID, "-4") {
+			err = errors.New("cannot transform " + e.ID)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+	return entities, nil
+}
+
+func (c *countingTransform) getParallelism() int { return 1 }
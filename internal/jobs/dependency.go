@@ -0,0 +1,384 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	DependencyAllOf = "allOf"
+	DependencyAnyOf = "anyOf"
+
+	UpstreamPending   = "pending"
+	UpstreamSucceeded = "succeeded"
+	UpstreamFailed    = "failed"
+	UpstreamMissing   = "missing"
+)
+
+// dependencyRetryInterval is how long a triggered dependent job waits before trying again, when it could not start
+// because it is already running or all tickets are taken
+var dependencyRetryInterval = 5 * time.Second
+
+// UpstreamState is what a dependent job knows about one of its upstream jobs since the dependent job was last triggered
+type UpstreamState struct {
+	JobID     string     `json:"jobId"`
+	State     string     `json:"state"` // pending, succeeded, failed or missing
+	Completed *time.Time `json:"completed,omitempty"`
+	Error     string     `json:"error,omitempty"`
+}
+
+// JobGraphNode is a job that depends on other jobs, or that other jobs depend on
+type JobGraphNode struct {
+	ID              string          `json:"id"`
+	Title           string          `json:"title"`
+	Paused          bool            `json:"paused"`
+	Condition       string          `json:"condition,omitempty"`
+	ForwardFailures bool            `json:"forwardFailures"`
+	Upstream        []UpstreamState `json:"upstream"`
+	Downstream      []string        `json:"downstream"`
+	LastRun         *jobResult      `json:"lastRun,omitempty"`
+}
+
+// dependentJob is a job with an ondependency trigger, and the completions of its upstream jobs since it last ran
+type dependentJob struct {
+	job             *job
+	dependsOn       []string
+	condition       string
+	forwardFailures bool
+	upstream        map[string]UpstreamState
+	due             bool // triggered, but the run has not started yet
+	starting        bool // a goroutine is trying to start the run
+}
+
+// dependencies keeps track of the dependent jobs registered with the runner. This state is only kept in memory,
+// so upstream completions and triggered runs that have not started are lost when the data hub restarts.
+type dependencies struct {
+	lock sync.Mutex
+	jobs map[string]*dependentJob
+}
+
+func newDependencies() *dependencies {
+	return &dependencies{jobs: make(map[string]*dependentJob)}
+}
+
+// record registers that an upstream job completed, and returns what the dependent job should do:
+// run it, forward a failure, or keep waiting
+func (d *dependentJob) record(upstreamID string, err error) (run bool, failure error) {
+	now := time.Now()
+	state := UpstreamState{JobID: upstreamID, State: UpstreamSucceeded, Completed: &now}
+	if err != nil {
+		state.State = UpstreamFailed
+		state.Error = err.Error()
+	}
+	d.upstream[upstreamID] = state
+
+	succeeded, failed := 0, 0
+	var firstFailure UpstreamState
+	for _, id := range d.dependsOn {
+		switch d.upstream[id].State {
+		case UpstreamSucceeded:
+			succeeded++
+		case UpstreamFailed:
+			if failed == 0 {
+				firstFailure = d.upstream[id]
+			}
+			failed++
+		}
+	}
+	if d.condition == DependencyAnyOf {
+		run = err == nil
+		if d.forwardFailures && failed == len(d.dependsOn) {
+			failure = fmt.Errorf("all upstream jobs failed, first was '%s': %s", firstFailure.JobID, firstFailure.Error)
+		}
+	} else {
+		run = succeeded == len(d.dependsOn)
+		if d.forwardFailures && err != nil {
+			failure = fmt.Errorf("upstream job '%s' failed: %s", upstreamID, err.Error())
+		}
+	}
+	if run || failure != nil {
+		d.upstream = make(map[string]UpstreamState)
+	}
+	if run {
+		d.due = true
+	}
+	return run, failure
+}
+
+// addDependentJob registers a job to be run when its upstream jobs complete
+func (runner *Runner) addDependentJob(j *job) error {
+	runner.logger.Infof("Adding job with id '%s'(%s) to run after %v", j.id, j.title, j.dependsOn)
+	condition := j.condition
+	if condition == "" {
+		condition = DependencyAllOf
+	}
+	runner.dependencies.lock.Lock()
+	defer runner.dependencies.lock.Unlock()
+	runner.dependencies.jobs[j.id] = &dependentJob{
+		job:             j,
+		dependsOn:       j.dependsOn,
+		condition:       condition,
+		forwardFailures: j.forwardFailures,
+		upstream:        make(map[string]UpstreamState),
+	}
+	return nil
+}
+
+// removeDependentJob forgets a dependent job, together with the upstream completions it has seen
+func (runner *Runner) removeDependentJob(jobID string) {
+	if runner.dependencies == nil {
+		return
+	}
+	runner.dependencies.lock.Lock()
+	defer runner.dependencies.lock.Unlock()
+	delete(runner.dependencies.jobs, jobID)
+}
+
+// jobCompleted is called when a job run ends, and starts the jobs that depend on it. If a dependent job is set
+// to forward failures, its run is recorded as failed without running it, and the failure is passed on to the
+// jobs depending on it.
+func (runner *Runner) jobCompleted(jobID string, err error) {
+	if runner.dependencies == nil {
+		return
+	}
+	var toRun []*dependentJob
+	failed := make(map[*job]error)
+	runner.dependencies.lock.Lock()
+	for _, d := range runner.dependencies.jobs {
+		if !containsString(d.dependsOn, jobID) {
+			continue
+		}
+		run, failure := d.record(jobID, err)
+		if run {
+			// a run that is still trying to start also covers this trigger
+			if !d.starting {
+				d.starting = true
+				toRun = append(toRun, d)
+			}
+		} else if failure != nil {
+			failed[d.job] = failure
+		}
+	}
+	runner.dependencies.lock.Unlock()
+
+	for _, d := range toRun {
+		runner.logger.Infof("Upstream job '%s' completed, starting job with id '%s' (%s)", jobID, d.job.id, d.job.title)
+		go runner.runDependent(d)
+	}
+	for j, failure := range failed {
+		runner.logger.Warnf("Job with id '%s' (%s) not run: %v", j.id, j.title, failure)
+		j.failRun(failure)
+		runner.jobCompleted(j.id, failure)
+	}
+}
+
+// runDependent runs a triggered dependent job. If the run does not start, because the job is already running or
+// there are no tickets, it is tried again until it starts, or until the job is removed.
+func (runner *Runner) runDependent(d *dependentJob) {
+	for {
+		d.job.Run()
+		runner.dependencies.lock.Lock()
+		again := d.due && runner.dependencies.jobs[d.job.id] == d
+		if !again {
+			d.starting = false
+		}
+		runner.dependencies.lock.Unlock()
+		if !again {
+			return
+		}
+		time.Sleep(dependencyRetryInterval)
+	}
+}
+
+// dependencyStarted is called when a job run starts, which is the run owed to its upstream jobs if it was triggered
+func (runner *Runner) dependencyStarted(jobID string) {
+	if runner.dependencies == nil {
+		return
+	}
+	runner.dependencies.lock.Lock()
+	defer runner.dependencies.lock.Unlock()
+	if d, ok := runner.dependencies.jobs[jobID]; ok {
+		d.due = false
+	}
+}
+
+// upstreamStates returns the upstream states of a registered dependent job, or nil if it is not registered
+func (runner *Runner) upstreamStates(jobID string) map[string]UpstreamState {
+	if runner.dependencies == nil {
+		return nil
+	}
+	runner.dependencies.lock.Lock()
+	defer runner.dependencies.lock.Unlock()
+	d, ok := runner.dependencies.jobs[jobID]
+	if !ok {
+		return nil
+	}
+	states := make(map[string]UpstreamState, len(d.upstream))
+	for k, v := range d.upstream {
+		states[k] = v
+	}
+	return states
+}
+
+// dependencyTrigger returns the ondependency trigger of a job configuration, or nil if it has none
+func dependencyTrigger(jobConfig *JobConfiguration) *JobTrigger {
+	for i, t := range jobConfig.Triggers {
+		if t.TriggerType == TriggerTypeDependency {
+			return &jobConfig.Triggers[i]
+		}
+	}
+	return nil
+}
+
+// verifyDependencyTrigger checks the options of an ondependency trigger
+func verifyDependencyTrigger(trigger JobTrigger) error {
+	if len(trigger.DependsOn) == 0 {
+		return errors.New("trigger type 'ondependency' requires that 'dependsOn' lists at least one job id")
+	}
+	if trigger.Condition != "" && trigger.Condition != DependencyAllOf && trigger.Condition != DependencyAnyOf {
+		return errors.New("need to set 'condition'. must be one of: allOf, anyOf")
+	}
+	return nil
+}
+
+// verifyDependencies makes sure a job has at most one ondependency trigger, and that adding it to the other
+// jobs does not create a cycle of dependencies
+func verifyDependencies(jobConfig *JobConfiguration, existing []*JobConfiguration) error {
+	count := 0
+	for _, t := range jobConfig.Triggers {
+		if t.TriggerType == TriggerTypeDependency {
+			count++
+		}
+	}
+	if count > 1 {
+		return errors.New("a job can only have one 'ondependency' trigger")
+	}
+
+	graph := make(map[string][]string)
+	for _, c := range existing {
+		if t := dependencyTrigger(c); t != nil {
+			graph[c.ID] = t.DependsOn
+		}
+	}
+	delete(graph, jobConfig.ID)
+	if t := dependencyTrigger(jobConfig); t != nil {
+		graph[jobConfig.ID] = t.DependsOn
+	}
+
+	// any new cycle has to go through the job being added
+	visited := make(map[string]bool)
+	var path []string
+	var visit func(id string) bool
+	visit = func(id string) bool {
+		path = append(path, id)
+		for _, upstream := range graph[id] {
+			if upstream == jobConfig.ID {
+				path = append(path, upstream)
+				return true
+			}
+			if !visited[upstream] {
+				visited[upstream] = true
+				if visit(upstream) {
+					return true
+				}
+			}
+		}
+		path = path[:len(path)-1]
+		return false
+	}
+	if visit(jobConfig.ID) {
+		return fmt.Errorf("job dependencies can not form a cycle: %s", strings.Join(path, " -> "))
+	}
+	return nil
+}
+
+// GetJobGraph returns the jobs that are linked by ondependency triggers, with the upstream completions that each
+// dependent job has seen since it last ran
+func (s *Scheduler) GetJobGraph() []*JobGraphNode {
+	configs := s.ListJobs()
+	byID := make(map[string]*JobConfiguration, len(configs))
+	for _, c := range configs {
+		byID[c.ID] = c
+	}
+
+	nodes := make(map[string]*JobGraphNode)
+	node := func(id string) *JobGraphNode {
+		n, ok := nodes[id]
+		if !ok {
+			n = &JobGraphNode{ID: id, Upstream: make([]UpstreamState, 0), Downstream: make([]string, 0)}
+			if c, found := byID[id]; found {
+				n.Title = c.Title
+				n.Paused = c.Paused
+			}
+			lastRun := &jobResult{}
+			if err := s.Store.GetObject(server.JobResultIndex, id, lastRun); err == nil && lastRun.ID != "" {
+				n.LastRun = lastRun
+			}
+			nodes[id] = n
+		}
+		return n
+	}
+
+	for _, c := range configs {
+		t := dependencyTrigger(c)
+		if t == nil {
+			continue
+		}
+		n := node(c.ID)
+		n.Condition = t.Condition
+		if n.Condition == "" {
+			n.Condition = DependencyAllOf
+		}
+		n.ForwardFailures = t.ForwardFailures
+		states := s.Runner.upstreamStates(c.ID)
+		for _, upstream := range t.DependsOn {
+			state, ok := states[upstream]
+			if !ok {
+				state = UpstreamState{JobID: upstream, State: UpstreamPending}
+			}
+			if _, found := byID[upstream]; !found {
+				state.State = UpstreamMissing
+			}
+			n.Upstream = append(n.Upstream, state)
+			u := node(upstream)
+			u.Downstream = append(u.Downstream, c.ID)
+		}
+	}
+
+	result := make([]*JobGraphNode, 0, len(nodes))
+	for _, n := range nodes {
+		sort.Strings(n.Downstream)
+		result = append(result, n)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].ID < result[j].ID })
+	return result
+}
+
+func containsString(values []string, value string) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,212 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("Job dependencies", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testdependencies_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, dsm, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	upstream := func(id string) *JobConfiguration {
+		return &JobConfiguration{
+			ID: id, Title: id, Paused: true,
+			Source:   map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(5)},
+			Sink:     map[string]interface{}{"Type": "DevNullSink"},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+		}
+	}
+	dependent := func(id string, trigger JobTrigger) *JobConfiguration {
+		trigger.TriggerType = TriggerTypeDependency
+		trigger.JobType = JobTypeIncremental
+		return &JobConfiguration{
+			ID: id, Title: id,
+			Source:   map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(5)},
+			Sink:     map[string]interface{}{"Type": "DatasetSink", "Name": id},
+			Triggers: []JobTrigger{trigger},
+		}
+	}
+	stateOf := func(jobID string) map[string]string {
+		states := map[string]string{}
+		for _, n := range scheduler.GetJobGraph() {
+			if n.ID == jobID {
+				for _, u := range n.Upstream {
+					states[u.JobID] = u.State
+				}
+			}
+		}
+		return states
+	}
+	lastError := func(jobID string) string {
+		result := &jobResult{}
+		_ = store.GetObject(server.JobResultIndex, jobID, result)
+		return result.LastError
+	}
+
+	It("Should reject invalid dependency triggers and cycles", func() {
+		Expect(scheduler.AddJob(upstream("a"))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("b", JobTrigger{DependsOn: []string{"a"}}))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("c", JobTrigger{DependsOn: []string{"b"}}))).To(BeNil())
+
+		err := scheduler.AddJob(dependent("x", JobTrigger{}))
+		Expect(err).To(Equal(errors.New("trigger type 'ondependency' requires that 'dependsOn' lists at least one job id")))
+		err = scheduler.AddJob(dependent("x", JobTrigger{DependsOn: []string{"a"}, Condition: "someOf"}))
+		Expect(err).To(Equal(errors.New("need to set 'condition'. must be one of: allOf, anyOf")))
+		err = scheduler.AddJob(dependent("x", JobTrigger{DependsOn: []string{"x"}}))
+		Expect(err).To(Equal(errors.New("job dependencies can not form a cycle: x -> x")))
+
+		a := dependent("a", JobTrigger{DependsOn: []string{"c"}})
+		err = scheduler.AddJob(a)
+		Expect(err).To(Equal(errors.New("job dependencies can not form a cycle: a -> c -> b -> a")))
+	})
+
+	It("Should run a job when all of its upstream jobs have succeeded", func() {
+		Expect(scheduler.AddJob(upstream("a"))).To(BeNil())
+		Expect(scheduler.AddJob(upstream("b"))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("c", JobTrigger{DependsOn: []string{"a", "b"}}))).To(BeNil())
+		_, _ = dsm.CreateDataset("c", nil)
+
+		_, err := scheduler.RunJob("a", JobTypeIncremental)
+		Expect(err).To(BeNil())
+		Eventually(func() map[string]string { return stateOf("c") }).
+			Should(Equal(map[string]string{"a": UpstreamSucceeded, "b": UpstreamPending}))
+		Expect(lastError("c")).To(BeEmpty())
+		res, _ := dsm.GetDataset("c").GetEntities("", 10)
+		Expect(res.Entities).To(BeEmpty(), "c waits for b")
+
+		_, err = scheduler.RunJob("b", JobTypeIncremental)
+		Expect(err).To(BeNil())
+		Eventually(func() int {
+			res, _ := dsm.GetDataset("c").GetEntities("", 10)
+			return len(res.Entities)
+		}).Should(Equal(5))
+		Expect(stateOf("c")).To(Equal(map[string]string{"a": UpstreamPending, "b": UpstreamPending}))
+
+		graph := scheduler.GetJobGraph()
+		Expect(graph).To(HaveLen(3))
+		Expect(graph[0].Downstream).To(Equal([]string{"c"}))
+		Expect(graph[2].Condition).To(Equal(DependencyAllOf))
+	})
+
+	It("Should run a job when any of its upstream jobs has succeeded", func() {
+		Expect(scheduler.AddJob(upstream("a"))).To(BeNil())
+		Expect(scheduler.AddJob(upstream("b"))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("c", JobTrigger{DependsOn: []string{"a", "b"}, Condition: DependencyAnyOf}))).
+			To(BeNil())
+		_, _ = dsm.CreateDataset("c", nil)
+
+		runner.jobCompleted("a", errors.New("boom"))
+		Expect(stateOf("c")).To(Equal(map[string]string{"a": UpstreamFailed, "b": UpstreamPending}))
+		runner.jobCompleted("b", nil)
+		Eventually(func() int {
+			res, _ := dsm.GetDataset("c").GetEntities("", 10)
+			return len(res.Entities)
+		}).Should(Equal(5))
+	})
+
+	It("Should run a triggered job once it gets a ticket", func() {
+		interval := dependencyRetryInterval
+		dependencyRetryInterval = 10 * time.Millisecond
+		defer func() { dependencyRetryInterval = interval }()
+		Expect(scheduler.AddJob(upstream("a"))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("b", JobTrigger{DependsOn: []string{"a"}}))).To(BeNil())
+		_, _ = dsm.CreateDataset("b", nil)
+		entities := func() int {
+			res, _ := dsm.GetDataset("b").GetEntities("", 10)
+			return len(res.Entities)
+		}
+
+		// b is already running, so the triggered run has to wait for it
+		runner.raffle.runningMu.Lock()
+		runner.raffle.runningJobs["b"] = &runState{id: "b"}
+		runner.raffle.runningMu.Unlock()
+		runner.jobCompleted("a", nil)
+		runner.jobCompleted("a", nil)
+		Consistently(entities, 50*time.Millisecond).Should(Equal(0))
+
+		runner.raffle.runningMu.Lock()
+		delete(runner.raffle.runningJobs, "b")
+		runner.raffle.runningMu.Unlock()
+		Eventually(entities).Should(Equal(5))
+		Eventually(func() bool {
+			runner.dependencies.lock.Lock()
+			defer runner.dependencies.lock.Unlock()
+			d := runner.dependencies.jobs["b"]
+			return d.due || d.starting
+		}).Should(BeFalse())
+	})
+
+	It("Should forward failures down the chain when asked to", func() {
+		Expect(scheduler.AddJob(upstream("a"))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("b", JobTrigger{DependsOn: []string{"a"}, ForwardFailures: true}))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("c", JobTrigger{DependsOn: []string{"b"}, ForwardFailures: true}))).To(BeNil())
+		Expect(scheduler.AddJob(dependent("d", JobTrigger{DependsOn: []string{"b"}}))).To(BeNil())
+
+		runner.jobCompleted("a", errors.New("boom"))
+		Expect(lastError("b")).To(Equal("upstream job 'a' failed: boom"))
+		Expect(lastError("c")).To(Equal("upstream job 'b' failed: upstream job 'a' failed: boom"))
+		Expect(lastError("d")).To(BeEmpty(), "d waits for b to succeed")
+		Expect(stateOf("d")).To(Equal(map[string]string{"b": UpstreamFailed}))
+		Expect(stateOf("b")).To(Equal(map[string]string{"a": UpstreamPending}))
+
+		// the forwarded failure is a run in the history of the job, with a log
+		runs, err := scheduler.GetJobRuns("c", 0, 0)
+		Expect(err).To(BeNil())
+		Expect(runs.Runs).To(HaveLen(1))
+		Expect(runs.Runs[0].Status).To(Equal(RunStatusFailed))
+		Expect(runs.Runs[0].TriggerType).To(Equal(TriggerTypeDependency))
+		Expect(runs.Runs[0].Errors[0]).To(Equal("upstream job 'b' failed: upstream job 'a' failed: boom"))
+		runLog, err := scheduler.GetJobRunLog("c", runs.Runs[0].ID)
+		Expect(err).To(BeNil())
+		Expect(runLog.Entries).To(HaveLen(1))
+		Expect(runLog.Entries[0].Level).To(Equal(RunLogError))
+		Expect(runLog.Entries[0].Message).To(ContainSubstring("upstream job 'b' failed"))
+	})
+
+	It("Should show missing upstream jobs and forget deleted dependents", func() {
+		Expect(scheduler.AddJob(dependent("b", JobTrigger{DependsOn: []string{"a"}}))).To(BeNil())
+		Expect(stateOf("b")).To(Equal(map[string]string{"a": UpstreamMissing}))
+
+		Expect(scheduler.DeleteJob("b")).To(BeNil())
+		Expect(scheduler.GetJobGraph()).To(BeEmpty())
+		Expect(runner.upstreamStates("b")).To(BeNil())
+	})
+})
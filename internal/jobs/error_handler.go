@@ -18,6 +18,7 @@ import (
 	"context"
 	"errors"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/mimiro-io/datahub/internal/server"
@@ -27,16 +28,39 @@ const (
 	ErrorHandlerReRun   = "rerun"
 	ErrorHandlerReQueue = "requeue"
 	ErrorHandlerLog     = "log"
+	// ErrorHandlerDeadLetter keeps failing entities in the dead letters of the job
+	ErrorHandlerDeadLetter = "deadletter"
 )
 
-var ErrorHandlerTypes = map[string]bool{ErrorHandlerReRun: true, ErrorHandlerReQueue: true, ErrorHandlerLog: true}
+var ErrorHandlerTypes = map[string]bool{
+	ErrorHandlerReRun: true, ErrorHandlerReQueue: true, ErrorHandlerLog: true, ErrorHandlerDeadLetter: true,
+}
 
+// ErrorHandler handles failures of a job run. With a BackoffFactor, the delay between reruns is multiplied by it for
+// each rerun, up to MaxRetryDelay. Jitter takes a random part off each delay. Without them all reruns wait RetryDelay.
 type ErrorHandler struct {
-	Type                 string `json:"errorHandler"` // rerun, requeue, log
-	MaxRetries           int    `json:"maxRetries"`   // default 1
-	RetryDelay           int64  `json:"retryDelay"`   // seconds, default 30
-	MaxItems             int    `json:"maxItems"`     // 0 = all
+	Type                 string  `json:"errorHandler"`            // rerun, requeue, log, deadletter
+	MaxRetries           int     `json:"maxRetries"`              // default 1
+	RetryDelay           int64   `json:"retryDelay"`              // seconds, default 30
+	MaxItems             int     `json:"maxItems"`                // 0 = all
+	BackoffFactor        float64 `json:"backoffFactor,omitempty"` // 1 or more
+	MaxRetryDelay        int64   `json:"maxRetryDelay,omitempty"` // seconds, 0 = no max
+	Jitter               float64 `json:"jitter,omitempty"`        // 0 to 1
 	failingEntityHandler failingEntityHandler
+	retried              int
+}
+
+// nextRetryDelay returns how long to wait before the next rerun
+func (h *ErrorHandler) nextRetryDelay() time.Duration {
+	backoff := Backoff{
+		InitialDelay: time.Duration(h.RetryDelay),
+		MaxDelay:     time.Duration(h.MaxRetryDelay),
+		Factor:       h.BackoffFactor,
+		Jitter:       h.Jitter,
+	}
+	delay := backoff.Next(h.retried)
+	h.retried++
+	return delay
 }
 
 func (h *ErrorHandler) init(dsm *server.DsManager) {
@@ -105,19 +129,41 @@ func (r *ReQueueFailingEntityHandler) handleFailingEntity(runner *Runner, entity
 	return r.queue.enQueue(entity)
 }
 
+// handleFailure hands a failing entity to an error handler, together with the stage it failed in and the error,
+// for the handlers that keep these
+func handleFailure(
+	eh failingEntityHandler,
+	runner *Runner,
+	entity *server.Entity,
+	jobID string,
+	stage string,
+	cause error,
+) error {
+	if dl, ok := eh.(*DeadLetterFailingEntityHandler); ok {
+		return dl.handleFailure(runner, entity, jobID, stage, cause)
+	}
+	return eh.handleFailingEntity(runner, entity, jobID)
+}
+
 type wrappedTransform struct {
 	t                     Transform
 	failingEntityHandlers []failingEntityHandler
 	jobId                 string
+	job                   *job
+	lock                  sync.Mutex
+	lastError             error
+	failed                int
 }
 
 type wrappedSink struct {
 	s                     Sink
 	failingEntityHandlers []failingEntityHandler
 	jobId                 string
+	job                   *job
 	lastError             error
 	lastProcessed         int
 	recursionDepth        int
+	failed                int
 }
 
 // verifyErrorHandlers checks that the error handlers are valid, and also
@@ -134,7 +180,7 @@ func verifyErrorHandlers(trigger JobTrigger, id string, title string) error {
 			}
 			counts[eh.Type] = 1
 			if _, ok := ErrorHandlerTypes[eh.Type]; !ok {
-				return errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log")
+				return errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log, deadLetter")
 			}
 
 			// set defaults
@@ -147,10 +193,19 @@ func verifyErrorHandlers(trigger JobTrigger, id string, title string) error {
 					eh.RetryDelay = 30
 				}
 				eh.RetryDelay = int64(time.Second) * eh.RetryDelay
+				eh.MaxRetryDelay = int64(time.Second) * eh.MaxRetryDelay
+				if eh.BackoffFactor != 0 && eh.BackoffFactor < 1 {
+					return errors.New("backoffFactor must be 1 or more")
+				}
+				if eh.Jitter < 0 || eh.Jitter > 1 {
+					return errors.New("jitter must be between 0 and 1")
+				}
 			case ErrorHandlerLog:
 				eh.failingEntityHandler = &LogFailingEntityHandler{MaxItems: eh.MaxItems, jobId: id, jobTitle: title}
 			case ErrorHandlerReQueue:
 				eh.failingEntityHandler = &ReQueueFailingEntityHandler{MaxItems: eh.MaxItems}
+			case ErrorHandlerDeadLetter:
+				eh.failingEntityHandler = &DeadLetterFailingEntityHandler{MaxItems: eh.MaxItems}
 			default:
 				return errors.New("unknown error handler: " + eh.Type)
 			}
@@ -164,8 +219,12 @@ func verifyErrorHandlers(trigger JobTrigger, id string, title string) error {
 func (j *job) handleJobError(err *error) {
 	if err == nil || *err == nil || *err == MaxItemsExceededError {
 		if wrappedSink, isWrapped := j.pipeline.spec().sink.(*wrappedSink); isWrapped {
-			if wrappedSink.lastError != nil {
-				*err = wrappedSink.lastError
+			lastError := wrappedSink.lastError
+			if lastError == nil {
+				lastError = j.transformError()
+			}
+			if lastError != nil {
+				*err = lastError
 				lastRun := &jobResult{}
 				_ = j.runner.store.GetObject(server.JobResultIndex, j.id, lastRun)
 				lastRun.LastError = (*err).Error()
@@ -183,6 +242,9 @@ func (j *job) handleJobError(err *error) {
 			return
 		}
 	}
+	if err != nil && *err != nil && errors.Is(*err, ErrCircuitOpen) {
+		return // the job is on hold, and runs again on its next trigger
+	}
 	if err != nil && *err != nil && (*err).Error() == "got job interrupt" {
 		j.runner.logger.Debugf("job %v (%v) interrupted", j.title, j.id)
 		return
@@ -192,7 +254,7 @@ func (j *job) handleJobError(err *error) {
 			if eh.Type == ErrorHandlerReRun {
 				if eh.MaxRetries > 0 {
 					eh.MaxRetries = eh.MaxRetries - 1
-					time.AfterFunc(time.Duration(eh.RetryDelay), func() {
+					time.AfterFunc(eh.nextRetryDelay(), func() {
 						j.runner.logger.Infof("re-running job %v (%v). Try number %v", j.title, j.id, eh.MaxRetries)
 						// j.pipeline.sync(j, ctx)
 						j.Run()
@@ -209,7 +271,7 @@ func (j *job) instrumentErrorHandling() {
 		failingEntityHandlers := make([]failingEntityHandler, 0)
 		for _, eh := range j.errorHandlers {
 			// TODO: excluded reQueue handler for now. first release only supports reRun and log
-			if eh.Type == ErrorHandlerLog { //|| eh.Type == ErrorHandlerReQueue {
+			if eh.Type == ErrorHandlerLog || eh.Type == ErrorHandlerDeadLetter { //|| eh.Type == ErrorHandlerReQueue {
 				failingEntityHandlers = append(failingEntityHandlers, eh.failingEntityHandler)
 			}
 		}
@@ -221,8 +283,7 @@ func (j *job) instrumentErrorHandling() {
 			wrapped, isWrapped := j.pipeline.spec().transform.(*wrappedTransform)
 			if !isWrapped {
 				j.pipeline.spec().transform = &wrappedTransform{
-					j.pipeline.spec().transform, failingEntityHandlers,
-					j.id,
+					t: j.pipeline.spec().transform, failingEntityHandlers: failingEntityHandlers, jobId: j.id, job: j,
 				}
 			} else {
 				wrapped.reset()
@@ -231,7 +292,7 @@ func (j *job) instrumentErrorHandling() {
 		wrapped, isWrapped := j.pipeline.spec().sink.(*wrappedSink)
 		if !isWrapped {
 			j.pipeline.spec().sink = &wrappedSink{
-				s: j.pipeline.spec().sink, failingEntityHandlers: failingEntityHandlers, jobId: j.id,
+				s: j.pipeline.spec().sink, failingEntityHandlers: failingEntityHandlers, jobId: j.id, job: j,
 			}
 		} else {
 			wrapped.reset()
@@ -246,38 +307,70 @@ func (w *wrappedTransform) GetConfig() map[string]interface{} {
 }
 
 func (w *wrappedTransform) transformEntities(runner *Runner, entities []*server.Entity, jobTag string) ([]*server.Entity, error) {
-	transformedEntities, err := w.t.transformEntities(runner, entities, jobTag)
-	//if err != nil {
-	//	splitPoint := len(entities) / 2
-	//	left := entities[:splitPoint]
-	//	leftResult, leftErr := w.transformEntities(runner, left, jobTag)
-	//	if leftErr != nil && len(entities) <= 1 {
-	//		for _, eh := range w.failingEntityHandlers {
-	//			for _, entity := range entities {
-	//				err2 := eh.handleFailingEntity(runner, entity, w.jobId)
-	//				if err2 != nil {
-	//					return nil, err2
-	//				}
-	//			}
-	//		}
-	//	}
-	//
-	//	right := entities[splitPoint:]
-	//	rightResult, rightErr := w.transformEntities(runner, right, jobTag)
-	//	if rightErr != nil && len(entities) <= 1 {
-	//		for _, eh := range w.failingEntityHandlers {
-	//			for _, entity := range entities {
-	//				err2 := eh.handleFailingEntity(runner, entity, w.jobId)
-	//				if err2 != nil {
-	//					return nil, err2
-	//				}
-	//			}
-	//		}
-	//	}
-	//
-	//	return append(leftResult, rightResult...), nil
-	//}
-	return transformedEntities, err
+	return w.transformWith(w.t, runner, entities, jobTag)
+}
+
+// transformWith runs entities through t, which is the wrapped transform or a clone of it. When the job keeps dead
+// letters, the entities of a failing batch are transformed again one at a time, and the failing ones are handed to
+// the error handlers, so that the rest of the batch can go on to the sink. Transforms can have side effects, like
+// calling a remote service, so each entity is transformed at most twice rather than once per halving of the batch.
+func (w *wrappedTransform) transformWith(t Transform, runner *Runner, entities []*server.Entity, jobTag string) ([]*server.Entity, error) {
+	transformedEntities, err := t.transformEntities(runner, entities, jobTag)
+	if err == nil || len(entities) == 0 || !w.keepsDeadLetters() || errors.Is(err, ErrCircuitOpen) {
+		return transformedEntities, err
+	}
+	if len(entities) == 1 {
+		return nil, w.failEntity(runner, entities[0], err)
+	}
+	result := make([]*server.Entity, 0, len(entities))
+	for _, entity := range entities {
+		transformed, err := t.transformEntities(runner, []*server.Entity{entity}, jobTag)
+		if errors.Is(err, ErrCircuitOpen) {
+			return nil, err
+		}
+		if err != nil {
+			if err := w.failEntity(runner, entity, err); err != nil {
+				return nil, err
+			}
+			continue
+		}
+		result = append(result, transformed...)
+	}
+	return result, nil
+}
+
+// failEntity hands an entity that failed to transform to the error handlers
+func (w *wrappedTransform) failEntity(runner *Runner, entity *server.Entity, err error) error {
+	w.job.logRun(RunLogWarn, RunLogSourceTransform, "entity %v failed to transform: %v", entity.ID, err)
+	w.lock.Lock()
+	w.failed++
+	w.lastError = err
+	w.lock.Unlock()
+	for _, eh := range w.failingEntityHandlers {
+		if err2 := handleFailure(eh, runner, entity, w.jobId, RunLogSourceTransform, err); err2 != nil {
+			return err2
+		}
+	}
+	return nil
+}
+
+func (w *wrappedTransform) keepsDeadLetters() bool {
+	for _, eh := range w.failingEntityHandlers {
+		if _, ok := eh.(*DeadLetterFailingEntityHandler); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// transformError returns the last error of an entity the transform handed to the error handlers in this run
+func (j *job) transformError() error {
+	if w, ok := j.pipeline.spec().transform.(*wrappedTransform); ok {
+		w.lock.Lock()
+		defer w.lock.Unlock()
+		return w.lastError
+	}
+	return nil
 }
 
 func (w *wrappedTransform) getParallelism() int {
@@ -285,6 +378,10 @@ func (w *wrappedTransform) getParallelism() int {
 }
 
 func (w *wrappedTransform) reset() {
+	w.lock.Lock()
+	w.lastError = nil
+	w.failed = 0
+	w.lock.Unlock()
 	for _, eh := range w.failingEntityHandlers {
 		eh.reset()
 	}
@@ -299,12 +396,20 @@ var MaxItemsExceededError = errors.New("errorHandler: max items reached")
 func (w *wrappedSink) processEntities(runner *Runner, entities []*server.Entity) error {
 	// try to run batch
 	err := w.s.processEntities(runner, entities)
+	if errors.Is(err, ErrCircuitOpen) {
+		// the entities did not fail, the host is down. the job is put on hold
+		return err
+	}
 	if err != nil {
 		// if this was a single entity, and it failed, run handles
 		if len(entities) <= 1 {
+			w.failed += len(entities)
+			for _, entity := range entities {
+				w.job.logRun(RunLogWarn, RunLogSourceSink, "entity %v failed to process: %v", entity.ID, err)
+			}
 			for _, eh := range w.failingEntityHandlers {
 				for _, entity := range entities {
-					err2 := eh.handleFailingEntity(runner, entity, w.jobId)
+					err2 := handleFailure(eh, runner, entity, w.jobId, RunLogSourceSink, err)
 					if err2 != nil {
 						if w.lastError == nil {
 							w.lastError = err
@@ -358,6 +463,7 @@ func (w *wrappedSink) endFullSync(ctx context.Context, runner *Runner) error {
 
 func (w *wrappedSink) reset() {
 	w.recursionDepth = 0
+	w.failed = 0
 	for _, eh := range w.failingEntityHandlers {
 		eh.reset()
 	}
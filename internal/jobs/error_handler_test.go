@@ -343,19 +343,19 @@ var _ = Describe("A failed trigger", func() {
 		Entry("empty handler object",
 			tableInput{onErrorJSON: "[{}]"}, expected{
 				ErrorHandlers: nil,
-				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log"),
+				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log, deadLetter"),
 			}),
 		Entry("missing errorHandler in handler object",
 			tableInput{onErrorJSON: `[{"maxItems": 5}]`}, expected{
 				ErrorHandlers: nil,
-				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log"),
+				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log, deadLetter"),
 			}),
 		Entry(
 			"unknown errorHandler in handler object",
 			tableInput{onErrorJSON: `[{"errorHandler": "bogus"}]`},
 			expected{
 				ErrorHandlers: nil,
-				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log"),
+				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log, deadLetter"),
 			},
 		),
 		Entry(
@@ -363,7 +363,7 @@ var _ = Describe("A failed trigger", func() {
 			tableInput{onErrorJSON: `[{"errorHandler": "log"}, {"errorHandler": "bogus"}]`},
 			expected{
 				ErrorHandlers: nil,
-				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log"),
+				InitError:     errors.New("need to set 'errorHandler'. must be one of: reRun, reQueue, log, deadLetter"),
 			},
 		),
 		Entry("one valid handler should be accepted", tableInput{onErrorJSON: `[{"errorHandler": "log"}]`}, expected{
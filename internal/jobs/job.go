@@ -15,6 +15,7 @@
 package jobs
 
 import (
+	"errors"
 	"fmt"
 	"os"
 	"sync"
@@ -26,15 +27,21 @@ import (
 )
 
 type job struct {
-	id            string
-	title         string
-	pipeline      Pipeline
-	schedule      string
-	topic         string
-	isEvent       bool
-	runner        *Runner
-	errorHandlers []*ErrorHandler
-	dsm           *server.DsManager
+	id              string
+	title           string
+	pipeline        Pipeline
+	schedule        string
+	topic           string
+	triggerType     string
+	isEvent         bool
+	dependsOn       []string
+	condition       string
+	forwardFailures bool
+	runner          *Runner
+	errorHandlers   []*ErrorHandler
+	dsm             *server.DsManager
+	counts          *RunCounts // counts of the current run
+	log             *runLog    // log of the current run
 }
 
 type jobResult struct {
@@ -54,6 +61,10 @@ type jobResult struct {
 // next run, if a full job doesn't get one, we assume it is waiting for an incr job to finnish, so it gets postponed for
 // 5s
 func (j *job) Run() {
+	if b := j.runner.circuitBreakers.open(j.circuitEndpoints()...); b != nil {
+		j.hold(b, b.openError())
+		return
+	}
 	ticket := j.runner.raffle.borrowTicket(j)
 	if ticket == nil {
 		if j.pipeline.isFullSync() { // reschedule to try again in a bit
@@ -83,14 +94,24 @@ func (j *job) Run() {
 		return
 	}
 
+	j.runner.dependencyStarted(j.id)
+
 	// attach error handlers
 	var pipelineErr error
+	var processed int
+	var run *JobRun
 	j.instrumentErrorHandling()
 	defer func() {
 		j.handleJobError(&pipelineErr)
+		if !errors.Is(pipelineErr, ErrCircuitOpen) { // jobs on hold have not completed
+			j.runner.jobCompleted(j.id, pipelineErr)
+		}
 	}()
 
 	defer j.runner.raffle.returnTicket(ticket)
+	defer func() {
+		j.finishRun(run, processed, pipelineErr)
+	}()
 	msg := "job"
 	if j.isEvent {
 		msg = "event"
@@ -99,6 +120,7 @@ func (j *job) Run() {
 	if j.pipeline.isFullSync() {
 		jobType = "fullsync"
 	}
+	run = j.newRun(ticket.runState.started, jobType)
 
 	j.runner.logger.Infow(fmt.Sprintf("Starting %v %s with id '%s' (%s)", jobType, msg, j.title, j.id),
 		"job.jobId", j.id,
@@ -120,11 +142,14 @@ func (j *job) Run() {
 		"job.jobTitle", j.title,
 		"job.state", "Running",
 		"job.jobType", jobType)
-	processed, err := j.pipeline.sync(j, ticket.runState.ctx)
+	var err error
+	processed, err = j.pipeline.sync(j, ticket.runState.ctx)
 	pipelineErr = err
 	timed := time.Since(ticket.runState.started)
 	if err != nil {
-		if err.Error() == "got job interrupt" { // if a job gets killed, this will trigger
+		if errors.Is(err, ErrCircuitOpen) {
+			j.hold(j.runner.circuitBreakers.open(j.circuitEndpoints()...), err)
+		} else if err.Error() == "got job interrupt" { // if a job gets killed, this will trigger
 			_ = j.runner.statsdClient.Count("jobs.cancelled", timed.Nanoseconds(), tags, 1)
 			j.runner.logger.Infow(fmt.Sprintf("Job '%s' (%s) was terminated", j.title, j.id),
 				"job.jobId", j.id,
@@ -0,0 +1,347 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"errors"
+	"regexp"
+	"sort"
+
+	"github.com/mimiro-io/datahub/internal/jobs/source"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	LineageDataset = "core.Lineage"
+
+	LineageNodeDataset  = "dataset"
+	LineageNodeJob      = "job"
+	LineageNodeEndpoint = "endpoint"
+
+	LineageDirectionUpstream   = "upstream"
+	LineageDirectionDownstream = "downstream"
+
+	lineageNamespace = "http://data.mimiro.io/core/lineage/"
+)
+
+// LineageNode is a dataset, job or external endpoint in the lineage graph
+type LineageNode struct {
+	ID   string `json:"id"`
+	Type string `json:"type"`
+	Name string `json:"name"`
+}
+
+// LineageEdge points in the direction data flows. Relation is one of
+// source, dependency, sink, transaction or transform.
+type LineageEdge struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	Relation string `json:"relation"`
+}
+
+// Lineage is the graph of how data flows between datasets through the configured jobs
+type Lineage struct {
+	Nodes []*LineageNode `json:"nodes"`
+	Edges []*LineageEdge `json:"edges"`
+}
+
+// matches txn.DatasetEntities["name"] and txn.DatasetEntities.name in transform code
+var transactionDatasetPattern = regexp.MustCompile(
+	`DatasetEntities\s*(?:\[\s*["'\x60]([^"'\x60]+)["'\x60]\s*\]|\.([A-Za-z_$][\w$]*))`,
+)
+
+func LineageNodeID(nodeType string, name string) string {
+	return nodeType + ":" + name
+}
+
+// GetLineage builds the lineage graph from all stored job configurations. If nodeID is given, only
+// the part of the graph upstream and/or downstream from that node is returned, depending on direction.
+// An empty direction returns both.
+func (s *Scheduler) GetLineage(nodeID string, direction string) (*Lineage, error) {
+	builder := newLineageBuilder()
+	for _, jobConfig := range s.ListJobs() {
+		err := s.addJobLineage(builder, jobConfig)
+		if err != nil {
+			s.Logger.Warnf("Unable to resolve lineage for job with id %s (%s): %v", jobConfig.ID, jobConfig.Title, err)
+		}
+	}
+	lineage := builder.build()
+	if nodeID == "" {
+		return lineage, nil
+	}
+	if builder.nodes[nodeID] == nil {
+		return nil, errors.New("no lineage found for " + nodeID)
+	}
+
+	switch direction {
+	case LineageDirectionUpstream:
+		return lineage.subGraph(nodeID, true, false), nil
+	case LineageDirectionDownstream:
+		return lineage.subGraph(nodeID, false, true), nil
+	case "":
+		return lineage.subGraph(nodeID, true, true), nil
+	default:
+		return nil, errors.New("direction must be one of: upstream, downstream")
+	}
+}
+
+// addJobLineage adds the nodes and edges that the given job contributes to the graph
+func (s *Scheduler) addJobLineage(builder *lineageBuilder, jobConfig *JobConfiguration) error {
+	jobNode := builder.node(LineageNodeJob, jobConfig.ID, jobConfig.Title)
+
+	jobConfig, _, err := s.resolveJobConfiguration(jobConfig, false)
+	if err != nil {
+		return err
+	}
+	jobSource, err := s.parseSource(jobConfig)
+	if err != nil {
+		return err
+	}
+	switch src := jobSource.(type) {
+	case *source.DatasetSource:
+		builder.edge(builder.dataset(src.DatasetName), jobNode, "source")
+	case *source.MultiSource:
+		builder.edge(builder.dataset(src.DatasetName), jobNode, "source")
+		for _, dep := range src.Dependencies {
+			builder.edge(builder.dataset(dep.Dataset), jobNode, "dependency")
+		}
+	case *source.UnionDatasetSource:
+		for _, dsSrc := range src.DatasetSources {
+			builder.edge(builder.dataset(dsSrc.DatasetName), jobNode, "source")
+		}
+	case *source.HTTPDatasetSource:
+		builder.edge(builder.node(LineageNodeEndpoint, src.Endpoint, src.Endpoint), jobNode, "source")
+	}
+
+	jobSink, err := s.parseSink(jobConfig)
+	if err != nil {
+		return err
+	}
+	switch snk := jobSink.(type) {
+	case *datasetSink:
+		builder.edge(jobNode, builder.dataset(snk.DatasetName), "sink")
+	case *httpDatasetSink:
+		builder.edge(jobNode, builder.node(LineageNodeEndpoint, snk.Endpoint, snk.Endpoint), "sink")
+	}
+
+	if jobConfig.Transform != nil {
+		switch jobConfig.Transform["Type"] {
+		case "HttpTransform":
+			if url, ok := jobConfig.Transform["Url"].(string); ok && url != "" {
+				builder.edge(builder.node(LineageNodeEndpoint, url, url), jobNode, "transform")
+			}
+		case "JavascriptTransform":
+			if code64, ok := jobConfig.Transform["Code"].(string); ok {
+				code, err := base64.StdEncoding.DecodeString(code64)
+				if err != nil {
+					return err
+				}
+				for _, name := range transactionDatasets(string(code)) {
+					builder.edge(jobNode, builder.dataset(name), "transaction")
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// transactionDatasets finds the datasets written to with ExecuteTransaction in transform code.
+// Dataset names that are computed at runtime cannot be detected.
+func transactionDatasets(code string) []string {
+	seen := make(map[string]bool)
+	var result []string
+	for _, m := range transactionDatasetPattern.FindAllStringSubmatch(code, -1) {
+		name := m[1]
+		if name == "" {
+			name = m[2]
+		}
+		if !seen[name] {
+			seen[name] = true
+			result = append(result, name)
+		}
+	}
+	return result
+}
+
+// subGraph returns the nodes and edges reachable from nodeID following edges backwards (upstream)
+// and/or forwards (downstream)
+func (l *Lineage) subGraph(nodeID string, upstream bool, downstream bool) *Lineage {
+	included := map[string]bool{nodeID: true}
+	includedEdges := make(map[*LineageEdge]bool)
+	walk := func(forward bool) {
+		queue := []string{nodeID}
+		visited := map[string]bool{nodeID: true}
+		for len(queue) > 0 {
+			current := queue[0]
+			queue = queue[1:]
+			for _, edge := range l.Edges {
+				from, to := edge.From, edge.To
+				if !forward {
+					from, to = to, from
+				}
+				if from != current {
+					continue
+				}
+				includedEdges[edge] = true
+				included[to] = true
+				if !visited[to] {
+					visited[to] = true
+					queue = append(queue, to)
+				}
+			}
+		}
+	}
+	if upstream {
+		walk(false)
+	}
+	if downstream {
+		walk(true)
+	}
+
+	result := &Lineage{Nodes: make([]*LineageNode, 0), Edges: make([]*LineageEdge, 0)}
+	for _, node := range l.Nodes {
+		if included[node.ID] {
+			result.Nodes = append(result.Nodes, node)
+		}
+	}
+	for _, edge := range l.Edges {
+		if includedEdges[edge] {
+			result.Edges = append(result.Edges, edge)
+		}
+	}
+	return result
+}
+
+type lineageBuilder struct {
+	nodes map[string]*LineageNode
+	edges map[LineageEdge]bool
+}
+
+func newLineageBuilder() *lineageBuilder {
+	return &lineageBuilder{nodes: make(map[string]*LineageNode), edges: make(map[LineageEdge]bool)}
+}
+
+func (b *lineageBuilder) node(nodeType string, name string, title string) string {
+	id := LineageNodeID(nodeType, name)
+	if _, ok := b.nodes[id]; !ok {
+		b.nodes[id] = &LineageNode{ID: id, Type: nodeType, Name: title}
+	}
+	return id
+}
+
+func (b *lineageBuilder) dataset(name string) string {
+	return b.node(LineageNodeDataset, name, name)
+}
+
+func (b *lineageBuilder) edge(from string, to string, relation string) {
+	b.edges[LineageEdge{From: from, To: to, Relation: relation}] = true
+}
+
+func (b *lineageBuilder) build() *Lineage {
+	lineage := &Lineage{Nodes: make([]*LineageNode, 0, len(b.nodes)), Edges: make([]*LineageEdge, 0, len(b.edges))}
+	for _, node := range b.nodes {
+		lineage.Nodes = append(lineage.Nodes, node)
+	}
+	for edge := range b.edges {
+		e := edge
+		lineage.Edges = append(lineage.Edges, &e)
+	}
+	sort.Slice(lineage.Nodes, func(i, j int) bool { return lineage.Nodes[i].ID < lineage.Nodes[j].ID })
+	sort.Slice(lineage.Edges, func(i, j int) bool {
+		a, b := lineage.Edges[i], lineage.Edges[j]
+		if a.From != b.From {
+			return a.From < b.From
+		}
+		if a.To != b.To {
+			return a.To < b.To
+		}
+		return a.Relation < b.Relation
+	})
+	return lineage
+}
+
+// storeJobLineage records the datasets and endpoints a job reads from and writes to as an entity
+// in the core.Lineage dataset, so that lineage can be queried and followed through /changes
+func (s *Scheduler) storeJobLineage(jobConfig *JobConfiguration, deleted bool) error {
+	lineageDataset := s.DatasetManager.GetDataset(LineageDataset)
+	if lineageDataset == nil {
+		return errors.New("missing dataset " + LineageDataset)
+	}
+	nsm := s.Store.NamespaceManager
+	prefix, err := nsm.AssertPrefixMappingForExpansion(lineageNamespace)
+	if err != nil {
+		return err
+	}
+	core, err := nsm.AssertPrefixMappingForExpansion("http://data.mimiro.io/core/")
+	if err != nil {
+		return err
+	}
+	datasetPrefix, err := nsm.AssertPrefixMappingForExpansion("http://data.mimiro.io/core/dataset/")
+	if err != nil {
+		return err
+	}
+	rdf, err := nsm.AssertPrefixMappingForExpansion(server.RdfNamespaceExpansion)
+	if err != nil {
+		return err
+	}
+
+	entity := server.NewEntity(prefix+":job/"+jobConfig.ID, 0)
+	entity.IsDeleted = deleted
+	entity.References[rdf+":type"] = core + ":job"
+	entity.Properties[prefix+":title"] = jobConfig.Title
+
+	if !deleted {
+		builder := newLineageBuilder()
+		err = s.addJobLineage(builder, jobConfig)
+		if err != nil {
+			return err
+		}
+		lineage := builder.build()
+		jobNode := LineageNodeID(LineageNodeJob, jobConfig.ID)
+		var reads, writes, readsEndpoints, writesEndpoints []string
+		for _, edge := range lineage.Edges {
+			if edge.To == jobNode {
+				node := builder.nodes[edge.From]
+				if node.Type == LineageNodeDataset {
+					reads = append(reads, datasetPrefix+":"+node.Name)
+				} else {
+					readsEndpoints = append(readsEndpoints, node.Name)
+				}
+			} else {
+				node := builder.nodes[edge.To]
+				if node.Type == LineageNodeDataset {
+					writes = append(writes, datasetPrefix+":"+node.Name)
+				} else {
+					writesEndpoints = append(writesEndpoints, node.Name)
+				}
+			}
+		}
+		if len(reads) > 0 {
+			entity.References[prefix+":reads"] = reads
+		}
+		if len(writes) > 0 {
+			entity.References[prefix+":writes"] = writes
+		}
+		if len(readsEndpoints) > 0 {
+			entity.Properties[prefix+":readsEndpoint"] = readsEndpoints
+		}
+		if len(writesEndpoints) > 0 {
+			entity.Properties[prefix+":writesEndpoint"] = writesEndpoints
+		}
+	}
+
+	return lineageDataset.StoreEntities([]*server.Entity{entity})
+}
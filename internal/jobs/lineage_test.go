@@ -0,0 +1,131 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("The lineage graph", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testlineage_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, dsm, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	addJob := func(id string, source string, sink string, transform string) {
+		config := fmt.Sprintf(`{
+			"id" : "%v",
+			"title" : "%v",
+			"triggers": [{"triggerType": "cron", "jobType": "incremental", "schedule": "@every 2s"}],
+			"paused": true,
+			"source" : %v,
+			"sink" : %v`, id, id, source, sink)
+		if transform != "" {
+			config += `, "transform": ` + transform
+		}
+		jobConfig, err := scheduler.Parse([]byte(config + "}"))
+		Expect(err).To(BeNil())
+		Expect(scheduler.AddJob(jobConfig)).To(Succeed())
+	}
+
+	It("should follow datasets through jobs, unions, transactions and endpoints", func() {
+		_, _ = dsm.CreateDataset("people", nil)
+		_, _ = dsm.CreateDataset("employees", nil)
+		code := base64.StdEncoding.EncodeToString([]byte(`function transform_entities(entities) {
+			var txn = NewTransaction();
+			txn.DatasetEntities["audit"] = entities;
+			ExecuteTransaction(txn);
+			return entities;
+		}`))
+
+		addJob("j1", `{"Type": "HttpDatasetSource", "Url": "http://remote/datasets/people/changes"}`,
+			`{"Type": "DatasetSink", "Name": "people"}`, "")
+		addJob("j2", `{"Type": "UnionDatasetSource", "DatasetSources": [{"Name": "people"}, {"Name": "employees"}]}`,
+			`{"Type": "DatasetSink", "Name": "persons"}`,
+			`{"Type": "JavascriptTransform", "Code": "`+code+`"}`)
+		addJob("j3", `{"Type": "DatasetSource", "Name": "persons"}`,
+			`{"Type": "HttpDatasetSink", "Url": "http://remote/datasets/persons/entities"}`, "")
+
+		lineage, err := scheduler.GetLineage("", "")
+		Expect(err).To(BeNil())
+		Expect(lineage.Nodes).To(HaveLen(9))
+		Expect(lineage.Edges).To(ContainElement(&LineageEdge{From: "job:j2", To: "dataset:audit", Relation: "transaction"}))
+
+		upstream, err := scheduler.GetLineage("dataset:persons", LineageDirectionUpstream)
+		Expect(err).To(BeNil())
+		var ids []string
+		for _, n := range upstream.Nodes {
+			ids = append(ids, n.ID)
+		}
+		Expect(ids).To(Equal([]string{
+			"dataset:employees", "dataset:people", "dataset:persons",
+			"endpoint:http://remote/datasets/people/changes", "job:j1", "job:j2",
+		}))
+
+		downstream, err := scheduler.GetLineage("dataset:people", LineageDirectionDownstream)
+		Expect(err).To(BeNil())
+		ids = nil
+		for _, n := range downstream.Nodes {
+			ids = append(ids, n.ID)
+		}
+		Expect(ids).To(Equal([]string{
+			"dataset:audit", "dataset:people", "dataset:persons",
+			"endpoint:http://remote/datasets/persons/entities", "job:j2", "job:j3",
+		}))
+
+		_, err = scheduler.GetLineage("dataset:unknown", "")
+		Expect(err).NotTo(BeNil())
+	})
+
+	It("should record job lineage as entities in the lineage dataset", func() {
+		addJob("j1", `{"Type": "DatasetSource", "Name": "people"}`, `{"Type": "DatasetSink", "Name": "persons"}`, "")
+
+		lineageDataset := dsm.GetDataset(LineageDataset)
+		Expect(lineageDataset).NotTo(BeNil())
+		result, err := lineageDataset.GetEntities("", 10)
+		Expect(err).To(BeNil())
+		Expect(result.Entities).To(HaveLen(1))
+		prefix, _ := store.NamespaceManager.GetPrefixMappingForExpansion(lineageNamespace)
+		datasetPrefix, _ := store.NamespaceManager.GetPrefixMappingForExpansion("http://data.mimiro.io/core/dataset/")
+		Expect(result.Entities[0].ID).To(Equal(prefix + ":job/j1"))
+		Expect(result.Entities[0].References[prefix+":reads"]).To(Equal([]any{datasetPrefix + ":people"}))
+		Expect(result.Entities[0].References[prefix+":writes"]).To(Equal([]any{datasetPrefix + ":persons"}))
+
+		Expect(scheduler.DeleteJob("j1")).To(Succeed())
+		result, _ = lineageDataset.GetEntities("", 10)
+		Expect(result.Entities[0].IsDeleted).To(BeTrue())
+	})
+})
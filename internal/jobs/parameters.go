@@ -0,0 +1,236 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"regexp"
+
+	"github.com/mimiro-io/datahub/internal/security"
+)
+
+const (
+	ParamTypeString = "string"
+	ParamTypeInt    = "int"
+	ParamTypeFloat  = "float"
+	ParamTypeBool   = "bool"
+	ParamTypeSecret = "secret"
+
+	// a parameter with this name sets the batch size of the job
+	batchSizeParam = "batchSize"
+)
+
+var (
+	ParamTypes = map[string]bool{
+		ParamTypeString: true, ParamTypeInt: true, ParamTypeFloat: true, ParamTypeBool: true, ParamTypeSecret: true,
+	}
+	paramReferencePattern = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_.-]*)\}`)
+)
+
+// JobParameter is a typed value that can be referenced as ${name} in the source, sink and transform config of a job.
+// The value is taken from the variables of the job, or from Default if the job has no variable for it.
+// A secret parameter has a value reader as value, like {"type": "env", "value": "API_KEY"}, which is read through the
+// login provider manager when the job is scheduled.
+type JobParameter struct {
+	Name        string      `json:"name"`
+	Type        string      `json:"type"`
+	Default     interface{} `json:"default,omitempty"`
+	Required    bool        `json:"required,omitempty"`
+	Description string      `json:"description,omitempty"`
+}
+
+// resolveJobConfiguration returns a copy of the job configuration where the parameter references in the source,
+// sink and transform config are replaced by their values, together with the values. When secrets is false,
+// references to secret parameters are left as they are, so that secrets do not end up in lineage or error messages.
+// Jobs without parameters and variables are returned as they are.
+func (s *Scheduler) resolveJobConfiguration(
+	jobConfig *JobConfiguration,
+	secrets bool,
+) (*JobConfiguration, map[string]interface{}, error) {
+	if len(jobConfig.Parameters) == 0 && len(jobConfig.Variables) == 0 {
+		return jobConfig, nil, nil
+	}
+	values, err := s.parameterValues(jobConfig, secrets)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	resolved := *jobConfig
+	for _, m := range []*map[string]interface{}{&resolved.Source, &resolved.Sink, &resolved.Transform} {
+		if *m == nil {
+			continue
+		}
+		value, err := substituteParams(*m, values)
+		if err != nil {
+			return nil, nil, err
+		}
+		*m = value.(map[string]interface{})
+	}
+	if batchSize, ok := values[batchSizeParam].(float64); ok {
+		resolved.BatchSize = int(batchSize)
+	}
+	return &resolved, values, nil
+}
+
+// parameterValues checks the parameters and variables of a job, and returns the value of each parameter.
+// Secret parameters that are not read are given their own reference as value.
+func (s *Scheduler) parameterValues(jobConfig *JobConfiguration, secrets bool) (map[string]interface{}, error) {
+	values := make(map[string]interface{}, len(jobConfig.Parameters))
+	types := make(map[string]string, len(jobConfig.Parameters))
+	for _, p := range jobConfig.Parameters {
+		if p.Name == "" || !paramReferencePattern.MatchString("${"+p.Name+"}") {
+			return nil, fmt.Errorf("invalid parameter name '%s'", p.Name)
+		}
+		if _, ok := types[p.Name]; ok {
+			return nil, fmt.Errorf("parameter '%s' is defined more than once", p.Name)
+		}
+		paramType := p.Type
+		if paramType == "" {
+			paramType = ParamTypeString
+		}
+		if !ParamTypes[paramType] {
+			return nil, fmt.Errorf("parameter '%s' has unknown type '%s'. must be one of: string, int, float, bool, secret",
+				p.Name, p.Type)
+		}
+		if p.Name == batchSizeParam && paramType != ParamTypeInt {
+			return nil, fmt.Errorf("parameter '%s' must be of type int", batchSizeParam)
+		}
+		types[p.Name] = paramType
+
+		raw, ok := jobConfig.Variables[p.Name]
+		if !ok {
+			raw = p.Default
+		}
+		if raw == nil {
+			if p.Required {
+				return nil, fmt.Errorf("parameter '%s' is required, but has no value", p.Name)
+			}
+			continue
+		}
+		value, err := toParamValue(paramType, raw)
+		if err != nil {
+			return nil, fmt.Errorf("parameter '%s': %w", p.Name, err)
+		}
+		if reader, ok := value.(*security.ValueReader); ok {
+			if !secrets {
+				values[p.Name] = "${" + p.Name + "}"
+				continue
+			}
+			if s.Runner == nil || s.Runner.tokenProviders == nil {
+				return nil, fmt.Errorf("parameter '%s': no provider manager to read secrets with", p.Name)
+			}
+			value = s.Runner.tokenProviders.LoadValue(reader)
+		}
+		values[p.Name] = value
+	}
+	for name := range jobConfig.Variables {
+		if _, ok := types[name]; !ok {
+			return nil, fmt.Errorf("variable '%s' is not a parameter of the job", name)
+		}
+	}
+	return values, nil
+}
+
+// toParamValue checks that a value matches the type of its parameter. Numbers are returned as float64, like numbers
+// read from json.
+func toParamValue(paramType string, raw interface{}) (interface{}, error) {
+	switch paramType {
+	case ParamTypeString:
+		if v, ok := raw.(string); ok {
+			return v, nil
+		}
+	case ParamTypeBool:
+		if v, ok := raw.(bool); ok {
+			return v, nil
+		}
+	case ParamTypeInt, ParamTypeFloat:
+		var v float64
+		switch n := raw.(type) {
+		case float64:
+			v = n
+		case int:
+			v = float64(n)
+		case int64:
+			v = float64(n)
+		default:
+			return nil, fmt.Errorf("value %v is not a number", raw)
+		}
+		if paramType == ParamTypeInt && v != math.Trunc(v) {
+			return nil, fmt.Errorf("value %v is not an int", raw)
+		}
+		return v, nil
+	case ParamTypeSecret:
+		if m, ok := raw.(map[string]interface{}); ok {
+			t, _ := m["type"].(string)
+			v, _ := m["value"].(string)
+			if (t == "text" || t == "env") && v != "" {
+				return &security.ValueReader{Type: t, Value: v}, nil
+			}
+		}
+		return nil, errors.New(`secrets must be given as {"type": "env" or "text", "value": "..."}`)
+	}
+	return nil, fmt.Errorf("value %v is not a %s", raw, paramType)
+}
+
+// substituteParams replaces parameter references in all strings of a config value. A string that is only a
+// reference gets the typed value of the parameter, so that "${batchSize}" becomes a number.
+func substituteParams(value interface{}, values map[string]interface{}) (interface{}, error) {
+	switch v := value.(type) {
+	case map[string]interface{}:
+		result := make(map[string]interface{}, len(v))
+		for k, child := range v {
+			resolved, err := substituteParams(child, values)
+			if err != nil {
+				return nil, err
+			}
+			result[k] = resolved
+		}
+		return result, nil
+	case []interface{}:
+		result := make([]interface{}, len(v))
+		for i, child := range v {
+			resolved, err := substituteParams(child, values)
+			if err != nil {
+				return nil, err
+			}
+			result[i] = resolved
+		}
+		return result, nil
+	case string:
+		return substituteString(v, values)
+	}
+	return value, nil
+}
+
+func substituteString(s string, values map[string]interface{}) (interface{}, error) {
+	matches := paramReferencePattern.FindAllStringSubmatchIndex(s, -1)
+	if len(matches) == 0 {
+		return s, nil
+	}
+	for _, m := range matches {
+		name := s[m[2]:m[3]]
+		if _, ok := values[name]; !ok {
+			return nil, fmt.Errorf("'%s' references unknown parameter or parameter without value '%s'", s, name)
+		}
+	}
+	if len(matches) == 1 && matches[0][0] == 0 && matches[0][1] == len(s) {
+		return values[s[matches[0][2]:matches[0][3]]], nil
+	}
+	return paramReferencePattern.ReplaceAllStringFunc(s, func(ref string) string {
+		return fmt.Sprint(values[ref[2:len(ref)-1]])
+	}), nil
+}
@@ -0,0 +1,149 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/jobs/source"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("Job parameters", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testparameters_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, dsm, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	httpJob := func() *JobConfiguration {
+		return &JobConfiguration{
+			ID: "params", Title: "params", Paused: true,
+			Parameters: []JobParameter{
+				{Name: "baseUrl", Default: "http://localhost:7777"},
+				{Name: "customer", Type: ParamTypeString, Required: true},
+				{Name: "apiKey", Type: ParamTypeSecret, Default: map[string]interface{}{"type": "env", "value": "PARAMS_TEST_KEY"}},
+				{Name: "batchSize", Type: ParamTypeInt, Default: 50},
+			},
+			Variables: map[string]interface{}{"customer": "acme", "batchSize": float64(7)},
+			Source: map[string]interface{}{
+				"Type": "HttpDatasetSource",
+				"Url":  "${baseUrl}/datasets/${customer}/changes?key=${apiKey}",
+			},
+			Sink:     map[string]interface{}{"Type": "DatasetSink", "Name": "${customer}-out"},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+		}
+	}
+
+	It("Should resolve references to parameters, variables and secrets", func() {
+		GinkgoT().Setenv("PARAMS_TEST_KEY", "s3cret")
+		config := httpJob()
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		stored, _ := scheduler.LoadJob("params")
+		Expect(stored.Source["Url"]).To(Equal("${baseUrl}/datasets/${customer}/changes?key=${apiKey}"),
+			"the stored job keeps the references")
+
+		pipeline, err := scheduler.toPipeline(stored, JobTypeIncremental)
+		Expect(err).To(BeNil())
+		spec := pipeline.spec()
+		Expect(spec.source.(*source.HTTPDatasetSource).Endpoint).
+			To(Equal("http://localhost:7777/datasets/acme/changes?key=s3cret"))
+		Expect(spec.sink.(*datasetSink).DatasetName).To(Equal("acme-out"))
+		Expect(spec.batchSize).To(Equal(7))
+
+		lineage, err := scheduler.GetLineage(LineageNodeID(LineageNodeJob, "params"), "")
+		Expect(err).To(BeNil())
+		var ids []string
+		for _, n := range lineage.Nodes {
+			ids = append(ids, n.ID)
+		}
+		Expect(ids).To(ContainElement(LineageNodeID(LineageNodeEndpoint,
+			"http://localhost:7777/datasets/acme/changes?key=${apiKey}")), "secrets are not part of the lineage")
+	})
+
+	It("Should reject invalid parameters and variables", func() {
+		for message, change := range map[string]func(c *JobConfiguration){
+			"is required":              func(c *JobConfiguration) { delete(c.Variables, "customer") },
+			"is not a parameter":       func(c *JobConfiguration) { c.Variables["nope"] = "x" },
+			"is not a number":          func(c *JobConfiguration) { c.Variables["batchSize"] = "many" },
+			"is not an int":            func(c *JobConfiguration) { c.Variables["batchSize"] = 2.5 },
+			"unknown type":             func(c *JobConfiguration) { c.Parameters[0].Type = "url" },
+			"more than once":           func(c *JobConfiguration) { c.Parameters[1].Name = "baseUrl" },
+			"secrets must be given as": func(c *JobConfiguration) { c.Variables["apiKey"] = "s3cret" },
+			"unknown parameter":        func(c *JobConfiguration) { c.Sink["Name"] = "${tenant}" },
+		} {
+			config := httpJob()
+			change(config)
+			err := scheduler.AddJob(config)
+			Expect(err).To(MatchError(ContainSubstring(message)), message)
+		}
+		Expect(scheduler.ListJobs()).To(BeEmpty())
+	})
+
+	It("Should let transforms read parameters with GetParam", func() {
+		_, _ = dsm.CreateDataset("out", nil)
+		js := `function transform_entities(entities) {
+			for (var e of entities) {
+				e.Properties["customer"] = GetParam("customer");
+				e.Properties["limit"] = GetParam("limit");
+				e.Properties["missing"] = GetParam("missing");
+			}
+			return entities;
+		}`
+		config := &JobConfiguration{
+			ID: "getparam", Title: "getparam", Paused: true,
+			Parameters: []JobParameter{
+				{Name: "customer", Default: "acme"},
+				{Name: "limit", Type: ParamTypeFloat, Default: 2.5},
+			},
+			Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(2)},
+			Transform: map[string]interface{}{
+				"Type": "JavascriptTransform",
+				"Code": base64.StdEncoding.EncodeToString([]byte(js)),
+			},
+			Sink:     map[string]interface{}{"Type": "DatasetSink", "Name": "out"},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+		}
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		triggered, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		triggered[0].Run()
+
+		result, err := dsm.GetDataset("out").GetEntities("", 10)
+		Expect(err).To(BeNil())
+		Expect(result.Entities).To(HaveLen(2))
+		Expect(result.Entities[0].Properties["customer"]).To(Equal("acme"))
+		Expect(result.Entities[0].Properties["limit"]).To(Equal(2.5))
+		Expect(result.Entities[0].Properties["missing"]).To(BeNil())
+	})
+})
@@ -48,6 +48,18 @@ type (
 	IncrementalPipeline struct{ PipelineSpec }
 )
 
+// startsSourceFullSync tells if a full sync should call source.StartFullSync. Usually only sink.startFullSync is
+// called, to make sure we run on changes.
+// exception is when the sink is http(we want to process entities instead of changes)
+// or source is DatasetSource with LatestOnly (we can produce entities using the changes collection, also for http sink)
+// or source is multisource (we need to grab watermarks at beginning of fullsync)
+func (spec *PipelineSpec) startsSourceFullSync() bool {
+	dss, isDatasetSource := spec.source.(*jobSource.DatasetSource)
+	return spec.sink.GetConfig()["Type"] == "HttpDatasetSink" ||
+		(isDatasetSource && dss.LatestOnly) ||
+		spec.source.GetConfig()["Type"] == "MultiSource"
+}
+
 func (pipeline *FullSyncPipeline) spec() *PipelineSpec { return &pipeline.PipelineSpec }
 func (pipeline *FullSyncPipeline) isFullSync() bool    { return true }
 func (pipeline *FullSyncPipeline) sync(job *job, ctx context.Context) (int, error) {
@@ -62,18 +74,13 @@ func (pipeline *FullSyncPipeline) sync(job *job, ctx context.Context) (int, erro
 
 	keepReading := true
 
-	// don't call source.startFullSync, just sink.startFullSync. to make sure we run on changes.
-	// exception is when the sink is http(we want to process entities instead of changes)
-	// or source is DatasetSource with LatestOnly (we can produce entities using the changes collection, also for http sink)
-	// or source is multisource (we need to grab watermarks at beginning of fullsync)
 	dss, isDatasetSource := pipeline.source.(*jobSource.DatasetSource)
-	if pipeline.sink.GetConfig()["Type"] == "HttpDatasetSink" ||
-		(isDatasetSource && dss.LatestOnly) ||
-		pipeline.source.GetConfig()["Type"] == "MultiSource" {
+	if pipeline.startsSourceFullSync() {
 		pipeline.source.StartFullSync()
 	}
 	err = pipeline.sink.startFullSync(runner)
 	if err != nil {
+		job.logRun(RunLogError, RunLogSourceSink, "failed to start full sync: %v", err)
 		return 0, err
 	}
 	syncJobState.ContinuationToken = ""
@@ -101,6 +108,7 @@ func (pipeline *FullSyncPipeline) sync(job *job, ctx context.Context) (int, erro
 						if err2 != nil {
 							return err2
 						}
+						job.countTransformed(len(entities))
 					}
 
 					// write to sink
@@ -108,8 +116,10 @@ func (pipeline *FullSyncPipeline) sync(job *job, ctx context.Context) (int, erro
 					err2 = pipeline.sink.processEntities(runner, entities)
 					_ = runner.statsdClient.Timing("pipeline.sink.batch", time.Since(sinkTS), tags, 1)
 					if err2 != nil {
+						job.logRun(RunLogError, RunLogSourceSink, "failed to write %v entities: %v", len(entities), err2)
 						return err2
 					}
+					job.countWritten(len(entities))
 				}
 
 				// capture token if there is one
@@ -151,6 +161,7 @@ func (pipeline *FullSyncPipeline) sync(job *job, ctx context.Context) (int, erro
 	pipeline.source.EndFullSync()
 	err = pipeline.sink.endFullSync(ctx, runner)
 	if err != nil {
+		job.logRun(RunLogError, RunLogSourceSink, "failed to end full sync: %v", err)
 		return entCnt, err
 	}
 
@@ -195,6 +206,7 @@ func (pipeline *IncrementalPipeline) sync(job *job, ctx context.Context) (int, e
 			"job.jobTitle", job.title,
 			"job.state", "Running",
 		).Warnf("job %s has a multi source, and has never run before. Doing a full sync first", job.id)
+		job.logRun(RunLogWarn, RunLogSourceJob, "multi source has never run before, doing a full sync first")
 		return (&FullSyncPipeline{pipeline.PipelineSpec}).sync(job, ctx)
 	}
 
@@ -238,6 +250,12 @@ func (pipeline *IncrementalPipeline) sync(job *job, ctx context.Context) (int, e
 								pe, e := tc.transformEntities(runner, lentities, job.title)
 								res.entities = pe
 								res.err = e
+							} else if wt, ok := pipeline.transform.(*wrappedTransform); ok && reflect.TypeOf(wt.t) == reflect.TypeOf(&JavascriptTransform{}) {
+								// the javascript runtime can not be shared between workers, also when the transform is wrapped
+								tc, _ := wt.t.(*JavascriptTransform).Clone()
+								pe, e := wt.transformWith(tc, runner, lentities, job.title)
+								res.entities = pe
+								res.err = e
 							} else {
 								pe, e := pipeline.transform.transformEntities(runner, lentities, job.title)
 								res.entities = pe
@@ -279,6 +297,8 @@ func (pipeline *IncrementalPipeline) sync(job *job, ctx context.Context) (int, e
 							entities = append(entities, res.entities...)
 						}
 
+						job.countTransformed(len(entities))
+
 						err = runner.statsdClient.Timing("pipeline.transform.batch", time.Since(transformTS), tags, 1)
 						if err != nil {
 							return err
@@ -290,8 +310,10 @@ func (pipeline *IncrementalPipeline) sync(job *job, ctx context.Context) (int, e
 					err = pipeline.sink.processEntities(runner, entities)
 					_ = runner.statsdClient.Timing("pipeline.sink.batch", time.Since(sinkTS), tags, 1)
 					if err != nil {
+						job.logRun(RunLogError, RunLogSourceSink, "failed to write %v entities: %v", len(entities), err)
 						return err
 					}
+					job.countWritten(len(entities))
 				}
 
 				// store token if there is one
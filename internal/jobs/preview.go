@@ -0,0 +1,206 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/jobs/source"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	DefaultPreviewBatches = 1
+	MaxPreviewBatches     = 10
+
+	// previewTimeout bounds how long a preview may read and transform
+	previewTimeout = time.Minute
+)
+
+// PreviewOptions controls how much of a job a preview runs
+type PreviewOptions struct {
+	JobType   string // fullsync or incremental, defaults to incremental
+	Batches   int    // number of batches to read, defaults to DefaultPreviewBatches
+	BatchSize int    // overrides the batch size of the job when set
+}
+
+// PreviewBatch is one batch read from the source, and what the transform made of it
+type PreviewBatch struct {
+	Read        int              `json:"read"`
+	ReadMs      int64            `json:"readMs"`
+	TransformMs int64            `json:"transformMs"`
+	Entities    []*server.Entity `json:"entities"`
+}
+
+// JobPreview is the result of a dry run of a job. TokenAfter is the continuation token the job would have stored,
+// the stored token of the job is not changed.
+type JobPreview struct {
+	JobID       string          `json:"jobId"`
+	JobType     string          `json:"jobType"`
+	BatchSize   int             `json:"batchSize"`
+	TokenBefore string          `json:"tokenBefore"`
+	TokenAfter  string          `json:"tokenAfter"`
+	DurationMs  int64           `json:"durationMs"`
+	Batches     []*PreviewBatch `json:"batches"`
+	Error       string          `json:"error,omitempty"`
+	Log         []*RunLogEntry  `json:"log"`
+}
+
+var errPreviewComplete = errors.New("preview complete")
+
+// PreviewJob does a dry run of a job configuration, which does not have to be saved. It reads a few batches from
+// the source and runs them through the transform, but never writes to the sink or stores the continuation token.
+// Transactions executed by a javascript transform are skipped. An error is returned if the configuration can not
+// be used, errors from the source or transform are reported in the preview.
+func (s *Scheduler) PreviewJob(ctx context.Context, jobConfig *JobConfiguration, options PreviewOptions) (*JobPreview, error) {
+	if options.JobType == "" {
+		options.JobType = JobTypeIncremental
+	}
+	if _, ok := JobTypes[options.JobType]; !ok {
+		return nil, errors.New("need to set 'jobType'. must be one of: fullsync, incremental")
+	}
+	if options.Batches <= 0 {
+		options.Batches = DefaultPreviewBatches
+	}
+	if options.Batches > MaxPreviewBatches {
+		options.Batches = MaxPreviewBatches
+	}
+	if len(jobConfig.Source) == 0 {
+		return nil, errors.New("you must configure a source")
+	}
+	if len(jobConfig.Sink) == 0 {
+		return nil, errors.New("you must configure a sink")
+	}
+	pipeline, err := s.toPipeline(jobConfig, options.JobType)
+	if err != nil {
+		return nil, err
+	}
+	spec := pipeline.spec()
+	if options.BatchSize > 0 {
+		spec.batchSize = options.BatchSize
+	}
+
+	log := newRunLog(s.Runner.runLogSize)
+	if jt, ok := spec.transform.(*JavascriptTransform); ok {
+		jt.runLog = log
+		jt.dryRun = true
+	}
+
+	preview := &JobPreview{
+		JobID:     jobConfig.ID,
+		JobType:   options.JobType,
+		BatchSize: spec.batchSize,
+		Batches:   make([]*PreviewBatch, 0),
+	}
+	if !pipeline.isFullSync() && jobConfig.ID != "" {
+		state, err := s.GetJobState(jobConfig.ID)
+		if err != nil {
+			return nil, err
+		}
+		preview.TokenBefore = state.ContinuationToken
+	}
+	// like the incremental pipeline, a multi source that has never run is read as a full sync
+	isMultiSource := spec.source.GetConfig()["Type"] == "MultiSource"
+	if (pipeline.isFullSync() || (isMultiSource && preview.TokenBefore == "")) && spec.startsSourceFullSync() {
+		spec.source.StartFullSync()
+	}
+	preview.TokenAfter = preview.TokenBefore
+
+	started := time.Now()
+	err = s.previewBatches(ctx, spec, options.Batches, preview)
+	preview.DurationMs = time.Since(started).Milliseconds()
+	if err != nil {
+		preview.Error = err.Error()
+		log.add(RunLogError, RunLogSourceJob, "preview failed: "+err.Error())
+	} else {
+		log.add(RunLogInfo, RunLogSourceJob, fmt.Sprintf("preview read %v batches", len(preview.Batches)))
+	}
+	preview.Log = log.list()
+	return preview, nil
+}
+
+// previewBatches reads up to the given number of batches from the source of the pipeline, and transforms them
+func (s *Scheduler) previewBatches(ctx context.Context, spec *PipelineSpec, batches int, preview *JobPreview) error {
+	ctx, cancel := context.WithTimeout(ctx, previewTimeout)
+	defer cancel()
+	// the context only stops the source, running javascript has to be interrupted
+	if jt, ok := spec.transform.(*JavascriptTransform); ok {
+		stopTransform := context.AfterFunc(ctx, func() {
+			jt.sandbox.cancel("preview stopped: " + ctx.Err().Error())
+		})
+		defer stopTransform()
+	}
+
+	token, err := source.DecodeToken(spec.source.GetConfig()["Type"], preview.TokenBefore)
+	if err != nil {
+		return err
+	}
+	for len(preview.Batches) < batches {
+		readTS := time.Now()
+		done := true
+		err = spec.source.ReadEntities(ctx, token, spec.batchSize,
+			func(entities []*server.Entity, c source.DatasetContinuation) error {
+				if err := ctx.Err(); err != nil {
+					return err
+				}
+				if len(entities) == 0 { // the last page of a tokenized source
+					done = true
+					return nil
+				}
+				batch := &PreviewBatch{
+					Read:     len(entities),
+					ReadMs:   time.Since(readTS).Milliseconds(),
+					Entities: entities,
+				}
+				preview.Batches = append(preview.Batches, batch)
+				if spec.transform != nil {
+					transformTS := time.Now()
+					transformed, err := spec.transform.transformEntities(s.Runner, entities, "preview")
+					batch.TransformMs = time.Since(transformTS).Milliseconds()
+					if err != nil {
+						return err
+					}
+					batch.Entities = transformed
+				}
+				done = c.GetToken() == ""
+				if !done {
+					encoded, err := c.Encode()
+					if err != nil {
+						return err
+					}
+					preview.TokenAfter = encoded
+					token = c
+				}
+				if len(preview.Batches) >= batches {
+					return errPreviewComplete
+				}
+				readTS = time.Now()
+				return nil
+			})
+		if errors.Is(err, errPreviewComplete) {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if done {
+			return nil
+		}
+	}
+	return nil
+}
@@ -0,0 +1,156 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"context"
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("A job preview", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testpreview_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, dsm, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	jobConfig := func(js string) *JobConfiguration {
+		config := &JobConfiguration{
+			ID: "preview", Title: "preview", Paused: true, BatchSize: 3,
+			Source:   map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(10)},
+			Sink:     map[string]interface{}{"Type": "DatasetSink", "Name": "out"},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+		}
+		if js != "" {
+			config.Transform = map[string]interface{}{
+				"Type": "JavascriptTransform",
+				"Code": base64.StdEncoding.EncodeToString([]byte(js)),
+			}
+		}
+		return config
+	}
+
+	It("Should transform a few batches without writing anything", func() {
+		_, _ = dsm.CreateDataset("out", nil)
+		_, _ = dsm.CreateDataset("side", nil)
+		Expect(scheduler.AddJob(jobConfig(`function transform_entities(entities) {
+			var txn = NewTransaction();
+			txn.DatasetEntities["side"] = entities;
+			ExecuteTransaction(txn);
+			Log("batch of " + entities.length);
+			return entities.slice(1);
+		}`))).To(BeNil())
+		config, _ := scheduler.LoadJob("preview")
+
+		preview, err := scheduler.PreviewJob(context.Background(), config, PreviewOptions{Batches: 2})
+		Expect(err).To(BeNil())
+		Expect(preview.Error).To(BeEmpty())
+		Expect(preview.JobType).To(Equal(JobTypeIncremental))
+		Expect(preview.BatchSize).To(Equal(3))
+		Expect(preview.TokenBefore).To(Equal(""))
+		Expect(preview.TokenAfter).To(Equal("6"))
+		Expect(preview.Batches).To(HaveLen(2))
+		Expect(preview.Batches[0].Read).To(Equal(3))
+		Expect(preview.Batches[0].Entities).To(HaveLen(2))
+		Expect(preview.Batches[1].Entities[0].ID).To(HaveSuffix(":e-4"))
+
+		var messages []string
+		for _, e := range preview.Log {
+			messages = append(messages, e.Message)
+		}
+		Expect(messages).To(Equal([]string{
+			"preview: skipped writing 3 entities to dataset side",
+			"batch of 3",
+			"preview: skipped writing 3 entities to dataset side",
+			"batch of 3",
+			"preview read 2 batches",
+		}))
+
+		state, _ := scheduler.GetJobState("preview")
+		Expect(state.ContinuationToken).To(BeEmpty(), "the stored token is not moved")
+		for _, name := range []string{"out", "side"} {
+			res, _ := dsm.GetDataset(name).GetEntities("", 10)
+			Expect(res.Entities).To(BeEmpty(), "nothing is written to "+name)
+		}
+		runs, _ := scheduler.GetJobRuns("preview", 0, 0)
+		Expect(runs.Total).To(BeZero(), "a preview is not a run")
+	})
+
+	It("Should continue from the stored token, and stop at the end of the source", func() {
+		Expect(store.StoreObject(server.JobDataIndex, "preview",
+			&SyncJobState{ID: "preview", ContinuationToken: "6"})).To(BeNil())
+
+		preview, err := scheduler.PreviewJob(context.Background(), jobConfig(""), PreviewOptions{Batches: 5})
+		Expect(err).To(BeNil())
+		Expect(preview.TokenBefore).To(Equal("6"))
+		Expect(preview.TokenAfter).To(Equal("10"))
+		Expect(preview.Batches).To(HaveLen(2))
+		Expect(preview.Batches[1].Read).To(Equal(1))
+
+		preview, _ = scheduler.PreviewJob(context.Background(), jobConfig(""),
+			PreviewOptions{JobType: JobTypeFull, BatchSize: 10, Batches: 100})
+		Expect(preview.TokenBefore).To(Equal(""), "a full sync starts from the beginning")
+		Expect(preview.Batches).To(HaveLen(1))
+		Expect(preview.Batches[0].Read).To(Equal(10))
+	})
+
+	It("Should interrupt a transform that runs past the end of the preview", func() {
+		config := jobConfig(`function transform_entities(entities) { while (true) {} }`)
+		ctx, cancel := context.WithTimeout(context.Background(), 200*time.Millisecond)
+		defer cancel()
+		started := time.Now()
+		preview, err := scheduler.PreviewJob(ctx, config, PreviewOptions{})
+		Expect(err).To(BeNil())
+		Expect(time.Since(started)).To(BeNumerically("<", 10*time.Second))
+		Expect(preview.Error).To(ContainSubstring("preview stopped: context deadline exceeded"))
+	})
+
+	It("Should report transform errors and reject invalid configurations", func() {
+		config := jobConfig(`function transform_entities(entities) { throw new Error("boom"); }`)
+		config.ID = "not-saved"
+		preview, err := scheduler.PreviewJob(context.Background(), config, PreviewOptions{})
+		Expect(err).To(BeNil())
+		Expect(preview.Error).To(ContainSubstring("boom"))
+		Expect(preview.Batches).To(HaveLen(1))
+		Expect(preview.Log[len(preview.Log)-1].Level).To(Equal(RunLogError))
+
+		config.Transform = map[string]interface{}{"Type": "MagicTransform"}
+		_, err = scheduler.PreviewJob(context.Background(), config, PreviewOptions{})
+		Expect(err).NotTo(BeNil())
+		_, err = scheduler.PreviewJob(context.Background(), jobConfig(""), PreviewOptions{JobType: "sometimes"})
+		Expect(err).NotTo(BeNil())
+	})
+})
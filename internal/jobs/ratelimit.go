@@ -0,0 +1,97 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"fmt"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+// parseRateLimit reads the RateLimit config of a source, sink or transform. It returns nil when there is none.
+func parseRateLimit(config map[string]interface{}) (*server.RateLimit, error) {
+	raw, ok := config["RateLimit"]
+	if !ok || raw == nil {
+		return nil, nil
+	}
+	m, ok := raw.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("RateLimit must be an object")
+	}
+	limit := &server.RateLimit{}
+	for key, value := range m {
+		if key == "Per" {
+			per, ok := value.(string)
+			if !ok {
+				return nil, errors.New("RateLimit.Per must be a string")
+			}
+			limit.Per = per
+			continue
+		}
+		f, ok := value.(float64)
+		if !ok || f < 0 {
+			return nil, fmt.Errorf("RateLimit.%s must be a positive number", key)
+		}
+		switch key {
+		case "RequestsPerSecond":
+			limit.RequestsPerSecond = f
+		case "EntitiesPerSecond":
+			limit.EntitiesPerSecond = f
+		case "ConcurrentRequests":
+			limit.ConcurrentRequests = int(f)
+		default:
+			return nil, fmt.Errorf("unknown RateLimit option '%s'. must be one of: RequestsPerSecond, "+
+				"EntitiesPerSecond, ConcurrentRequests, Per", key)
+		}
+	}
+	if err := limit.Validate(); err != nil {
+		return nil, err
+	}
+	return limit, nil
+}
+
+// rateLimitUses returns the limits that a job puts on the requests of its source, sink and transform
+func (s *Scheduler) rateLimitUses(jobConfig *JobConfiguration) ([]server.RateLimitUse, error) {
+	jobConfig, _, err := s.resolveJobConfiguration(jobConfig, true)
+	if err != nil {
+		return nil, err
+	}
+	var uses []server.RateLimitUse
+	for _, config := range []map[string]interface{}{jobConfig.Source, jobConfig.Sink, jobConfig.Transform} {
+		switch config["Type"] {
+		case "HttpDatasetSource", "HttpDatasetSink", "HttpTransform":
+		default:
+			continue
+		}
+		limit, err := parseRateLimit(config)
+		if err != nil {
+			return nil, err
+		}
+		url, _ := config["Url"].(string)
+		tokenProvider, _ := config["TokenProvider"].(string)
+		uses = append(uses, server.RateLimitUse{Limit: limit, URL: url, LoginProvider: tokenProvider})
+	}
+	return uses, nil
+}
+
+func rateLimitOwner(jobID string) string {
+	return "job:" + jobID
+}
+
+// GetRateLimits returns the rate limiters shared by the jobs and proxy datasets of the hub
+func (s *Scheduler) GetRateLimits() []server.RateLimiterState {
+	return s.Runner.rateLimiters.States()
+}
@@ -0,0 +1,169 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("Rate limits", func() {
+	testCnt := 0
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testratelimit_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, _, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	It("Should read rate limit config", func() {
+		limit, err := parseRateLimit(map[string]interface{}{
+			"RateLimit": map[string]interface{}{"RequestsPerSecond": 2.5, "ConcurrentRequests": float64(3), "Per": "loginProvider"},
+		})
+		Expect(err).To(BeNil())
+		Expect(*limit).To(Equal(server.RateLimit{RequestsPerSecond: 2.5, ConcurrentRequests: 3, Per: "loginProvider"}))
+
+		limit, err = parseRateLimit(map[string]interface{}{})
+		Expect(err).To(BeNil())
+		Expect(limit).To(BeNil())
+
+		for config, message := range map[string]string{
+			"EntitiesPerSecond": "positive number",
+			"Per":               "must be per host or loginProvider",
+			"Burst":             "unknown RateLimit option",
+		} {
+			value := map[string]interface{}{"EntitiesPerSecond": float64(-1), "Per": "dataset", "Burst": float64(1)}[config]
+			_, err := parseRateLimit(map[string]interface{}{"RateLimit": map[string]interface{}{config: value}})
+			Expect(err).To(MatchError(ContainSubstring(message)), config)
+		}
+	})
+
+	It("Should share the limit of a host between jobs", func() {
+		var inFlight, maxInFlight, requests int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			atomic.AddInt32(&requests, 1)
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(10 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			w.WriteHeader(http.StatusOK)
+		}))
+		defer srv.Close()
+
+		sinkJob := func(id string) *JobConfiguration {
+			return &JobConfiguration{
+				ID: id, Title: id, Paused: true, BatchSize: 2,
+				Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(10)},
+				Sink: map[string]interface{}{
+					"Type":      "HttpDatasetSink",
+					"Url":       srv.URL + "/datasets/" + id + "/entities",
+					"RateLimit": map[string]interface{}{"ConcurrentRequests": float64(1)},
+				},
+				Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+			}
+		}
+
+		var wg sync.WaitGroup
+		for _, id := range []string{"first", "second", "third"} {
+			config := sinkJob(id)
+			Expect(scheduler.AddJob(config)).To(BeNil())
+			triggered, err := scheduler.toTriggeredJobs(config)
+			Expect(err).To(BeNil())
+			wg.Add(1)
+			go func(j *job) {
+				defer GinkgoRecover()
+				defer wg.Done()
+				j.Run()
+			}(triggered[0])
+		}
+		wg.Wait()
+
+		Expect(atomic.LoadInt32(&requests)).To(Equal(int32(15)), "each job sends 5 batches")
+		Expect(atomic.LoadInt32(&maxInFlight)).To(Equal(int32(1)), "the jobs take turns sending to the host")
+		for _, id := range []string{"first", "second", "third"} {
+			runs, _ := scheduler.GetJobRuns(id, 0, 1)
+			Expect(runs.Runs[0].Status).To(Equal(RunStatusSucceeded))
+		}
+		Expect(scheduler.GetRateLimits()).To(ContainElement(And(
+			HaveField("Limit.ConcurrentRequests", 1),
+			HaveField("InFlight", 0),
+		)))
+	})
+
+	It("Should take limits from the jobs that are added, and only from them", func() {
+		limited := func(id string, concurrent int) *JobConfiguration {
+			return &JobConfiguration{
+				ID: id, Title: id, Paused: true, BatchSize: 2,
+				Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(10)},
+				Sink: map[string]interface{}{
+					"Type":      "HttpDatasetSink",
+					"Url":       "http://ratelimit-jobs.example.io/datasets/" + id + "/entities",
+					"RateLimit": map[string]interface{}{"ConcurrentRequests": float64(concurrent)},
+				},
+				Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+			}
+		}
+		concurrency := func() interface{} {
+			for _, s := range scheduler.GetRateLimits() {
+				if s.Key == "host:ratelimit-jobs.example.io" {
+					return s.Limit.ConcurrentRequests
+				}
+			}
+			return nil
+		}
+
+		Expect(scheduler.AddJob(limited("first", 2))).To(BeNil())
+		Expect(concurrency()).To(Equal(2))
+
+		// parsing a job, as previews and lineage do, does not limit anything
+		_, err := scheduler.toPipeline(limited("preview", 1), JobTypeIncremental)
+		Expect(err).To(BeNil())
+		Expect(concurrency()).To(Equal(2))
+
+		Expect(scheduler.AddJob(limited("first", 3))).To(BeNil())
+		Expect(concurrency()).To(Equal(3), "an edited job no longer holds its old limit")
+		Expect(scheduler.AddJob(limited("second", 1))).To(BeNil())
+		Expect(concurrency()).To(Equal(1))
+		Expect(scheduler.DeleteJob("second")).To(Succeed())
+		Expect(concurrency()).To(Equal(3))
+		Expect(scheduler.DeleteJob("first")).To(Succeed())
+		Expect(concurrency()).To(BeNil())
+	})
+})
@@ -0,0 +1,138 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	RunLogInfo  = "info"
+	RunLogWarn  = "warn"
+	RunLogError = "error"
+
+	RunLogSourceJob       = "job"
+	RunLogSourceTransform = "transform"
+	RunLogSourceSink      = "sink"
+
+	DefaultRunLogMaxEntries = 1000
+
+	// runLogMaxMessage is the max length of a single log message, longer messages are cut
+	runLogMaxMessage = 4096
+)
+
+// RunLogEntry is a single line in the log of a job run
+type RunLogEntry struct {
+	Time    time.Time `json:"time"`
+	Level   string    `json:"level"`
+	Source  string    `json:"source"`
+	Message string    `json:"message"`
+}
+
+// RunLog is the log of a job run. When there are more entries than the log can hold, the oldest are dropped.
+type RunLog struct {
+	JobID   string         `json:"jobId"`
+	RunID   string         `json:"runId"`
+	Dropped int            `json:"dropped"`
+	Entries []*RunLogEntry `json:"entries"`
+}
+
+// runLog is the bounded log buffer of the current run of a job. It is shared with parallel transforms,
+// so it is safe for concurrent use.
+type runLog struct {
+	lock       sync.Mutex
+	maxEntries int
+	dropped    int
+	entries    []*RunLogEntry
+}
+
+func newRunLog(maxEntries int) *runLog {
+	if maxEntries <= 0 {
+		maxEntries = DefaultRunLogMaxEntries
+	}
+	return &runLog{maxEntries: maxEntries, entries: make([]*RunLogEntry, 0)}
+}
+
+// add appends an entry to the log, nil logs are ignored
+func (l *runLog) add(level string, source string, message string) {
+	if l == nil {
+		return
+	}
+	if len(message) > runLogMaxMessage {
+		message = message[:runLogMaxMessage] + "..."
+	}
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.entries = append(l.entries, &RunLogEntry{Time: time.Now(), Level: level, Source: source, Message: message})
+	if len(l.entries) > l.maxEntries {
+		l.dropped += len(l.entries) - l.maxEntries
+		l.entries = l.entries[len(l.entries)-l.maxEntries:]
+	}
+}
+
+// list returns the entries currently in the log
+func (l *runLog) list() []*RunLogEntry {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return l.entries
+}
+
+func (l *runLog) toRunLog(run *JobRun) *RunLog {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	return &RunLog{JobID: run.JobID, RunID: run.ID, Dropped: l.dropped, Entries: l.entries}
+}
+
+// logRun adds a formatted entry to the log of the current run of the job
+func (j *job) logRun(level string, source string, format string, args ...interface{}) {
+	if j == nil {
+		return
+	}
+	j.log.add(level, source, fmt.Sprintf(format, args...))
+}
+
+// attachRunLog lets the javascript transform of the job write its Log calls to the log of the current run
+func (j *job) attachRunLog() {
+	t := j.pipeline.spec().transform
+	if w, ok := t.(*wrappedTransform); ok {
+		t = w.t
+	}
+	if jt, ok := t.(*JavascriptTransform); ok {
+		jt.runLog = j.log
+	}
+}
+
+func (runner *Runner) storeRunLog(run *JobRun, l *runLog) error {
+	if l == nil {
+		return nil
+	}
+	return runner.store.StoreObject(server.JobRunLogIndex, runKey(run.JobID, run.ID), l.toRunLog(run))
+}
+
+// GetJobRunLog returns the log of a single run of a job, or nil if it is not found
+func (s *Scheduler) GetJobRunLog(jobID string, runID string) (*RunLog, error) {
+	runLog := &RunLog{}
+	if err := s.Store.GetObject(server.JobRunLogIndex, runKey(jobID, runID), runLog); err != nil {
+		return nil, err
+	}
+	if runLog.RunID == "" {
+		return nil, nil
+	}
+	return runLog, nil
+}
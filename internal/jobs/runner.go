@@ -15,6 +15,8 @@
 package jobs
 
 import (
+	"sync"
+
 	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/bamzi/jobrunner"
 	"github.com/mustafaturan/bus"
@@ -36,6 +38,14 @@ type Runner struct {
 	tokenProviders *security.TokenProviders
 	raffle         *raffle
 	eventBus       server.EventBus
+	dependencies   *dependencies
+	runRetention   runRetention
+	runLogSize     int
+	deadLetterLock sync.Mutex
+	// circuitBreakers are shared by all jobs, so that they stop sending to a failing host together
+	circuitBreakers *circuitBreakers
+	// rateLimiters are shared by all jobs and proxy datasets, and limited by the jobs that are added
+	rateLimiters *server.RateLimiters
 }
 
 // SyncJobState used to capture the state of a running job
@@ -69,6 +79,12 @@ func NewRunner(
 		statsdClient:   statsdClient,
 		raffle:         NewRaffle(config.PoolFull, config.PoolIncremental, logger, statsdClient),
 		eventBus:       eb,
+		dependencies:   newDependencies(),
+		runRetention:   runRetention{maxRuns: config.RunHistoryMaxRuns, maxAge: config.RunHistoryMaxAge},
+		runLogSize:     config.RunLogMaxEntries,
+		circuitBreakers: newCircuitBreakers(
+			config.CircuitBreakerThreshold, config.CircuitBreakerOpenDuration, logger, statsdClient),
+		rateLimiters: store.RateLimiters,
 	}
 }
 
@@ -85,6 +101,8 @@ func (runner *Runner) Stop() {
 func (runner *Runner) addJob(job *job) error {
 	if job.isEvent {
 		return runner.addEventJob(job)
+	} else if len(job.dependsOn) > 0 {
+		return runner.addDependentJob(job)
 	} else {
 		return runner.addScheduledJob(job)
 	}
@@ -131,6 +149,8 @@ func (runner *Runner) deleteJob(jobID string) error {
 		// make sure the schedules are removed from the crontab
 		clearCrontab(runner.scheduledJobs, jobID)
 		runner.eventBus.UnsubscribeToDataset(jobID)
+		runner.removeDependentJob(jobID)
+		runner.rateLimiters.Remove(rateLimitOwner(jobID))
 	}()
 	err := runner.store.DeleteObject(server.JobConfigIndex, jobID)
 	if err != nil {
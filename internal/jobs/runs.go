@@ -0,0 +1,329 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	RunStatusSucceeded = "succeeded"
+	RunStatusFailed    = "failed"
+	RunStatusCancelled = "cancelled"
+	// RunStatusOnHold is the status of runs stopped because the circuit breaker of a host they send to opened
+	RunStatusOnHold = "onhold"
+
+	// RunTriggerManual is the trigger type of runs started through RunJob
+	RunTriggerManual = "manual"
+
+	DefaultRunsLimit = 20
+	MaxRunsLimit     = 1000
+
+	runIDFormat = "20060102T150405.000000000Z"
+)
+
+// RunCounts counts the entities passing through each stage of a job run
+type RunCounts struct {
+	Read        int `json:"read"`        // entities read from the source
+	Transformed int `json:"transformed"` // entities returned by the transform
+	Written     int `json:"written"`     // entities accepted by the sink
+	Failed      int `json:"failed"`      // entities given to the error handlers
+}
+
+// JobRun is the record of a single run of a job
+type JobRun struct {
+	ID          string    `json:"id"`
+	JobID       string    `json:"jobId"`
+	Title       string    `json:"title"`
+	TriggerType string    `json:"triggerType"`
+	JobType     string    `json:"jobType"`
+	Status      string    `json:"status"`
+	Start       time.Time `json:"start"`
+	End         time.Time `json:"end"`
+	DurationMs  int64     `json:"durationMs"`
+	TokenBefore string    `json:"tokenBefore"`
+	TokenAfter  string    `json:"tokenAfter"`
+	Counts      RunCounts `json:"counts"`
+	Errors      []string  `json:"errors,omitempty"` // the error and the errors it wraps, outermost first
+}
+
+// JobRuns is a page of job runs, newest first
+type JobRuns struct {
+	Total  int       `json:"total"`
+	Offset int       `json:"offset"`
+	Limit  int       `json:"limit"`
+	Runs   []*JobRun `json:"runs"`
+}
+
+// runRetention bounds how many runs are kept per job. Zero means no limit.
+type runRetention struct {
+	maxRuns int
+	maxAge  time.Duration
+}
+
+func runKey(jobID string, runID string) string {
+	return jobID + "::" + runID
+}
+
+func runsPrefix(jobID string) []byte {
+	return append(server.JobRunIndexBytes, []byte("::"+jobID+"::")...)
+}
+
+// newRun starts the record of a job run
+func (j *job) newRun(started time.Time, jobType string) *JobRun {
+	run := &JobRun{
+		ID:          started.UTC().Format(runIDFormat),
+		JobID:       j.id,
+		Title:       j.title,
+		TriggerType: j.triggerType,
+		JobType:     jobType,
+		Start:       started,
+		TokenBefore: j.continuationToken(),
+	}
+	j.counts = &run.Counts
+	j.log = newRunLog(j.runner.runLogSize)
+	j.attachRunLog()
+	j.logRun(RunLogInfo, RunLogSourceJob, "starting %s run, triggered by %s", jobType, j.triggerType)
+	return run
+}
+
+// finishRun completes the record of a job run with its outcome, and stores it. It is called before the ticket is
+// returned, so errors the error handlers kept in a wrapped sink are picked up here.
+func (j *job) finishRun(run *JobRun, processed int, err error) {
+	j.counts = nil
+	run.End = time.Now()
+	run.DurationMs = run.End.Sub(run.Start).Milliseconds()
+	run.TokenAfter = j.continuationToken()
+	run.Counts.Read = processed
+	if ws, ok := j.pipeline.spec().sink.(*wrappedSink); ok {
+		if (err == nil || errors.Is(err, MaxItemsExceededError)) && ws.lastError != nil {
+			err = ws.lastError
+		}
+		run.Counts.Failed = ws.failed
+		run.Counts.Written -= ws.failed
+		if run.Counts.Written < 0 {
+			run.Counts.Written = 0
+		}
+	}
+	if wt, ok := j.pipeline.spec().transform.(*wrappedTransform); ok {
+		if transformErr := j.transformError(); (err == nil || errors.Is(err, MaxItemsExceededError)) && transformErr != nil {
+			err = transformErr
+		}
+		run.Counts.Failed += wt.failed
+	}
+	run.Status = RunStatusSucceeded
+	if err != nil {
+		run.Status = RunStatusFailed
+		if err.Error() == "got job interrupt" {
+			run.Status = RunStatusCancelled
+		} else if errors.Is(err, ErrCircuitOpen) {
+			run.Status = RunStatusOnHold
+		}
+		for e := err; e != nil; e = errors.Unwrap(e) {
+			run.Errors = append(run.Errors, e.Error())
+		}
+	}
+	if run.Status == RunStatusFailed {
+		j.logRun(RunLogError, RunLogSourceJob, "run failed after reading %v entities: %v", processed, err)
+	} else {
+		j.logRun(RunLogInfo, RunLogSourceJob, "run %s after reading %v entities", run.Status, processed)
+	}
+	if err := j.runner.storeRunLog(run, j.log); err != nil {
+		j.runner.logger.Warnf("Failed to store log of run %s of job %s (%s): %v", run.ID, j.id, j.title, err)
+	}
+	j.log = nil
+	j.attachRunLog()
+	if err := j.runner.storeRun(run); err != nil {
+		j.runner.logger.Warnf("Failed to store run %s of job %s (%s): %v", run.ID, j.id, j.title, err)
+	}
+}
+
+// failRun records a run of the job that failed without running, such as one triggered by an upstream job that
+// failed. It is stored like other runs, with its log and as the last result of the job. The state of the current
+// run is left alone, since the job may be running at the same time.
+func (j *job) failRun(err error) {
+	now := time.Now()
+	jobType := "incremental"
+	if j.pipeline.isFullSync() {
+		jobType = "fullsync"
+	}
+	token := j.continuationToken()
+	run := &JobRun{
+		ID:          now.UTC().Format(runIDFormat),
+		JobID:       j.id,
+		Title:       j.title,
+		TriggerType: j.triggerType,
+		JobType:     jobType,
+		Status:      RunStatusFailed,
+		Start:       now,
+		End:         now,
+		TokenBefore: token,
+		TokenAfter:  token,
+	}
+	for e := err; e != nil; e = errors.Unwrap(e) {
+		run.Errors = append(run.Errors, e.Error())
+	}
+	log := newRunLog(j.runner.runLogSize)
+	log.add(RunLogError, RunLogSourceJob, fmt.Sprintf("%s run, triggered by %s, failed without running: %v",
+		jobType, j.triggerType, err))
+	if err := j.runner.storeRunLog(run, log); err != nil {
+		j.runner.logger.Warnf("Failed to store log of run %s of job %s (%s): %v", run.ID, j.id, j.title, err)
+	}
+	if err := j.runner.storeRun(run); err != nil {
+		j.runner.logger.Warnf("Failed to store run %s of job %s (%s): %v", run.ID, j.id, j.title, err)
+	}
+	_ = j.runner.store.StoreObject(server.JobResultIndex, j.id, &jobResult{
+		ID:        j.id,
+		Title:     j.title,
+		Start:     now,
+		End:       now,
+		LastError: err.Error(),
+	})
+}
+
+// continuationToken returns the stored continuation token of the job. The store panics on reads after it is
+// closed, which can happen when a run ends during shutdown, so that is treated as no token.
+func (j *job) continuationToken() (token string) {
+	defer func() {
+		if r := recover(); r != nil {
+			token = ""
+		}
+	}()
+	state := &SyncJobState{}
+	if err := j.runner.store.GetObject(server.JobDataIndex, j.id, state); err != nil {
+		return ""
+	}
+	return state.ContinuationToken
+}
+
+func (j *job) countTransformed(n int) {
+	if j.counts != nil {
+		j.counts.Transformed += n
+	}
+}
+
+func (j *job) countWritten(n int) {
+	if j.counts != nil {
+		j.counts.Written += n
+	}
+}
+
+// storeRun stores a job run, and removes the runs of the job that are outside the retention
+func (runner *Runner) storeRun(run *JobRun) error {
+	if err := runner.store.StoreObject(server.JobRunIndex, runKey(run.JobID, run.ID), run); err != nil {
+		return err
+	}
+	if runner.runRetention.maxRuns == 0 && runner.runRetention.maxAge == 0 {
+		return nil
+	}
+	runs, err := runner.loadRuns(run.JobID)
+	if err != nil {
+		return err
+	}
+	for i, r := range runs {
+		tooMany := runner.runRetention.maxRuns > 0 && i >= runner.runRetention.maxRuns
+		tooOld := runner.runRetention.maxAge > 0 && time.Since(r.Start) > runner.runRetention.maxAge
+		if tooMany || tooOld {
+			if err := runner.deleteRun(r.JobID, r.ID); err != nil {
+				return err
+			}
+		}
+	}
+	return nil
+}
+
+// loadRuns returns all stored runs of a job, newest first
+func (runner *Runner) loadRuns(jobID string) ([]*JobRun, error) {
+	runs := make([]*JobRun, 0)
+	err := runner.store.IterateObjectsRaw(runsPrefix(jobID), func(jsonData []byte) error {
+		run := &JobRun{}
+		if err := json.Unmarshal(jsonData, run); err != nil {
+			return err
+		}
+		runs = append(runs, run)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(runs, func(i, j int) bool { return runs[i].ID > runs[j].ID })
+	return runs, nil
+}
+
+// deleteRuns removes the run history of a job
+func (runner *Runner) deleteRuns(jobID string) error {
+	runs, err := runner.loadRuns(jobID)
+	if err != nil {
+		return err
+	}
+	for _, r := range runs {
+		if err := runner.deleteRun(jobID, r.ID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// deleteRun removes a single run and its log
+func (runner *Runner) deleteRun(jobID string, runID string) error {
+	if err := runner.store.DeleteObject(server.JobRunLogIndex, runKey(jobID, runID)); err != nil {
+		return err
+	}
+	return runner.store.DeleteObject(server.JobRunIndex, runKey(jobID, runID))
+}
+
+// GetJobRuns returns a page of the runs of a job, newest first
+func (s *Scheduler) GetJobRuns(jobID string, offset int, limit int) (*JobRuns, error) {
+	if offset < 0 {
+		return nil, errors.New("offset can not be negative")
+	}
+	if limit <= 0 {
+		limit = DefaultRunsLimit
+	}
+	if limit > MaxRunsLimit {
+		limit = MaxRunsLimit
+	}
+	runs, err := s.Runner.loadRuns(jobID)
+	if err != nil {
+		return nil, err
+	}
+	page := &JobRuns{Total: len(runs), Offset: offset, Limit: limit, Runs: make([]*JobRun, 0)}
+	if offset < len(runs) {
+		end := offset + limit
+		if end > len(runs) {
+			end = len(runs)
+		}
+		page.Runs = runs[offset:end]
+	}
+	return page, nil
+}
+
+// GetJobRun returns a single run of a job, or nil if it is not found
+func (s *Scheduler) GetJobRun(jobID string, runID string) (*JobRun, error) {
+	run := &JobRun{}
+	if err := s.Store.GetObject(server.JobRunIndex, runKey(jobID, runID), run); err != nil {
+		return nil, err
+	}
+	if run.ID == "" {
+		return nil, nil
+	}
+	return run, nil
+}
@@ -0,0 +1,256 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"time"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	. "github.com/onsi/gomega/gstruct"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("The job run history", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testruns_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, dsm, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	addJob := func(js string) *JobConfiguration {
+		_, _ = dsm.CreateDataset("out", nil)
+		config := &JobConfiguration{
+			ID: "runs", Title: "runs", Paused: true, BatchSize: 5,
+			Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(10)},
+			Transform: map[string]interface{}{
+				"Type": "JavascriptTransform",
+				"Code": base64.StdEncoding.EncodeToString([]byte(js)),
+			},
+			Sink:     map[string]interface{}{"Type": "DatasetSink", "Name": "out"},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h"}},
+		}
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		return config
+	}
+	runAndWait := func(jobID string, expectedRuns int) {
+		_, err := scheduler.RunJob(jobID, JobTypeIncremental)
+		Expect(err).To(BeNil())
+		Eventually(func() int {
+			runs, _ := scheduler.GetJobRuns(jobID, 0, 0)
+			return runs.Total
+		}).Should(Equal(expectedRuns))
+	}
+
+	It("Should record every run with counts and continuation tokens", func() {
+		addJob(`function transform_entities(entities) {
+			return entities.filter(function(e, i) { return i % 2 == 0; });
+		}`)
+		runAndWait("runs", 1)
+		runAndWait("runs", 2)
+
+		runs, err := scheduler.GetJobRuns("runs", 0, 0)
+		Expect(err).To(BeNil())
+		Expect(runs.Limit).To(Equal(DefaultRunsLimit))
+		Expect(runs.Runs).To(HaveLen(2))
+
+		latest, first := runs.Runs[0], runs.Runs[1]
+		Expect(first.ID < latest.ID).To(BeTrue(), "newest first")
+		Expect(first.JobID).To(Equal("runs"))
+		Expect(first.TriggerType).To(Equal(RunTriggerManual))
+		Expect(first.JobType).To(Equal(JobTypeIncremental))
+		Expect(first.Status).To(Equal(RunStatusSucceeded))
+		Expect(first.End.Before(first.Start)).To(BeFalse())
+		Expect(first.TokenBefore).To(Equal(""))
+		Expect(first.TokenAfter).To(Equal("10"))
+		Expect(first.Counts).To(Equal(RunCounts{Read: 10, Transformed: 6, Written: 6}))
+		Expect(first.Errors).To(BeEmpty())
+
+		Expect(latest.TokenBefore).To(Equal("10"))
+		Expect(latest.Counts).To(Equal(RunCounts{}))
+
+		page, err := scheduler.GetJobRuns("runs", 1, 1)
+		Expect(err).To(BeNil())
+		Expect(page.Total).To(Equal(2))
+		Expect(page.Runs).To(HaveLen(1))
+		Expect(page.Runs[0].ID).To(Equal(first.ID))
+		page, _ = scheduler.GetJobRuns("runs", 2, 1)
+		Expect(page.Runs).To(BeEmpty())
+		_, err = scheduler.GetJobRuns("runs", -1, 1)
+		Expect(err).NotTo(BeNil())
+
+		run, err := scheduler.GetJobRun("runs", first.ID)
+		Expect(err).To(BeNil())
+		Expect(run.Counts).To(Equal(first.Counts))
+		run, err = scheduler.GetJobRun("runs", "nope")
+		Expect(err).To(BeNil())
+		Expect(run).To(BeNil())
+	})
+
+	It("Should record the error of a failed run", func() {
+		addJob(`function transform_entities(entities) { throw new Error("boom"); }`)
+		runAndWait("runs", 1)
+
+		runs, _ := scheduler.GetJobRuns("runs", 0, 0)
+		run := runs.Runs[0]
+		Expect(run.Status).To(Equal(RunStatusFailed))
+		Expect(run.Errors).NotTo(BeEmpty())
+		Expect(run.Errors[0]).To(ContainSubstring("boom"))
+		Expect(run.Counts).To(Equal(RunCounts{Read: 5}), "the first batch failed in the transform")
+		Expect(run.TokenAfter).To(Equal(""))
+	})
+
+	It("Should only keep the runs within the retention", func() {
+		runner.runRetention = runRetention{maxRuns: 2, maxAge: 24 * time.Hour}
+		now := time.Now()
+		for i, age := range []time.Duration{48 * time.Hour, 3 * time.Hour, 2 * time.Hour, time.Hour} {
+			start := now.Add(-age)
+			Expect(runner.storeRun(&JobRun{
+				ID: start.UTC().Format(runIDFormat), JobID: "runs", Title: fmt.Sprint(i), Start: start,
+			})).To(BeNil())
+		}
+		runs, _ := scheduler.GetJobRuns("runs", 0, 0)
+		Expect(runs.Total).To(Equal(2))
+		Expect(runs.Runs[0].Title).To(Equal("3"))
+		Expect(runs.Runs[1].Title).To(Equal("2"))
+
+		runner.runRetention = runRetention{maxAge: 90 * time.Minute}
+		Expect(runner.storeRun(&JobRun{ID: now.UTC().Format(runIDFormat), JobID: "runs", Title: "4", Start: now})).To(BeNil())
+		runs, _ = scheduler.GetJobRuns("runs", 0, 0)
+		Expect(runs.Total).To(Equal(2), "the run that is two hours old is removed")
+	})
+
+	It("Should delete the runs of a deleted job", func() {
+		addJob(`function transform_entities(entities) { return entities; }`)
+		runAndWait("runs", 1)
+		runs, _ := scheduler.GetJobRuns("runs", 0, 0)
+		runID := runs.Runs[0].ID
+		Expect(scheduler.DeleteJob("runs")).To(BeNil())
+		runs, _ = scheduler.GetJobRuns("runs", 0, 0)
+		Expect(runs.Total).To(BeZero())
+		runLog, err := scheduler.GetJobRunLog("runs", runID)
+		Expect(err).To(BeNil())
+		Expect(runLog).To(BeNil())
+	})
+
+	It("Should keep the transform log of each run", func() {
+		addJob(`function transform_entities(entities) {
+			for (e of entities) { Log("saw " + GetId(e), e.ID.endsWith(":e-4") ? "WARNING" : "INFO"); }
+			return entities;
+		}`)
+		runAndWait("runs", 1)
+
+		runs, _ := scheduler.GetJobRuns("runs", 0, 0)
+		runLog, err := scheduler.GetJobRunLog("runs", runs.Runs[0].ID)
+		Expect(err).To(BeNil())
+		Expect(runLog.JobID).To(Equal("runs"))
+		Expect(runLog.RunID).To(Equal(runs.Runs[0].ID))
+		Expect(runLog.Dropped).To(BeZero())
+		Expect(runLog.Entries).To(HaveLen(12))
+		Expect(runLog.Entries[0].Source).To(Equal(RunLogSourceJob))
+		Expect(runLog.Entries[1]).To(PointTo(MatchFields(IgnoreExtras, Fields{
+			"Level": Equal(RunLogInfo), "Source": Equal(RunLogSourceTransform), "Message": HaveSuffix(":e-0"),
+		})))
+		Expect(runLog.Entries[5].Level).To(Equal(RunLogWarn))
+		Expect(runLog.Entries[11].Message).To(Equal("run succeeded after reading 10 entities"))
+
+		runLog, err = scheduler.GetJobRunLog("runs", "nope")
+		Expect(err).To(BeNil())
+		Expect(runLog).To(BeNil())
+	})
+
+	It("Should only keep the latest entries of a large run log", func() {
+		runner.runLogSize = 3
+		addJob(`function transform_entities(entities) {
+			for (e of entities) { Log(GetId(e)); }
+			return entities;
+		}`)
+		runAndWait("runs", 1)
+
+		runs, _ := scheduler.GetJobRuns("runs", 0, 0)
+		runLog, _ := scheduler.GetJobRunLog("runs", runs.Runs[0].ID)
+		Expect(runLog.Dropped).To(Equal(9))
+		Expect(runLog.Entries).To(HaveLen(3))
+		Expect(runLog.Entries[0].Message).To(HaveSuffix(":e-8"))
+		Expect(runLog.Entries[2].Source).To(Equal(RunLogSourceJob))
+	})
+
+	It("Should log failing entities and http sink errors", func() {
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			body, _ := io.ReadAll(r.Body)
+			if strings.Contains(string(body), `e-3"`) {
+				w.WriteHeader(http.StatusBadRequest)
+				_, _ = w.Write([]byte("e-3 is not welcome"))
+			}
+		}))
+		defer srv.Close()
+
+		config := &JobConfiguration{
+			ID: "runs", Title: "runs", Paused: true, BatchSize: 5,
+			Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(10)},
+			Sink:   map[string]interface{}{"Type": "HttpDatasetSink", "Url": srv.URL},
+			Triggers: []JobTrigger{{
+				TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: "@every 1h",
+				ErrorHandlers: []*ErrorHandler{{Type: "log"}},
+			}},
+		}
+		Expect(scheduler.AddJob(config)).To(BeNil())
+		runAndWait("runs", 1)
+
+		runs, _ := scheduler.GetJobRuns("runs", 0, 0)
+		runLog, _ := scheduler.GetJobRunLog("runs", runs.Runs[0].ID)
+		Expect(runLog.Entries[1].Source).To(Equal(RunLogSourceSink))
+		Expect(runLog.Entries[1].Message).To(Equal("failed to write 5 entities: received http sink error (400): e-3 is not welcome"))
+
+		// the log error handler is only used by triggered runs
+		jobs, err := scheduler.toTriggeredJobs(config)
+		Expect(err).To(BeNil())
+		jobs[0].Run()
+		runs, _ = scheduler.GetJobRuns("runs", 0, 0)
+		Expect(runs.Total).To(Equal(2))
+		Expect(runs.Runs[0].Counts.Failed).To(Equal(1))
+		runLog, _ = scheduler.GetJobRunLog("runs", runs.Runs[0].ID)
+		var sinkMessages []string
+		for _, e := range runLog.Entries {
+			if e.Source == RunLogSourceSink {
+				sinkMessages = append(sinkMessages, e.Message)
+			}
+		}
+		Expect(sinkMessages).To(HaveLen(1))
+		Expect(sinkMessages[0]).To(ContainSubstring("e-3 failed to process"))
+		Expect(sinkMessages[0]).To(ContainSubstring("received http sink error (400): e-3 is not welcome"))
+	})
+})
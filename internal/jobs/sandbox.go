@@ -0,0 +1,154 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/mimiro-io/goja"
+)
+
+// JavascriptLimits bounds what one call into a javascript transform, such as the transform of one batch, may use.
+// Zero means no limit. There is no memory limit, as goja can not tell how much memory one runtime uses.
+type JavascriptLimits struct {
+	TimeLimit  time.Duration // execution time
+	QueryLimit int           // calls to Query and FindById, and pages read by PagedQuery
+}
+
+// LimitExceededError tells that a javascript transform was stopped because it went over one of its limits
+type LimitExceededError struct {
+	Reason string
+}
+
+func (e *LimitExceededError) Error() string {
+	return "javascript transform stopped: " + e.Reason
+}
+
+// NewJavascriptLimits makes limits from a time limit in seconds and a query limit
+func NewJavascriptLimits(timeLimit float64, queryLimit int) (JavascriptLimits, error) {
+	if timeLimit < 0 || queryLimit < 0 {
+		return JavascriptLimits{}, errors.New("javascript limits can not be negative")
+	}
+	return JavascriptLimits{
+		TimeLimit:  time.Duration(timeLimit * float64(time.Second)),
+		QueryLimit: queryLimit,
+	}, nil
+}
+
+// JavascriptLimitsFromConfig reads the TimeLimit (seconds) and QueryLimit of a transform config
+func JavascriptLimitsFromConfig(config map[string]interface{}) (JavascriptLimits, error) {
+	values := make(map[string]float64, 2)
+	for _, key := range []string{"TimeLimit", "QueryLimit"} {
+		v, ok := config[key]
+		if !ok || v == nil {
+			continue
+		}
+		f, ok := v.(float64)
+		if !ok {
+			return JavascriptLimits{}, fmt.Errorf("%s must be a number", key)
+		}
+		values[key] = f
+	}
+	return NewJavascriptLimits(values["TimeLimit"], int(values["QueryLimit"]))
+}
+
+// sandbox enforces the limits of a javascript transform. Go functions called from javascript are counted with
+// countQuery, and running javascript is stopped with Runtime.Interrupt when a limit is passed.
+type sandbox struct {
+	limits  JavascriptLimits
+	runtime *goja.Runtime
+	lock    sync.Mutex
+	queries int
+	running bool
+	stopped *LimitExceededError
+	// cancelled is the reason given to cancel, it stops the running call and every later call
+	cancelled string
+}
+
+// stop interrupts the running javascript, keeping the first reason
+func (s *sandbox) stop(reason string) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	if !s.running || s.stopped != nil {
+		return
+	}
+	s.stopped = &LimitExceededError{Reason: reason}
+	s.runtime.Interrupt(s.stopped)
+}
+
+// cancel stops the running javascript, and makes every later call stop at once
+func (s *sandbox) cancel(reason string) {
+	s.lock.Lock()
+	s.cancelled = reason
+	s.lock.Unlock()
+	s.stop(reason)
+}
+
+// countQuery counts a query, and returns false if it goes over the query limit
+func (s *sandbox) countQuery() bool {
+	if s == nil || s.limits.QueryLimit == 0 {
+		return true
+	}
+	s.lock.Lock()
+	s.queries++
+	exceeded := s.queries > s.limits.QueryLimit
+	s.lock.Unlock()
+	if exceeded {
+		s.stop(fmt.Sprintf("more than %d queries", s.limits.QueryLimit))
+	}
+	return !exceeded
+}
+
+// run calls f with the limits in place, and returns a LimitExceededError if f was stopped
+func (s *sandbox) run(f func() error) error {
+	s.lock.Lock()
+	s.queries = 0
+	s.running = true
+	s.stopped = nil
+	if s.cancelled != "" {
+		s.stopped = &LimitExceededError{Reason: s.cancelled}
+		s.runtime.Interrupt(s.stopped)
+	}
+	s.lock.Unlock()
+
+	if s.limits.TimeLimit > 0 {
+		timer := time.AfterFunc(s.limits.TimeLimit, func() {
+			s.stop(fmt.Sprintf("ran for more than %v", s.limits.TimeLimit))
+		})
+		defer timer.Stop()
+	}
+
+	err := f()
+
+	// no interrupts after this, so that a late timer can not stop the next call
+	s.lock.Lock()
+	s.running = false
+	stopped := s.stopped
+	s.lock.Unlock()
+	s.runtime.ClearInterrupt()
+	if stopped != nil {
+		return stopped
+	}
+	var interrupted *goja.InterruptedError
+	if errors.As(err, &interrupted) {
+		if limitErr, ok := interrupted.Value().(*LimitExceededError); ok {
+			return limitErr
+		}
+	}
+	return err
+}
@@ -0,0 +1,127 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("A javascript transform with limits", func() {
+	testCnt := 0
+	var dsm *server.DsManager
+	var store *server.Store
+	var storeLocation string
+	runner := &Runner{statsdClient: &statsd.NoOpClient{}}
+	entities := []*server.Entity{server.NewEntity("1", 1)}
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_js_limits_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean test files in "+storeLocation)
+		e := &conf.Config{
+			Logger:        zap.NewNop().Sugar(),
+			StoreLocation: storeLocation,
+		}
+		store = server.NewStore(e, &statsd.NoOpClient{})
+		dsm = server.NewDsManager(e, store, server.NoOpBus())
+	})
+	AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	newTransform := func(js string, limits JavascriptLimits) (*JavascriptTransform, error) {
+		code := base64.StdEncoding.EncodeToString([]byte(js))
+		return NewJavascriptTransformWithLimits(zap.NewNop().Sugar(), code, store, dsm, limits)
+	}
+
+	It("Should stop an endless loop at the time limit, and run the next batch", func() {
+		transform, err := newTransform(`
+			function transform_entities(entities) {
+				if (entities.length > 1) {
+					while (true) {}
+				}
+				return entities;
+			}`, JavascriptLimits{TimeLimit: 100 * time.Millisecond})
+		Expect(err).To(BeNil())
+
+		start := time.Now()
+		_, err = transform.transformEntities(runner, []*server.Entity{server.NewEntity("1", 1), server.NewEntity("2", 1)}, "")
+		Expect(time.Since(start)).To(BeNumerically("<", 5*time.Second))
+		Expect(err).To(BeAssignableToTypeOf(&LimitExceededError{}))
+		Expect(err.Error()).To(Equal("javascript transform stopped: ran for more than 100ms"))
+
+		result, err := transform.transformEntities(runner, entities, "")
+		Expect(err).To(BeNil())
+		Expect(result).To(HaveLen(1))
+	})
+
+	It("Should stop endless top level code", func() {
+		_, err := newTransform(`while (true) {}`, JavascriptLimits{TimeLimit: 100 * time.Millisecond})
+		Expect(err).To(BeAssignableToTypeOf(&LimitExceededError{}))
+	})
+
+	It("Should stop a transform that queries too much", func() {
+		transform, err := newTransform(`
+			function transform_entities(entities) {
+				for (let i = 0; i < entities.length * 10; i++) {
+					FindById("http://data.mimiro.io/people/homer", []);
+				}
+				return entities;
+			}`, JavascriptLimits{QueryLimit: 10})
+		Expect(err).To(BeNil())
+
+		_, err = transform.transformEntities(runner, entities, "")
+		Expect(err).To(BeNil(), "ten queries are allowed in each batch")
+		_, err = transform.transformEntities(runner, entities, "")
+		Expect(err).To(BeNil())
+		_, err = transform.transformEntities(runner, append(entities, server.NewEntity("2", 1)), "")
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(Equal("javascript transform stopped: more than 10 queries"))
+	})
+
+	It("Should keep its limits when cloned", func() {
+		transform, err := newTransform(`function transform_entities(entities) { while (true) {} }`,
+			JavascriptLimits{TimeLimit: 50 * time.Millisecond})
+		Expect(err).To(BeNil())
+		clone, err := transform.Clone()
+		Expect(err).To(BeNil())
+		_, err = clone.transformEntities(runner, entities, "")
+		Expect(err).To(BeAssignableToTypeOf(&LimitExceededError{}))
+	})
+
+	It("Should read limits from the transform config", func() {
+		limits, err := JavascriptLimitsFromConfig(map[string]interface{}{
+			"Type": "JavascriptTransform", "TimeLimit": 1.5, "QueryLimit": float64(100),
+		})
+		Expect(err).To(BeNil())
+		Expect(limits).To(Equal(JavascriptLimits{TimeLimit: 1500 * time.Millisecond, QueryLimit: 100}))
+		_, err = JavascriptLimitsFromConfig(map[string]interface{}{"TimeLimit": "10s"})
+		Expect(err).NotTo(BeNil())
+		_, err = JavascriptLimitsFromConfig(map[string]interface{}{"QueryLimit": float64(-1)})
+		Expect(err).NotTo(BeNil())
+	})
+})
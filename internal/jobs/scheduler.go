@@ -22,6 +22,7 @@ import (
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
@@ -44,17 +45,19 @@ type Scheduler struct {
 	Store          *server.Store
 	Runner         *Runner
 	DatasetManager *server.DsManager
+	versionLock    sync.Mutex
 }
 
 const (
-	TriggerTypeCron     = "cron"
-	TriggerTypeOnChange = "onchange"
-	JobTypeFull         = "fullsync"
-	JobTypeIncremental  = "incremental"
+	TriggerTypeCron       = "cron"
+	TriggerTypeOnChange   = "onchange"
+	TriggerTypeDependency = "ondependency"
+	JobTypeFull           = "fullsync"
+	JobTypeIncremental    = "incremental"
 )
 
 var (
-	TriggerTypes = map[string]bool{TriggerTypeOnChange: true, TriggerTypeCron: true}
+	TriggerTypes = map[string]bool{TriggerTypeOnChange: true, TriggerTypeCron: true, TriggerTypeDependency: true}
 	JobTypes     = map[string]bool{JobTypeFull: true, JobTypeIncremental: true}
 )
 
@@ -71,6 +74,9 @@ type JobTrigger struct {
 	JobType          string        `json:"jobType"`
 	Schedule         string        `json:"schedule"`
 	MonitoredDataset string        `json:"monitoredDataset"`
+	DependsOn        []string      `json:"dependsOn"`       // ondependency: ids of the upstream jobs
+	Condition        string        `json:"condition"`       // ondependency: allOf (default) or anyOf
+	ForwardFailures  bool          `json:"forwardFailures"` // ondependency: fail instead of wait when upstream fails
 	ErrorHandlers    ErrorHandlers `json:"onError"`
 }
 
@@ -87,6 +93,8 @@ type JobConfiguration struct {
 	Triggers    []JobTrigger           `json:"triggers"`
 	Paused      bool                   `json:"paused"`
 	BatchSize   int                    `json:"batchSize"`
+	Parameters  []JobParameter         `json:"parameters,omitempty"`
+	Variables   map[string]interface{} `json:"variables,omitempty"`
 }
 
 type ScheduleEntries struct {
@@ -144,6 +152,11 @@ func NewScheduler(
 func (s *Scheduler) Start(ctx context.Context) error {
 	s.Logger.Infof("Starting the JobScheduler")
 
+	_, err := s.DatasetManager.CreateDataset(LineageDataset, nil)
+	if err != nil {
+		s.Logger.Warnf("Failed to create %s dataset: %v", LineageDataset, err)
+	}
+
 	for _, j := range s.loadConfigurations() {
 		err := s.AddJob(j)
 		if err != nil {
@@ -165,6 +178,11 @@ func (s *Scheduler) Stop(ctx context.Context) error {
 // It is important that jobs are valid, so care is taken to validate the JobConfiguration before
 // it can be scheduled.
 func (s *Scheduler) AddJob(jobConfig *JobConfiguration) error {
+	return s.AddJobVersion(jobConfig, "", "")
+}
+
+// AddJobVersion adds a job like AddJob, and records who changed it and why if this makes a new version of the job
+func (s *Scheduler) AddJobVersion(jobConfig *JobConfiguration, author string, comment string) error {
 	err := s.verify(jobConfig)
 	if err != nil {
 		return err
@@ -175,17 +193,33 @@ func (s *Scheduler) AddJob(jobConfig *JobConfiguration) error {
 	if err != nil {
 		return err
 	}
+	rateLimits, err := s.rateLimitUses(jobConfig)
+	if err != nil {
+		return err
+	}
+
+	err = s.recordJobVersion(jobConfig, author, comment)
+	if err != nil {
+		return err
+	}
 
 	err = s.Store.StoreObject(server.JobConfigIndex, jobConfig.ID, jobConfig) // store it for the future
 	if err != nil {
 		return err
 	}
 
+	err = s.storeJobLineage(jobConfig, false)
+	if err != nil {
+		s.Logger.Warnf("Failed to update lineage for job with id %s (%s): %v", jobConfig.ID, jobConfig.Title, err)
+	}
+	s.Runner.rateLimiters.Configure(rateLimitOwner(jobConfig.ID), rateLimits)
+
 	g, _ := errgroup.WithContext(context.Background())
 	g.Go(func() error {
 		// make sure we clear up before adding
 		clearCrontab(s.Runner.scheduledJobs, jobConfig.ID)
 		s.Runner.eventBus.UnsubscribeToDataset(jobConfig.ID)
+		s.Runner.removeDependentJob(jobConfig.ID)
 		for _, job := range triggeredJobs {
 			if !jobConfig.Paused { // only add the job if it is not paused
 				err := s.Runner.addJob(job)
@@ -221,6 +255,7 @@ func (s *Scheduler) toTriggeredJobs(jobConfig *JobConfiguration) ([]*job, error)
 				title:         jobConfig.Title,
 				pipeline:      pipeline,
 				topic:         t.MonitoredDataset,
+				triggerType:   t.TriggerType,
 				isEvent:       true,
 				runner:        s.Runner,
 				errorHandlers: t.ErrorHandlers,
@@ -232,10 +267,24 @@ func (s *Scheduler) toTriggeredJobs(jobConfig *JobConfiguration) ([]*job, error)
 				title:         jobConfig.Title,
 				pipeline:      pipeline,
 				schedule:      t.Schedule,
+				triggerType:   t.TriggerType,
 				runner:        s.Runner,
 				errorHandlers: t.ErrorHandlers,
 				dsm:           s.DatasetManager,
 			})
+		case TriggerTypeDependency:
+			result = append(result, &job{
+				id:              jobConfig.ID,
+				title:           jobConfig.Title,
+				pipeline:        pipeline,
+				dependsOn:       t.DependsOn,
+				condition:       t.Condition,
+				forwardFailures: t.ForwardFailures,
+				triggerType:     t.TriggerType,
+				runner:          s.Runner,
+				errorHandlers:   t.ErrorHandlers,
+				dsm:             s.DatasetManager,
+			})
 		default:
 			return nil, fmt.Errorf("could not map trigger configuration to job: %v", t)
 		}
@@ -255,6 +304,22 @@ func (s *Scheduler) DeleteJob(jobID string) error {
 	if err != nil {
 		return err
 	}
+	err = s.Runner.deleteRuns(jobConfig.ID)
+	if err != nil {
+		s.Logger.Warnf("Failed to delete run history for job with id %s (%s): %v", jobConfig.ID, jobConfig.Title, err)
+	}
+	_, err = s.Runner.deleteDeadLetters(jobConfig.ID, nil)
+	if err != nil {
+		s.Logger.Warnf("Failed to delete dead letters for job with id %s (%s): %v", jobConfig.ID, jobConfig.Title, err)
+	}
+
+	if jobConfig.ID == "" {
+		return nil
+	}
+	err = s.storeJobLineage(jobConfig, true)
+	if err != nil {
+		s.Logger.Warnf("Failed to update lineage for job with id %s (%s): %v", jobConfig.ID, jobConfig.Title, err)
+	}
 
 	return nil
 }
@@ -429,6 +494,99 @@ func (s *Scheduler) ResetJob(jobid string, since string) error {
 	return nil
 }
 
+// ErrTimeResetNotSupported is returned when a job source cannot be reset to a point in time
+var ErrTimeResetNotSupported = errors.New("job source cannot be reset to a point in time")
+
+// ResetJobToTime resets the job since token so that the job continues with the changes recorded
+// after the given time. This is only possible for jobs reading changes from local datasets.
+func (s *Scheduler) ResetJobToTime(jobid string, t time.Time) error {
+	jobConfig, err := s.LoadJob(jobid)
+	if err != nil {
+		return err
+	}
+	if jobConfig == nil || jobConfig.ID == "" {
+		return errors.New("could not load job with id " + jobid)
+	}
+
+	syncJobState := &SyncJobState{}
+	err = s.Store.GetObject(server.JobDataIndex, jobid, syncJobState)
+	if err != nil {
+		return err
+	}
+
+	jobConfig, _, err = s.resolveJobConfiguration(jobConfig, false)
+	if err != nil {
+		return err
+	}
+
+	var token string
+	sourceType := jobConfig.Source["Type"]
+	switch sourceType {
+	case "DatasetSource":
+		name, _ := jobConfig.Source["Name"].(string)
+		token, err = s.offsetTokenAtTime(name, t)
+	case "UnionDatasetSource":
+		cont := &source.UnionDatasetContinuation{}
+		datasets, _ := jobConfig.Source["DatasetSources"].([]interface{})
+		for _, dsSrcConfig := range datasets {
+			dsSrcConfigMap, _ := dsSrcConfig.(map[string]interface{})
+			name, _ := dsSrcConfigMap["Name"].(string)
+			offset, err := s.offsetTokenAtTime(name, t)
+			if err != nil {
+				return err
+			}
+			cont.DatasetNames = append(cont.DatasetNames, name)
+			cont.Tokens = append(cont.Tokens, &source.StringDatasetContinuation{Token: offset})
+		}
+		token, err = cont.Encode()
+	case "MultiSource":
+		// dependencies are only known from the job state, so only the datasets already tracked there are moved
+		var decoded source.DatasetContinuation
+		decoded, err = source.DecodeToken(sourceType, syncJobState.ContinuationToken)
+		if err != nil {
+			return err
+		}
+		cont := decoded.(*source.MultiDatasetContinuation)
+		name, _ := jobConfig.Source["Name"].(string)
+		cont.MainToken, err = s.offsetTokenAtTime(name, t)
+		if err != nil {
+			return err
+		}
+		for depName := range cont.DependencyTokens {
+			offset, err := s.offsetTokenAtTime(depName, t)
+			if err != nil {
+				return err
+			}
+			cont.DependencyTokens[depName] = &source.StringDatasetContinuation{Token: offset}
+		}
+		token, err = cont.Encode()
+	default:
+		return fmt.Errorf("%w: %v", ErrTimeResetNotSupported, sourceType)
+	}
+	if err != nil {
+		return err
+	}
+
+	s.Logger.Infof("Resolved %s to since token %s for job with id '%s'", t.Format(time.RFC3339), token, jobid)
+	return s.ResetJob(jobid, token)
+}
+
+// offsetTokenAtTime returns the change offset of a local dataset at the given time, as a job since token
+func (s *Scheduler) offsetTokenAtTime(datasetName string, t time.Time) (string, error) {
+	dataset := s.DatasetManager.GetDataset(datasetName)
+	if dataset == nil {
+		return "", fmt.Errorf("dataset %s not found", datasetName)
+	}
+	if dataset.IsProxy() || dataset.IsVirtual() {
+		return "", fmt.Errorf("%w: dataset %s is not a local dataset", ErrTimeResetNotSupported, datasetName)
+	}
+	offset, err := dataset.OffsetAtTime(t)
+	if err != nil {
+		return "", err
+	}
+	return strconv.FormatUint(offset, 10), nil
+}
+
 // RunJob runs an existing job, if not already running. It does so by adding a temp job to the scheduler, without saving it.
 // The temp job is added with the RunOnce flag set to true
 func (s *Scheduler) RunJob(jobid string, jobType string) (string, error) {
@@ -448,11 +606,12 @@ func (s *Scheduler) RunJob(jobid string, jobType string) (string, error) {
 	}
 
 	job := &job{
-		id:       jobConfig.ID,
-		title:    jobConfig.Title,
-		pipeline: pipeline,
-		runner:   s.Runner,
-		dsm:      s.DatasetManager,
+		id:          jobConfig.ID,
+		title:       jobConfig.Title,
+		pipeline:    pipeline,
+		triggerType: RunTriggerManual,
+		runner:      s.Runner,
+		dsm:         s.DatasetManager,
 		// no error handlers when running manually
 		errorHandlers: nil,
 	}
@@ -507,7 +666,8 @@ func (s *Scheduler) verify(jobConfiguration *JobConfiguration) error {
 	if len(jobConfiguration.Title) <= 0 {
 		return errors.New("job configuration needs a title")
 	}
-	for _, config := range s.ListJobs() {
+	existing := s.ListJobs()
+	for _, config := range existing {
 		if config.Title == jobConfiguration.Title {
 			if config.ID != jobConfiguration.ID {
 				return errors.New("job configuration title must be unique")
@@ -524,9 +684,15 @@ func (s *Scheduler) verify(jobConfiguration *JobConfiguration) error {
 	if len(jobConfiguration.Triggers) <= 0 {
 		return errors.New("job Configuration needs at least 1 trigger")
 	}
+	if err := verifyDependencies(jobConfiguration, existing); err != nil {
+		return err
+	}
+	if _, _, err := s.resolveJobConfiguration(jobConfiguration, false); err != nil {
+		return err
+	}
 	for _, trigger := range jobConfiguration.Triggers {
 		if _, ok := TriggerTypes[trigger.TriggerType]; !ok {
-			return errors.New("need to set 'triggerType'. must be one of: cron, onchange")
+			return errors.New("need to set 'triggerType'. must be one of: cron, onchange, ondependency")
 		}
 		if _, ok := JobTypes[trigger.JobType]; !ok {
 			return errors.New("need to set 'jobType'. must be one of: fullsync, incremental")
@@ -538,6 +704,15 @@ func (s *Scheduler) verify(jobConfiguration *JobConfiguration) error {
 			}
 			return errors.New("trigger type 'onchange' requires that 'MonitoredDataset' parameter also is set")
 		}
+		if trigger.TriggerType == TriggerTypeDependency {
+			if err := verifyDependencyTrigger(trigger); err != nil {
+				return err
+			}
+			if err := verifyErrorHandlers(trigger, jobConfiguration.ID, jobConfiguration.Title); err != nil {
+				return err
+			}
+			continue
+		}
 
 		_, err := cron.ParseStandard(trigger.Schedule)
 		if err != nil {
@@ -557,6 +732,10 @@ func (s *Scheduler) verify(jobConfiguration *JobConfiguration) error {
 // toPipeline converts the json in the JobConfiguration to concrete types.
 // A Pipeline is basically a Source -> Transform -> Sink
 func (s *Scheduler) toPipeline(jobConfig *JobConfiguration, jobType string) (Pipeline, error) {
+	jobConfig, params, err := s.resolveJobConfiguration(jobConfig, true)
+	if err != nil {
+		return nil, err
+	}
 	sink, err := s.parseSink(jobConfig)
 	if err != nil {
 		return nil, err
@@ -570,6 +749,9 @@ func (s *Scheduler) toPipeline(jobConfig *JobConfiguration, jobType string) (Pip
 	if err != nil {
 		return nil, err
 	}
+	if jt, ok := transform.(*JavascriptTransform); ok {
+		jt.params = params
+	}
 
 	batchSize := jobConfig.BatchSize
 	if batchSize < 1 {
@@ -606,9 +788,10 @@ func (s *Scheduler) parseSource(jobConfig *JobConfiguration) (source.Source, err
 				if ok && endpoint != "" {
 					src.Endpoint = endpoint.(string)
 				}
+				tokenProviderName := ""
 				tokenProviderRaw, ok := sourceConfig["TokenProvider"]
 				if ok {
-					tokenProviderName := tokenProviderRaw.(string)
+					tokenProviderName = tokenProviderRaw.(string)
 					// security
 					if tokenProviderName != "" {
 						// attempt to parse the token provider
@@ -617,6 +800,11 @@ func (s *Scheduler) parseSource(jobConfig *JobConfiguration) (source.Source, err
 						}
 					}
 				}
+				rateLimit, err := parseRateLimit(sourceConfig)
+				if err != nil {
+					return nil, err
+				}
+				src.RateLimiter = s.Runner.rateLimiters.For(rateLimit, src.Endpoint, tokenProviderName)
 				return src, nil
 			case "DatasetSource":
 				var err error
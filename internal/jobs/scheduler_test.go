@@ -35,6 +35,7 @@ import (
 	"go.uber.org/zap"
 
 	"github.com/mimiro-io/datahub/internal/conf"
+	"github.com/mimiro-io/datahub/internal/jobs/source"
 	"github.com/mimiro-io/datahub/internal/security"
 	"github.com/mimiro-io/datahub/internal/server"
 )
@@ -122,6 +123,65 @@ var _ = Describe("The Scheduler", func() {
 			"We find the continuation token that was injected with ResetJob in the syncState")
 	})
 
+	It("Should reset a job to a point in time when asked to", func() {
+		people, _ := dsm.CreateDataset("People", nil)
+		places, _ := dsm.CreateDataset("Places", nil)
+		ns, _ := store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/test/")
+		for i := 0; i < 2; i++ {
+			_ = people.StoreEntities([]*server.Entity{server.NewEntity(fmt.Sprintf("%s:person%v", ns, i), 0)})
+			_ = places.StoreEntities([]*server.Entity{server.NewEntity(fmt.Sprintf("%s:place%v", ns, i), 0)})
+		}
+		t := time.Now()
+		_ = people.StoreEntities([]*server.Entity{server.NewEntity(ns+":person2", 0)})
+
+		addJob := func(id string, sourceConfig string) {
+			sj, err := scheduler.Parse([]byte(`{
+				"id" : "` + id + `",
+				"title" : "` + id + `",
+				"triggers": [{"triggerType": "cron", "jobType": "incremental", "schedule": "@every 2s"}],
+				"paused": true,
+				"source" : ` + sourceConfig + `,
+				"sink" : {"Type" : "DevNullSink"}}`))
+			Expect(err).To(BeNil())
+			Expect(scheduler.AddJob(sj)).To(Succeed())
+			Expect(store.StoreObject(server.JobDataIndex, id, &SyncJobState{ID: id})).To(Succeed())
+		}
+		addJob("dataset-job", `{"Type" : "DatasetSource", "Name" : "People"}`)
+		addJob("union-job", `{"Type" : "UnionDatasetSource", "DatasetSources" : [{"Name" : "People"}, {"Name" : "Places"}]}`)
+		addJob("multi-job", `{"Type" : "MultiSource", "Name" : "People", "Dependencies" : [{"dataset" : "Places",
+			"joins" : [{"dataset" : "People", "predicate" : "http://data.mimiro.io/test/at", "inverse" : true}]}]}`)
+		addJob("sample-job", `{"Type" : "SampleSource", "NumberOfEntities" : 1}`)
+
+		state := &SyncJobState{}
+		Expect(scheduler.ResetJobToTime("dataset-job", t)).To(Succeed())
+		Expect(store.GetObject(server.JobDataIndex, "dataset-job", state)).To(Succeed())
+		Expect(state.ContinuationToken).To(Equal("2"))
+
+		Expect(scheduler.ResetJobToTime("union-job", t)).To(Succeed())
+		Expect(store.GetObject(server.JobDataIndex, "union-job", state)).To(Succeed())
+		token, err := source.DecodeToken("UnionDatasetSource", state.ContinuationToken)
+		Expect(err).To(BeNil())
+		union := token.(*source.UnionDatasetContinuation)
+		Expect(union.DatasetNames).To(Equal([]string{"People", "Places"}))
+		Expect(union.Tokens[0].Token).To(Equal("2"))
+		Expect(union.Tokens[1].Token).To(Equal("2"))
+
+		// only the dependencies already in the job state are moved
+		Expect(store.StoreObject(server.JobDataIndex, "multi-job", &SyncJobState{ID: "multi-job",
+			ContinuationToken: `{"MainToken":"3","DependencyTokens":{"Places":{"Token":"0"}}}`})).To(Succeed())
+		Expect(scheduler.ResetJobToTime("multi-job", t)).To(Succeed())
+		Expect(store.GetObject(server.JobDataIndex, "multi-job", state)).To(Succeed())
+		token, err = source.DecodeToken("MultiSource", state.ContinuationToken)
+		Expect(err).To(BeNil())
+		multi := token.(*source.MultiDatasetContinuation)
+		Expect(multi.MainToken).To(Equal("2"))
+		Expect(multi.DependencyTokens).To(HaveLen(1))
+		Expect(multi.DependencyTokens["Places"].Token).To(Equal("2"))
+
+		err = scheduler.ResetJobToTime("sample-job", t)
+		Expect(errors.Is(err, ErrTimeResetNotSupported)).To(BeTrue())
+	})
+
 	It("Should kill a job when asked to", func() {
 		// install a job that runs 50*100 ms (6 sec, exceeding goblins 5s timeout)
 		sj, err := scheduler.Parse([]byte((`{
@@ -735,7 +795,7 @@ var _ = Describe("The Scheduler", func() {
 				Source:   validSource,
 				Sink:     validSink,
 			})
-			Expect(err).To(Equal(errors.New("need to set 'triggerType'. must be one of: cron, onchange")))
+			Expect(err).To(Equal(errors.New("need to set 'triggerType'. must be one of: cron, onchange, ondependency")))
 		})
 
 		It("Should fail if JobType is missing", func() {
@@ -755,7 +815,7 @@ var _ = Describe("The Scheduler", func() {
 					{TriggerType: "foo"},
 				},
 			})
-			Expect(err).To(Equal(errors.New("need to set 'triggerType'. must be one of: cron, onchange")))
+			Expect(err).To(Equal(errors.New("need to set 'triggerType'. must be one of: cron, onchange, ondependency")))
 		})
 		It("Should fail if sync type is unknown", func() {
 			err := scheduler.AddJob(&JobConfiguration{
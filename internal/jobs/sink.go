@@ -15,18 +15,16 @@
 package jobs
 
 import (
-	"bytes"
 	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"io/ioutil"
 	"net/http"
 	"strings"
 	"time"
 
-	"github.com/gojektech/heimdall/v6"
-	"github.com/gojektech/heimdall/v6/httpclient"
 	"github.com/google/uuid"
 	"go.uber.org/zap"
 
@@ -56,10 +54,12 @@ func (s *Scheduler) parseSink(jobConfig *JobConfiguration) (Sink, error) {
 					sink.Store = s.Store
 					sink.logger = s.Logger.Named("sink")
 					sink.Endpoint, _ = server.URLJoin(dataset.ProxyConfig.RemoteURL, "/entities")
+					sink.Backoff = defaultSinkBackoff
 
 					if dataset.ProxyConfig.AuthProviderName != "" {
 						sink.TokenProvider = dataset.ProxyConfig.AuthProviderName
 					}
+					sink.RateLimiter = s.Runner.rateLimiters.For(dataset.ProxyConfig.RateLimit, sink.Endpoint, sink.TokenProvider)
 					return sink, nil
 				}
 				sink := &datasetSink{}
@@ -95,6 +95,16 @@ func (s *Scheduler) parseSink(jobConfig *JobConfiguration) (Sink, error) {
 				if ok {
 					sink.TokenProvider = tokenProvider.(string)
 				}
+				backoff, err := parseBackoff(sinkConfig, defaultSinkBackoff)
+				if err != nil {
+					return nil, err
+				}
+				sink.Backoff = backoff
+				rateLimit, err := parseRateLimit(sinkConfig)
+				if err != nil {
+					return nil, err
+				}
+				sink.RateLimiter = s.Runner.rateLimiters.For(rateLimit, sink.Endpoint, sink.TokenProvider)
 				return sink, nil
 			default:
 				return nil, errors.New("unknown sink type: " + sinkTypeName.(string))
@@ -166,6 +176,8 @@ type httpDatasetSink struct {
 	TokenProvider    string // for use in token auth
 	ExpandNamespaces bool   // used to instruct the sink to expand all namespaces
 	StripPrefixes    bool   // used to instruct the sink to remove prefixes
+	Backoff          Backoff
+	RateLimiter      *server.RateLimiter // shared with other jobs sending to the same host or login provider
 	Store            *server.Store
 	inFullSync       bool
 	fullSyncID       string
@@ -184,18 +196,9 @@ func (httpDatasetSink *httpDatasetSink) startFullSync(runner *Runner) error {
 func (httpDatasetSink *httpDatasetSink) endFullSync(ctx context.Context, runner *Runner) error {
 	// send empty batch to server with end
 	timeout := 60 * time.Minute
-	client := httpclient.NewClient(
-		httpclient.WithHTTPTimeout(timeout),
-		httpclient.WithRetryCount(3),
-		httpclient.WithRetrier(
-			heimdall.NewRetrier(
-				heimdall.NewConstantBackoff(2*time.Second, 100*time.Millisecond),
-			),
-		),
-	)
-
 	// create headers if needed
 	url := httpDatasetSink.Endpoint
+	client := runner.newRetryingClient(url, timeout, httpDatasetSink.Backoff).limitedBy(httpDatasetSink.RateLimiter, 0)
 
 	allObjects := make([]interface{}, 1)
 	allObjects[0] = httpDatasetSink.Store.GetGlobalContext(true)
@@ -204,27 +207,28 @@ func (httpDatasetSink *httpDatasetSink) endFullSync(ctx context.Context, runner
 	if err != nil {
 		return err
 	}
-	r := bytes.NewReader(jsonEntities)
-	req, err := http.NewRequest("POST", url, r) //
-	if err != nil {
-		return err
-	}
+	res, err := server.SendCompressed(url, jsonEntities, client.Do, func(r io.Reader) (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, r) //
+		if err != nil {
+			return nil, err
+		}
 
-	// add full sync headers
-	req.Header.Add("universal-data-api-full-sync-end", "true")
-	req.Header.Add("universal-data-api-full-sync-id", httpDatasetSink.fullSyncID)
+		// add full sync headers
+		req.Header.Add("universal-data-api-full-sync-end", "true")
+		req.Header.Add("universal-data-api-full-sync-id", httpDatasetSink.fullSyncID)
 
-	if httpDatasetSink.TokenProvider != "" {
-		// attempt to parse the token provider
-		if provider, ok := runner.tokenProviders.Get(strings.ToLower(httpDatasetSink.TokenProvider)); ok {
-			provider.Authorize(req)
+		if httpDatasetSink.TokenProvider != "" {
+			// attempt to parse the token provider
+			if provider, ok := runner.tokenProviders.Get(strings.ToLower(httpDatasetSink.TokenProvider)); ok {
+				provider.Authorize(req)
+			}
 		}
-	}
-
-	res, err := client.Do(req)
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
+	defer func() { _ = res.Body.Close() }()
 
 	if res.StatusCode != 200 {
 		return handleHTTPError(res)
@@ -240,18 +244,10 @@ func (httpDatasetSink *httpDatasetSink) endFullSync(ctx context.Context, runner
 
 func (httpDatasetSink *httpDatasetSink) processEntities(runner *Runner, entities []*server.Entity) error {
 	timeout := 60 * time.Minute
-	client := httpclient.NewClient(
-		httpclient.WithHTTPTimeout(timeout),
-		httpclient.WithRetryCount(3),
-		httpclient.WithRetrier(
-			heimdall.NewRetrier(
-				heimdall.NewConstantBackoff(2*time.Second, 100*time.Millisecond),
-			),
-		),
-	)
-
 	// create headers if needed
 	url := httpDatasetSink.Endpoint
+	client := runner.newRetryingClient(url, timeout, httpDatasetSink.Backoff).
+		limitedBy(httpDatasetSink.RateLimiter, len(entities))
 
 	allObjects := make([]interface{}, len(entities)+1)
 	allObjects[0] = httpDatasetSink.Store.GetGlobalContext(true)
@@ -264,38 +260,42 @@ func (httpDatasetSink *httpDatasetSink) processEntities(runner *Runner, entities
 	if err != nil {
 		return err
 	}
-	r := bytes.NewReader(jsonEntities)
-	req, err := http.NewRequest("POST", url, r) //
-	if err != nil {
-		return err
-	}
+	isFirstBatch := httpDatasetSink.isFirstBatch
+	res, err := server.SendCompressed(url, jsonEntities, client.Do, func(r io.Reader) (*http.Request, error) {
+		req, err := http.NewRequest("POST", url, r) //
+		if err != nil {
+			return nil, err
+		}
 
-	// add full sync headers if required
-	if httpDatasetSink.inFullSync {
-		// add sync id header
-		req.Header.Add("universal-data-api-full-sync-id", httpDatasetSink.fullSyncID)
+		// add full sync headers if required
+		if httpDatasetSink.inFullSync {
+			// add sync id header
+			req.Header.Add("universal-data-api-full-sync-id", httpDatasetSink.fullSyncID)
 
-		if httpDatasetSink.isFirstBatch {
-			// add start header and set first to false
-			req.Header.Add("universal-data-api-full-sync-start", "true")
-			httpDatasetSink.isFirstBatch = false
+			if isFirstBatch {
+				// add start header
+				req.Header.Add("universal-data-api-full-sync-start", "true")
+			}
 		}
-	}
 
-	// security
-	if httpDatasetSink.TokenProvider != "" {
-		// attempt to parse the token provider
-		if provider, ok := runner.tokenProviders.Get(strings.ToLower(httpDatasetSink.TokenProvider)); ok {
-			provider.Authorize(req)
+		// security
+		if httpDatasetSink.TokenProvider != "" {
+			// attempt to parse the token provider
+			if provider, ok := runner.tokenProviders.Get(strings.ToLower(httpDatasetSink.TokenProvider)); ok {
+				provider.Authorize(req)
+			}
 		}
-	}
 
-	req.Header.Add("Content-Type", "application/json")
-
-	res, err := client.Do(req)
+		req.Header.Add("Content-Type", "application/json")
+		return req, nil
+	})
+	if isFirstBatch {
+		httpDatasetSink.isFirstBatch = false
+	}
 	if err != nil {
 		return err
 	}
+	defer func() { _ = res.Body.Close() }()
 
 	if res.StatusCode != 200 {
 		return handleHTTPError(res)
@@ -31,10 +31,11 @@ import (
 
 type HTTPDatasetSource struct {
 	Endpoint       string
-	Authentication string            // "none, basic, token"
-	User           string            // for use in basic auth
-	Password       string            // for use in basic auth
-	TokenProvider  security.Provider // for use in token auth
+	Authentication string              // "none, basic, token"
+	User           string              // for use in basic auth
+	Password       string              // for use in basic auth
+	TokenProvider  security.Provider   // for use in token auth
+	RateLimiter    *server.RateLimiter // shared with other jobs reading from the same host or login provider
 	Store          *server.Store
 	Logger         *zap.SugaredLogger
 }
@@ -88,12 +89,18 @@ func (httpDatasetSource *HTTPDatasetSource) ReadEntities(ctx context.Context, si
 	if httpDatasetSource.TokenProvider != nil {
 		httpDatasetSource.TokenProvider.Authorize(req)
 	}
+	server.AcceptCompressedResponses(req)
 
 	// do get
-	res, err := netClient.Do(req.WithContext(ctx))
+	limiter := httpDatasetSource.RateLimiter
+	res, err := limiter.Do(netClient, req.WithContext(ctx), 0)
 	if err != nil {
 		return err
 	}
+	if err = server.DecodeResponse(res); err != nil {
+		res.Body.Close()
+		return err
+	}
 	defer res.Body.Close()
 	if res.StatusCode != 200 {
 		return handleHTTPError(res)
@@ -115,6 +122,9 @@ func (httpDatasetSource *HTTPDatasetSource) ReadEntities(ctx context.Context, si
 		if entity.ID == "@continuation" {
 			continuationToken.Token = entity.GetStringProperty("token")
 		} else {
+			if err := limiter.WaitEntities(ctx, 1); err != nil {
+				return err
+			}
 			entities = append(entities, entity)
 			read++
 			if read == batchSize {
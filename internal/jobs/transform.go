@@ -27,7 +27,6 @@ import (
 
 	"github.com/DataDog/datadog-go/v5/statsd"
 	"github.com/gofrs/uuid"
-	"github.com/gojektech/heimdall/v6/httpclient"
 	"github.com/mimiro-io/goja"
 	"go.uber.org/zap"
 
@@ -192,11 +191,26 @@ func (s *Scheduler) parseTransform(config *JobConfiguration) (Transform, error)
 				} else {
 					transform.SupportContext = false
 				}
+				backoff, err := parseBackoff(transformConfig, defaultTransformBackoff)
+				if err != nil {
+					return nil, err
+				}
+				transform.Backoff = backoff
+				rateLimit, err := parseRateLimit(transformConfig)
+				if err != nil {
+					return nil, err
+				}
+				transform.RateLimiter = s.Runner.rateLimiters.For(rateLimit, transform.URL, transform.TokenProvider)
 				return transform, nil
 			case "JavascriptTransform":
 				code64, ok := transformConfig["Code"]
 				if ok && code64 != "" {
-					transform, err := NewJavascriptTransform(s.Logger, code64.(string), s.Store, s.DatasetManager)
+					limits, err := JavascriptLimitsFromConfig(transformConfig)
+					if err != nil {
+						return nil, err
+					}
+					transform, err := NewJavascriptTransformWithLimits(
+						s.Logger, code64.(string), s.Store, s.DatasetManager, limits)
 					if err != nil {
 						return nil, err
 					}
@@ -224,6 +238,18 @@ func NewJavascriptTransform(
 	code64 string,
 	store *server.Store,
 	dsm *server.DsManager,
+) (*JavascriptTransform, error) {
+	return NewJavascriptTransformWithLimits(log, code64, store, dsm, JavascriptLimits{})
+}
+
+// NewJavascriptTransformWithLimits makes a transform that is stopped when one call into it, or the
+// top level of its code, goes over the limits
+func NewJavascriptTransformWithLimits(
+	log *zap.SugaredLogger,
+	code64 string,
+	store *server.Store,
+	dsm *server.DsManager,
+	limits JavascriptLimits,
 ) (*JavascriptTransform, error) {
 	transform := &JavascriptTransform{Logger: log.Named("transform")}
 	code, err := base64.StdEncoding.DecodeString(code64)
@@ -234,6 +260,8 @@ func NewJavascriptTransform(
 	transform.Runtime = goja.New()
 	transform.Store = store
 	transform.DatasetManager = dsm
+	transform.Limits = limits
+	transform.sandbox = &sandbox{limits: limits, runtime: transform.Runtime}
 
 	// add query function to runtime
 	transform.Runtime.Set("Query", transform.Query)
@@ -251,8 +279,12 @@ func NewJavascriptTransform(
 	transform.Runtime.Set("UUID", transform.UUID)
 	transform.Runtime.Set("WriteQueryResult", transform.WriteQueryResult)
 	transform.Runtime.Set("GetDatasetChanges", transform.DatasetChanges)
+	transform.Runtime.Set("GetParam", transform.GetParam)
 
-	_, err = transform.Runtime.RunString(string(code))
+	err = transform.sandbox.run(func() error {
+		_, err := transform.Runtime.RunString(string(code))
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -276,6 +308,11 @@ type JavascriptTransform struct {
 	Parallelism       int
 	QueryResultWriter QueryResultWriter
 	DatasetManager    *server.DsManager
+	Limits            JavascriptLimits
+	sandbox           *sandbox
+	runLog            *runLog                // log of the current job run, if any
+	dryRun            bool                   // when set, transactions are logged instead of executed
+	params            map[string]interface{} // parameter values of the job
 }
 
 func (javascriptTransform *JavascriptTransform) DatasetChanges(
@@ -303,12 +340,20 @@ func (javascriptTransform *JavascriptTransform) getParallelism() int {
 // Clone the transform for use in parallel processing
 func (javascriptTransform *JavascriptTransform) Clone() (*JavascriptTransform, error) {
 	code := base64.StdEncoding.EncodeToString(javascriptTransform.Code)
-	return NewJavascriptTransform(
+	clone, err := NewJavascriptTransformWithLimits(
 		javascriptTransform.Logger,
 		code,
 		javascriptTransform.Store,
 		javascriptTransform.DatasetManager,
+		javascriptTransform.Limits,
 	)
+	if err != nil {
+		return nil, err
+	}
+	clone.runLog = javascriptTransform.runLog
+	clone.dryRun = javascriptTransform.dryRun
+	clone.params = javascriptTransform.params
+	return clone, nil
 }
 
 func (javascriptTransform *JavascriptTransform) AsEntity(val interface{}) (res *server.Entity) {
@@ -336,6 +381,13 @@ func (javascriptTransform *JavascriptTransform) NewTransaction() *server.Transac
 }
 
 func (javascriptTransform *JavascriptTransform) ExecuteTransaction(txn *server.Transaction) error {
+	if javascriptTransform.dryRun {
+		for dataset, entities := range txn.DatasetEntities {
+			javascriptTransform.runLog.add(RunLogInfo, RunLogSourceTransform,
+				fmt.Sprintf("preview: skipped writing %v entities to dataset %s", len(entities), dataset))
+		}
+		return nil
+	}
 	return javascriptTransform.Store.ExecuteTransaction(txn)
 }
 
@@ -343,15 +395,24 @@ func (javascriptTransform *JavascriptTransform) Log(thing interface{}, logLevel
 	switch strings.ToLower(logLevel) {
 	case "info":
 		javascriptTransform.Logger.Info(thing)
+		javascriptTransform.runLog.add(RunLogInfo, RunLogSourceTransform, fmt.Sprint(thing))
 	case "warn", "warning":
 		javascriptTransform.Logger.WithOptions(zap.AddStacktrace(zap.DPanicLevel)).Warn(thing)
+		javascriptTransform.runLog.add(RunLogWarn, RunLogSourceTransform, fmt.Sprint(thing))
 	case "error", "err":
 		javascriptTransform.Logger.WithOptions(zap.AddStacktrace(zap.DPanicLevel)).Error(thing)
+		javascriptTransform.runLog.add(RunLogError, RunLogSourceTransform, fmt.Sprint(thing))
 	default:
 		javascriptTransform.Logger.Info(thing)
+		javascriptTransform.runLog.add(RunLogInfo, RunLogSourceTransform, fmt.Sprint(thing))
 	}
 }
 
+// GetParam returns the value of a job parameter, or null if the job has no such parameter
+func (javascriptTransform *JavascriptTransform) GetParam(name string) interface{} {
+	return javascriptTransform.params[name]
+}
+
 func (javascriptTransform *JavascriptTransform) Timing(name string, end bool) {
 	if end {
 		if _, ok := javascriptTransform.timings[name]; ok {
@@ -408,6 +469,9 @@ func (javascriptTransform *JavascriptTransform) Query(
 	inverse bool,
 	datasets []string,
 ) [][]interface{} {
+	if !javascriptTransform.sandbox.countQuery() {
+		return nil
+	}
 	ts := time.Now()
 	results, err := javascriptTransform.Store.GetManyRelatedEntities(startingEntities, predicate, inverse, datasets, true)
 	_ = javascriptTransform.statsDClient.Timing("transform.Query.time",
@@ -460,6 +524,9 @@ func (javascriptTransform *JavascriptTransform) PagedQuery(
 			}
 		}
 
+		if !javascriptTransform.sandbox.countQuery() {
+			return nil
+		}
 		ts := time.Now()
 		results, err := javascriptTransform.Store.GetManyRelatedEntitiesAtTime(conts, pageSize, true)
 		_ = javascriptTransform.statsDClient.Timing(
@@ -490,6 +557,9 @@ func (javascriptTransform *JavascriptTransform) PagedQuery(
 }
 
 func (javascriptTransform *JavascriptTransform) ByID(entityID string, datasets []string) *server.Entity {
+	if !javascriptTransform.sandbox.countQuery() {
+		return nil
+	}
 	ts := time.Now()
 	entity, err := javascriptTransform.Store.GetEntity(entityID, datasets, true)
 	_ = javascriptTransform.statsDClient.Timing("transform.ById.time",
@@ -539,7 +609,7 @@ func (javascriptTransform *JavascriptTransform) ExecuteQuery(resultWriter QueryR
 	javascriptTransform.statsDClient = &statsd.NoOpClient{}
 
 	// invoke transform, and catch js runtime err
-	err = queryFunc()
+	err = javascriptTransform.sandbox.run(queryFunc)
 	if err != nil {
 		return err
 	}
@@ -558,7 +628,12 @@ func (javascriptTransform *JavascriptTransform) BuildEntities(params map[string]
 
 	javascriptTransform.Runtime.Set("Emit", emit)
 
-	res, err := buildFunc(params, since, limit) // return continuation and error
+	var res string
+	err = javascriptTransform.sandbox.run(func() error {
+		var err error
+		res, err = buildFunc(params, since, limit) // return continuation and error
+		return err
+	})
 	if err != nil {
 		javascriptTransform.Logger.Errorf("build_entities failed: %v", err.Error())
 	}
@@ -580,7 +655,12 @@ func (javascriptTransform *JavascriptTransform) transformEntities(
 	javascriptTransform.timings = map[string]time.Time{}
 
 	// invoke transform, and catch js runtime err
-	result, err := transformFunc(entities)
+	var result interface{}
+	err = javascriptTransform.sandbox.run(func() error {
+		var err error
+		result, err = transformFunc(entities)
+		return err
+	})
 	if err != nil {
 		return nil, err
 	}
@@ -648,6 +728,8 @@ type HTTPTransform struct {
 	TokenProvider    string                   // for use in token auth
 	TimeOut          float64                  // set timeout for http-transform
 	SupportContext   bool                     // indicates if this transform supports context
+	Backoff          Backoff                  // retries of failed requests, none by default
+	RateLimiter      *server.RateLimiter      // shared with other jobs sending to the same host or login provider
 	NamespaceManager *server.NamespaceManager // the store
 }
 
@@ -661,10 +743,11 @@ func (httpTransform *HTTPTransform) transformEntities(
 	jobTag string,
 ) ([]*server.Entity, error) {
 	timeout := time.Duration(httpTransform.TimeOut) * time.Second
-	client := httpclient.NewClient(httpclient.WithHTTPTimeout(timeout))
 
 	// create headers if needed
 	url := httpTransform.URL
+	client := runner.newRetryingClient(url, timeout, httpTransform.Backoff).
+		limitedBy(httpTransform.RateLimiter, len(entities))
 
 	var jsonData []byte
 	var err error
@@ -712,12 +795,12 @@ func (httpTransform *HTTPTransform) transformEntities(
 	if err != nil {
 		return nil, err
 	}
+	defer func() { _ = res.Body.Close() }()
 	if res.StatusCode != 200 {
 		return nil, handleHTTPError(res)
 	}
 
 	// parse json back into []*Entity
-	defer func() { _ = res.Body.Close() }()
 	body, err := io.ReadAll(res.Body)
 	if err != nil {
 		return nil, err
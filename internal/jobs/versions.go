@@ -0,0 +1,370 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var ErrJobVersionNotFound = errors.New("job version not found")
+
+// JobVersion is an immutable copy of a job configuration, saved every time the configuration of the job changes.
+// Pausing and resuming a job does not make a new version.
+type JobVersion struct {
+	Version   int               `json:"version"`
+	JobID     string            `json:"jobId"`
+	Author    string            `json:"author"`
+	Comment   string            `json:"comment"`
+	Timestamp time.Time         `json:"timestamp"`
+	Config    *JobConfiguration `json:"config,omitempty"`
+}
+
+// JobConfigChange is a value that differs between two versions of a job configuration. Path is the json path of
+// the value, like "triggers[0].schedule". For javascript code, CodeDiff has a line by line diff of the decoded code.
+type JobConfigChange struct {
+	Path          string      `json:"path"`
+	From          interface{} `json:"from,omitempty"`
+	To            interface{} `json:"to,omitempty"`
+	CodeDiff      []string    `json:"codeDiff,omitempty"`
+	CodeDiffError string      `json:"codeDiffError,omitempty"`
+}
+
+// JobVersionDiff lists the changes needed to go from one version of a job configuration to another
+type JobVersionDiff struct {
+	JobID   string             `json:"jobId"`
+	From    int                `json:"from"`
+	To      int                `json:"to"`
+	Changes []*JobConfigChange `json:"changes"`
+}
+
+func versionKey(jobID string, version int) string {
+	return fmt.Sprintf("%s::%010d", jobID, version)
+}
+
+func versionsPrefix(jobID string) []byte {
+	return append(server.JobVersionIndexBytes, []byte("::"+jobID+"::")...)
+}
+
+// recordJobVersion saves the job configuration as a new version, unless it is the same as the latest version
+func (s *Scheduler) recordJobVersion(jobConfig *JobConfiguration, author string, comment string) error {
+	s.versionLock.Lock()
+	defer s.versionLock.Unlock()
+
+	versions, err := s.loadJobVersions(jobConfig.ID)
+	if err != nil {
+		return err
+	}
+	next := 1
+	if len(versions) > 0 {
+		latest := versions[0]
+		same, err := sameJobConfiguration(latest.Config, jobConfig)
+		if err != nil || same {
+			return err
+		}
+		next = latest.Version + 1
+	}
+
+	// keep a copy, so later changes to the configuration does not change the version
+	raw, err := json.Marshal(jobConfig)
+	if err != nil {
+		return err
+	}
+	config := &JobConfiguration{}
+	if err := json.Unmarshal(raw, config); err != nil {
+		return err
+	}
+	return s.Store.StoreObject(server.JobVersionIndex, versionKey(jobConfig.ID, next), &JobVersion{
+		Version:   next,
+		JobID:     jobConfig.ID,
+		Author:    author,
+		Comment:   comment,
+		Timestamp: time.Now(),
+		Config:    config,
+	})
+}
+
+// sameJobConfiguration compares two job configurations, ignoring if they are paused
+func sameJobConfiguration(a *JobConfiguration, b *JobConfiguration) (bool, error) {
+	if a == nil || b == nil {
+		return a == b, nil
+	}
+	ca, cb := *a, *b
+	ca.Paused, cb.Paused = false, false
+	ja, err := json.Marshal(ca)
+	if err != nil {
+		return false, err
+	}
+	jb, err := json.Marshal(cb)
+	if err != nil {
+		return false, err
+	}
+	return bytes.Equal(ja, jb), nil
+}
+
+// loadJobVersions returns all versions of a job, newest first
+func (s *Scheduler) loadJobVersions(jobID string) ([]*JobVersion, error) {
+	versions := make([]*JobVersion, 0)
+	err := s.Store.IterateObjectsRaw(versionsPrefix(jobID), func(jsonData []byte) error {
+		version := &JobVersion{}
+		if err := json.Unmarshal(jsonData, version); err != nil {
+			return err
+		}
+		versions = append(versions, version)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(versions, func(i, j int) bool { return versions[i].Version > versions[j].Version })
+	return versions, nil
+}
+
+// GetJobVersions lists the versions of a job, newest first, without their configurations
+func (s *Scheduler) GetJobVersions(jobID string) ([]*JobVersion, error) {
+	versions, err := s.loadJobVersions(jobID)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range versions {
+		v.Config = nil
+	}
+	return versions, nil
+}
+
+// GetJobVersion returns a single version of a job, with its configuration. If version is 0, the latest version is
+// returned.
+func (s *Scheduler) GetJobVersion(jobID string, version int) (*JobVersion, error) {
+	if version == 0 {
+		versions, err := s.loadJobVersions(jobID)
+		if err != nil {
+			return nil, err
+		}
+		if len(versions) == 0 {
+			return nil, ErrJobVersionNotFound
+		}
+		return versions[0], nil
+	}
+	jobVersion := &JobVersion{}
+	if err := s.Store.GetObject(server.JobVersionIndex, versionKey(jobID, version), jobVersion); err != nil {
+		return nil, err
+	}
+	if jobVersion.Version == 0 {
+		return nil, ErrJobVersionNotFound
+	}
+	return jobVersion, nil
+}
+
+// DiffJobVersions lists what changed in the configuration of a job from one version to another. If to is 0, the
+// latest version is used.
+func (s *Scheduler) DiffJobVersions(jobID string, from int, to int) (*JobVersionDiff, error) {
+	fromVersion, err := s.GetJobVersion(jobID, from)
+	if err != nil {
+		return nil, err
+	}
+	toVersion, err := s.GetJobVersion(jobID, to)
+	if err != nil {
+		return nil, err
+	}
+	changes, err := DiffJobConfigurations(fromVersion.Config, toVersion.Config)
+	if err != nil {
+		return nil, err
+	}
+	return &JobVersionDiff{JobID: jobID, From: fromVersion.Version, To: toVersion.Version, Changes: changes}, nil
+}
+
+// RollbackJob makes an earlier version of a job configuration the current one. This is saved as a new version, so
+// the history is kept. The job keeps its paused state, or gets the one of the version if it has been deleted.
+func (s *Scheduler) RollbackJob(jobID string, version int, author string) (*JobVersion, error) {
+	jobVersion, err := s.GetJobVersion(jobID, version)
+	if err != nil {
+		return nil, err
+	}
+	config := jobVersion.Config
+	if current, err := s.LoadJob(jobID); err == nil && current.ID != "" {
+		config.Paused = current.Paused
+	}
+	comment := fmt.Sprintf("rollback to version %d", jobVersion.Version)
+	if err := s.AddJobVersion(config, author, comment); err != nil {
+		return nil, err
+	}
+	return s.GetJobVersion(jobID, 0)
+}
+
+// DiffJobConfigurations compares the json of two job configurations value by value
+func DiffJobConfigurations(from *JobConfiguration, to *JobConfiguration) ([]*JobConfigChange, error) {
+	fromValues, err := flattenJSON(from)
+	if err != nil {
+		return nil, err
+	}
+	toValues, err := flattenJSON(to)
+	if err != nil {
+		return nil, err
+	}
+	paths := make([]string, 0, len(fromValues)+len(toValues))
+	for p := range fromValues {
+		paths = append(paths, p)
+	}
+	for p := range toValues {
+		if _, ok := fromValues[p]; !ok {
+			paths = append(paths, p)
+		}
+	}
+	sort.Strings(paths)
+
+	changes := make([]*JobConfigChange, 0)
+	for _, p := range paths {
+		f, t := fromValues[p], toValues[p]
+		if reflect.DeepEqual(f, t) {
+			continue
+		}
+		change := &JobConfigChange{Path: p, From: f, To: t}
+		if p == "transform.Code" {
+			fs, _ := f.(string)
+			ts, _ := t.(string)
+			codeDiff, err := diffLines(decodeCode(fs), decodeCode(ts))
+			if err != nil {
+				change.CodeDiffError = err.Error()
+			}
+			change.CodeDiff = codeDiff
+		}
+		changes = append(changes, change)
+	}
+	return changes, nil
+}
+
+// flattenJSON maps the json paths of all values in a job configuration to the values
+func flattenJSON(config *JobConfiguration) (map[string]interface{}, error) {
+	raw, err := json.Marshal(config)
+	if err != nil {
+		return nil, err
+	}
+	var doc interface{}
+	if err := json.Unmarshal(raw, &doc); err != nil {
+		return nil, err
+	}
+	values := make(map[string]interface{})
+	var walk func(path string, v interface{})
+	walk = func(path string, v interface{}) {
+		switch value := v.(type) {
+		case map[string]interface{}:
+			for k, child := range value {
+				if path == "" {
+					walk(k, child)
+				} else {
+					walk(path+"."+k, child)
+				}
+			}
+		case []interface{}:
+			for i, child := range value {
+				walk(fmt.Sprintf("%s[%d]", path, i), child)
+			}
+		default:
+			values[path] = value
+		}
+	}
+	walk("", doc)
+	return values, nil
+}
+
+func decodeCode(code64 string) []string {
+	if code64 == "" {
+		return nil
+	}
+	code, err := base64.StdEncoding.DecodeString(code64)
+	if err != nil {
+		code = []byte(code64)
+	}
+	return strings.Split(string(code), "\n")
+}
+
+// maxDiffCells bounds the size of the table used by diffLines, about 16 MB
+const maxDiffCells = 1 << 22
+
+// errTooLargeToDiff is returned by diffLines when the changed part of the code has too many lines to diff
+var errTooLargeToDiff = errors.New("too large to diff")
+
+// diffLines makes a line by line diff, where removed lines start with "- ", added lines with "+ " and unchanged
+// lines with "  ". Lines that are the same at the start and end are not part of the longest common subsequence table,
+// and if the lines in between would need a table bigger than maxDiffCells, errTooLargeToDiff is returned.
+func diffLines(from []string, to []string) ([]string, error) {
+	prefix := 0
+	for prefix < len(from) && prefix < len(to) && from[prefix] == to[prefix] {
+		prefix++
+	}
+	suffix := 0
+	for suffix < len(from)-prefix && suffix < len(to)-prefix &&
+		from[len(from)-1-suffix] == to[len(to)-1-suffix] {
+		suffix++
+	}
+	midFrom := from[prefix : len(from)-suffix]
+	midTo := to[prefix : len(to)-suffix]
+	if (len(midFrom)+1)*(len(midTo)+1) > maxDiffCells {
+		return nil, errTooLargeToDiff
+	}
+
+	// longest common subsequence, lcs[i*width+j] is the length for midFrom[i:] and midTo[j:]
+	width := len(midTo) + 1
+	lcs := make([]int32, (len(midFrom)+1)*width)
+	for i := len(midFrom) - 1; i >= 0; i-- {
+		for j := len(midTo) - 1; j >= 0; j-- {
+			if midFrom[i] == midTo[j] {
+				lcs[i*width+j] = lcs[(i+1)*width+j+1] + 1
+			} else if lcs[(i+1)*width+j] >= lcs[i*width+j+1] {
+				lcs[i*width+j] = lcs[(i+1)*width+j]
+			} else {
+				lcs[i*width+j] = lcs[i*width+j+1]
+			}
+		}
+	}
+	result := make([]string, 0, len(from)+len(to)-prefix-suffix)
+	for _, line := range from[:prefix] {
+		result = append(result, "  "+line)
+	}
+	i, j := 0, 0
+	for i < len(midFrom) && j < len(midTo) {
+		switch {
+		case midFrom[i] == midTo[j]:
+			result = append(result, "  "+midFrom[i])
+			i++
+			j++
+		case lcs[(i+1)*width+j] >= lcs[i*width+j+1]:
+			result = append(result, "- "+midFrom[i])
+			i++
+		default:
+			result = append(result, "+ "+midTo[j])
+			j++
+		}
+	}
+	for ; i < len(midFrom); i++ {
+		result = append(result, "- "+midFrom[i])
+	}
+	for ; j < len(midTo); j++ {
+		result = append(result, "+ "+midTo[j])
+	}
+	for _, line := range from[len(from)-suffix:] {
+		result = append(result, "  "+line)
+	}
+	return result, nil
+}
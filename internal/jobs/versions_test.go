@@ -0,0 +1,169 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package jobs
+
+import (
+	"encoding/base64"
+	"fmt"
+	"os"
+	"strings"
+
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("Job versions", func() {
+	testCnt := 0
+	var scheduler *Scheduler
+	var store *server.Store
+	var runner *Runner
+	var storeLocation string
+	BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./testversions_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		scheduler, store, runner, _, _ = setupScheduler(storeLocation)
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	jobConfig := func(schedule string, js string) *JobConfiguration {
+		return &JobConfiguration{
+			ID: "versioned", Title: "versioned", Paused: true,
+			Source: map[string]interface{}{"Type": "SampleSource", "NumberOfEntities": float64(1)},
+			Transform: map[string]interface{}{
+				"Type": "JavascriptTransform",
+				"Code": base64.StdEncoding.EncodeToString([]byte(js)),
+			},
+			Sink:     map[string]interface{}{"Type": "DevNullSink"},
+			Triggers: []JobTrigger{{TriggerType: TriggerTypeCron, JobType: JobTypeIncremental, Schedule: schedule}},
+		}
+	}
+	v1Code := "function transform_entities(entities) {\n  return entities;\n}"
+	v2Code := "function transform_entities(entities) {\n  Log(entities.length);\n  return entities;\n}"
+
+	It("Should record a version when the configuration changes", func() {
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", v1Code), "alice", "first")).To(BeNil())
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", v1Code), "bob", "no change")).To(BeNil())
+		Expect(scheduler.UnpauseJob("versioned")).To(BeNil())
+		Expect(scheduler.PauseJob("versioned")).To(BeNil())
+		Expect(scheduler.AddJobVersion(jobConfig("@every 2h", v2Code), "bob", "log batches")).To(BeNil())
+
+		versions, err := scheduler.GetJobVersions("versioned")
+		Expect(err).To(BeNil())
+		Expect(versions).To(HaveLen(2), "saving the same config and pausing does not make new versions")
+		Expect(versions[0].Version).To(Equal(2))
+		Expect(versions[0].Author).To(Equal("bob"))
+		Expect(versions[0].Comment).To(Equal("log batches"))
+		Expect(versions[0].Config).To(BeNil())
+		Expect(versions[1].Author).To(Equal("alice"))
+		Expect(versions[1].Timestamp.After(versions[0].Timestamp)).To(BeFalse())
+
+		v1, err := scheduler.GetJobVersion("versioned", 1)
+		Expect(err).To(BeNil())
+		Expect(v1.Config.Triggers[0].Schedule).To(Equal("@every 1h"))
+		latest, _ := scheduler.GetJobVersion("versioned", 0)
+		Expect(latest.Version).To(Equal(2))
+		_, err = scheduler.GetJobVersion("versioned", 3)
+		Expect(err).To(Equal(ErrJobVersionNotFound))
+	})
+
+	It("Should diff two versions", func() {
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", v1Code), "alice", "")).To(BeNil())
+		Expect(scheduler.AddJobVersion(jobConfig("@every 2h", v2Code), "alice", "")).To(BeNil())
+
+		diff, err := scheduler.DiffJobVersions("versioned", 1, 0)
+		Expect(err).To(BeNil())
+		Expect(diff.From).To(Equal(1))
+		Expect(diff.To).To(Equal(2))
+		Expect(diff.Changes).To(HaveLen(2))
+		Expect(diff.Changes[0].Path).To(Equal("transform.Code"))
+		Expect(diff.Changes[0].CodeDiff).To(Equal([]string{
+			"  function transform_entities(entities) {",
+			"+   Log(entities.length);",
+			"    return entities;",
+			"  }",
+		}))
+		Expect(diff.Changes[1]).To(Equal(&JobConfigChange{
+			Path: "triggers[0].schedule", From: "@every 1h", To: "@every 2h",
+		}))
+
+		_, err = scheduler.DiffJobVersions("versioned", 1, 7)
+		Expect(err).To(Equal(ErrJobVersionNotFound))
+	})
+
+	It("Should diff large code, but not when too many lines have changed", func() {
+		lines := func(n int, prefix string) string {
+			code := make([]string, n)
+			for i := range code {
+				code[i] = fmt.Sprintf("// %s %d", prefix, i)
+			}
+			return strings.Join(code, "\n")
+		}
+		big := lines(10000, "line")
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", big), "alice", "")).To(BeNil())
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", big+"\nLog(1);"), "alice", "")).To(BeNil())
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", lines(10000, "other")), "alice", "")).To(BeNil())
+
+		diff, err := scheduler.DiffJobVersions("versioned", 1, 2)
+		Expect(err).To(BeNil())
+		Expect(diff.Changes[0].CodeDiffError).To(BeEmpty())
+		Expect(diff.Changes[0].CodeDiff).To(HaveLen(10001))
+		Expect(diff.Changes[0].CodeDiff[10000]).To(Equal("+ Log(1);"))
+
+		diff, err = scheduler.DiffJobVersions("versioned", 2, 3)
+		Expect(err).To(BeNil())
+		Expect(diff.Changes[0].CodeDiff).To(BeNil())
+		Expect(diff.Changes[0].CodeDiffError).To(Equal("too large to diff"))
+	})
+
+	It("Should roll back to an earlier version as a new version", func() {
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", v1Code), "alice", "")).To(BeNil())
+		Expect(scheduler.AddJobVersion(jobConfig("@every 2h", v2Code), "bob", "")).To(BeNil())
+		Expect(scheduler.UnpauseJob("versioned")).To(BeNil())
+
+		version, err := scheduler.RollbackJob("versioned", 1, "carol")
+		Expect(err).To(BeNil())
+		Expect(version.Version).To(Equal(3))
+		Expect(version.Author).To(Equal("carol"))
+		Expect(version.Comment).To(Equal("rollback to version 1"))
+
+		current, _ := scheduler.LoadJob("versioned")
+		Expect(current.Triggers[0].Schedule).To(Equal("@every 1h"))
+		Expect(current.Transform["Code"]).To(Equal(base64.StdEncoding.EncodeToString([]byte(v1Code))))
+		Expect(current.Paused).To(BeFalse(), "the job is still running")
+
+		_, err = scheduler.RollbackJob("versioned", 9, "carol")
+		Expect(err).To(Equal(ErrJobVersionNotFound))
+	})
+
+	It("Should keep the versions of a deleted job, so it can be restored", func() {
+		Expect(scheduler.AddJobVersion(jobConfig("@every 1h", v1Code), "alice", "")).To(BeNil())
+		Expect(scheduler.DeleteJob("versioned")).To(BeNil())
+		Expect(scheduler.ListJobs()).To(BeEmpty())
+
+		_, err := scheduler.RollbackJob("versioned", 1, "alice")
+		Expect(err).To(BeNil())
+		Expect(scheduler.ListJobs()).To(HaveLen(1))
+		versions, _ := scheduler.GetJobVersions("versioned")
+		Expect(versions).To(HaveLen(1), "the restored job is the same as the latest version")
+	})
+})
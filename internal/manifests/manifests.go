@@ -0,0 +1,197 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifests
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	KindDataset = "dataset"
+	KindJob     = "job"
+)
+
+// DatasetManifest is the desired state of a dataset. It takes the same options as when a dataset is created
+// through the api.
+type DatasetManifest struct {
+	Name string `json:"name"`
+	server.CreateDatasetConfig
+}
+
+// Manifest is a single job or dataset read from a manifest file
+type Manifest struct {
+	Kind    string
+	Name    string
+	File    string
+	Dataset *DatasetManifest
+	Job     *jobs.JobConfiguration
+}
+
+// Manifests is everything read from a manifest directory. Fingerprint changes when the content of any of the
+// files change.
+type Manifests struct {
+	Items       []*Manifest
+	Fingerprint string
+}
+
+func isManifestFile(name string) bool {
+	switch strings.ToLower(filepath.Ext(name)) {
+	case ".json", ".yaml", ".yml":
+		return true
+	}
+	return false
+}
+
+// ReadManifests reads all json and yaml files in a directory and its sub directories. Files and directories starting
+// with a "." are skipped, this also skips the hidden data directories of a mounted kubernetes ConfigMap.
+// A file can hold several manifests, either as a list or as several yaml documents separated by "---".
+// It fails if any file is invalid, or if a job or dataset is defined more than once, so that a broken file is
+// never mistaken for removed objects.
+func ReadManifests(location string) (*Manifests, error) {
+	result := &Manifests{Items: make([]*Manifest, 0)}
+	seen := make(map[string]string)
+	hash := sha256.New()
+	err := filepath.WalkDir(location, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != location && strings.HasPrefix(d.Name(), ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if d.IsDir() || !isManifestFile(d.Name()) {
+			return nil
+		}
+		file, _ := filepath.Rel(location, path)
+		content, err := os.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		hash.Write([]byte(file))
+		hash.Write(content)
+
+		items, err := parseManifests(content)
+		if err != nil {
+			return fmt.Errorf("%s: %w", file, err)
+		}
+		for _, item := range items {
+			item.File = file
+			key := item.Kind + "/" + item.Name
+			if other, ok := seen[key]; ok {
+				return fmt.Errorf("%s: %s %s is also defined in %s", file, item.Kind, item.Name, other)
+			}
+			seen[key] = file
+			result.Items = append(result.Items, item)
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	result.Fingerprint = hex.EncodeToString(hash.Sum(nil))
+	return result, nil
+}
+
+// parseManifests reads the manifests in a file. json is valid yaml, so the yaml decoder is used for both
+func parseManifests(content []byte) ([]*Manifest, error) {
+	items := make([]*Manifest, 0)
+	decoder := yaml.NewDecoder(bytes.NewReader(content))
+	for {
+		var doc interface{}
+		err := decoder.Decode(&doc)
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
+		var docs []interface{}
+		switch value := doc.(type) {
+		case nil:
+			continue
+		case []interface{}:
+			docs = value
+		default:
+			docs = []interface{}{value}
+		}
+		for _, d := range docs {
+			m, ok := d.(map[string]interface{})
+			if !ok {
+				return nil, errors.New("a manifest must be an object with a kind")
+			}
+			item, err := toManifest(m)
+			if err != nil {
+				return nil, err
+			}
+			items = append(items, item)
+		}
+	}
+	return items, nil
+}
+
+func toManifest(doc map[string]interface{}) (*Manifest, error) {
+	kind, _ := doc["kind"].(string)
+	delete(doc, "kind")
+	raw, err := json.Marshal(doc)
+	if err != nil {
+		return nil, err
+	}
+
+	item := &Manifest{Kind: strings.ToLower(kind)}
+	switch item.Kind {
+	case KindDataset:
+		item.Dataset = &DatasetManifest{}
+		if err := strictUnmarshal(raw, item.Dataset); err != nil {
+			return nil, fmt.Errorf("invalid dataset manifest: %w", err)
+		}
+		item.Name = item.Dataset.Name
+	case KindJob:
+		item.Job = &jobs.JobConfiguration{}
+		if err := strictUnmarshal(raw, item.Job); err != nil {
+			return nil, fmt.Errorf("invalid job manifest: %w", err)
+		}
+		item.Name = item.Job.ID
+	default:
+		return nil, fmt.Errorf("unknown manifest kind '%s', must be one of: %s, %s", kind, KindDataset, KindJob)
+	}
+	if item.Name == "" {
+		return nil, fmt.Errorf("%s manifest needs a name", item.Kind)
+	}
+	return item, nil
+}
+
+// strictUnmarshal fails on unknown fields, so that typos in manifests are not silently ignored
+func strictUnmarshal(raw []byte, v interface{}) error {
+	decoder := json.NewDecoder(bytes.NewReader(raw))
+	decoder.DisallowUnknownFields()
+	return decoder.Decode(v)
+}
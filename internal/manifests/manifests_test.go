@@ -0,0 +1,290 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifests
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/security"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+func TestManifests(t *testing.T) {
+	RegisterFailHandler(Fail)
+	RunSpecs(t, "Manifests Suite")
+}
+
+const datasetsYaml = `
+kind: Dataset
+name: people
+metadata:
+  description: all the people
+  tags: [hr]
+---
+kind: dataset
+name: places
+`
+
+const jobJSON = `[{
+	"kind": "Job",
+	"id": "copy-people",
+	"title": "copy people",
+	"paused": true,
+	"source": {"Type": "DatasetSource", "Name": "people"},
+	"sink": {"Type": "DatasetSink", "Name": "places"},
+	"triggers": [{"triggerType": "cron", "jobType": "incremental", "schedule": "@every 1h"}]
+}]`
+
+var _ = Describe("Reading manifests", func() {
+	var location string
+	BeforeEach(func() {
+		location = GinkgoT().TempDir()
+	})
+
+	It("Should read json and yaml files, and skip hidden files", func() {
+		Expect(os.WriteFile(filepath.Join(location, "datasets.yaml"), []byte(datasetsYaml), 0o644)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(location, "jobs"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "jobs", "copy.json"), []byte(jobJSON), 0o644)).To(Succeed())
+		Expect(os.MkdirAll(filepath.Join(location, "..data"), 0o755)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "..data", "datasets.yaml"), []byte(datasetsYaml), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "README.md"), []byte("# manifests"), 0o644)).To(Succeed())
+
+		manifests, err := ReadManifests(location)
+		Expect(err).To(BeNil())
+		Expect(manifests.Items).To(HaveLen(3))
+		Expect(manifests.Items[0].Kind).To(Equal(KindDataset))
+		Expect(manifests.Items[0].Dataset.Metadata.Tags).To(Equal([]string{"hr"}))
+		Expect(manifests.Items[1].Name).To(Equal("places"))
+		Expect(manifests.Items[2].File).To(Equal(filepath.Join("jobs", "copy.json")))
+		Expect(manifests.Items[2].Job.Triggers[0].Schedule).To(Equal("@every 1h"))
+
+		again, _ := ReadManifests(location)
+		Expect(again.Fingerprint).To(Equal(manifests.Fingerprint))
+		Expect(os.WriteFile(filepath.Join(location, "more.yml"), []byte("kind: dataset\nname: more"), 0o644)).To(Succeed())
+		changed, _ := ReadManifests(location)
+		Expect(changed.Fingerprint).NotTo(Equal(manifests.Fingerprint))
+	})
+
+	It("Should reject invalid and duplicate manifests", func() {
+		file := filepath.Join(location, "a.yaml")
+		for content, message := range map[string]string{
+			"kind: Pipeline\nname: x":          "unknown manifest kind",
+			"kind: dataset\ndescription: x":    "unknown field",
+			"kind: dataset":                    "needs a name",
+			"- 1\n- 2":                         "must be an object",
+			"kind: dataset\nname: [unclosed\n": "a.yaml",
+		} {
+			Expect(os.WriteFile(file, []byte(content), 0o644)).To(Succeed())
+			_, err := ReadManifests(location)
+			Expect(err).To(MatchError(ContainSubstring(message)), content)
+		}
+
+		Expect(os.WriteFile(file, []byte(datasetsYaml), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "b.yaml"), []byte("kind: dataset\nname: people"), 0o644)).To(Succeed())
+		_, err := ReadManifests(location)
+		Expect(err).To(MatchError("b.yaml: dataset people is also defined in a.yaml"))
+	})
+})
+
+var _ = Describe("Syncing manifests", func() {
+	testCnt := 0
+	var store *server.Store
+	var dsm *server.DsManager
+	var runner *jobs.Runner
+	var scheduler *jobs.Scheduler
+	var service *Service
+	var env *conf.Config
+	var location string
+	BeforeEach(func() {
+		testCnt++
+		location = GinkgoT().TempDir()
+		logger := zap.NewNop().Sugar()
+		env = &conf.Config{
+			Logger:        logger,
+			StoreLocation: fmt.Sprintf("./test_manifests_%v", testCnt),
+			RunnerConfig:  &conf.RunnerConfig{PoolIncremental: 10, PoolFull: 5},
+			Manifests:     &conf.ManifestsConfig{Location: location},
+		}
+		Expect(os.RemoveAll(env.StoreLocation)).To(Succeed())
+		sc := &statsd.NoOpClient{}
+		store = server.NewStore(env, sc)
+		dsm = server.NewDsManager(env, store, server.NoOpBus())
+		tps := security.NewTokenProviders(logger, security.NewProviderManager(env, store, logger), nil)
+		runner = jobs.NewRunner(env, store, tps, server.NoOpBus(), sc)
+		scheduler = jobs.NewScheduler(env, store, dsm, runner)
+		service = NewService(env, store, dsm, scheduler)
+
+		Expect(os.WriteFile(filepath.Join(location, "datasets.yaml"), []byte(datasetsYaml), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "copy.json"), []byte(jobJSON), 0o644)).To(Succeed())
+	})
+	AfterEach(func() {
+		runner.Stop()
+		_ = store.Close()
+		_ = os.RemoveAll(env.StoreLocation)
+	})
+
+	actions := func(plan *Plan) []string {
+		var result []string
+		for _, c := range plan.Changes {
+			result = append(result, c.Kind+" "+c.Name+" "+c.Action)
+		}
+		return result
+	}
+
+	It("Should plan without changing anything, and then apply the plan", func() {
+		plan, err := service.Plan()
+		Expect(err).To(BeNil())
+		Expect(plan.Applied).To(BeFalse())
+		Expect(actions(plan)).To(Equal([]string{
+			"dataset people create", "dataset places create", "job copy-people create",
+		}))
+		Expect(dsm.IsDataset("people")).To(BeFalse())
+		Expect(scheduler.ListJobs()).To(BeEmpty())
+
+		plan, err = service.Apply()
+		Expect(err).To(BeNil())
+		Expect(plan.Applied).To(BeTrue())
+		Expect(dsm.GetDataset("people").Metadata.Description).To(Equal("all the people"))
+		Expect(dsm.IsDataset("places")).To(BeTrue())
+		job, _ := scheduler.LoadJob("copy-people")
+		Expect(job.Title).To(Equal("copy people"))
+		versions, _ := scheduler.GetJobVersions("copy-people")
+		Expect(versions[0].Author).To(Equal("manifests"))
+		Expect(versions[0].Comment).To(Equal("applied from manifest copy.json"))
+
+		plan, _ = service.Plan()
+		Expect(actions(plan)).To(Equal([]string{
+			"dataset people unchanged", "dataset places unchanged", "job copy-people unchanged",
+		}))
+	})
+
+	It("Should update changed objects, and keep the paused state of jobs", func() {
+		_, _ = service.Apply()
+		Expect(scheduler.UnpauseJob("copy-people")).To(Succeed())
+
+		Expect(os.WriteFile(filepath.Join(location, "datasets.yaml"),
+			[]byte("kind: dataset\nname: people\n---\nkind: dataset\nname: places"), 0o644)).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "copy.json"),
+			[]byte(`{"kind": "job", "id": "copy-people", "title": "copy people", "paused": true,
+			"source": {"Type": "DatasetSource", "Name": "people"}, "sink": {"Type": "DatasetSink", "Name": "places"},
+			"triggers": [{"triggerType": "cron", "jobType": "incremental", "schedule": "@every 2h"}]}`), 0o644)).To(Succeed())
+
+		plan, err := service.Apply()
+		Expect(err).To(BeNil())
+		Expect(actions(plan)).To(Equal([]string{
+			"dataset people update", "dataset places unchanged", "job copy-people update",
+		}))
+		Expect(plan.Changes[2].Diff).To(Equal([]*jobs.JobConfigChange{
+			{Path: "triggers[0].schedule", From: "@every 1h", To: "@every 2h"},
+		}))
+		Expect(dsm.GetDataset("people").Metadata).To(BeNil())
+		job, _ := scheduler.LoadJob("copy-people")
+		Expect(job.Triggers[0].Schedule).To(Equal("@every 2h"))
+		Expect(job.Paused).To(BeFalse(), "the job was resumed by an operator")
+	})
+
+	It("Should only delete what it manages", func() {
+		_, _ = dsm.CreateDataset("manual", nil)
+		Expect(scheduler.AddJob(&jobs.JobConfiguration{
+			ID: "manual-job", Title: "manual job", Paused: true,
+			Source:   map[string]interface{}{"Type": "DatasetSource", "Name": "manual"},
+			Sink:     map[string]interface{}{"Type": "DevNullSink"},
+			Triggers: []jobs.JobTrigger{{TriggerType: "cron", JobType: "incremental", Schedule: "@every 1h"}},
+		})).To(Succeed())
+		_, _ = service.Apply()
+
+		Expect(os.Remove(filepath.Join(location, "copy.json"))).To(Succeed())
+		Expect(os.WriteFile(filepath.Join(location, "datasets.yaml"), []byte("kind: dataset\nname: places"), 0o644)).To(Succeed())
+		plan, err := service.Apply()
+		Expect(err).To(BeNil())
+		Expect(actions(plan)).To(Equal([]string{
+			"dataset places unchanged", "job copy-people delete", "dataset people keep",
+		}))
+		Expect(plan.Changes[2].Reason).To(ContainSubstring("MANIFESTS_PRUNE_DATASETS"))
+		job, _ := scheduler.LoadJob("copy-people")
+		Expect(job.ID).To(BeEmpty())
+		Expect(dsm.IsDataset("people")).To(BeTrue())
+		Expect(dsm.IsDataset("manual")).To(BeTrue(), "unmanaged objects are never deleted")
+		job, _ = scheduler.LoadJob("manual-job")
+		Expect(job.ID).To(Equal("manual-job"))
+
+		env.Manifests.PruneDatasets = true
+		plan, _ = service.Apply()
+		Expect(actions(plan)).To(Equal([]string{"dataset places unchanged", "dataset people delete"}))
+		Expect(dsm.IsDataset("people")).To(BeFalse())
+	})
+
+	It("Should refuse to remove everything when there are no manifests", func() {
+		_, _ = service.Apply()
+		Expect(os.Remove(filepath.Join(location, "copy.json"))).To(Succeed())
+		Expect(os.Remove(filepath.Join(location, "datasets.yaml"))).To(Succeed())
+		_, err := service.Plan()
+		Expect(err).To(Equal(ErrEmptyManifests))
+		_, err = service.Apply()
+		Expect(err).To(Equal(ErrEmptyManifests))
+		job, _ := scheduler.LoadJob("copy-people")
+		Expect(job.ID).To(Equal("copy-people"))
+
+		env.Manifests.AllowEmpty = true
+		plan, err := service.Apply()
+		Expect(err).To(BeNil())
+		Expect(actions(plan)).To(Equal([]string{"job copy-people delete", "dataset people keep", "dataset places keep"}))
+		job, _ = scheduler.LoadJob("copy-people")
+		Expect(job.ID).To(BeEmpty())
+	})
+
+	It("Should adopt existing objects, but not change settings that can not be changed", func() {
+		_, _ = dsm.CreateDataset("places", &server.CreateDatasetConfig{
+			ProxyDatasetConfig: &server.ProxyDatasetConfig{RemoteURL: "http://localhost:7777/datasets/places"},
+		})
+		_, _ = dsm.CreateDataset("people", nil)
+
+		plan, err := service.Apply()
+		Expect(err).To(BeNil())
+		Expect(actions(plan)).To(Equal([]string{
+			"dataset people update", "dataset places conflict", "job copy-people create",
+		}))
+		Expect(plan.Changes[0].Reason).To(ContainSubstring("adopted"))
+		Expect(dsm.GetDataset("places").ProxyConfig.RemoteURL).To(Equal("http://localhost:7777/datasets/places"))
+
+		Expect(os.WriteFile(filepath.Join(location, "datasets.yaml"),
+			[]byte("kind: dataset\nname: people\nmetadata:\n  description: all the people\n  tags: [hr]"), 0o644)).To(Succeed())
+		env.Manifests.PruneDatasets = true
+		plan, _ = service.Apply()
+		Expect(actions(plan)).To(Equal([]string{"dataset people unchanged", "job copy-people unchanged"}))
+		Expect(dsm.IsDataset("places")).To(BeTrue(), "a dataset in conflict is not adopted")
+	})
+
+	It("Should not change anything when a manifest is invalid", func() {
+		Expect(os.WriteFile(filepath.Join(location, "broken.json"), []byte(`{"kind": "job", `), 0o644)).To(Succeed())
+		_, err := service.Apply()
+		Expect(err).To(MatchError(ContainSubstring("broken.json")))
+		Expect(dsm.IsDataset("people")).To(BeFalse())
+
+		disabled := NewService(&conf.Config{Logger: env.Logger}, store, dsm, scheduler)
+		_, err = disabled.Plan()
+		Expect(err).To(Equal(ErrManifestsDisabled))
+	})
+})
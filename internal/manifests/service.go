@@ -0,0 +1,426 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package manifests
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+const (
+	ActionCreate    = "create"
+	ActionUpdate    = "update"
+	ActionDelete    = "delete"
+	ActionUnchanged = "unchanged"
+	ActionKeep      = "keep"
+	ActionConflict  = "conflict"
+
+	// author of the job versions made by the sync
+	manifestsAuthor = "manifests"
+	managedKey      = "manifests"
+)
+
+var (
+	ErrManifestsDisabled = errors.New("manifest sync is not enabled, set MANIFESTS_LOCATION to turn it on")
+	ErrEmptyManifests    = errors.New("no manifests found, this would remove all managed jobs and datasets. " +
+		"set MANIFESTS_ALLOW_EMPTY to allow it")
+)
+
+// Change is what the sync does with a single job or dataset. Error is set if applying it failed.
+type Change struct {
+	Kind   string                  `json:"kind"`
+	Name   string                  `json:"name"`
+	Action string                  `json:"action"`
+	File   string                  `json:"file,omitempty"`
+	Reason string                  `json:"reason,omitempty"`
+	Diff   []*jobs.JobConfigChange `json:"diff,omitempty"`
+	Error  string                  `json:"error,omitempty"`
+
+	manifest *Manifest
+	managed  bool
+}
+
+// Plan lists the changes needed to bring the hub in line with the manifests
+type Plan struct {
+	Location    string    `json:"location"`
+	Fingerprint string    `json:"fingerprint"`
+	Applied     bool      `json:"applied"`
+	Changes     []*Change `json:"changes"`
+}
+
+// managedObjects are the jobs and datasets created or adopted by the sync. Only these are ever deleted by it.
+type managedObjects struct {
+	Datasets []string `json:"datasets"`
+	Jobs     []string `json:"jobs"`
+}
+
+// Service keeps the jobs and datasets of the hub in sync with a directory of manifests
+type Service struct {
+	logger    *zap.SugaredLogger
+	config    *conf.ManifestsConfig
+	store     *server.Store
+	dsm       *server.DsManager
+	scheduler *jobs.Scheduler
+	lock      sync.Mutex
+	quit      chan bool
+	applied   string
+}
+
+func NewService(env *conf.Config, store *server.Store, dsm *server.DsManager, scheduler *jobs.Scheduler) *Service {
+	config := env.Manifests
+	if config == nil {
+		config = &conf.ManifestsConfig{}
+	}
+	return &Service{
+		logger:    env.Logger.Named("manifests"),
+		config:    config,
+		store:     store,
+		dsm:       dsm,
+		scheduler: scheduler,
+		quit:      make(chan bool, 1),
+	}
+}
+
+// Start applies the manifests, and then keeps checking the directory for changes
+func (s *Service) Start(ctx context.Context) error {
+	if s.config.Location == "" {
+		s.logger.Info("MANIFESTS_LOCATION not set, manifest sync disabled")
+		return nil
+	}
+	s.logger.Infof("Syncing jobs and datasets from manifests in %s", s.config.Location)
+	s.sync()
+
+	interval := s.config.PollInterval
+	if interval <= 0 {
+		interval = 30 * time.Second
+	}
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-s.quit:
+				return
+			case <-ticker.C:
+				s.sync()
+			}
+		}
+	}()
+	return nil
+}
+
+func (s *Service) Stop(ctx context.Context) error {
+	go func() { s.quit <- true }()
+	return nil
+}
+
+// sync applies the manifests if they have changed since they were last applied
+func (s *Service) sync() {
+	manifests, err := ReadManifests(s.config.Location)
+	if err != nil {
+		s.logger.Warnf("Failed to read manifests, nothing is changed: %v", err)
+		return
+	}
+	s.lock.Lock()
+	unchanged := manifests.Fingerprint == s.applied
+	s.lock.Unlock()
+	if unchanged {
+		return
+	}
+	plan, err := s.apply(manifests)
+	if err != nil {
+		s.logger.Warnf("Failed to apply manifests: %v", err)
+		return
+	}
+	for _, c := range plan.Changes {
+		switch {
+		case c.Error != "":
+			s.logger.Warnf("Failed to %s %s %s from %s: %s", c.Action, c.Kind, c.Name, c.File, c.Error)
+		case c.Action == ActionConflict || c.Action == ActionKeep:
+			s.logger.Warnf("Did not change %s %s: %s", c.Kind, c.Name, c.Reason)
+		case c.Action != ActionUnchanged:
+			s.logger.Infof("Manifest sync did %s %s %s", c.Action, c.Kind, c.Name)
+		}
+	}
+}
+
+// Plan reads the manifests and lists what Apply would change, without changing anything
+func (s *Service) Plan() (*Plan, error) {
+	if s.config.Location == "" {
+		return nil, ErrManifestsDisabled
+	}
+	manifests, err := ReadManifests(s.config.Location)
+	if err != nil {
+		return nil, err
+	}
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	return s.plan(manifests)
+}
+
+// Apply reads the manifests and changes jobs and datasets to match them. Nothing is changed if any manifest
+// is invalid. Errors for single jobs or datasets are reported in the returned plan.
+func (s *Service) Apply() (*Plan, error) {
+	if s.config.Location == "" {
+		return nil, ErrManifestsDisabled
+	}
+	manifests, err := ReadManifests(s.config.Location)
+	if err != nil {
+		return nil, err
+	}
+	return s.apply(manifests)
+}
+
+func (s *Service) apply(manifests *Manifests) (*Plan, error) {
+	s.lock.Lock()
+	defer s.lock.Unlock()
+	plan, err := s.plan(manifests)
+	if err != nil {
+		return nil, err
+	}
+
+	managed := &managedObjects{}
+	failed := false
+	for _, c := range plan.Changes {
+		err := s.applyChange(c)
+		if err != nil {
+			c.Error = err.Error()
+			failed = true
+		}
+		// objects are only taken over if they could be changed, and forgotten when they are deleted
+		keep := c.managed || (err == nil && c.Action != ActionConflict)
+		if c.Action == ActionDelete && err == nil {
+			keep = false
+		}
+		if !keep {
+			continue
+		}
+		if c.Kind == KindDataset {
+			managed.Datasets = append(managed.Datasets, c.Name)
+		} else {
+			managed.Jobs = append(managed.Jobs, c.Name)
+		}
+	}
+	if err := s.store.StoreObject(server.StoreMetaIndex, managedKey, managed); err != nil {
+		return nil, err
+	}
+	plan.Applied = true
+	if !failed {
+		// failed changes are tried again at the next check of the directory
+		s.applied = manifests.Fingerprint
+	} else {
+		s.applied = ""
+	}
+	return plan, nil
+}
+
+func (s *Service) applyChange(c *Change) error {
+	switch {
+	case c.Kind == KindDataset && c.Action == ActionCreate:
+		_, err := s.dsm.CreateDataset(c.Name, &c.manifest.Dataset.CreateDatasetConfig)
+		return err
+	case c.Kind == KindDataset && c.Action == ActionUpdate:
+		metadata := c.manifest.Dataset.Metadata
+		if metadata == nil {
+			metadata = &server.DatasetMetadata{}
+		}
+		_, err := s.dsm.UpdateDataset(c.Name, &server.UpdateDatasetConfig{Metadata: metadata})
+		return err
+	case c.Kind == KindDataset && c.Action == ActionDelete:
+		return s.dsm.DeleteDataset(c.Name)
+	case c.Kind == KindJob && (c.Action == ActionCreate || c.Action == ActionUpdate):
+		comment := fmt.Sprintf("applied from manifest %s", c.File)
+		return s.scheduler.AddJobVersion(c.manifest.Job, manifestsAuthor, comment)
+	case c.Kind == KindJob && c.Action == ActionDelete:
+		return s.scheduler.DeleteJob(c.Name)
+	}
+	return nil
+}
+
+// plan compares the manifests with the current jobs and datasets. Datasets are created before jobs, so that jobs
+// can use them, and deletes are done last. A directory without manifests is refused when it would remove
+// managed objects, since an empty or unmounted directory is more likely a mistake than a wish to delete everything.
+func (s *Service) plan(manifests *Manifests) (*Plan, error) {
+	managed := &managedObjects{}
+	if err := s.store.GetObject(server.StoreMetaIndex, managedKey, managed); err != nil {
+		return nil, err
+	}
+	managedNames := map[string]map[string]bool{KindDataset: toSet(managed.Datasets), KindJob: toSet(managed.Jobs)}
+
+	plan := &Plan{Location: s.config.Location, Fingerprint: manifests.Fingerprint, Changes: make([]*Change, 0)}
+	wanted := map[string]map[string]bool{KindDataset: {}, KindJob: {}}
+	for _, kind := range []string{KindDataset, KindJob} {
+		for _, m := range manifests.Items {
+			if m.Kind != kind {
+				continue
+			}
+			wanted[kind][m.Name] = true
+			var change *Change
+			var err error
+			if kind == KindDataset {
+				change = s.planDataset(m)
+			} else {
+				change, err = s.planJob(m)
+				if err != nil {
+					return nil, err
+				}
+			}
+			change.managed = managedNames[kind][m.Name]
+			if !change.managed && change.Action != ActionCreate && change.Action != ActionConflict {
+				change.Reason = "adopted, it was not created by the manifests"
+			}
+			plan.Changes = append(plan.Changes, change)
+		}
+	}
+
+	for _, id := range sortedKeys(managedNames[KindJob]) {
+		if wanted[KindJob][id] {
+			continue
+		}
+		if job, err := s.scheduler.LoadJob(id); err != nil || job.ID == "" {
+			continue // already gone
+		}
+		plan.Changes = append(plan.Changes, &Change{Kind: KindJob, Name: id, Action: ActionDelete, managed: true})
+	}
+	for _, name := range sortedKeys(managedNames[KindDataset]) {
+		if wanted[KindDataset][name] || !s.dsm.IsDataset(name) {
+			continue
+		}
+		change := &Change{Kind: KindDataset, Name: name, Action: ActionDelete, managed: true}
+		if !s.config.PruneDatasets {
+			change.Action = ActionKeep
+			change.Reason = "removed from the manifests, set MANIFESTS_PRUNE_DATASETS to delete it"
+		}
+		plan.Changes = append(plan.Changes, change)
+	}
+	if len(manifests.Items) == 0 && len(plan.Changes) > 0 && !s.config.AllowEmpty {
+		return nil, ErrEmptyManifests
+	}
+	return plan, nil
+}
+
+func (s *Service) planDataset(m *Manifest) *Change {
+	change := &Change{Kind: KindDataset, Name: m.Name, File: m.File, manifest: m}
+	ds := s.dsm.GetDataset(m.Name)
+	if ds == nil {
+		change.Action = ActionCreate
+		return change
+	}
+
+	wanted := m.Dataset
+	if !sameJSON(proxyConfig(ds.ProxyConfig), proxyConfig(wanted.ProxyDatasetConfig)) ||
+		!sameJSON(virtualConfig(ds.VirtualDatasetConfig), virtualConfig(wanted.VirtualDatasetConfig)) ||
+		!sameJSON(namespaces(ds.PublicNamespaces), namespaces(wanted.PublicNamespaces)) {
+		change.Action = ActionConflict
+		change.Reason = "proxy, virtual and public namespace settings can not be changed on an existing dataset"
+		return change
+	}
+	if sameJSON(metadata(ds.GetMetadata()), metadata(wanted.Metadata)) {
+		change.Action = ActionUnchanged
+	} else {
+		change.Action = ActionUpdate
+	}
+	return change
+}
+
+// planJob compares a job manifest with the stored job. Whether a job is paused is left to the operators, so it is
+// only taken from the manifest when the job is created.
+func (s *Service) planJob(m *Manifest) (*Change, error) {
+	change := &Change{Kind: KindJob, Name: m.Name, File: m.File, manifest: m}
+	current, err := s.scheduler.LoadJob(m.Name)
+	if err != nil {
+		return nil, err
+	}
+	if current.ID == "" {
+		change.Action = ActionCreate
+		return change, nil
+	}
+
+	m.Job.Paused = current.Paused
+	diff, err := jobs.DiffJobConfigurations(current, m.Job)
+	if err != nil {
+		return nil, err
+	}
+	if len(diff) == 0 {
+		change.Action = ActionUnchanged
+	} else {
+		change.Action = ActionUpdate
+		change.Diff = diff
+	}
+	return change, nil
+}
+
+func proxyConfig(c *server.ProxyDatasetConfig) *server.ProxyDatasetConfig {
+	if c == nil || c.RemoteURL == "" {
+		return nil
+	}
+	return c
+}
+
+func virtualConfig(c *server.VirtualDatasetConfig) *server.VirtualDatasetConfig {
+	if c == nil || c.Transform == "" {
+		return nil
+	}
+	return c
+}
+
+func namespaces(n []string) []string {
+	if len(n) == 0 {
+		return nil
+	}
+	return n
+}
+
+func metadata(m *server.DatasetMetadata) *server.DatasetMetadata {
+	if m == nil {
+		return &server.DatasetMetadata{}
+	}
+	return m
+}
+
+// sameJSON compares values by their json, so that numbers read from yaml and json are the same
+func sameJSON(a interface{}, b interface{}) bool {
+	ja, errA := json.Marshal(a)
+	jb, errB := json.Marshal(b)
+	return errA == nil && errB == nil && string(ja) == string(jb)
+}
+
+func toSet(values []string) map[string]bool {
+	set := make(map[string]bool, len(values))
+	for _, v := range values {
+		set[v] = true
+	}
+	return set
+}
+
+func sortedKeys(set map[string]bool) []string {
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
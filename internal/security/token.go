@@ -89,6 +89,11 @@ func (providers *TokenProviders) toProvider(provider ProviderConfig) Provider {
 	}
 }
 
+// LoadValue reads a value, like a secret, with the value readers of the provider manager
+func (providers *TokenProviders) LoadValue(vr *ValueReader) string {
+	return providers.pm.LoadValue(vr)
+}
+
 func (providers *TokenProviders) ListProviders() ([]ProviderConfig, error) {
 	return providers.pm.ListProviders()
 }
@@ -0,0 +1,221 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"strings"
+)
+
+const (
+	DeletedInclude = ""
+	DeletedOnly    = "only"
+	DeletedExclude = "exclude"
+)
+
+// ChangesFilter selects which changes are emitted from a dataset, and which properties they carry.
+// Identifiers can be given as full URIs or as CURIEs. Entities that are filtered out still move
+// the continuation token forward, so that clients resume after them.
+type ChangesFilter struct {
+	Types         []string // rdf:type references, an entity matches if it has one of them
+	HasProperties []string // properties or references the entity must have
+	Deleted       string   // one of DeletedInclude, DeletedOnly or DeletedExclude
+	Where         []string // property predicates on the form key=value or key!=value
+	Properties    []string // if given, only these properties and references are returned
+
+	resolved      bool
+	rdfType       string
+	types         map[string]bool
+	hasProperties []string
+	where         []propertyPredicate
+	properties    map[string]bool
+}
+
+type propertyPredicate struct {
+	key      string
+	value    string
+	refValue string // value resolved as an identifier, for matching references
+	negate   bool
+}
+
+// unresolvable marks identifiers in unknown namespaces, which can never match a stored entity
+const unresolvable = ""
+
+// IsEmpty returns true if the filter lets every change through unchanged
+func (f *ChangesFilter) IsEmpty() bool {
+	return f == nil || (len(f.Types) == 0 && len(f.HasProperties) == 0 && f.Deleted == DeletedInclude &&
+		len(f.Where) == 0 && len(f.Properties) == 0)
+}
+
+// Resolve validates the filter and translates its identifiers to the CURIEs used in the store
+func (f *ChangesFilter) Resolve(nsm *NamespaceManager) error {
+	if f.Deleted != DeletedInclude && f.Deleted != DeletedOnly && f.Deleted != DeletedExclude {
+		return fmt.Errorf("deleted must be one of: %s, %s", DeletedOnly, DeletedExclude)
+	}
+
+	f.rdfType = resolveIdentifier(nsm, RdfTypeURI)
+	f.types = make(map[string]bool)
+	for _, t := range f.Types {
+		f.types[resolveIdentifier(nsm, t)] = true
+	}
+	f.hasProperties = make([]string, 0, len(f.HasProperties))
+	for _, p := range f.HasProperties {
+		f.hasProperties = append(f.hasProperties, resolveIdentifier(nsm, p))
+	}
+	f.where = make([]propertyPredicate, 0, len(f.Where))
+	for _, w := range f.Where {
+		key, value, found := strings.Cut(w, "=")
+		if !found || key == "" {
+			return fmt.Errorf("invalid property predicate %q, expected key=value or key!=value", w)
+		}
+		negate := strings.HasSuffix(key, "!")
+		key = strings.TrimSuffix(key, "!")
+		f.where = append(f.where, propertyPredicate{
+			key:      resolveIdentifier(nsm, key),
+			value:    value,
+			refValue: resolveIdentifier(nsm, value),
+			negate:   negate,
+		})
+	}
+	if len(f.Properties) > 0 {
+		f.properties = make(map[string]bool)
+		for _, p := range f.Properties {
+			f.properties[resolveIdentifier(nsm, p)] = true
+		}
+	}
+	f.resolved = true
+	return nil
+}
+
+// resolveIdentifier looks up the stored CURIE for a URI or CURIE without creating new namespace mappings
+func resolveIdentifier(nsm *NamespaceManager, identifier string) string {
+	if strings.HasPrefix(identifier, "http://") || strings.HasPrefix(identifier, "https://") {
+		expansion, localName, err := getURLParts(identifier)
+		if err != nil {
+			return unresolvable
+		}
+		prefix, err := nsm.GetPrefixMappingForExpansion(expansion)
+		if err != nil {
+			return unresolvable
+		}
+		return prefix + ":" + localName
+	}
+	return nsm.StorageCurie(identifier)
+}
+
+// Apply returns the json to emit for a change, and false if the change is filtered out
+func (f *ChangesFilter) Apply(jsonData []byte) ([]byte, bool, error) {
+	if f.IsEmpty() {
+		return jsonData, true, nil
+	}
+	if !f.resolved {
+		return nil, false, fmt.Errorf("changes filter must be resolved before use")
+	}
+	entity := &Entity{}
+	err := json.Unmarshal(jsonData, entity)
+	if err != nil {
+		return nil, false, err
+	}
+	if !f.matches(entity) {
+		return nil, false, nil
+	}
+	if f.properties == nil {
+		return jsonData, true, nil
+	}
+	for k := range entity.Properties {
+		if !f.properties[k] {
+			delete(entity.Properties, k)
+		}
+	}
+	for k := range entity.References {
+		if !f.properties[k] {
+			delete(entity.References, k)
+		}
+	}
+	projected, err := json.Marshal(entity)
+	return projected, true, err
+}
+
+func (f *ChangesFilter) matches(entity *Entity) bool {
+	switch f.Deleted {
+	case DeletedOnly:
+		if !entity.IsDeleted {
+			return false
+		}
+	case DeletedExclude:
+		if entity.IsDeleted {
+			return false
+		}
+	}
+
+	if len(f.types) > 0 {
+		found := false
+		for _, t := range valuesOf(entity.References[f.rdfType]) {
+			if f.types[t] {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+
+	for _, p := range f.hasProperties {
+		_, isProp := entity.Properties[p]
+		_, isRef := entity.References[p]
+		if !isProp && !isRef {
+			return false
+		}
+	}
+
+	for _, w := range f.where {
+		found := false
+		for _, v := range valuesOf(entity.Properties[w.key]) {
+			if v == w.value {
+				found = true
+				break
+			}
+		}
+		for _, v := range valuesOf(entity.References[w.key]) {
+			if v == w.value || (w.refValue != unresolvable && v == w.refValue) {
+				found = true
+				break
+			}
+		}
+		if found == w.negate {
+			return false
+		}
+	}
+	return true
+}
+
+// valuesOf returns single and list values as strings
+func valuesOf(value any) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []any:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	case []string:
+		return v
+	}
+	return []string{fmt.Sprint(value)}
+}
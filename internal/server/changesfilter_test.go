@@ -0,0 +1,131 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("A filtered change feed", func() {
+	testCnt := 0
+	var storeLocation string
+	var store *Store
+	var ds *Dataset
+	var people, rdf string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_changes_filter_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = NewStore(e, &statsd.NoOpClient{})
+		dsm := NewDsManager(e, store, NoOpBus())
+		ds, _ = dsm.CreateDataset("mixed", nil)
+		people, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/people/")
+		rdf, _ = store.NamespaceManager.AssertPrefixMappingForExpansion(RdfNamespaceExpansion)
+
+		var entities []*Entity
+		for i := 0; i < 10; i++ {
+			e := NewEntity(fmt.Sprintf("%s:e%v", people, i), 0)
+			e.Properties[people+":name"] = fmt.Sprintf("name-%v", i)
+			e.Properties[people+":age"] = i
+			if i%2 == 0 {
+				e.References[rdf+":type"] = people + ":Person"
+				e.Properties[people+":email"] = "x@example.com"
+			} else {
+				e.References[rdf+":type"] = people + ":Company"
+			}
+			e.IsDeleted = i == 8
+			entities = append(entities, e)
+		}
+		Expect(ds.StoreEntities(entities)).To(Succeed())
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	changes := func(filter *ChangesFilter, since uint64, limit int) ([]*Entity, uint64) {
+		Expect(filter.Resolve(store.NamespaceManager)).To(Succeed())
+		var result []*Entity
+		next, err := ds.ProcessFilteredChangesRaw(since, limit, false, filter, func(jsonData []byte) error {
+			e := &Entity{}
+			Expect(json.Unmarshal(jsonData, e)).To(Succeed())
+			result = append(result, e)
+			return nil
+		})
+		Expect(err).To(BeNil())
+		return result, next
+	}
+
+	ginkgo.It("should filter on type given as uri or curie", func() {
+		result, _ := changes(&ChangesFilter{Types: []string{"http://data.mimiro.io/people/Person"}}, 0, 0)
+		Expect(result).To(HaveLen(5))
+		result, _ = changes(&ChangesFilter{Types: []string{people + ":Company"}}, 0, 0)
+		Expect(result).To(HaveLen(5))
+		result, _ = changes(&ChangesFilter{Types: []string{"http://unknown.example.com/Person"}}, 0, 0)
+		Expect(result).To(BeEmpty())
+	})
+
+	ginkgo.It("should filter on properties, predicates and deletion state", func() {
+		result, _ := changes(&ChangesFilter{HasProperties: []string{people + ":email"}, Deleted: DeletedExclude}, 0, 0)
+		Expect(result).To(HaveLen(4))
+		result, _ = changes(&ChangesFilter{Deleted: DeletedOnly}, 0, 0)
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].ID).To(Equal(people + ":e8"))
+		result, _ = changes(&ChangesFilter{Where: []string{people + ":age=3"}}, 0, 0)
+		Expect(result).To(HaveLen(1))
+		result, _ = changes(&ChangesFilter{Where: []string{"http://data.mimiro.io/people/name!=name-3"}}, 0, 0)
+		Expect(result).To(HaveLen(9))
+		result, _ = changes(&ChangesFilter{Where: []string{rdf + ":type=http://data.mimiro.io/people/Company"}}, 0, 0)
+		Expect(result).To(HaveLen(5))
+
+		Expect((&ChangesFilter{Deleted: "maybe"}).Resolve(store.NamespaceManager)).NotTo(Succeed())
+		Expect((&ChangesFilter{Where: []string{"novalue"}}).Resolve(store.NamespaceManager)).NotTo(Succeed())
+	})
+
+	ginkgo.It("should project selected properties", func() {
+		result, _ := changes(&ChangesFilter{Properties: []string{people + ":name"}}, 0, 1)
+		Expect(result).To(HaveLen(1))
+		Expect(result[0].Properties).To(Equal(map[string]any{people + ":name": "name-0"}))
+		Expect(result[0].References).To(BeEmpty())
+	})
+
+	ginkgo.It("should continue after filtered changes", func() {
+		filter := &ChangesFilter{Types: []string{people + ":Company"}}
+		first, next := changes(filter, 0, 2)
+		Expect(first).To(HaveLen(2))
+		Expect(first[1].ID).To(Equal(people + ":e3"))
+		Expect(next).To(Equal(uint64(4)), "token should point after the last emitted change")
+
+		rest, next := changes(filter, next, 0)
+		Expect(rest).To(HaveLen(3))
+		Expect(rest[0].ID).To(Equal(people + ":e5"))
+		Expect(next).To(Equal(uint64(10)), "token should point after filtered out changes at the end")
+
+		none, after := changes(filter, next, 0)
+		Expect(none).To(BeEmpty())
+		Expect(after).To(Equal(next))
+	})
+})
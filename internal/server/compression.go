@@ -0,0 +1,228 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/zstd"
+)
+
+const (
+	EncodingGzip     = "gzip"
+	EncodingZstd     = "zstd"
+	EncodingIdentity = "identity"
+
+	// SupportedEncodings is sent in Accept-Encoding, in order of preference
+	SupportedEncodings = EncodingZstd + ", " + EncodingGzip
+)
+
+var ErrUnsupportedEncoding = errors.New("unsupported content encoding")
+
+// DecodeBody wraps body in a reader for the given Content-Encoding. Closing the returned reader closes body.
+func DecodeBody(encoding string, body io.ReadCloser) (io.ReadCloser, error) {
+	switch strings.ToLower(strings.TrimSpace(encoding)) {
+	case "", EncodingIdentity:
+		return body, nil
+	case EncodingGzip, "x-gzip":
+		zr, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, err
+		}
+		return &decodedBody{Reader: zr, closers: []func() error{zr.Close, body.Close}}, nil
+	case EncodingZstd:
+		// one goroutine per reader, the default of one per cpu adds up with many concurrent requests
+		zr, err := zstd.NewReader(body, zstd.WithDecoderConcurrency(1))
+		if err != nil {
+			return nil, err
+		}
+		return &decodedBody{Reader: zr, closers: []func() error{
+			func() error { zr.Close(); return nil },
+			body.Close,
+		}}, nil
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+type decodedBody struct {
+	io.Reader
+	closers []func() error
+}
+
+func (d *decodedBody) Close() error {
+	var err error
+	for _, c := range d.closers {
+		if cerr := c(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	return err
+}
+
+// NewEncoder compresses everything written to it into w with the given encoding.
+// Close must be called to flush the last of the data.
+func NewEncoder(encoding string, w io.Writer) (io.WriteCloser, error) {
+	switch encoding {
+	case EncodingGzip:
+		return gzip.NewWriter(w), nil
+	case EncodingZstd:
+		return zstd.NewWriter(w)
+	}
+	return nil, fmt.Errorf("%w: %s", ErrUnsupportedEncoding, encoding)
+}
+
+// Encode compresses data with the given encoding
+func Encode(encoding string, data []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	enc, err := NewEncoder(encoding, &buf)
+	if err != nil {
+		return nil, err
+	}
+	if _, err = enc.Write(data); err != nil {
+		return nil, err
+	}
+	if err = enc.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// NegotiateEncoding picks the preferred encoding from an Accept-Encoding header,
+// and returns an empty string when the response should not be compressed.
+func NegotiateEncoding(acceptEncoding string) string {
+	accepted := map[string]bool{}
+	for _, part := range strings.Split(acceptEncoding, ",") {
+		fields := strings.Split(part, ";")
+		name := strings.ToLower(strings.TrimSpace(fields[0]))
+		q := ""
+		for _, p := range fields[1:] {
+			if p = strings.TrimSpace(p); strings.HasPrefix(p, "q=") {
+				q = strings.TrimSpace(p[2:])
+			}
+		}
+		accepted[name] = q == "" || strings.Trim(q, "0.") != ""
+	}
+	for _, encoding := range []string{EncodingZstd, EncodingGzip} {
+		if accepted[encoding] {
+			return encoding
+		}
+	}
+	return ""
+}
+
+// peerEncodings remembers, per scheme and host, the request encoding a peer advertised in the
+// Accept-Encoding header of its responses. Peers that have not advertised one get uncompressed requests.
+var peerEncodings sync.Map
+
+func peerKey(u *url.URL) string {
+	return u.Scheme + "://" + u.Host
+}
+
+// AcceptCompressedResponses asks the peer for a compressed response. The response body
+// must then be read through DecodeResponse.
+func AcceptCompressedResponses(req *http.Request) {
+	req.Header.Set("Accept-Encoding", SupportedEncodings)
+}
+
+// DecodeResponse replaces the body of res with its decoded content, and notes which
+// request encodings the peer has advertised.
+func DecodeResponse(res *http.Response) error {
+	NotePeerEncodings(res)
+	body, err := DecodeBody(res.Header.Get("Content-Encoding"), res.Body)
+	if err != nil {
+		return err
+	}
+	res.Body = body
+	res.Header.Del("Content-Encoding")
+	return nil
+}
+
+// NotePeerEncodings records the request encodings advertised in a response. A 415 response
+// means the peer did not accept a compressed request, and it gets uncompressed requests from then on.
+func NotePeerEncodings(res *http.Response) {
+	if res == nil || res.Request == nil || res.Request.URL == nil {
+		return
+	}
+	key := peerKey(res.Request.URL)
+	if res.StatusCode == http.StatusUnsupportedMediaType && res.Request.Header.Get("Content-Encoding") != "" {
+		peerEncodings.Delete(key)
+		return
+	}
+	if advertised := res.Header.Get("Accept-Encoding"); advertised != "" {
+		if encoding := NegotiateEncoding(advertised); encoding != "" {
+			peerEncodings.Store(key, encoding)
+		} else {
+			peerEncodings.Delete(key)
+		}
+	}
+}
+
+// RequestEncodingFor returns the encoding to compress request bodies sent to the given url with,
+// or an empty string when the peer has not said it accepts compressed requests.
+func RequestEncodingFor(rawURL string) string {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return ""
+	}
+	if encoding, ok := peerEncodings.Load(peerKey(u)); ok {
+		return encoding.(string)
+	}
+	return ""
+}
+
+// SendCompressed sends body with do, compressed when the peer at url has advertised that it accepts
+// compressed requests. If the peer turns a compressed request down, it is sent again uncompressed.
+func SendCompressed(url string, body []byte, do func(req *http.Request) (*http.Response, error),
+	newRequest func(r io.Reader) (*http.Request, error),
+) (*http.Response, error) {
+	send := func(encoding string) (*http.Response, error) {
+		data := body
+		if encoding != "" {
+			var err error
+			if data, err = Encode(encoding, body); err != nil {
+				return nil, err
+			}
+		}
+		req, err := newRequest(bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		res, err := do(req)
+		if err != nil {
+			return nil, err
+		}
+		NotePeerEncodings(res)
+		return res, nil
+	}
+
+	encoding := RequestEncodingFor(url)
+	res, err := send(encoding)
+	if err == nil && encoding != "" && res.StatusCode == http.StatusUnsupportedMediaType {
+		_ = res.Body.Close()
+		return send("")
+	}
+	return res, err
+}
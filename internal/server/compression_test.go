@@ -0,0 +1,129 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("Compressed entity streams", func() {
+	ginkgo.It("Should prefer zstd and respect q=0", func() {
+		Expect(NegotiateEncoding("")).To(Equal(""))
+		Expect(NegotiateEncoding("gzip, deflate, br")).To(Equal(EncodingGzip))
+		Expect(NegotiateEncoding("gzip, zstd")).To(Equal(EncodingZstd))
+		Expect(NegotiateEncoding("zstd;q=0, gzip;q=0.5")).To(Equal(EncodingGzip))
+		Expect(NegotiateEncoding("gzip;q=0.0")).To(Equal(""))
+		Expect(NegotiateEncoding("br")).To(Equal(""))
+	})
+
+	ginkgo.It("Should decode what it encodes", func() {
+		data := []byte(`[{"id":"@context","namespaces":{}},{"id":"ns0:1","props":{}}]`)
+		for _, encoding := range []string{EncodingGzip, EncodingZstd} {
+			encoded, err := Encode(encoding, data)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(encoded).NotTo(Equal(data))
+			body, err := DecodeBody(encoding, io.NopCloser(bytes.NewReader(encoded)))
+			Expect(err).NotTo(HaveOccurred())
+			decoded, err := io.ReadAll(body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(decoded).To(Equal(data))
+			Expect(body.Close()).To(Succeed())
+		}
+		_, err := DecodeBody("br", io.NopCloser(bytes.NewReader(data)))
+		Expect(err).To(MatchError(ErrUnsupportedEncoding))
+	})
+
+	ginkgo.It("Should remember which peers accept compressed requests", func() {
+		response := func(status int, requestEncoding string, advertised string) *http.Response {
+			u, _ := url.Parse("http://peer.example.com:4242/datasets/people/entities")
+			req := &http.Request{URL: u, Header: http.Header{}}
+			if requestEncoding != "" {
+				req.Header.Set("Content-Encoding", requestEncoding)
+			}
+			res := &http.Response{StatusCode: status, Request: req, Header: http.Header{}}
+			if advertised != "" {
+				res.Header.Set("Accept-Encoding", advertised)
+			}
+			return res
+		}
+		endpoint := "http://peer.example.com:4242/datasets/other/entities"
+
+		Expect(RequestEncodingFor(endpoint)).To(Equal(""))
+		NotePeerEncodings(response(http.StatusOK, "", SupportedEncodings))
+		Expect(RequestEncodingFor(endpoint)).To(Equal(EncodingZstd))
+		Expect(RequestEncodingFor("https://peer.example.com:4242/datasets/other/entities")).To(Equal(""))
+
+		NotePeerEncodings(response(http.StatusUnsupportedMediaType, EncodingZstd, ""))
+		Expect(RequestEncodingFor(endpoint)).To(Equal(""))
+	})
+
+	ginkgo.It("Should forward posts to proxies with their content type, uncompressed if compression is turned down", func() {
+		storeLocation := "./test_compression_proxy"
+		_ = os.RemoveAll(storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store := NewStore(e, &statsd.NoOpClient{})
+		defer func() {
+			_ = store.Close()
+			_ = os.RemoveAll(storeLocation)
+		}()
+		dsm := NewDsManager(e, store, NoOpBus())
+
+		var encodings, contentTypes, bodies []string
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			// advertises compression, but turns compressed posts down
+			w.Header().Set("Accept-Encoding", SupportedEncodings)
+			encodings = append(encodings, r.Header.Get("Content-Encoding"))
+			contentTypes = append(contentTypes, r.Header.Get("Content-Type"))
+			body, _ := io.ReadAll(r.Body)
+			bodies = append(bodies, string(body))
+			if r.Header.Get("Content-Encoding") != "" {
+				w.WriteHeader(http.StatusUnsupportedMediaType)
+			}
+		}))
+		defer srv.Close()
+		NotePeerEncodings(&http.Response{
+			StatusCode: http.StatusOK,
+			Request:    httptest.NewRequest(http.MethodGet, srv.URL, nil),
+			Header:     http.Header{"Accept-Encoding": []string{SupportedEncodings}},
+		})
+		Expect(RequestEncodingFor(srv.URL)).To(Equal(EncodingZstd))
+
+		ds, err := dsm.CreateDataset("proxied", &CreateDatasetConfig{ProxyDatasetConfig: &ProxyDatasetConfig{
+			RemoteURL: srv.URL + "/datasets/proxied",
+		}})
+		Expect(err).To(BeNil())
+		triples := "<http://data.example.io/a> <http://data.example.io/name> \"a\" .\n"
+		header := http.Header{"Content-Type": []string{"application/n-triples"}}
+		err = ds.AsProxy(func(req *http.Request) {}).ForwardEntities(io.NopCloser(strings.NewReader(triples)), header)
+		Expect(err).To(BeNil())
+
+		Expect(encodings).To(Equal([]string{EncodingZstd, ""}))
+		Expect(contentTypes).To(Equal([]string{"application/n-triples", "application/n-triples"}))
+		Expect(bodies[1]).To(Equal(triples))
+	})
+})
@@ -38,6 +38,10 @@ const (
 	ContentIndex       CollectionIndex = 15
 	StoreNextDatasetID CollectionIndex = 16
 	LoginProviderIndex CollectionIndex = 17
+	JobRunIndex        CollectionIndex = 18
+	JobRunLogIndex     CollectionIndex = 19
+	JobVersionIndex    CollectionIndex = 20
+	DeadLetterIndex    CollectionIndex = 21
 )
 
 var (
@@ -46,6 +50,10 @@ var (
 	ContentIndexBytes       = uint16ToBytes(ContentIndex)
 	StoreNextDatasetIDBytes = uint16ToBytes(StoreNextDatasetID)
 	LoginProviderIndexBytes = uint16ToBytes(LoginProviderIndex)
+	JobRunIndexBytes        = uint16ToBytes(JobRunIndex)
+	JobRunLogIndexBytes     = uint16ToBytes(JobRunLogIndex)
+	JobVersionIndexBytes    = uint16ToBytes(JobVersionIndex)
+	DeadLetterIndexBytes    = uint16ToBytes(DeadLetterIndex)
 )
 
 func uint16ToBytes(i CollectionIndex) []byte {
@@ -92,8 +100,16 @@ func collectionToStr(idx uint16) string {
 		return "StoreNextDatasetID"
 	case uint16(LoginProviderIndex):
 		return "LoginProviderIndex"
+	case uint16(JobRunIndex):
+		return "JobRunIndex"
+	case uint16(JobRunLogIndex):
+		return "JobRunLogIndex"
+	case uint16(JobVersionIndex):
+		return "JobVersionIndex"
+	case uint16(DeadLetterIndex):
+		return "DeadLetterIndex"
 	default:
 		return "unknown"
 	}
 
-}
\ No newline at end of file
+}
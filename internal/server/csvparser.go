@@ -0,0 +1,221 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// CSVMapping describes how the rows of a CSV document become entities. Templates refer to
+// columns by name, as in http://data.example.com/people/{id}, and values are URL path escaped.
+type CSVMapping struct {
+	IDTemplate    string             `json:"idTemplate"`
+	Separator     string             `json:"separator"`
+	DeletedColumn string             `json:"deletedColumn"`
+	Namespaces    map[string]string  `json:"namespaces"`
+	Columns       []CSVColumnMapping `json:"columns"`
+}
+
+// CSVColumnMapping maps a column to a property, or to a reference when IsReference is set.
+// The ReferenceTemplate of a reference column builds the referenced identifier, where {value} is the cell value.
+// Without a template, the value must be a URI or a CURIE using the mapping namespaces.
+type CSVColumnMapping struct {
+	Column            string `json:"column"`
+	Property          string `json:"property"`
+	Type              string `json:"type"` // string (default), integer, float or boolean
+	ListSeparator     string `json:"listSeparator"`
+	IsReference       bool   `json:"isReference"`
+	ReferenceTemplate string `json:"referenceTemplate"`
+}
+
+var csvTemplateVariable = regexp.MustCompile(`\{([^}]+)}`)
+
+// CSVStreamParser parses CSV documents with a header row into entities, one entity per row
+type CSVStreamParser struct {
+	store   *Store
+	mapping *CSVMapping
+	props   []string // the namespaced property of each column mapping
+}
+
+func NewCSVStreamParser(store *Store, mapping *CSVMapping) (*CSVStreamParser, error) {
+	if mapping.IDTemplate == "" {
+		return nil, errors.New("csv mapping must have an idTemplate")
+	}
+	if len([]rune(mapping.Separator)) > 1 {
+		return nil, errors.New("csv separator must be a single character")
+	}
+	p := &CSVStreamParser{store: store, mapping: mapping}
+	for _, col := range mapping.Columns {
+		if col.Column == "" || col.Property == "" {
+			return nil, errors.New("csv column mappings must have a column and a property")
+		}
+		switch col.Type {
+		case "", "string", "integer", "float", "boolean":
+		default:
+			return nil, fmt.Errorf("unknown csv column type %s", col.Type)
+		}
+		prop, err := store.GetNamespacedIdentifier(col.Property, mapping.Namespaces)
+		if err != nil {
+			return nil, err
+		}
+		p.props = append(p.props, prop)
+	}
+	return p, nil
+}
+
+func (p *CSVStreamParser) ParseStream(reader io.Reader, emitEntity func(*Entity) error) error {
+	r := csv.NewReader(reader)
+	if p.mapping.Separator != "" {
+		r.Comma = []rune(p.mapping.Separator)[0]
+	}
+	r.FieldsPerRecord = -1
+
+	header, err := r.Read()
+	if err != nil {
+		return errors.New("parsing error: unable to read csv header " + err.Error())
+	}
+	index := make(map[string]int, len(header))
+	for i, name := range header {
+		index[strings.TrimSpace(name)] = i
+	}
+	for _, col := range p.mapping.Columns {
+		if _, ok := index[col.Column]; !ok {
+			return fmt.Errorf("parsing error: column %s is not in the csv header", col.Column)
+		}
+	}
+	for _, name := range csvTemplateVariable.FindAllStringSubmatch(p.mapping.IDTemplate, -1) {
+		if _, ok := index[name[1]]; !ok {
+			return fmt.Errorf("parsing error: idTemplate column %s is not in the csv header", name[1])
+		}
+	}
+
+	for row := 2; ; row++ {
+		record, err := r.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("parsing error: %w", err)
+		}
+		cell := func(column string) string {
+			i, ok := index[column]
+			if !ok || i >= len(record) {
+				return ""
+			}
+			return strings.TrimSpace(record[i])
+		}
+		entity, err := p.toEntity(cell)
+		if err != nil {
+			return fmt.Errorf("parsing error: row %d: %w", row, err)
+		}
+		if err := emitEntity(entity); err != nil {
+			return err
+		}
+	}
+}
+
+func (p *CSVStreamParser) toEntity(cell func(column string) string) (*Entity, error) {
+	idValue, err := expandCSVTemplate(p.mapping.IDTemplate, cell, "")
+	if err != nil {
+		return nil, err
+	}
+	id, err := p.store.GetNamespacedIdentifier(idValue, p.mapping.Namespaces)
+	if err != nil {
+		return nil, err
+	}
+	entity := NewEntity(id, 0)
+
+	if p.mapping.DeletedColumn != "" {
+		if v := cell(p.mapping.DeletedColumn); v != "" {
+			entity.IsDeleted, err = strconv.ParseBool(v)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", p.mapping.DeletedColumn, err)
+			}
+		}
+	}
+
+	for i, col := range p.mapping.Columns {
+		raw := cell(col.Column)
+		if raw == "" {
+			continue
+		}
+		values := []string{raw}
+		if col.ListSeparator != "" {
+			values = strings.Split(raw, col.ListSeparator)
+		}
+		for _, v := range values {
+			v = strings.TrimSpace(v)
+			if v == "" {
+				continue
+			}
+			if col.IsReference {
+				if col.ReferenceTemplate != "" {
+					if v, err = expandCSVTemplate(col.ReferenceTemplate, cell, v); err != nil {
+						return nil, err
+					}
+				}
+				ref, err := p.store.GetNamespacedIdentifier(v, p.mapping.Namespaces)
+				if err != nil {
+					return nil, fmt.Errorf("column %s: %w", col.Column, err)
+				}
+				addReferenceValue(entity.References, p.props[i], ref)
+				continue
+			}
+			value, err := csvValue(col.Type, v)
+			if err != nil {
+				return nil, fmt.Errorf("column %s: %w", col.Column, err)
+			}
+			addPropertyValue(entity.Properties, p.props[i], value)
+		}
+	}
+	return entity, nil
+}
+
+// expandCSVTemplate replaces {column} with the escaped value of the column, and {value} with the given value
+func expandCSVTemplate(template string, cell func(column string) string, value string) (string, error) {
+	var err error
+	result := csvTemplateVariable.ReplaceAllStringFunc(template, func(variable string) string {
+		name := variable[1 : len(variable)-1]
+		v := value
+		if name != "value" || value == "" {
+			v = cell(name)
+		}
+		if v == "" && err == nil {
+			err = fmt.Errorf("template %s has no value for %s", template, name)
+		}
+		return url.PathEscape(v)
+	})
+	return result, err
+}
+
+func csvValue(valueType string, v string) (interface{}, error) {
+	switch valueType {
+	case "integer":
+		i, err := strconv.ParseInt(v, 10, 64)
+		return float64(i), err
+	case "float":
+		return strconv.ParseFloat(v, 64)
+	case "boolean":
+		return strconv.ParseBool(v)
+	}
+	return v, nil
+}
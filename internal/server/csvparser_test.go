@@ -0,0 +1,120 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("The CSV stream parser", func() {
+	testCnt := 0
+	var storeLocation string
+	var store *Store
+	var people, countries string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_csv_parser_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = NewStore(e, &statsd.NoOpClient{})
+		people, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://example.com/people/")
+		countries, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://example.com/countries/")
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	mapping := func() *CSVMapping {
+		return &CSVMapping{
+			IDTemplate:    "p:{id}",
+			DeletedColumn: "removed",
+			Namespaces:    map[string]string{"p": "http://example.com/people/"},
+			Columns: []CSVColumnMapping{
+				{Column: "name", Property: "p:name"},
+				{Column: "age", Property: "http://example.com/people/age", Type: "integer"},
+				{Column: "nicks", Property: "p:nick", ListSeparator: "|"},
+				{
+					Column: "country", Property: "p:country", IsReference: true,
+					ReferenceTemplate: "http://example.com/countries/{value}",
+				},
+			},
+		}
+	}
+	parse := func(m *CSVMapping, doc string) ([]*Entity, error) {
+		p, err := NewCSVStreamParser(store, m)
+		if err != nil {
+			return nil, err
+		}
+		var result []*Entity
+		err = p.ParseStream(strings.NewReader(doc), func(e *Entity) error {
+			result = append(result, e)
+			return nil
+		})
+		return result, err
+	}
+
+	ginkgo.It("should map rows to entities", func() {
+		entities, err := parse(mapping(), "id,name,age,nicks,country,removed,ignored\n"+
+			"1,\"Smith, Jane\",42,jj|js,NO,false,x\n"+
+			"john doe,John,,,,true,\n")
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(2))
+		Expect(entities[0].ID).To(Equal(people + ":1"))
+		Expect(entities[0].Properties).To(Equal(map[string]interface{}{
+			people + ":name": "Smith, Jane",
+			people + ":age":  float64(42),
+			people + ":nick": []interface{}{"jj", "js"},
+		}))
+		Expect(entities[0].References[people+":country"]).To(Equal(countries + ":NO"))
+		Expect(entities[0].IsDeleted).To(BeFalse())
+
+		Expect(entities[1].ID).To(Equal(people + ":john%20doe"))
+		Expect(entities[1].Properties).To(HaveLen(1))
+		Expect(entities[1].IsDeleted).To(BeTrue())
+	})
+
+	ginkgo.It("should use the separator from the mapping", func() {
+		m := mapping()
+		m.Separator = ";"
+		entities, err := parse(m, "id;name;age;nicks;country;removed\n1;Jane;1;;;\n")
+		Expect(err).To(BeNil())
+		Expect(entities[0].Properties[people+":name"]).To(Equal("Jane"))
+	})
+
+	ginkgo.It("should reject invalid mappings and values", func() {
+		_, err := parse(&CSVMapping{}, "id\n1\n")
+		Expect(err).NotTo(BeNil())
+
+		_, err = parse(mapping(), "id,name\n1,Jane\n")
+		Expect(err).To(MatchError(ContainSubstring("column age is not in the csv header")))
+
+		_, err = parse(mapping(), "id,name,age,nicks,country,removed\n1,Jane,old,,,\n")
+		Expect(err).To(MatchError(ContainSubstring("row 2: column age")))
+
+		_, err = parse(mapping(), "id,name,age,nicks,country,removed\n,Jane,1,,,\n")
+		Expect(err).To(MatchError(ContainSubstring("no value for id")))
+	})
+})
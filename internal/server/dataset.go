@@ -22,6 +22,7 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"reflect"
 	"sync"
 	"sync/atomic"
 	"time"
@@ -35,14 +36,18 @@ type fullSyncLease struct {
 }
 
 type ProxyDatasetConfig struct {
-	RemoteURL           string `json:"remoteUrl"`
-	UpstreamTransform   string `json:"upstreamTransform"`
-	DownstreamTransform string `json:"downstreamTransform"`
-	AuthProviderName    string `json:"authProviderName"`
+	RemoteURL           string     `json:"remoteUrl"`
+	UpstreamTransform   string     `json:"upstreamTransform"`
+	DownstreamTransform string     `json:"downstreamTransform"`
+	AuthProviderName    string     `json:"authProviderName"`
+	RateLimit           *RateLimit `json:"rateLimit,omitempty"`
 }
 
 type VirtualDatasetConfig struct {
 	Transform string
+	// limits of one call to the transform, zero means no limit
+	TimeLimit  float64 // seconds
+	QueryLimit int
 }
 
 // Dataset data structure
@@ -64,6 +69,23 @@ type Dataset struct {
 	fullSyncID           string
 	ProxyConfig          *ProxyDatasetConfig   `json:"proxyConfig"`
 	VirtualDatasetConfig *VirtualDatasetConfig `json:"virtualDatasetConfig"`
+	Metadata             *DatasetMetadata      `json:"metadata,omitempty"`
+	metadataLock         sync.RWMutex          // guards Metadata, which is replaced when core.Dataset changes
+}
+
+// GetMetadata returns the catalogue metadata of the dataset. The metadata is replaced rather than changed,
+// so the result can be read without holding a lock.
+func (ds *Dataset) GetMetadata() *DatasetMetadata {
+	ds.metadataLock.RLock()
+	defer ds.metadataLock.RUnlock()
+	return ds.Metadata
+}
+
+// marshal returns the dataset as it is stored
+func (ds *Dataset) marshal() ([]byte, error) {
+	ds.metadataLock.RLock()
+	defer ds.metadataLock.RUnlock()
+	return json.Marshal(ds)
 }
 
 // NewDataset Create a new dataset from the params provided
@@ -758,6 +780,26 @@ func (ds *Dataset) updateDataset(newItemCount int64, entities []*Entity) error {
 			if err != nil {
 				return err
 			}
+			if dsInterface, found := ds.store.datasets.Load(dsEntity.Properties[dsInfo.NameKey]); found {
+				dataset := dsInterface.(*Dataset)
+				metadata := metadataFromEntity(dsEntity, dsInfo.DatasetPrefix)
+				var jsonData []byte
+				dataset.metadataLock.Lock()
+				if !reflect.DeepEqual(dataset.Metadata, metadata) {
+					dataset.Metadata = metadata
+					jsonData, err = json.Marshal(dataset)
+				}
+				dataset.metadataLock.Unlock()
+				if err != nil {
+					return err
+				}
+				if jsonData != nil {
+					err = ds.store.storeValue(dataset.getStorageKey(), jsonData)
+					if err != nil {
+						return err
+					}
+				}
+			}
 			newNamespaces := dsEntity.Properties[dsInfo.PublicNamespacesKey]
 			if newNamespaces != nil {
 				var newNamespacesArray []string
@@ -774,7 +816,7 @@ func (ds *Dataset) updateDataset(newItemCount int64, entities []*Entity) error {
 				if found {
 					dataset := dsInterface.(*Dataset)
 					dataset.PublicNamespaces = newNamespacesArray
-					jsonData, err := json.Marshal(dataset)
+					jsonData, err := dataset.marshal()
 					if err != nil {
 						return err
 					}
@@ -1037,6 +1079,19 @@ func (ds *Dataset) ProcessChangesRaw(
 	limit int,
 	latestOnly bool,
 	processChangedEntity func(entityJson []byte) error,
+) (uint64, error) {
+	return ds.ProcessFilteredChangesRaw(since, limit, latestOnly, nil, processChangedEntity)
+}
+
+// ProcessFilteredChangesRaw is ProcessChangesRaw with a resolved ChangesFilter applied. The limit
+// counts emitted changes, while the returned token is after the last change looked at, including
+// changes that were filtered out.
+func (ds *Dataset) ProcessFilteredChangesRaw(
+	since uint64,
+	limit int,
+	latestOnly bool,
+	filter *ChangesFilter,
+	processChangedEntity func(entityJson []byte) error,
 ) (uint64, error) {
 	lastSeen := since
 	foundChanges := false
@@ -1064,6 +1119,10 @@ func (ds *Dataset) ProcessChangesRaw(
 			processFn := func(entityChangeID []byte) error {
 				entityItem, _ := txn.Get(entityChangeID)
 				return entityItem.Value(func(jsonVal []byte) error {
+					jsonVal, ok, err := filter.Apply(jsonVal)
+					if err != nil || !ok {
+						return err
+					}
 					atomic.AddInt64(&processed, 1)
 					return processChangedEntity(jsonVal)
 				})
@@ -0,0 +1,382 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"reflect"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+const (
+	DiffAdded    = "added"
+	DiffRemoved  = "removed"
+	DiffModified = "modified"
+)
+
+// ValueDiff holds the value of a property or reference before and after a change.
+// A missing From means the value was added, a missing To means it was removed.
+type ValueDiff struct {
+	From any `json:"from,omitempty"`
+	To   any `json:"to,omitempty"`
+}
+
+// EntityDiff describes how a single entity differs between two dataset states
+type EntityDiff struct {
+	ID         string                `json:"id"`
+	Change     string                `json:"change"`
+	Properties map[string]*ValueDiff `json:"props,omitempty"`
+	References map[string]*ValueDiff `json:"refs,omitempty"`
+}
+
+// OffsetAtTime returns the change log offset of the first change recorded after the given time.
+// The returned offset can be used as a since value to get all changes after that point in time,
+// and describes the state of the dataset as it was at that time.
+func (ds *Dataset) OffsetAtTime(t time.Time) (uint64, error) {
+	ts := uint64(t.UnixNano())
+	var offset uint64
+
+	err := ds.store.database.View(func(txn *badger.Txn) error {
+		prefix := make([]byte, 6)
+		binary.BigEndian.PutUint16(prefix, DatasetEntityChangeLog)
+		binary.BigEndian.PutUint32(prefix[2:], ds.InternalID)
+
+		upper, found, err := ds.nextOffset(txn, prefix)
+		if err != nil || !found {
+			return err
+		}
+
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		// transaction times grow with the change log sequence, so we can binary search
+		// over offsets. gaps in the sequence are skipped by seeking to the next existing change.
+		lower := uint64(0)
+		seekKey := make([]byte, 14)
+		copy(seekKey, prefix)
+		for lower < upper {
+			mid := lower + (upper-lower)/2
+			binary.BigEndian.PutUint64(seekKey[6:], mid)
+			it.Seek(seekKey)
+			if !it.ValidForPrefix(prefix) {
+				upper = mid
+				continue
+			}
+			item := it.Item()
+			seq := binary.BigEndian.Uint64(item.Key()[6:14])
+			var txnTime uint64
+			err := item.Value(func(val []byte) error {
+				txnTime = binary.BigEndian.Uint64(val[14:22])
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			if txnTime > ts {
+				upper = mid
+			} else {
+				lower = seq + 1
+			}
+		}
+		offset = lower
+		return nil
+	})
+
+	return offset, err
+}
+
+// nextOffset returns the offset following the last change in the change log
+func (ds *Dataset) nextOffset(txn *badger.Txn, prefix []byte) (uint64, bool, error) {
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.PrefetchValues = false
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	it.Seek(append(append([]byte{}, prefix...), 0xFF))
+	if !it.ValidForPrefix(prefix) {
+		return 0, false, nil
+	}
+	return binary.BigEndian.Uint64(it.Item().Key()[6:14]) + 1, true, nil
+}
+
+// Diff compares the dataset as it was before offset from with the dataset as it was before offset to.
+// processDiff is called in internal id order for each entity that was added, removed or modified.
+// The latest entities are walked in order, and the version of each entity at from and to is looked up in the
+// entity index, so the diff is streamed without holding the change log in memory.
+func (ds *Dataset) Diff(from uint64, to uint64, processDiff func(diff *EntityDiff) error) error {
+	return ds.store.database.View(func(txn *badger.Txn) error {
+		fromBound, err := ds.versionBound(txn, from)
+		if err != nil {
+			return err
+		}
+		toBound, err := ds.versionBound(txn, to)
+		if err != nil {
+			return err
+		}
+		lowerBound := fromBound
+		if bytes.Compare(toBound, lowerBound) < 0 {
+			lowerBound = toBound
+		}
+
+		prefix := make([]byte, 6)
+		binary.BigEndian.PutUint16(prefix, DatasetLatestEntities)
+		binary.BigEndian.PutUint32(prefix[2:], ds.InternalID)
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+
+		versionOpts := badger.DefaultIteratorOptions
+		versionOpts.Reverse = true
+		versionOpts.PrefetchValues = false
+		versions := txn.NewIterator(versionOpts)
+		defer versions.Close()
+
+		for it.Rewind(); it.ValidForPrefix(prefix); it.Next() {
+			latestKey, err := it.Item().ValueCopy(nil)
+			if err != nil {
+				return err
+			}
+			// entities not changed since the earlier of the two offsets are the same in both
+			if bytes.Compare(latestKey[14:], lowerBound) <= 0 {
+				continue
+			}
+			rid := binary.BigEndian.Uint64(it.Item().Key()[6:])
+			fromKey := ds.versionAt(versions, rid, fromBound)
+			toKey := ds.versionAt(versions, rid, toBound)
+			if fromKey != nil && bytes.Equal(fromKey, toKey) {
+				continue
+			}
+			err = diffEntityVersions(txn, fromKey, toKey, processDiff)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// versionBound returns the transaction time and batch sequence of the last change before offset, which is the
+// newest entity version that is part of the dataset as it was before offset. It is nil if there are no changes
+// before offset.
+func (ds *Dataset) versionBound(txn *badger.Txn, offset uint64) ([]byte, error) {
+	if offset == 0 {
+		return nil, nil
+	}
+	prefix := make([]byte, 6)
+	binary.BigEndian.PutUint16(prefix, DatasetEntityChangeLog)
+	binary.BigEndian.PutUint32(prefix[2:], ds.InternalID)
+	opts := badger.DefaultIteratorOptions
+	opts.Reverse = true
+	opts.Prefix = prefix
+	it := txn.NewIterator(opts)
+	defer it.Close()
+
+	seekKey := make([]byte, 22)
+	copy(seekKey, prefix)
+	binary.BigEndian.PutUint64(seekKey[6:], offset-1)
+	binary.BigEndian.PutUint64(seekKey[14:], math.MaxUint64)
+	it.Seek(seekKey)
+	if !it.ValidForPrefix(prefix) {
+		return nil, nil
+	}
+	entityKey, err := it.Item().ValueCopy(nil)
+	if err != nil {
+		return nil, err
+	}
+	return entityKey[14:], nil
+}
+
+// versionAt returns the key of the newest version of an entity in this dataset that is not newer than bound,
+// using a reverse iterator over the entity index
+func (ds *Dataset) versionAt(versions *badger.Iterator, rid uint64, bound []byte) []byte {
+	if bound == nil {
+		return nil
+	}
+	prefix := make([]byte, 14)
+	binary.BigEndian.PutUint16(prefix, EntityIDToJSONIndexID)
+	binary.BigEndian.PutUint64(prefix[2:], rid)
+	binary.BigEndian.PutUint32(prefix[10:], ds.InternalID)
+	versions.Seek(append(append([]byte{}, prefix...), bound...))
+	if !versions.ValidForPrefix(prefix) {
+		return nil
+	}
+	return versions.Item().KeyCopy(nil)
+}
+
+// DiffDataset compares the latest entities in the dataset with the latest entities in other.
+// Entities only found in other are reported as added, entities only found in this dataset as removed.
+func (ds *Dataset) DiffDataset(other *Dataset, processDiff func(diff *EntityDiff) error) error {
+	return ds.store.database.View(func(txn *badger.Txn) error {
+		prefix := make([]byte, 6)
+		binary.BigEndian.PutUint16(prefix, DatasetLatestEntities)
+		binary.BigEndian.PutUint32(prefix[2:], ds.InternalID)
+		otherPrefix := make([]byte, 6)
+		binary.BigEndian.PutUint16(otherPrefix, DatasetLatestEntities)
+		binary.BigEndian.PutUint32(otherPrefix[2:], other.InternalID)
+
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		otherOpts := badger.DefaultIteratorOptions
+		otherOpts.Prefix = otherPrefix
+		otherIt := txn.NewIterator(otherOpts)
+		defer otherIt.Close()
+
+		// both indexes are ordered by internal id, so we can walk them side by side
+		it.Rewind()
+		otherIt.Rewind()
+		for it.ValidForPrefix(prefix) || otherIt.ValidForPrefix(otherPrefix) {
+			var fromKey, toKey []byte
+			var err error
+			switch {
+			case !otherIt.ValidForPrefix(otherPrefix):
+				fromKey, err = it.Item().ValueCopy(nil)
+				it.Next()
+			case !it.ValidForPrefix(prefix):
+				toKey, err = otherIt.Item().ValueCopy(nil)
+				otherIt.Next()
+			default:
+				rid := binary.BigEndian.Uint64(it.Item().Key()[6:])
+				otherRid := binary.BigEndian.Uint64(otherIt.Item().Key()[6:])
+				if rid <= otherRid {
+					fromKey, err = it.Item().ValueCopy(nil)
+					it.Next()
+				}
+				if err == nil && otherRid <= rid {
+					toKey, err = otherIt.Item().ValueCopy(nil)
+					otherIt.Next()
+				}
+			}
+			if err != nil {
+				return err
+			}
+			err = diffEntityVersions(txn, fromKey, toKey, processDiff)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+func diffEntityVersions(txn *badger.Txn, fromKey []byte, toKey []byte, processDiff func(diff *EntityDiff) error) error {
+	prevJSON, prev, err := loadEntityVersion(txn, fromKey)
+	if err != nil {
+		return err
+	}
+	nextJSON, next, err := loadEntityVersion(txn, toKey)
+	if err != nil {
+		return err
+	}
+	diff := DiffEntities(prevJSON, nextJSON, prev, next)
+	if diff == nil {
+		return nil
+	}
+	return processDiff(diff)
+}
+
+func loadEntityVersion(txn *badger.Txn, entityKey []byte) ([]byte, *Entity, error) {
+	if entityKey == nil {
+		return nil, nil, nil
+	}
+	item, err := txn.Get(entityKey)
+	if err != nil {
+		return nil, nil, err
+	}
+	jsonData, err := item.ValueCopy(nil)
+	if err != nil {
+		return nil, nil, err
+	}
+	e := &Entity{}
+	err = json.Unmarshal(jsonData, e)
+	if err != nil {
+		return nil, nil, err
+	}
+	return jsonData, e, nil
+}
+
+// DiffEntities returns the differences between two versions of an entity, or nil if they are equal.
+// A nil or deleted version is treated as the entity not being present.
+func DiffEntities(prevJson []byte, thisJson []byte, prevEntity *Entity, thisEntity *Entity) *EntityDiff {
+	prevExists := prevEntity != nil && !prevEntity.IsDeleted
+	thisExists := thisEntity != nil && !thisEntity.IsDeleted
+
+	diff := &EntityDiff{}
+	switch {
+	case !prevExists && !thisExists:
+		return nil
+	case !prevExists:
+		diff.ID = thisEntity.ID
+		diff.Change = DiffAdded
+		diff.Properties = diffValues(nil, thisEntity.Properties)
+		diff.References = diffValues(nil, thisEntity.References)
+	case !thisExists:
+		diff.ID = prevEntity.ID
+		diff.Change = DiffRemoved
+		diff.Properties = diffValues(prevEntity.Properties, nil)
+		diff.References = diffValues(prevEntity.References, nil)
+	default:
+		if len(prevEntity.Properties) == len(thisEntity.Properties) &&
+			len(prevEntity.References) == len(thisEntity.References) &&
+			IsEntityEqual(prevJson, thisJson, prevEntity, thisEntity) {
+			return nil
+		}
+		diff.ID = thisEntity.ID
+		diff.Change = DiffModified
+		diff.Properties = diffValues(prevEntity.Properties, thisEntity.Properties)
+		diff.References = diffValues(prevEntity.References, thisEntity.References)
+		if len(diff.Properties) == 0 && len(diff.References) == 0 {
+			return nil
+		}
+	}
+	return diff
+}
+
+func diffValues(prev map[string]interface{}, this map[string]interface{}) map[string]*ValueDiff {
+	result := make(map[string]*ValueDiff)
+	for k, v := range prev {
+		thisVal, ok := this[k]
+		if !ok {
+			result[k] = &ValueDiff{From: v}
+			continue
+		}
+		v1, _ := toJsonValue(v)
+		v2, _ := toJsonValue(thisVal)
+		if !reflect.DeepEqual(v1, v2) {
+			result[k] = &ValueDiff{From: v, To: thisVal}
+		}
+	}
+	for k, v := range this {
+		if _, ok := prev[k]; !ok {
+			result[k] = &ValueDiff{To: v}
+		}
+	}
+	if len(result) == 0 {
+		return nil
+	}
+	return result
+}
@@ -0,0 +1,171 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("A dataset diff", func() {
+	testCnt := 0
+	var storeLocation string
+	var store *Store
+	var dsm *DsManager
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_dataset_diff_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = NewStore(e, &statsd.NoOpClient{})
+		dsm = NewDsManager(e, store, NoOpBus())
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	person := func(id string, name string, deleted bool) *Entity {
+		e := NewEntity("http://data.mimiro.io/people/"+id, 0)
+		e.Properties["http://data.mimiro.io/people/name"] = name
+		e.References["http://data.mimiro.io/people/worksfor"] = "http://data.mimiro.io/company/c1"
+		e.IsDeleted = deleted
+		return e
+	}
+	collect := func(diffs *[]*EntityDiff) func(diff *EntityDiff) error {
+		return func(diff *EntityDiff) error {
+			*diffs = append(*diffs, diff)
+			return nil
+		}
+	}
+
+	ginkgo.It("should report added, removed and modified entities between two offsets", func() {
+		ds, _ := dsm.CreateDataset("people", nil)
+		Expect(ds.StoreEntities([]*Entity{person("p1", "Frank", false), person("p2", "Jim", false)})).To(Succeed())
+		middle, err := ds.OffsetAtTime(time.Now())
+		Expect(err).To(BeNil())
+		Expect(middle).To(Equal(uint64(2)))
+
+		Expect(ds.StoreEntities([]*Entity{
+			person("p1", "Frank", false),
+			person("p2", "James", false),
+			person("p3", "Bob", false),
+		})).To(Succeed())
+
+		var diffs []*EntityDiff
+		Expect(ds.Diff(middle, 100, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(HaveLen(2))
+		Expect(diffs[0].Change).To(Equal(DiffModified))
+		Expect(diffs[0].ID).To(Equal("http://data.mimiro.io/people/p2"))
+		Expect(diffs[0].References).To(BeNil())
+		Expect(diffs[0].Properties).To(HaveLen(1))
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].From).To(Equal("Jim"))
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].To).To(Equal("James"))
+		Expect(diffs[1].Change).To(Equal(DiffAdded))
+		Expect(diffs[1].ID).To(Equal("http://data.mimiro.io/people/p3"))
+		Expect(diffs[1].References["http://data.mimiro.io/people/worksfor"].To).
+			To(Equal("http://data.mimiro.io/company/c1"))
+
+		Expect(ds.StoreEntities([]*Entity{person("p1", "Frank", true)})).To(Succeed())
+		diffs = nil
+		Expect(ds.Diff(0, 100, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(HaveLen(2), "p1 was deleted, so only p2 and p3 are added from an empty dataset")
+
+		diffs = nil
+		Expect(ds.Diff(middle, 100, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(HaveLen(3))
+		Expect(diffs[0].Change).To(Equal(DiffRemoved))
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].From).To(Equal("Frank"))
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].To).To(BeNil())
+	})
+
+	ginkgo.It("should use the versions at each offset, not the latest", func() {
+		ds, _ := dsm.CreateDataset("people", nil)
+		Expect(ds.StoreEntities([]*Entity{person("p1", "Frank", false), person("p2", "Jim", false)})).To(Succeed())
+		Expect(ds.StoreEntities([]*Entity{person("p2", "James", false)})).To(Succeed())
+		Expect(ds.StoreEntities([]*Entity{person("p2", "Jimmy", false), person("p3", "Bob", false)})).To(Succeed())
+
+		var diffs []*EntityDiff
+		Expect(ds.Diff(1, 3, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(HaveLen(1), "p1 did not change, p3 came later")
+		Expect(diffs[0].Change).To(Equal(DiffAdded))
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].To).To(Equal("James"))
+
+		diffs = nil
+		Expect(ds.Diff(5, 3, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(HaveLen(2), "diffs can go back in time")
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].From).To(Equal("Jimmy"))
+		Expect(diffs[0].Properties["http://data.mimiro.io/people/name"].To).To(Equal("James"))
+		Expect(diffs[1].Change).To(Equal(DiffRemoved))
+
+		diffs = nil
+		Expect(ds.Diff(3, 3, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(BeEmpty())
+	})
+
+	ginkgo.It("should resolve timestamps to offsets", func() {
+		ds, _ := dsm.CreateDataset("people", nil)
+		offset, err := ds.OffsetAtTime(time.Now())
+		Expect(err).To(BeNil())
+		Expect(offset).To(Equal(uint64(0)))
+
+		before := time.Now()
+		Expect(ds.StoreEntities([]*Entity{person("p1", "Frank", false)})).To(Succeed())
+		time.Sleep(5 * time.Millisecond)
+		between := time.Now()
+		Expect(ds.StoreEntities([]*Entity{person("p2", "Jim", false)})).To(Succeed())
+
+		offset, _ = ds.OffsetAtTime(before)
+		Expect(offset).To(Equal(uint64(0)))
+		offset, _ = ds.OffsetAtTime(between)
+		Expect(offset).To(Equal(uint64(1)))
+		offset, _ = ds.OffsetAtTime(time.Now())
+		Expect(offset).To(Equal(uint64(2)))
+	})
+
+	ginkgo.It("should compare the latest entities of two datasets", func() {
+		ds, _ := dsm.CreateDataset("people", nil)
+		other, _ := dsm.CreateDataset("people2", nil)
+		Expect(ds.StoreEntities([]*Entity{
+			person("p1", "Frank", false),
+			person("p2", "Jim", false),
+			person("p3", "Bob", false),
+		})).To(Succeed())
+		Expect(other.StoreEntities([]*Entity{
+			person("p2", "Jim", false),
+			person("p3", "Bobby", false),
+			person("p4", "Alice", false),
+		})).To(Succeed())
+
+		var diffs []*EntityDiff
+		Expect(ds.DiffDataset(other, collect(&diffs))).To(Succeed())
+		Expect(diffs).To(HaveLen(3))
+		Expect(diffs[0].ID).To(Equal("http://data.mimiro.io/people/p1"))
+		Expect(diffs[0].Change).To(Equal(DiffRemoved))
+		Expect(diffs[1].ID).To(Equal("http://data.mimiro.io/people/p3"))
+		Expect(diffs[1].Change).To(Equal(DiffModified))
+		Expect(diffs[2].ID).To(Equal("http://data.mimiro.io/people/p4"))
+		Expect(diffs[2].Change).To(Equal(DiffAdded))
+	})
+})
@@ -0,0 +1,189 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"strings"
+)
+
+// DatasetMetadata is the catalogue information attached to a dataset. It is stored on the
+// dataset's meta-entity in core.Dataset, and kept in sync with it.
+type DatasetMetadata struct {
+	Description    string         `json:"description,omitempty"`
+	Owners         []string       `json:"owners,omitempty"`
+	Tags           []string       `json:"tags,omitempty"`
+	Classification string         `json:"classification,omitempty"`
+	Custom         map[string]any `json:"custom,omitempty"`
+}
+
+// DatasetMetadataFilter selects datasets by their metadata. Empty fields match all datasets.
+// Query is matched case-insensitively against the dataset name, description, owners, tags,
+// classification and custom field values.
+type DatasetMetadataFilter struct {
+	Tag            string
+	Owner          string
+	Classification string
+	Query          string
+}
+
+const customMetadataKey = "custom/"
+
+func (f DatasetMetadataFilter) IsEmpty() bool {
+	return f.Tag == "" && f.Owner == "" && f.Classification == "" && f.Query == ""
+}
+
+// Matches returns true if the named dataset with the given metadata satisfies the filter
+func (f DatasetMetadataFilter) Matches(name string, metadata *DatasetMetadata) bool {
+	if f.IsEmpty() {
+		return true
+	}
+	if metadata == nil {
+		metadata = &DatasetMetadata{}
+	}
+	if f.Tag != "" && !containsFold(metadata.Tags, f.Tag) {
+		return false
+	}
+	if f.Owner != "" && !containsFold(metadata.Owners, f.Owner) {
+		return false
+	}
+	if f.Classification != "" && !strings.EqualFold(metadata.Classification, f.Classification) {
+		return false
+	}
+	if f.Query != "" {
+		q := strings.ToLower(f.Query)
+		candidates := []string{name, metadata.Description, metadata.Classification}
+		candidates = append(candidates, metadata.Owners...)
+		candidates = append(candidates, metadata.Tags...)
+		for _, v := range metadata.Custom {
+			candidates = append(candidates, fmt.Sprint(v))
+		}
+		for _, c := range candidates {
+			if strings.Contains(strings.ToLower(c), q) {
+				return true
+			}
+		}
+		return false
+	}
+	return true
+}
+
+// FilterDatasetNames returns the datasets in names whose metadata matches the filter
+func (dsm *DsManager) FilterDatasetNames(names []DatasetName, filter DatasetMetadataFilter) []DatasetName {
+	if filter.IsEmpty() {
+		return names
+	}
+	result := make([]DatasetName, 0)
+	for _, n := range names {
+		ds := dsm.GetDataset(n.Name)
+		if ds != nil && filter.Matches(n.Name, ds.GetMetadata()) {
+			result = append(result, n)
+		}
+	}
+	return result
+}
+
+// setMetadataProperties replaces the metadata properties of a core.Dataset entity
+func setMetadataProperties(entity *Entity, prefix string, metadata *DatasetMetadata) {
+	for k := range entity.Properties {
+		if strings.HasPrefix(k, prefix+":"+customMetadataKey) {
+			delete(entity.Properties, k)
+		}
+	}
+	for _, k := range []string{"description", "owners", "tags", "classification"} {
+		delete(entity.Properties, prefix+":"+k)
+	}
+	if metadata == nil {
+		return
+	}
+
+	if metadata.Description != "" {
+		entity.Properties[prefix+":description"] = metadata.Description
+	}
+	if len(metadata.Owners) > 0 {
+		entity.Properties[prefix+":owners"] = metadata.Owners
+	}
+	if len(metadata.Tags) > 0 {
+		entity.Properties[prefix+":tags"] = metadata.Tags
+	}
+	if metadata.Classification != "" {
+		entity.Properties[prefix+":classification"] = metadata.Classification
+	}
+	for k, v := range metadata.Custom {
+		entity.Properties[prefix+":"+customMetadataKey+k] = v
+	}
+}
+
+// metadataFromEntity reads the metadata properties of a core.Dataset entity. nil is returned
+// if the entity carries no metadata.
+func metadataFromEntity(entity *Entity, prefix string) *DatasetMetadata {
+	metadata := &DatasetMetadata{}
+	found := false
+	if v, ok := entity.Properties[prefix+":description"].(string); ok {
+		metadata.Description = v
+		found = true
+	}
+	if v, ok := entity.Properties[prefix+":owners"]; ok {
+		metadata.Owners = toStringSlice(v)
+		found = true
+	}
+	if v, ok := entity.Properties[prefix+":tags"]; ok {
+		metadata.Tags = toStringSlice(v)
+		found = true
+	}
+	if v, ok := entity.Properties[prefix+":classification"].(string); ok {
+		metadata.Classification = v
+		found = true
+	}
+	customPrefix := prefix + ":" + customMetadataKey
+	for k, v := range entity.Properties {
+		if strings.HasPrefix(k, customPrefix) {
+			if metadata.Custom == nil {
+				metadata.Custom = make(map[string]any)
+			}
+			metadata.Custom[strings.TrimPrefix(k, customPrefix)] = v
+			found = true
+		}
+	}
+	if !found {
+		return nil
+	}
+	return metadata
+}
+
+func toStringSlice(value any) []string {
+	switch v := value.(type) {
+	case []string:
+		return v
+	case string:
+		return []string{v}
+	case []any:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			result = append(result, fmt.Sprint(item))
+		}
+		return result
+	}
+	return nil
+}
+
+func containsFold(values []string, value string) bool {
+	for _, v := range values {
+		if strings.EqualFold(v, value) {
+			return true
+		}
+	}
+	return false
+}
@@ -62,6 +62,7 @@ func (dsm *DsManager) NewDatasetEntity(
 	proxyDatasetConfig *ProxyDatasetConfig,
 	virtualDatasetConfig *VirtualDatasetConfig,
 	publicNamespaces []string,
+	metadata *DatasetMetadata,
 ) *Entity {
 	prefix, _ := dsm.store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/core/dataset/")
 	core, _ := dsm.store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/core/")
@@ -88,6 +89,8 @@ func (dsm *DsManager) NewDatasetEntity(
 		entity.Properties[prefix+":publicNamespaces"] = publicNamespaces
 	}
 
+	setMetadataProperties(entity, prefix, metadata)
+
 	return entity
 }
 
@@ -102,10 +105,12 @@ type CreateDatasetConfig struct {
 	ProxyDatasetConfig   *ProxyDatasetConfig   `json:"ProxyDatasetConfig"`
 	VirtualDatasetConfig *VirtualDatasetConfig `json:"VirtualDatasetConfig"`
 	PublicNamespaces     []string              `json:"publicNamespaces"`
+	Metadata             *DatasetMetadata      `json:"metadata"`
 }
 
 type UpdateDatasetConfig struct {
-	ID string // update id/name
+	ID       string           // update id/name
+	Metadata *DatasetMetadata `json:"metadata"` // replaces the catalogue metadata if given
 }
 
 func (dsm *DsManager) CreateDataset(name string, createDatasetConfig *CreateDatasetConfig) (*Dataset, error) {
@@ -131,6 +136,7 @@ func (dsm *DsManager) CreateDataset(name string, createDatasetConfig *CreateData
 		ds.ProxyConfig = createDatasetConfig.ProxyDatasetConfig
 		ds.PublicNamespaces = createDatasetConfig.PublicNamespaces
 		ds.VirtualDatasetConfig = createDatasetConfig.VirtualDatasetConfig
+		ds.Metadata = createDatasetConfig.Metadata
 	}
 
 	jsonData, _ := json.Marshal(ds)
@@ -141,13 +147,14 @@ func (dsm *DsManager) CreateDataset(name string, createDatasetConfig *CreateData
 
 	dsm.store.datasets.Store(name, ds)
 	dsm.store.datasetsByInternalID.Store(ds.InternalID, ds)
+	ds.configureRateLimit()
 
 	// need to add the event publisher topic
 	dsm.logger.Infof("Registering dataset." + name)
 	dsm.eb.RegisterTopic(name)
 
 	// add the entity
-	ent := dsm.NewDatasetEntity(name, ds.ProxyConfig, ds.VirtualDatasetConfig, ds.PublicNamespaces)
+	ent := dsm.NewDatasetEntity(name, ds.ProxyConfig, ds.VirtualDatasetConfig, ds.PublicNamespaces, ds.Metadata)
 
 	core := dsm.GetDataset(datasetCore)
 	err = dsm.storeEntity(core, ent)
@@ -177,7 +184,7 @@ func (dsm *DsManager) UpdateDataset(name string, config *UpdateDatasetConfig) (*
 	defer ds.WriteLock.Unlock()
 
 	// new ID means rename
-	if config.ID != name {
+	if config.ID != "" && config.ID != name {
 		newName := config.ID
 		newExists := dsm.IsDataset(newName)
 		if newExists {
@@ -189,7 +196,7 @@ func (dsm *DsManager) UpdateDataset(name string, config *UpdateDatasetConfig) (*
 		// update stored datasets
 		ds.ID = newName
 		ds.SubjectIdentifier = "http://data.mimiro.io/datasets/" + newName
-		jsonData, _ := json.Marshal(ds)
+		jsonData, _ := ds.marshal()
 		newKey := ds.getStorageKey()
 		err := dsm.store.moveValue(oldKey, newKey, jsonData)
 		if err != nil {
@@ -199,6 +206,8 @@ func (dsm *DsManager) UpdateDataset(name string, config *UpdateDatasetConfig) (*
 		// update in local cache
 		dsm.store.datasets.Delete(name)
 		dsm.store.datasets.Store(newName, ds)
+		dsm.store.RateLimiters.Remove(rateLimitOwner(name))
+		ds.configureRateLimit()
 		dsm.store.datasetsByInternalID.Store(ds.InternalID, ds)
 
 		// update eventbus
@@ -231,6 +240,28 @@ func (dsm *DsManager) UpdateDataset(name string, config *UpdateDatasetConfig) (*
 		}
 		dsm.eb.Emit(context.Background(), "dataset.core.Dataset", nil)
 	}
+
+	if config.Metadata != nil {
+		// the dataset itself is updated from the stored entity, see Dataset.updateDataset
+		core := dsm.GetDataset(datasetCore)
+		dsInfo, err := ds.store.NamespaceManager.GetDatasetNamespaceInfo()
+		if err != nil {
+			return nil, err
+		}
+		entity, err := dsm.store.GetEntity(dsInfo.DatasetPrefix+":"+ds.ID, []string{datasetCore}, true)
+		if err != nil {
+			return nil, err
+		}
+		if entity == nil {
+			entity = dsm.NewDatasetEntity(ds.ID, ds.ProxyConfig, ds.VirtualDatasetConfig, ds.PublicNamespaces, nil)
+		}
+		setMetadataProperties(entity, dsInfo.DatasetPrefix, config.Metadata)
+		err = dsm.storeEntity(core, entity)
+		if err != nil {
+			return nil, err
+		}
+		dsm.eb.Emit(context.Background(), "dataset.core.Dataset", nil)
+	}
 	return ds, nil
 }
 
@@ -254,6 +285,7 @@ func (dsm *DsManager) DeleteDataset(name string) error {
 	// delete from local cache
 	dsm.store.datasets.Delete(name)
 	dsm.store.datasetsByInternalID.Delete(existingDataset.InternalID)
+	dsm.store.RateLimiters.Remove(rateLimitOwner(name))
 	key := existingDataset.getStorageKey()
 	err := dsm.store.deleteValue(key)
 	if err != nil {
@@ -277,7 +309,7 @@ func (dsm *DsManager) DeleteDataset(name string) error {
 	dsm.eb.UnregisterTopic(name) // unregister event-handler on this topic. Note that subscriptions are left.
 
 	// also delete the associated entity
-	entity, err2 := dsm.store.GetEntity(dsm.NewDatasetEntity(name, nil, nil, nil).ID, []string{datasetCore}, true)
+	entity, err2 := dsm.store.GetEntity(dsm.NewDatasetEntity(name, nil, nil, nil, nil).ID, []string{datasetCore}, true)
 	if err2 != nil {
 		return err2
 	}
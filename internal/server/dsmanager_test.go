@@ -20,6 +20,7 @@ import (
 	"math"
 	"os"
 	"reflect"
+	"sync"
 	"time"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
@@ -319,4 +320,90 @@ var _ = ginkgo.Describe("The dataset manager", func() {
 			Expect(dsContentNew).To(Equal(dsContent))
 		})
 	})
+
+	ginkgo.Describe("dataset metadata", func() {
+		ginkgo.It("should store metadata on the core.Dataset entity", func() {
+			_, err := dsm.CreateDataset("people", &CreateDatasetConfig{Metadata: &DatasetMetadata{
+				Description: "All known people",
+				Owners:      []string{"team-a"},
+				Tags:        []string{"hr", "pii"},
+				Custom:      map[string]any{"source": "crm"},
+			}})
+			Expect(err).To(BeNil())
+
+			details, found, err := dsm.GetDatasetDetails("people")
+			Expect(err).To(BeNil())
+			Expect(found).To(BeTrue())
+			Expect(details.Properties["ns0:description"]).To(Equal("All known people"))
+			Expect(details.Properties["ns0:tags"]).To(Equal([]any{"hr", "pii"}))
+			Expect(details.Properties["ns0:custom/source"]).To(Equal("crm"))
+		})
+
+		ginkgo.It("should replace metadata on update and keep the dataset in sync", func() {
+			_, _ = dsm.CreateDataset("people", &CreateDatasetConfig{Metadata: &DatasetMetadata{Tags: []string{"hr"}}})
+			_, err := dsm.UpdateDataset("people", &UpdateDatasetConfig{Metadata: &DatasetMetadata{
+				Owners:         []string{"team-b"},
+				Classification: "internal",
+			}})
+			Expect(err).To(BeNil())
+			Expect(dsm.GetDataset("people")).NotTo(BeNil(), "update without id should not rename")
+			Expect(dsm.GetDataset("people").Metadata).To(Equal(&DatasetMetadata{
+				Owners:         []string{"team-b"},
+				Classification: "internal",
+			}))
+
+			details, _, _ := dsm.GetDatasetDetails("people")
+			Expect(details.Properties).NotTo(HaveKey("ns0:tags"))
+			Expect(details.Properties["ns0:classification"]).To(Equal("internal"))
+
+			// metadata must survive restarts
+			_ = store.Close()
+			Expect(store.Open()).To(Succeed())
+			Expect(dsm.GetDataset("people").Metadata.Owners).To(Equal([]string{"team-b"}))
+		})
+
+		ginkgo.It("should filter dataset names on metadata", func() {
+			_, _ = dsm.CreateDataset("people", &CreateDatasetConfig{Metadata: &DatasetMetadata{
+				Owners: []string{"team-a"}, Tags: []string{"hr"}, Description: "Employees and contractors",
+			}})
+			_, _ = dsm.CreateDataset("places", &CreateDatasetConfig{Metadata: &DatasetMetadata{
+				Owners: []string{"team-b"}, Tags: []string{"geo"},
+			}})
+			_, _ = dsm.CreateDataset("things", nil)
+
+			names := dsm.GetDatasetNames()
+			Expect(dsm.FilterDatasetNames(names, DatasetMetadataFilter{})).To(HaveLen(4))
+			Expect(dsm.FilterDatasetNames(names, DatasetMetadataFilter{Tag: "HR"})).
+				To(Equal([]DatasetName{{Name: "people"}}))
+			Expect(dsm.FilterDatasetNames(names, DatasetMetadataFilter{Owner: "team-b"})).
+				To(Equal([]DatasetName{{Name: "places"}}))
+			Expect(dsm.FilterDatasetNames(names, DatasetMetadataFilter{Query: "contractor"})).
+				To(Equal([]DatasetName{{Name: "people"}}))
+			Expect(dsm.FilterDatasetNames(names, DatasetMetadataFilter{Query: "thin"})).
+				To(Equal([]DatasetName{{Name: "things"}}))
+			Expect(dsm.FilterDatasetNames(names, DatasetMetadataFilter{Tag: "hr", Owner: "team-b"})).To(BeEmpty())
+		})
+
+		ginkgo.It("should filter dataset names while metadata is updated", func() {
+			_, _ = dsm.CreateDataset("people", &CreateDatasetConfig{Metadata: &DatasetMetadata{Tags: []string{"hr"}}})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer ginkgo.GinkgoRecover()
+				defer wg.Done()
+				for i := 0; i < 20; i++ {
+					_, err := dsm.UpdateDataset("people", &UpdateDatasetConfig{Metadata: &DatasetMetadata{
+						Tags: []string{"hr"}, Description: fmt.Sprintf("version %v", i),
+					}})
+					Expect(err).To(BeNil())
+				}
+			}()
+			for i := 0; i < 200; i++ {
+				Expect(dsm.FilterDatasetNames(dsm.GetDatasetNames(), DatasetMetadataFilter{Tag: "hr"})).
+					To(Equal([]DatasetName{{Name: "people"}}))
+			}
+			wg.Wait()
+			Expect(dsm.GetDataset("people").GetMetadata().Description).To(Equal("version 19"))
+		})
+	})
 })
@@ -0,0 +1,355 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"strings"
+	"time"
+)
+
+const (
+	MaxGraphDepth            = 10
+	DefaultPathLimit         = 10
+	DefaultNeighbourhood     = 1000 // default max number of nodes in a neighbourhood
+	MaxNeighbourhoodLimit    = 10000
+	defaultNeighbourhoodHops = 1
+)
+
+// GraphEdge is a reference from one entity to another
+type GraphEdge struct {
+	From      string `json:"from"`
+	Predicate string `json:"predicate"`
+	To        string `json:"to"`
+}
+
+// Graph is a set of entities and the references between them
+type Graph struct {
+	Nodes     []*Entity   `json:"nodes"`
+	Edges     []GraphEdge `json:"edges"`
+	Truncated bool        `json:"truncated"` // true when the node limit stopped the exploration
+}
+
+// GraphFilter limits which references graph queries follow. References are followed in both directions
+// unless Directed is set, in which case only outgoing references are followed.
+type GraphFilter struct {
+	Predicates []string `json:"predicates"`
+	Datasets   []string `json:"datasets"`
+	Directed   bool     `json:"directed"`
+}
+
+type edge struct {
+	from, predicate, to uint64
+}
+
+// graphWalker finds the references of entities at one point in time, using the incoming and outgoing reference indexes
+type graphWalker struct {
+	store      *Store
+	predicates map[uint64]bool // nil means all
+	datasets   []uint32
+	directed   bool
+	at         int64
+}
+
+func (s *Store) newGraphWalker(filter GraphFilter) (*graphWalker, error) {
+	w := &graphWalker{
+		store:    s,
+		datasets: s.DatasetsToInternalIDs(filter.Datasets),
+		directed: filter.Directed,
+		at:       time.Now().UnixNano(),
+	}
+	if len(filter.Datasets) > 0 && len(w.datasets) == 0 {
+		return nil, errors.New("none of the datasets exist")
+	}
+	if len(filter.Predicates) > 0 {
+		w.predicates = make(map[uint64]bool, len(filter.Predicates))
+		txn := s.database.NewTransaction(false)
+		defer txn.Discard()
+		for _, p := range filter.Predicates {
+			curie := resolveIdentifier(s.NamespaceManager, p)
+			if curie == unresolvable {
+				continue
+			}
+			pid, exists, err := s.getIDForURI(txn, curie)
+			if err != nil {
+				return nil, err
+			}
+			if exists {
+				w.predicates[pid] = true
+			}
+		}
+	}
+	return w, nil
+}
+
+// edges returns the references to and from an entity that pass the filter
+func (w *graphWalker) edges(id uint64) ([]edge, error) {
+	if w.predicates != nil && len(w.predicates) == 0 {
+		return nil, nil
+	}
+	directions := []bool{false, true}
+	if w.directed {
+		directions = directions[:1]
+	}
+	result := make([]edge, 0)
+	for _, inverse := range directions {
+		searchBuffer := make([]byte, 10)
+		if inverse {
+			binary.BigEndian.PutUint16(searchBuffer, IncomingRefIndex)
+		} else {
+			binary.BigEndian.PutUint16(searchBuffer, OutgoingRefIndex)
+		}
+		binary.BigEndian.PutUint64(searchBuffer[2:], id)
+		relations, _, err := w.store.GetRelatedAtTime(&RelatedFrom{
+			RelationIndexFromKey: searchBuffer,
+			Inverse:              inverse,
+			Datasets:             w.datasets,
+			At:                   w.at,
+		}, 0)
+		if err != nil {
+			return nil, err
+		}
+		for _, r := range relations {
+			if w.predicates != nil && !w.predicates[r.PredicateID] {
+				continue
+			}
+			if inverse {
+				result = append(result, edge{from: r.EntityID, predicate: r.PredicateID, to: id})
+			} else {
+				result = append(result, edge{from: id, predicate: r.PredicateID, to: r.EntityID})
+			}
+		}
+	}
+	return result, nil
+}
+
+func (w *graphWalker) graphEdge(e edge) (GraphEdge, error) {
+	from, err := w.store.getURIForID(e.from)
+	if err != nil {
+		return GraphEdge{}, err
+	}
+	predicate, err := w.store.getURIForID(e.predicate)
+	if err != nil {
+		return GraphEdge{}, err
+	}
+	to, err := w.store.getURIForID(e.to)
+	if err != nil {
+		return GraphEdge{}, err
+	}
+	return GraphEdge{From: from, Predicate: predicate, To: to}, nil
+}
+
+// internalIDFor returns the internal id of an entity uri or CURIE, and false if the store has never seen it
+func (s *Store) internalIDFor(uri string) (uint64, bool, error) {
+	curie := resolveIdentifier(s.NamespaceManager, uri)
+	if curie == unresolvable || !strings.Contains(curie, ":") {
+		return 0, false, nil
+	}
+	txn := s.database.NewTransaction(false)
+	defer txn.Discard()
+	return s.getIDForURI(txn, curie)
+}
+
+// ShortestPaths returns up to limit of the shortest paths between two entities that are no longer than maxDepth
+// references. Each path lists its references in order, from the first entity towards the second. When references
+// are followed in both directions, an edge in a path can point backwards.
+func (s *Store) ShortestPaths(from string, to string, maxDepth int, limit int, filter GraphFilter) ([][]GraphEdge, error) {
+	if maxDepth < 1 || maxDepth > MaxGraphDepth {
+		return nil, fmt.Errorf("max depth must be between 1 and %d", MaxGraphDepth)
+	}
+	if limit < 1 {
+		limit = DefaultPathLimit
+	}
+	w, err := s.newGraphWalker(filter)
+	if err != nil {
+		return nil, err
+	}
+	start, exists, err := s.internalIDFor(from)
+	if err != nil || !exists {
+		return [][]GraphEdge{}, err
+	}
+	target, exists, err := s.internalIDFor(to)
+	if err != nil || !exists {
+		return [][]GraphEdge{}, err
+	}
+	if start == target {
+		return [][]GraphEdge{{}}, nil
+	}
+
+	// breadth first, remembering every edge that reaches a node on its shortest distance
+	depth := map[uint64]int{start: 0}
+	parents := make(map[uint64][]edge)
+	frontier := []uint64{start}
+	found := false
+	for d := 1; d <= maxDepth && !found && len(frontier) > 0; d++ {
+		next := make([]uint64, 0)
+		for _, id := range frontier {
+			edges, err := w.edges(id)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range edges {
+				other := e.to
+				if other == id {
+					other = e.from
+				}
+				if seen, ok := depth[other]; ok && seen < d {
+					continue
+				}
+				if _, ok := depth[other]; !ok {
+					depth[other] = d
+					next = append(next, other)
+				}
+				if !containsEdge(parents[other], e) {
+					parents[other] = append(parents[other], e)
+				}
+				if other == target {
+					found = true
+				}
+			}
+		}
+		frontier = next
+	}
+	if !found {
+		return [][]GraphEdge{}, nil
+	}
+
+	// walk back from the target
+	paths := make([][]edge, 0)
+	var walk func(id uint64, suffix []edge)
+	walk = func(id uint64, suffix []edge) {
+		if len(paths) >= limit {
+			return
+		}
+		if id == start {
+			path := make([]edge, len(suffix))
+			for i := range suffix {
+				path[i] = suffix[len(suffix)-1-i]
+			}
+			paths = append(paths, path)
+			return
+		}
+		for _, e := range parents[id] {
+			prev := e.from
+			if prev == id {
+				prev = e.to
+			}
+			if depth[prev] != depth[id]-1 {
+				continue
+			}
+			walk(prev, append(suffix, e))
+		}
+	}
+	walk(target, nil)
+
+	result := make([][]GraphEdge, len(paths))
+	for i, path := range paths {
+		result[i] = make([]GraphEdge, len(path))
+		for j, e := range path {
+			if result[i][j], err = w.graphEdge(e); err != nil {
+				return nil, err
+			}
+		}
+	}
+	return result, nil
+}
+
+// Neighbourhood returns the entities within a number of hops from an entity, and the references between them.
+// At most limit entities are returned.
+func (s *Store) Neighbourhood(uri string, hops int, limit int, filter GraphFilter, mergePartials bool) (*Graph, error) {
+	if hops == 0 {
+		hops = defaultNeighbourhoodHops
+	}
+	if hops < 1 || hops > MaxGraphDepth {
+		return nil, fmt.Errorf("hops must be between 1 and %d", MaxGraphDepth)
+	}
+	if limit < 1 {
+		limit = DefaultNeighbourhood
+	}
+	if limit > MaxNeighbourhoodLimit {
+		limit = MaxNeighbourhoodLimit
+	}
+	w, err := s.newGraphWalker(filter)
+	if err != nil {
+		return nil, err
+	}
+	graph := &Graph{Nodes: make([]*Entity, 0), Edges: make([]GraphEdge, 0)}
+	start, exists, err := s.internalIDFor(uri)
+	if err != nil || !exists {
+		return graph, err
+	}
+
+	nodes := []uint64{start}
+	included := map[uint64]bool{start: true}
+	var edges []edge
+	seenEdges := make(map[edge]bool)
+	frontier := []uint64{start}
+	for d := 1; d <= hops && len(frontier) > 0; d++ {
+		next := make([]uint64, 0)
+		for _, id := range frontier {
+			found, err := w.edges(id)
+			if err != nil {
+				return nil, err
+			}
+			for _, e := range found {
+				other := e.to
+				if other == id {
+					other = e.from
+				}
+				if !included[other] {
+					if len(nodes) >= limit {
+						graph.Truncated = true
+						continue
+					}
+					included[other] = true
+					nodes = append(nodes, other)
+					next = append(next, other)
+				}
+				if !seenEdges[e] {
+					seenEdges[e] = true
+					edges = append(edges, e)
+				}
+			}
+		}
+		frontier = next
+	}
+
+	for _, id := range nodes {
+		entity, err := s.GetEntityAtPointInTimeWithInternalID(id, w.at, w.datasets, mergePartials)
+		if err != nil {
+			return nil, err
+		}
+		graph.Nodes = append(graph.Nodes, entity)
+	}
+	for _, e := range edges {
+		ge, err := w.graphEdge(e)
+		if err != nil {
+			return nil, err
+		}
+		graph.Edges = append(graph.Edges, ge)
+	}
+	return graph, nil
+}
+
+func containsEdge(edges []edge, e edge) bool {
+	for _, existing := range edges {
+		if existing == e {
+			return true
+		}
+	}
+	return false
+}
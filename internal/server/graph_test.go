@@ -0,0 +1,140 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("Graph exploration", func() {
+	testCnt := 0
+	var dsm *DsManager
+	var store *Store
+	var storeLocation string
+	var p string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_graph_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		env := &conf.Config{
+			Logger:        zap.NewNop().Sugar(),
+			StoreLocation: storeLocation,
+		}
+		store = NewStore(env, &statsd.NoOpClient{})
+		dsm = NewDsManager(env, store, NoOpBus())
+		p, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/graph/")
+
+		entity := func(id string, refs map[string]interface{}) *Entity {
+			return NewEntityFromMap(map[string]interface{}{
+				"id":    p + ":" + id,
+				"props": map[string]interface{}{p + ":name": id},
+				"refs":  refs,
+			})
+		}
+		// a knows b, b knows d, a and d work at c, f knows a, e knows nobody
+		people, _ := dsm.CreateDataset("people", nil)
+		Expect(people.StoreEntities([]*Entity{
+			entity("a", map[string]interface{}{p + ":knows": p + ":b", p + ":worksAt": p + ":c"}),
+			entity("b", map[string]interface{}{p + ":knows": p + ":d"}),
+			entity("d", map[string]interface{}{p + ":worksAt": p + ":c"}),
+			entity("e", map[string]interface{}{}),
+			entity("f", map[string]interface{}{p + ":knows": p + ":a"}),
+		})).To(BeNil())
+		companies, _ := dsm.CreateDataset("companies", nil)
+		Expect(companies.StoreEntities([]*Entity{entity("c", map[string]interface{}{})})).To(BeNil())
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	edge := func(from, predicate, to string) GraphEdge {
+		return GraphEdge{From: p + ":" + from, Predicate: p + ":" + predicate, To: p + ":" + to}
+	}
+
+	ginkgo.It("Should find all shortest paths in both directions", func() {
+		paths, err := store.ShortestPaths(p+":a", "http://data.mimiro.io/graph/d", 4, 0, GraphFilter{})
+		Expect(err).To(BeNil())
+		Expect(paths).To(ConsistOf(
+			[]GraphEdge{edge("a", "knows", "b"), edge("b", "knows", "d")},
+			[]GraphEdge{edge("a", "worksAt", "c"), edge("d", "worksAt", "c")},
+		))
+	})
+
+	ginkgo.It("Should filter paths by predicate, direction, depth and dataset", func() {
+		paths, err := store.ShortestPaths(p+":a", p+":d", 4, 0, GraphFilter{Predicates: []string{p + ":knows"}})
+		Expect(err).To(BeNil())
+		Expect(paths).To(HaveLen(1))
+
+		paths, err = store.ShortestPaths(p+":d", p+":a", 4, 0, GraphFilter{Directed: true})
+		Expect(err).To(BeNil())
+		Expect(paths).To(BeEmpty(), "d only references c")
+
+		paths, err = store.ShortestPaths(p+":f", p+":d", 2, 0, GraphFilter{})
+		Expect(err).To(BeNil())
+		Expect(paths).To(BeEmpty(), "f is three hops away from d")
+		paths, err = store.ShortestPaths(p+":f", p+":d", 3, 1, GraphFilter{})
+		Expect(err).To(BeNil())
+		Expect(paths).To(HaveLen(1), "limited to one path")
+		Expect(paths[0]).To(HaveLen(3))
+
+		paths, err = store.ShortestPaths(p+":a", p+":d", 4, 0, GraphFilter{Datasets: []string{"companies"}})
+		Expect(err).To(BeNil())
+		Expect(paths).To(BeEmpty(), "all references are stored in people")
+
+		paths, err = store.ShortestPaths(p+":a", p+":e", 4, 0, GraphFilter{})
+		Expect(err).To(BeNil())
+		Expect(paths).To(BeEmpty())
+
+		_, err = store.ShortestPaths(p+":a", p+":e", MaxGraphDepth+1, 0, GraphFilter{})
+		Expect(err).NotTo(BeNil())
+	})
+
+	ginkgo.It("Should return the neighbourhood of an entity", func() {
+		graph, err := store.Neighbourhood(p+":a", 1, 0, GraphFilter{}, true)
+		Expect(err).To(BeNil())
+		ids := make([]string, 0)
+		for _, n := range graph.Nodes {
+			ids = append(ids, n.ID)
+		}
+		Expect(ids[0]).To(Equal(p + ":a"))
+		Expect(ids).To(ConsistOf(p+":a", p+":b", p+":c", p+":f"))
+		Expect(graph.Edges).To(ConsistOf(edge("a", "knows", "b"), edge("a", "worksAt", "c"), edge("f", "knows", "a")))
+		Expect(graph.Truncated).To(BeFalse())
+
+		graph, err = store.Neighbourhood(p+":a", 2, 0, GraphFilter{}, true)
+		Expect(err).To(BeNil())
+		Expect(graph.Nodes).To(HaveLen(5))
+		Expect(graph.Edges).To(HaveLen(5))
+		for _, n := range graph.Nodes {
+			Expect(n.Properties[p+":name"]).NotTo(BeNil())
+		}
+
+		graph, err = store.Neighbourhood(p+":a", 2, 2, GraphFilter{}, true)
+		Expect(err).To(BeNil())
+		Expect(graph.Nodes).To(HaveLen(2))
+		Expect(graph.Edges).To(HaveLen(1))
+		Expect(graph.Truncated).To(BeTrue())
+	})
+})
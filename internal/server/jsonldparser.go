@@ -0,0 +1,461 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+// UdaContinuationURI is the type of the node that carries the continuation token in JSON-LD output
+const UdaContinuationURI = "http://data.mimiro.io/core/uda/continuation"
+
+// JSONLDStreamParser parses JSON-LD documents into entities. The nodes at the top level of the document,
+// or in its @graph, become entities. Node references and values of terms typed @id become references,
+// and nested nodes become nested entities. Contexts must be embedded in the document, remote contexts
+// are not supported. The whole document is read before entities are emitted. Blank node identifiers are
+// scoped to the document.
+type JSONLDStreamParser struct {
+	store      *Store
+	skolem     skolemScope // the blank nodes of the document being parsed
+	blankNodes int
+}
+
+func NewJSONLDStreamParser(store *Store) *JSONLDStreamParser {
+	return &JSONLDStreamParser{store: store}
+}
+
+type jsonLDTerm struct {
+	id        string
+	valueType string // @id, @vocab or a datatype
+}
+
+type jsonLDContext struct {
+	terms map[string]*jsonLDTerm
+	vocab string
+	base  string
+}
+
+func (p *JSONLDStreamParser) ParseStream(reader io.Reader, emitEntity func(*Entity) error) error {
+	p.skolem = newSkolemScope()
+	p.blankNodes = 0
+	decoder := json.NewDecoder(reader)
+	decoder.UseNumber()
+	var doc interface{}
+	if err := decoder.Decode(&doc); err != nil {
+		return errors.New("parsing error: unable to read json-ld document " + err.Error())
+	}
+
+	entities := make(map[string]*Entity)
+	order := make([]*Entity, 0)
+	err := p.collectNodes(doc, &jsonLDContext{terms: map[string]*jsonLDTerm{}}, func(entity *Entity) {
+		if existing, ok := entities[entity.ID]; ok {
+			mergeEntity(existing, entity)
+			return
+		}
+		entities[entity.ID] = entity
+		order = append(order, entity)
+	})
+	if err != nil {
+		return errors.New("parsing error: " + err.Error())
+	}
+
+	for _, entity := range order {
+		if err := emitEntity(entity); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (p *JSONLDStreamParser) collectNodes(value interface{}, ctx *jsonLDContext, collect func(*Entity)) error {
+	switch v := value.(type) {
+	case []interface{}:
+		for _, item := range v {
+			if err := p.collectNodes(item, ctx, collect); err != nil {
+				return err
+			}
+		}
+		return nil
+	case map[string]interface{}:
+		if graph, ok := v["@graph"]; ok {
+			ctx, err := ctx.with(v["@context"])
+			if err != nil {
+				return err
+			}
+			return p.collectNodes(graph, ctx, collect)
+		}
+		entity, err := p.toEntity(v, ctx, true)
+		if err != nil || entity == nil {
+			return err
+		}
+		collect(entity)
+		return nil
+	}
+	return fmt.Errorf("expected a node object, got %v", value)
+}
+
+// toEntity converts a node object. Top level nodes without @id are given a generated blank node identifier,
+// which can not clash with the labels of blank nodes in the document, and nil is returned for the continuation node of datahub JSON-LD output.
+func (p *JSONLDStreamParser) toEntity(node map[string]interface{}, ctx *jsonLDContext, topLevel bool) (*Entity, error) {
+	ctx, err := ctx.with(node["@context"])
+	if err != nil {
+		return nil, err
+	}
+
+	entity := NewEntity("", 0)
+	if id, ok := node["@id"].(string); ok {
+		if entity.ID, err = p.identifier(ctx.expandIRI(id, false)); err != nil {
+			return nil, err
+		}
+	} else if topLevel {
+		p.blankNodes++
+		if entity.ID, err = p.store.GetNamespacedIdentifier(p.skolem.generated(p.blankNodes), nil); err != nil {
+			return nil, err
+		}
+	}
+
+	if types, ok := node["@type"]; ok {
+		rdfType, err := p.store.GetNamespacedIdentifier(RdfTypeURI, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, t := range asJSONLDList(types) {
+			s, ok := t.(string)
+			if !ok {
+				return nil, fmt.Errorf("@type must be a string, got %v", t)
+			}
+			typeIRI := ctx.expandIRI(s, true)
+			if typeIRI == UdaContinuationURI {
+				return nil, nil
+			}
+			ref, err := p.identifier(typeIRI)
+			if err != nil {
+				return nil, err
+			}
+			addReferenceValue(entity.References, rdfType, ref)
+		}
+	}
+
+	keys := make([]string, 0, len(node))
+	for key := range node {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	for _, key := range keys {
+		if strings.HasPrefix(key, "@") {
+			if key == "@reverse" {
+				return nil, errors.New("@reverse is not supported")
+			}
+			continue
+		}
+		iri := ctx.expandIRI(key, true)
+		if !isAbsoluteIRI(iri) {
+			// keys that do not expand to an IRI are dropped, as in JSON-LD expansion
+			continue
+		}
+		if iri == UdaDeletedURI {
+			for _, v := range asJSONLDList(node[key]) {
+				entity.IsDeleted = jsonLDBool(v)
+			}
+			continue
+		}
+		predicate, err := p.store.GetNamespacedIdentifier(iri, nil)
+		if err != nil {
+			return nil, err
+		}
+		for _, v := range asJSONLDList(node[key]) {
+			if err := p.addValue(entity, predicate, v, ctx.terms[key], ctx); err != nil {
+				return nil, fmt.Errorf("%s: %w", key, err)
+			}
+		}
+	}
+	return entity, nil
+}
+
+func (p *JSONLDStreamParser) addValue(entity *Entity, predicate string, value interface{}, term *jsonLDTerm, ctx *jsonLDContext) error {
+	valueType := ""
+	if term != nil {
+		valueType = term.valueType
+	}
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case []interface{}:
+		for _, item := range v {
+			if err := p.addValue(entity, predicate, item, term, ctx); err != nil {
+				return err
+			}
+		}
+		return nil
+	case string:
+		if valueType == "@id" || valueType == "@vocab" {
+			ref, err := p.identifier(ctx.expandIRI(v, valueType == "@vocab"))
+			if err != nil {
+				return err
+			}
+			addReferenceValue(entity.References, predicate, ref)
+			return nil
+		}
+		if valueType != "" {
+			addPropertyValue(entity.Properties, predicate, literalValue(rdfTerm{value: v, datatype: ctx.expandIRI(valueType, true)}))
+			return nil
+		}
+		addPropertyValue(entity.Properties, predicate, v)
+		return nil
+	case json.Number:
+		f, err := v.Float64()
+		if err != nil {
+			return err
+		}
+		addPropertyValue(entity.Properties, predicate, f)
+		return nil
+	case bool:
+		addPropertyValue(entity.Properties, predicate, v)
+		return nil
+	case map[string]interface{}:
+		if literal, ok := v["@value"]; ok {
+			datatype, _ := v["@type"].(string)
+			if s, ok := literal.(string); ok && datatype != "" {
+				addPropertyValue(entity.Properties, predicate, literalValue(rdfTerm{value: s, datatype: ctx.expandIRI(datatype, true)}))
+				return nil
+			}
+			return p.addValue(entity, predicate, literal, nil, ctx)
+		}
+		if list, ok := v["@list"]; ok {
+			return p.addValue(entity, predicate, list, term, ctx)
+		}
+		if set, ok := v["@set"]; ok {
+			return p.addValue(entity, predicate, set, term, ctx)
+		}
+		if id, ok := v["@id"].(string); ok && len(v) == 1 {
+			ref, err := p.identifier(ctx.expandIRI(id, false))
+			if err != nil {
+				return err
+			}
+			addReferenceValue(entity.References, predicate, ref)
+			return nil
+		}
+		nested, err := p.toEntity(v, ctx, false)
+		if err != nil {
+			return err
+		}
+		if nested != nil {
+			addPropertyValue(entity.Properties, predicate, nested)
+		}
+		return nil
+	}
+	return fmt.Errorf("unsupported value %v", value)
+}
+
+func (p *JSONLDStreamParser) identifier(iri string) (string, error) {
+	if strings.HasPrefix(iri, "_:") {
+		return p.store.GetNamespacedIdentifier(p.skolem.labelled(iri[2:]), nil)
+	}
+	if !strings.HasPrefix(iri, "http://") && !strings.HasPrefix(iri, "https://") {
+		return "", fmt.Errorf("only http and https IRIs are supported, got %s", iri)
+	}
+	return p.store.GetNamespacedIdentifier(iri, nil)
+}
+
+// with returns the context updated with a local @context value
+func (c *jsonLDContext) with(local interface{}) (*jsonLDContext, error) {
+	switch v := local.(type) {
+	case nil:
+		return c, nil
+	case []interface{}:
+		ctx := c
+		for _, item := range v {
+			if item == nil {
+				ctx = &jsonLDContext{terms: map[string]*jsonLDTerm{}}
+				continue
+			}
+			var err error
+			if ctx, err = ctx.with(item); err != nil {
+				return nil, err
+			}
+		}
+		return ctx, nil
+	case string:
+		return nil, fmt.Errorf("remote context %s is not supported", v)
+	case map[string]interface{}:
+		ctx := &jsonLDContext{terms: make(map[string]*jsonLDTerm, len(c.terms)+len(v)), vocab: c.vocab, base: c.base}
+		for k, t := range c.terms {
+			ctx.terms[k] = t
+		}
+		for key, value := range v {
+			switch key {
+			case "@vocab":
+				ctx.vocab, _ = value.(string)
+				continue
+			case "@base":
+				ctx.base, _ = value.(string)
+				continue
+			}
+			if strings.HasPrefix(key, "@") {
+				continue
+			}
+			switch def := value.(type) {
+			case nil:
+				delete(ctx.terms, key)
+			case string:
+				ctx.terms[key] = &jsonLDTerm{id: def}
+			case map[string]interface{}:
+				if _, ok := def["@reverse"]; ok {
+					return nil, fmt.Errorf("reverse term %s is not supported", key)
+				}
+				term := &jsonLDTerm{id: key}
+				if id, ok := def["@id"].(string); ok {
+					term.id = id
+				}
+				term.valueType, _ = def["@type"].(string)
+				ctx.terms[key] = term
+			default:
+				return nil, fmt.Errorf("invalid definition of term %s", key)
+			}
+		}
+		// expand the term definitions now that all are known, so that they can refer to each other
+		for key, term := range ctx.terms {
+			expanded := &jsonLDTerm{id: ctx.expandTerm(term.id, key, 0), valueType: term.valueType}
+			if expanded.valueType != "@id" && expanded.valueType != "@vocab" && expanded.valueType != "" {
+				expanded.valueType = ctx.expandTerm(expanded.valueType, "", 0)
+			}
+			ctx.terms[key] = expanded
+		}
+		return ctx, nil
+	}
+	return nil, errors.New("invalid @context")
+}
+
+// expandTerm expands the IRI of a term definition, which can use prefixes defined in the same context
+func (c *jsonLDContext) expandTerm(value string, term string, depth int) string {
+	if depth > 10 {
+		return value
+	}
+	if prefix, suffix, found := strings.Cut(value, ":"); found {
+		if t, ok := c.terms[prefix]; ok && prefix != term && prefix != "_" && !strings.HasPrefix(suffix, "//") {
+			return c.expandTerm(t.id, prefix, depth+1) + suffix
+		}
+		return value
+	}
+	if t, ok := c.terms[value]; ok && value != term {
+		return c.expandTerm(t.id, value, depth+1)
+	}
+	if c.vocab != "" {
+		return c.vocab + value
+	}
+	return value
+}
+
+// expandIRI expands a term, compact IRI or relative IRI. Keys and @type values are expanded with
+// vocab set, which makes terms and @vocab apply. Other values are resolved against @base.
+func (c *jsonLDContext) expandIRI(value string, vocab bool) string {
+	if vocab {
+		if t, ok := c.terms[value]; ok {
+			return t.id
+		}
+	}
+	if prefix, suffix, found := strings.Cut(value, ":"); found {
+		if prefix == "_" || strings.HasPrefix(suffix, "//") {
+			return value
+		}
+		if t, ok := c.terms[prefix]; ok {
+			return t.id + suffix
+		}
+		return value
+	}
+	if vocab && c.vocab != "" {
+		return c.vocab + value
+	}
+	if !vocab && c.base != "" {
+		if base, err := url.Parse(c.base); err == nil {
+			if ref, err := url.Parse(value); err == nil {
+				return base.ResolveReference(ref).String()
+			}
+		}
+	}
+	return value
+}
+
+func isAbsoluteIRI(value string) bool {
+	prefix, _, found := strings.Cut(value, ":")
+	return found && prefix != "" && !strings.ContainsAny(prefix, "/?#")
+}
+
+func asJSONLDList(value interface{}) []interface{} {
+	switch v := value.(type) {
+	case []interface{}:
+		return v
+	case map[string]interface{}:
+		if list, ok := v["@list"].([]interface{}); ok {
+			return list
+		}
+		if set, ok := v["@set"].([]interface{}); ok {
+			return set
+		}
+	}
+	return []interface{}{value}
+}
+
+func jsonLDBool(value interface{}) bool {
+	switch v := value.(type) {
+	case bool:
+		return v
+	case string:
+		b, _ := strconv.ParseBool(v)
+		return b
+	case map[string]interface{}:
+		return jsonLDBool(v["@value"])
+	}
+	return false
+}
+
+// mergeEntity adds the properties and references of a node that was given more than once, or of a subject
+// that was spilled to disk more than once
+func mergeEntity(entity *Entity, other *Entity) {
+	entity.IsDeleted = entity.IsDeleted || other.IsDeleted
+	for key, value := range other.Properties {
+		values, ok := value.([]interface{})
+		if !ok {
+			values = []interface{}{value}
+		}
+		for _, v := range values {
+			addPropertyValue(entity.Properties, key, v)
+		}
+	}
+	for key, value := range other.References {
+		switch v := value.(type) {
+		case string:
+			addReferenceValue(entity.References, key, v)
+		case []string:
+			for _, ref := range v {
+				addReferenceValue(entity.References, key, ref)
+			}
+		case []interface{}:
+			// entities read back from json, such as the spill files of the RDF parser
+			for _, ref := range v {
+				if s, ok := ref.(string); ok {
+					addReferenceValue(entity.References, key, s)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,143 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("The JSON-LD stream parser", func() {
+	testCnt := 0
+	var storeLocation string
+	var store *Store
+	var ex, rdf string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_jsonld_parser_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = NewStore(e, &statsd.NoOpClient{})
+		ex, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://example.com/")
+		rdf, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://www.w3.org/1999/02/22-rdf-syntax-ns#")
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	parse := func(doc string) ([]*Entity, error) {
+		var result []*Entity
+		err := NewJSONLDStreamParser(store).ParseStream(strings.NewReader(doc), func(e *Entity) error {
+			result = append(result, e)
+			return nil
+		})
+		return result, err
+	}
+
+	ginkgo.It("should expand terms, compact IRIs and typed values", func() {
+		entities, err := parse(`{
+  "@context": {
+    "ex": "http://example.com/",
+    "xsd": "http://www.w3.org/2001/XMLSchema#",
+    "name": "ex:name",
+    "knows": {"@id": "ex:knows", "@type": "@id"},
+    "born": {"@id": "ex:born", "@type": "xsd:integer"}
+  },
+  "@graph": [
+    {
+      "@id": "ex:bob",
+      "@type": ["ex:Person", "http://example.com/Agent"],
+      "name": {"@value": "Bob", "@language": "en"},
+      "born": "1970",
+      "ex:height": {"@value": "1.8", "@type": "xsd:double"},
+      "ex:nicks": {"@list": ["b", "bobby"]},
+      "knows": ["ex:alice", "_:someone"],
+      "ex:address": {"ex:street": "Main street"},
+      "ex:likes": {"@id": "ex:carl"},
+      "unmapped": "dropped"
+    },
+    {"@id": "ex:carl", "http://data.mimiro.io/core/uda/deleted": true},
+    {"@type": "http://data.mimiro.io/core/uda/continuation", "http://data.mimiro.io/core/uda/token": "abc"}
+  ]
+}`)
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(2))
+		bob := entities[0]
+		Expect(bob.ID).To(Equal(ex + ":bob"))
+		Expect(bob.References[rdf+":type"]).To(Equal([]string{ex + ":Person", ex + ":Agent"}))
+		Expect(bob.Properties[ex+":name"]).To(Equal("Bob"))
+		Expect(bob.Properties[ex+":born"]).To(Equal(float64(1970)))
+		Expect(bob.Properties[ex+":height"]).To(Equal(1.8))
+		Expect(bob.Properties[ex+":nicks"]).To(Equal([]interface{}{"b", "bobby"}))
+		knows := bob.References[ex+":knows"].([]string)
+		Expect(knows[0]).To(Equal(ex + ":alice"))
+		Expect(knows[1]).To(HaveSuffix("-someone"))
+		Expect(bob.References[ex+":likes"]).To(Equal(ex + ":carl"))
+		address := bob.Properties[ex+":address"].(*Entity)
+		Expect(address.ID).To(Equal(""))
+		Expect(address.Properties[ex+":street"]).To(Equal("Main street"))
+		Expect(bob.Properties).To(HaveLen(5))
+
+		Expect(entities[1].ID).To(Equal(ex + ":carl"))
+		Expect(entities[1].IsDeleted).To(BeTrue())
+	})
+
+	ginkgo.It("should read top level arrays, @vocab and merge nodes with the same id", func() {
+		entities, err := parse(`[
+  {"@context": {"@vocab": "http://example.com/"}, "@id": "http://example.com/bob", "name": "Bob"},
+  {"@context": {"@vocab": "http://example.com/"}, "@id": "http://example.com/bob", "age": 42},
+  {"@context": {"@vocab": "http://example.com/"}, "name": "Anonymous"}
+]`)
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(2))
+		Expect(entities[0].Properties[ex+":name"]).To(Equal("Bob"))
+		Expect(entities[0].Properties[ex+":age"]).To(Equal(float64(42)))
+		Expect(entities[1].ID).NotTo(BeEmpty())
+	})
+
+	ginkgo.It("should scope blank node identifiers to the document", func() {
+		doc := `[
+  {"@id": "_:b1", "http://example.com/name": "Labelled"},
+  {"http://example.com/name": "Anonymous", "http://example.com/knows": {"@id": "_:b1"}}
+]`
+		first, err := parse(doc)
+		Expect(err).To(BeNil())
+		Expect(first).To(HaveLen(2), "a generated identifier does not clash with a label")
+		Expect(first[1].References[ex+":knows"]).To(Equal(first[0].ID))
+
+		second, err := parse(doc)
+		Expect(err).To(BeNil())
+		Expect(second[0].ID).NotTo(Equal(first[0].ID))
+		Expect(second[1].ID).NotTo(Equal(first[1].ID))
+		Expect(store.NamespaceManager.ExpandCurie(second[0].ID)).To(HavePrefix(SkolemNamespace))
+	})
+
+	ginkgo.It("should turn remote contexts and non http identifiers down", func() {
+		_, err := parse(`{"@context": "https://schema.org/", "@id": "http://example.com/bob"}`)
+		Expect(err).To(MatchError(ContainSubstring("remote context")))
+		_, err = parse(`{"@id": "urn:bob", "http://example.com/name": "Bob"}`)
+		Expect(err).To(MatchError(ContainSubstring("only http and https")))
+	})
+})
@@ -0,0 +1,185 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// MergedChangesContinuation holds the next change log offset for each dataset in a merged change feed
+type MergedChangesContinuation struct {
+	Datasets []string `json:"datasets"`
+	Offsets  []uint64 `json:"offsets"`
+}
+
+// NewMergedChangesContinuation starts a merged change feed at the beginning of each dataset
+func NewMergedChangesContinuation(datasets []string) *MergedChangesContinuation {
+	return &MergedChangesContinuation{Datasets: datasets, Offsets: make([]uint64, len(datasets))}
+}
+
+// MergedChangesContinuationAtTime starts a merged change feed at the first change after the given time in each dataset
+func MergedChangesContinuationAtTime(datasets []*Dataset, t time.Time) (*MergedChangesContinuation, error) {
+	cont := &MergedChangesContinuation{}
+	for _, ds := range datasets {
+		offset, err := ds.OffsetAtTime(t)
+		if err != nil {
+			return nil, err
+		}
+		cont.Datasets = append(cont.Datasets, ds.ID)
+		cont.Offsets = append(cont.Offsets, offset)
+	}
+	return cont, nil
+}
+
+// DecodeMergedChangesContinuation reads a token made by Encode, and checks that it was made
+// for the same datasets in the same order
+func DecodeMergedChangesContinuation(token string, datasets []string) (*MergedChangesContinuation, error) {
+	if token == "" {
+		return NewMergedChangesContinuation(datasets), nil
+	}
+	data, err := base64.URLEncoding.DecodeString(token)
+	if err != nil {
+		return nil, err
+	}
+	cont := &MergedChangesContinuation{}
+	err = json.Unmarshal(data, cont)
+	if err != nil {
+		return nil, err
+	}
+	if len(cont.Datasets) != len(datasets) || len(cont.Offsets) != len(datasets) {
+		return nil, errors.New("continuation token does not match the requested datasets")
+	}
+	for i, name := range datasets {
+		if cont.Datasets[i] != name {
+			return nil, errors.New("continuation token does not match the requested datasets")
+		}
+	}
+	return cont, nil
+}
+
+func (c *MergedChangesContinuation) Encode() (string, error) {
+	data, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	return base64.URLEncoding.EncodeToString(data), nil
+}
+
+type mergedChangesHead struct {
+	idx     int
+	it      *badger.Iterator
+	prefix  []byte
+	offset  uint64
+	txnTime uint64
+	value   []byte // key of the entity version for this change
+}
+
+func (h *mergedChangesHead) read() error {
+	if !h.it.ValidForPrefix(h.prefix) {
+		h.value = nil
+		return nil
+	}
+	item := h.it.Item()
+	h.offset = binary.BigEndian.Uint64(item.Key()[6:14])
+	var err error
+	h.value, err = item.ValueCopy(nil)
+	if err != nil {
+		return err
+	}
+	h.txnTime = binary.BigEndian.Uint64(h.value[14:22])
+	return nil
+}
+
+// ProcessMergedChangesRaw streams the changes of several datasets interleaved in the order they were
+// committed. Changes committed at the same time are ordered by the position of their dataset in the list.
+// All datasets are read from one snapshot of the store. The continuation is moved forward past every
+// change looked at, and limit counts the changes passed to processChange.
+func (s *Store) ProcessMergedChangesRaw(
+	datasets []*Dataset,
+	cont *MergedChangesContinuation,
+	limit int,
+	filter *ChangesFilter,
+	processChange func(dataset string, jsonData []byte) error,
+) error {
+	if len(datasets) != len(cont.Offsets) {
+		return fmt.Errorf("continuation has %v offsets for %v datasets", len(cont.Offsets), len(datasets))
+	}
+	return s.database.View(func(txn *badger.Txn) error {
+		heads := make([]*mergedChangesHead, 0, len(datasets))
+		for i, ds := range datasets {
+			prefix := make([]byte, 6)
+			binary.BigEndian.PutUint16(prefix, DatasetEntityChangeLog)
+			binary.BigEndian.PutUint32(prefix[2:], ds.InternalID)
+			opts := badger.DefaultIteratorOptions
+			opts.Prefix = prefix
+			it := txn.NewIterator(opts)
+			defer it.Close()
+
+			seekKey := make([]byte, 14)
+			copy(seekKey, prefix)
+			binary.BigEndian.PutUint64(seekKey[6:], cont.Offsets[i])
+			it.Seek(seekKey)
+			head := &mergedChangesHead{idx: i, it: it, prefix: prefix}
+			if err := head.read(); err != nil {
+				return err
+			}
+			heads = append(heads, head)
+		}
+
+		processed := 0
+		for limit <= 0 || processed < limit {
+			// the number of datasets is small, so a linear scan for the oldest change is fine
+			var next *mergedChangesHead
+			for _, h := range heads {
+				if h.value != nil && (next == nil || h.txnTime < next.txnTime) {
+					next = h
+				}
+			}
+			if next == nil {
+				return nil
+			}
+
+			entityItem, err := txn.Get(next.value)
+			if err != nil {
+				return err
+			}
+			err = entityItem.Value(func(jsonData []byte) error {
+				jsonData, ok, err := filter.Apply(jsonData)
+				if err != nil || !ok {
+					return err
+				}
+				processed++
+				return processChange(datasets[next.idx].ID, jsonData)
+			})
+			if err != nil {
+				return err
+			}
+
+			cont.Offsets[next.idx] = next.offset + 1
+			next.it.Next()
+			if err := next.read(); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,106 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("A merged change feed", func() {
+	testCnt := 0
+	var storeLocation string
+	var store *Store
+	var a, b, c *Dataset
+	var people string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_merged_changes_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = NewStore(e, &statsd.NoOpClient{})
+		dsm := NewDsManager(e, store, NoOpBus())
+		a, _ = dsm.CreateDataset("a", nil)
+		b, _ = dsm.CreateDataset("b", nil)
+		c, _ = dsm.CreateDataset("c", nil)
+		people, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/people/")
+
+		// commit one entity at a time, alternating between the datasets
+		for i, ds := range []*Dataset{a, b, a, c, b, a} {
+			e := NewEntity(fmt.Sprintf("%s:e%v", people, i), 0)
+			e.Properties[people+":n"] = i
+			e.IsDeleted = i == 4
+			Expect(ds.StoreEntities([]*Entity{e})).To(Succeed())
+		}
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	changes := func(cont *MergedChangesContinuation, limit int, filter *ChangesFilter) []string {
+		var result []string
+		err := store.ProcessMergedChangesRaw([]*Dataset{a, b, c}, cont, limit, filter,
+			func(dataset string, jsonData []byte) error {
+				e := &Entity{}
+				Expect(json.Unmarshal(jsonData, e)).To(Succeed())
+				result = append(result, dataset+"/"+e.ID)
+				return nil
+			})
+		Expect(err).To(BeNil())
+		return result
+	}
+
+	ginkgo.It("should interleave changes in commit order", func() {
+		cont := NewMergedChangesContinuation([]string{"a", "b", "c"})
+		Expect(changes(cont, 0, nil)).To(Equal([]string{
+			"a/" + people + ":e0", "b/" + people + ":e1", "a/" + people + ":e2",
+			"c/" + people + ":e3", "b/" + people + ":e4", "a/" + people + ":e5",
+		}))
+		Expect(cont.Offsets).To(Equal([]uint64{3, 2, 1}))
+	})
+
+	ginkgo.It("should continue from an encoded token", func() {
+		cont := NewMergedChangesContinuation([]string{"a", "b", "c"})
+		Expect(changes(cont, 4, nil)).To(HaveLen(4))
+		token, err := cont.Encode()
+		Expect(err).To(BeNil())
+
+		cont, err = DecodeMergedChangesContinuation(token, []string{"a", "b", "c"})
+		Expect(err).To(BeNil())
+		Expect(changes(cont, 0, nil)).To(Equal([]string{"b/" + people + ":e4", "a/" + people + ":e5"}))
+		Expect(changes(cont, 0, nil)).To(BeEmpty())
+
+		_, err = DecodeMergedChangesContinuation(token, []string{"a", "c", "b"})
+		Expect(err).NotTo(BeNil())
+	})
+
+	ginkgo.It("should move past filtered changes", func() {
+		filter := &ChangesFilter{Deleted: DeletedExclude}
+		Expect(filter.Resolve(store.NamespaceManager)).To(Succeed())
+		cont := NewMergedChangesContinuation([]string{"a", "b", "c"})
+		Expect(changes(cont, 5, filter)).To(HaveLen(5))
+		Expect(cont.Offsets).To(Equal([]uint64{3, 2, 1}))
+	})
+})
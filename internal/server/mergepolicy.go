@@ -0,0 +1,288 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"errors"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+)
+
+const (
+	// MergeUnion keeps the values of all datasets, without duplicates
+	MergeUnion = "union"
+	// MergeFirstWins keeps the value of the dataset with the highest priority that has the property
+	MergeFirstWins = "firstWins"
+	// MergeLatestWins keeps the value of the dataset where the entity was most recently changed
+	MergeLatestWins = "latestWins"
+
+	DatasetNameURI = "http://data.mimiro.io/core/datasetname"
+	PartialsURI    = "http://data.mimiro.io/core/partials"
+	// ProvenanceURI holds a nested entity with the names of the datasets each merged value came from
+	ProvenanceURI = "http://data.mimiro.io/core/provenance"
+
+	mergePolicyKey = "mergepolicy"
+)
+
+// MergePolicy decides how the versions of an entity in several datasets are merged into one entity.
+// Datasets lists dataset names in priority order, highest first. Datasets that are not listed come after,
+// in the order they are stored. Properties sets the strategy of single properties and references, keyed
+// by CURIE or URI, and Default is used for all others.
+type MergePolicy struct {
+	Datasets   []string          `json:"datasets,omitempty"`
+	Default    string            `json:"default,omitempty"`
+	Properties map[string]string `json:"properties,omitempty"`
+	Provenance bool              `json:"provenance,omitempty"`
+
+	strategies map[string]string // strategies keyed by full URI, set by Resolve
+}
+
+func validMergeStrategy(strategy string) bool {
+	return strategy == MergeUnion || strategy == MergeFirstWins || strategy == MergeLatestWins
+}
+
+// Resolve validates the policy and expands the property identifiers it uses
+func (p *MergePolicy) Resolve(nsm *NamespaceManager) error {
+	if p.Default == "" {
+		p.Default = MergeUnion
+	}
+	if !validMergeStrategy(p.Default) {
+		return fmt.Errorf("merge strategy must be one of %s, %s or %s, got %s",
+			MergeUnion, MergeFirstWins, MergeLatestWins, p.Default)
+	}
+	p.strategies = make(map[string]string, len(p.Properties))
+	for property, strategy := range p.Properties {
+		if !validMergeStrategy(strategy) {
+			return fmt.Errorf("merge strategy of %s must be one of %s, %s or %s, got %s",
+				property, MergeUnion, MergeFirstWins, MergeLatestWins, strategy)
+		}
+		uri := property
+		if !strings.HasPrefix(property, "http://") && !strings.HasPrefix(property, "https://") {
+			var err error
+			if uri, err = nsm.ExpandCurie(property); err != nil {
+				return err
+			}
+		}
+		p.strategies[uri] = strategy
+	}
+	return nil
+}
+
+func (p *MergePolicy) strategy(nsm *NamespaceManager, key string) string {
+	if len(p.strategies) > 0 {
+		uri, err := nsm.ExpandCurie(key)
+		if err != nil {
+			uri = key
+		}
+		if strategy, ok := p.strategies[uri]; ok {
+			return strategy
+		}
+	}
+	return p.Default
+}
+
+// Merge merges the versions of an entity, where datasets holds the name of the dataset of each version
+func (p *MergePolicy) Merge(nsm *NamespaceManager, partials []*Entity, datasets []string) *Entity {
+	if len(partials) == 0 {
+		return nil
+	}
+	rank := func(i int) int {
+		for r, name := range p.Datasets {
+			if name == datasets[i] {
+				return r
+			}
+		}
+		return len(p.Datasets)
+	}
+	order := make([]int, len(partials))
+	for i := range order {
+		order[i] = i
+	}
+	sort.SliceStable(order, func(a, b int) bool { return rank(order[a]) < rank(order[b]) })
+
+	first := partials[order[0]]
+	result := &Entity{
+		ID:         first.ID,
+		InternalID: first.InternalID,
+		Properties: make(map[string]interface{}),
+		References: make(map[string]interface{}),
+	}
+	for _, e := range partials {
+		if e.Recorded > result.Recorded {
+			result.Recorded = e.Recorded
+		}
+	}
+
+	var provenance *Entity
+	if p.Provenance {
+		provenance = NewEntity("", 0)
+	}
+	merge := func(target map[string]interface{}, values func(e *Entity) map[string]interface{}) {
+		keys := make([]string, 0)
+		seen := make(map[string]bool)
+		for _, i := range order {
+			for key := range values(partials[i]) {
+				if !seen[key] {
+					seen[key] = true
+					keys = append(keys, key)
+				}
+			}
+		}
+		sort.Strings(keys)
+		for _, key := range keys {
+			var sources []int
+			for _, i := range order {
+				if _, ok := values(partials[i])[key]; ok {
+					sources = append(sources, i)
+				}
+			}
+			switch p.strategy(nsm, key) {
+			case MergeFirstWins:
+				sources = sources[:1]
+			case MergeLatestWins:
+				latest := sources[0]
+				for _, i := range sources[1:] {
+					if partials[i].Recorded > partials[latest].Recorded {
+						latest = i
+					}
+				}
+				sources = []int{latest}
+			}
+			var merged interface{}
+			for _, i := range sources {
+				merged = unionValues(merged, values(partials[i])[key])
+				if provenance != nil {
+					addPropertyValue(provenance.Properties, key, datasets[i])
+				}
+			}
+			target[key] = merged
+		}
+	}
+	merge(result.Properties, func(e *Entity) map[string]interface{} { return e.Properties })
+	merge(result.References, func(e *Entity) map[string]interface{} { return e.References })
+
+	if provenance != nil {
+		result.Properties[ProvenanceURI] = provenance
+	}
+	return result
+}
+
+// unionValues adds the values of v that are not already in existing. A single value stays a single value.
+func unionValues(existing interface{}, v interface{}) interface{} {
+	if existing == nil {
+		return v
+	}
+	values := valueList(existing)
+	for _, value := range valueList(v) {
+		found := false
+		for _, e := range values {
+			if reflect.DeepEqual(e, value) {
+				found = true
+				break
+			}
+		}
+		if !found {
+			values = append(values, value)
+		}
+	}
+	if len(values) == 1 {
+		return values[0]
+	}
+	return values
+}
+
+func valueList(v interface{}) []interface{} {
+	switch values := v.(type) {
+	case []interface{}:
+		return append([]interface{}{}, values...)
+	case []string:
+		result := make([]interface{}, len(values))
+		for i, s := range values {
+			result[i] = s
+		}
+		return result
+	}
+	return []interface{}{v}
+}
+
+// MergeMultiOriginEntity merges an entity made with partial merging turned off, where each version
+// is listed under core:partials with the name of its dataset
+func (p *MergePolicy) MergeMultiOriginEntity(nsm *NamespaceManager, entity *Entity) *Entity {
+	list, ok := entity.Properties[PartialsURI].([]interface{})
+	if !ok {
+		return entity
+	}
+	partials := make([]*Entity, 0, len(list))
+	datasets := make([]string, 0, len(list))
+	for _, item := range list {
+		partial, ok := item.(*Entity)
+		if !ok {
+			continue
+		}
+		name, _ := partial.Properties[DatasetNameURI].(string)
+		delete(partial.Properties, DatasetNameURI)
+		partials = append(partials, partial)
+		datasets = append(datasets, name)
+	}
+	merged := p.Merge(nsm, partials, datasets)
+	if merged == nil {
+		return entity
+	}
+	return merged
+}
+
+// MergePolicy returns the merge policy used when partials are merged, or nil when versions are
+// merged by appending the values of all datasets
+func (s *Store) MergePolicy() *MergePolicy {
+	return s.mergePolicy.Load()
+}
+
+// SetMergePolicy validates and stores the merge policy used when partials are merged.
+// A nil policy goes back to merging by appending the values of all datasets.
+func (s *Store) SetMergePolicy(policy *MergePolicy) error {
+	if policy == nil {
+		if err := s.DeleteObject(StoreMetaIndex, mergePolicyKey); err != nil {
+			return err
+		}
+		s.mergePolicy.Store(nil)
+		return nil
+	}
+	if err := policy.Resolve(s.NamespaceManager); err != nil {
+		return err
+	}
+	if err := s.StoreObject(StoreMetaIndex, mergePolicyKey, policy); err != nil {
+		return err
+	}
+	s.mergePolicy.Store(policy)
+	return nil
+}
+
+func (s *Store) loadMergePolicy() error {
+	policy := &MergePolicy{}
+	if err := s.GetObject(StoreMetaIndex, mergePolicyKey, policy); err != nil {
+		return err
+	}
+	if policy.Default == "" {
+		// not set
+		return nil
+	}
+	if err := policy.Resolve(s.NamespaceManager); err != nil {
+		return errors.New("stored merge policy is invalid: " + err.Error())
+	}
+	s.mergePolicy.Store(policy)
+	return nil
+}
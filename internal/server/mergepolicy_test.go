@@ -0,0 +1,155 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("A merge policy", func() {
+	testCnt := 0
+	var dsm *DsManager
+	var store *Store
+	var storeLocation string
+	var env *conf.Config
+	var prefix string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_merge_policy_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		env = &conf.Config{
+			Logger:        zap.NewNop().Sugar(),
+			StoreLocation: storeLocation,
+		}
+		store = NewStore(env, &statsd.NoOpClient{})
+		dsm = NewDsManager(env, store, NoOpBus())
+		prefix, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/people/")
+
+		crm, _ := dsm.CreateDataset("crm", nil)
+		Expect(crm.StoreEntities([]*Entity{NewEntityFromMap(map[string]interface{}{
+			"id": prefix + ":person-1",
+			"props": map[string]interface{}{
+				prefix + ":Name":  "Lisa",
+				prefix + ":Email": "lisa@crm",
+			},
+			"refs": map[string]interface{}{prefix + ":Friend": []string{prefix + ":person-2", prefix + ":person-3"}},
+		})})).To(BeNil())
+		hr, _ := dsm.CreateDataset("hr", nil)
+		Expect(hr.StoreEntities([]*Entity{NewEntityFromMap(map[string]interface{}{
+			"id": prefix + ":person-1",
+			"props": map[string]interface{}{
+				prefix + ":Name":  "Lisa Smith",
+				prefix + ":Email": "lisa@crm",
+			},
+			"refs": map[string]interface{}{prefix + ":Friend": prefix + ":person-3"},
+		})})).To(BeNil())
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	ginkgo.It("Should merge without duplicates by default", func() {
+		Expect(store.SetMergePolicy(&MergePolicy{})).To(BeNil())
+		e, err := store.GetEntity(prefix+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties[prefix+":Name"]).To(Equal([]interface{}{"Lisa", "Lisa Smith"}))
+		Expect(e.Properties[prefix+":Email"]).To(Equal("lisa@crm"))
+		Expect(e.References[prefix+":Friend"]).To(Equal([]interface{}{prefix + ":person-2", prefix + ":person-3"}))
+	})
+
+	ginkgo.It("Should let the dataset with the highest priority win", func() {
+		Expect(store.SetMergePolicy(&MergePolicy{
+			Datasets:   []string{"hr", "crm"},
+			Properties: map[string]string{"http://data.mimiro.io/people/Name": MergeFirstWins},
+		})).To(BeNil())
+		e, err := store.GetEntity(prefix+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties[prefix+":Name"]).To(Equal("Lisa Smith"))
+		Expect(e.References[prefix+":Friend"]).To(Equal([]interface{}{prefix + ":person-3", prefix + ":person-2"}))
+	})
+
+	ginkgo.It("Should let the latest change win", func() {
+		Expect(store.SetMergePolicy(&MergePolicy{
+			Datasets: []string{"hr", "crm"},
+			Default:  MergeLatestWins,
+		})).To(BeNil())
+		crm := dsm.GetDataset("crm")
+		Expect(crm.StoreEntities([]*Entity{NewEntityFromMap(map[string]interface{}{
+			"id":    prefix + ":person-1",
+			"props": map[string]interface{}{prefix + ":Name": "Lisa Jones"},
+			"refs":  map[string]interface{}{},
+		})})).To(BeNil())
+		e, err := store.GetEntity(prefix+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties[prefix+":Name"]).To(Equal("Lisa Jones"))
+		Expect(e.Properties[prefix+":Email"]).To(Equal("lisa@crm"), "only hr has an email now")
+	})
+
+	ginkgo.It("Should annotate values with the datasets they came from", func() {
+		Expect(store.SetMergePolicy(&MergePolicy{
+			Datasets:   []string{"crm"},
+			Default:    MergeFirstWins,
+			Properties: map[string]string{prefix + ":Friend": MergeUnion},
+			Provenance: true,
+		})).To(BeNil())
+		e, err := store.GetEntity(prefix+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		provenance := e.Properties[ProvenanceURI].(*Entity)
+		Expect(provenance.Properties[prefix+":Name"]).To(Equal("crm"))
+		Expect(provenance.Properties[prefix+":Friend"]).To(Equal([]interface{}{"crm", "hr"}))
+	})
+
+	ginkgo.It("Should merge entities fetched without partial merging", func() {
+		e, err := store.GetEntity(prefix+":person-1", nil, false)
+		Expect(err).To(BeNil())
+		policy := &MergePolicy{Datasets: []string{"hr"}, Default: MergeFirstWins}
+		Expect(policy.Resolve(store.NamespaceManager)).To(BeNil())
+		merged := policy.MergeMultiOriginEntity(store.NamespaceManager, e)
+		Expect(merged.Properties).NotTo(HaveKey(DatasetNameURI))
+		Expect(merged.Properties).NotTo(HaveKey(PartialsURI))
+		Expect(merged.Properties[prefix+":Name"]).To(Equal("Lisa Smith"))
+	})
+
+	ginkgo.It("Should reject unknown strategies and prefixes", func() {
+		Expect(store.SetMergePolicy(&MergePolicy{Default: "lastWins"})).NotTo(BeNil())
+		Expect(store.SetMergePolicy(&MergePolicy{Properties: map[string]string{"nope:Name": MergeUnion}})).NotTo(BeNil())
+		Expect(store.MergePolicy()).To(BeNil())
+	})
+
+	ginkgo.It("Should keep the policy across restarts and go back to appending when removed", func() {
+		Expect(store.SetMergePolicy(&MergePolicy{Default: MergeFirstWins, Datasets: []string{"hr"}})).To(BeNil())
+		Expect(store.Close()).To(BeNil())
+		store = NewStore(env, &statsd.NoOpClient{})
+		Expect(store.MergePolicy()).NotTo(BeNil())
+		Expect(store.MergePolicy().Datasets).To(Equal([]string{"hr"}))
+
+		Expect(store.SetMergePolicy(nil)).To(BeNil())
+		Expect(store.MergePolicy()).To(BeNil())
+		dsm = NewDsManager(env, store, NoOpBus())
+		e, err := store.GetEntity(prefix+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties[prefix+":Email"]).To(Equal([]interface{}{"lisa@crm", "lisa@crm"}))
+	})
+})
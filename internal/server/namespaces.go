@@ -0,0 +1,529 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+
+	"github.com/dgraph-io/badger/v4"
+)
+
+// Entities are stored with CURIEs using the generated prefixes (ns0, ns1, ...) and these never change.
+// Public prefixes are human-friendly names for the generated prefixes. They are used in contexts and
+// entities returned from the api, and are accepted wherever a CURIE is accepted as input.
+
+var validPrefix = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_.-]*$`)
+
+// reservedPrefixes are common uri schemes. A public prefix with one of these names would turn full uris
+// given as input into CURIEs of the mapping.
+var reservedPrefixes = map[string]bool{
+	"http": true, "https": true, "urn": true, "mailto": true, "file": true, "ftp": true, "ftps": true,
+	"tel": true, "data": true, "tag": true, "did": true, "ws": true, "wss": true, "ldap": true,
+}
+
+// NamespaceUsage describes a namespace mapping and how much it is used in the store
+type NamespaceUsage struct {
+	Prefix           string   `json:"prefix"`
+	StoragePrefix    string   `json:"storagePrefix"`
+	Expansion        string   `json:"expansion"`
+	Identifiers      int      `json:"identifiers"`
+	PublicNamespaces []string `json:"publicNamespaces,omitempty"` // datasets using this as a public namespace
+}
+
+// isPrefixTaken checks both storage and public prefixes. The caller must hold the lock.
+func (namespaceManager *NamespaceManager) isPrefixTaken(prefix string) bool {
+	if _, ok := namespaceManager.prefixToExpansionMapping[prefix]; ok {
+		return true
+	}
+	for _, public := range namespaceManager.publicPrefixes {
+		if public == prefix {
+			return true
+		}
+	}
+	return false
+}
+
+// storagePrefix resolves a public or storage prefix to the storage prefix. The caller must hold the lock.
+func (namespaceManager *NamespaceManager) storagePrefix(prefix string) (string, bool) {
+	if _, ok := namespaceManager.prefixToExpansionMapping[prefix]; ok {
+		return prefix, true
+	}
+	for storage, public := range namespaceManager.publicPrefixes {
+		if public == prefix {
+			return storage, true
+		}
+	}
+	return "", false
+}
+
+// AssignPrefix makes prefix the public prefix for the given expansion, creating the
+// mapping if the expansion is not yet known
+func (namespaceManager *NamespaceManager) AssignPrefix(uriExpansion string, prefix string) error {
+	if uriExpansion == "" {
+		return errors.New("expansion cannot be empty")
+	}
+	if !validPrefix.MatchString(prefix) {
+		return fmt.Errorf("invalid prefix %q", prefix)
+	}
+	if reservedPrefixes[strings.ToLower(prefix)] {
+		return fmt.Errorf("prefix %q is reserved for a uri scheme", prefix)
+	}
+	storage, err := namespaceManager.AssertPrefixMappingForExpansion(uriExpansion)
+	if err != nil {
+		return err
+	}
+
+	namespaceManager.lock.Lock()
+	defer namespaceManager.lock.Unlock()
+	current := namespaceManager.publicPrefixes[storage]
+	if prefix == current || (prefix == storage && current == "") {
+		return nil
+	}
+	if prefix != storage && namespaceManager.isPrefixTaken(prefix) {
+		return fmt.Errorf("prefix %s is already in use", prefix)
+	}
+	if prefix == storage {
+		delete(namespaceManager.publicPrefixes, storage)
+	} else {
+		namespaceManager.publicPrefixes[storage] = prefix
+	}
+	return namespaceManager.storeState()
+}
+
+// RenamePrefix changes the public prefix of the mapping currently known as oldPrefix
+func (namespaceManager *NamespaceManager) RenamePrefix(oldPrefix string, newPrefix string) error {
+	namespaceManager.lock.Lock()
+	storage, ok := namespaceManager.storagePrefix(oldPrefix)
+	expansion := namespaceManager.prefixToExpansionMapping[storage]
+	namespaceManager.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("unknown prefix %s", oldPrefix)
+	}
+	return namespaceManager.AssignPrefix(expansion, newPrefix)
+}
+
+// PublicPrefix returns the prefix shown to api consumers for a storage prefix
+func (namespaceManager *NamespaceManager) PublicPrefix(storagePrefix string) string {
+	namespaceManager.lock.Lock()
+	defer namespaceManager.lock.Unlock()
+	if public, ok := namespaceManager.publicPrefixes[storagePrefix]; ok {
+		return public
+	}
+	return storagePrefix
+}
+
+// PublicCurie translates a stored CURIE into one using the public prefix
+func (namespaceManager *NamespaceManager) PublicCurie(curie string) string {
+	namespaceManager.lock.Lock()
+	defer namespaceManager.lock.Unlock()
+	return publicCurie(curie, namespaceManager.publicPrefixes)
+}
+
+// StorageCurie translates a CURIE using a public prefix into the CURIE used in the store.
+// Other values are returned unchanged.
+func (namespaceManager *NamespaceManager) StorageCurie(curie string) string {
+	idx := strings.Index(curie, ":")
+	if idx == -1 {
+		return curie
+	}
+	namespaceManager.lock.Lock()
+	defer namespaceManager.lock.Unlock()
+	if len(namespaceManager.publicPrefixes) == 0 {
+		return curie
+	}
+	if storage, ok := namespaceManager.storagePrefix(curie[:idx]); ok {
+		return storage + curie[idx:]
+	}
+	return curie
+}
+
+// HasPublicPrefixes is true if any mapping has been given a public prefix
+func (namespaceManager *NamespaceManager) HasPublicPrefixes() bool {
+	namespaceManager.lock.Lock()
+	defer namespaceManager.lock.Unlock()
+	return len(namespaceManager.publicPrefixes) > 0
+}
+
+// PublicContext returns a copy of the context with storage prefixes replaced by public prefixes
+func (namespaceManager *NamespaceManager) PublicContext(context *Context) *Context {
+	namespaceManager.lock.Lock()
+	defer namespaceManager.lock.Unlock()
+	namespaces := make(map[string]string, len(context.Namespaces))
+	for prefix, expansion := range context.Namespaces {
+		if public, ok := namespaceManager.publicPrefixes[prefix]; ok {
+			prefix = public
+		}
+		namespaces[prefix] = expansion
+	}
+	return &Context{ID: context.ID, Namespaces: namespaces}
+}
+
+// PublicEntity returns a copy of the entity with all CURIEs using public prefixes
+func (namespaceManager *NamespaceManager) PublicEntity(entity *Entity) *Entity {
+	namespaceManager.lock.Lock()
+	public := make(map[string]string, len(namespaceManager.publicPrefixes))
+	for k, v := range namespaceManager.publicPrefixes {
+		public[k] = v
+	}
+	namespaceManager.lock.Unlock()
+	if len(public) == 0 || entity == nil {
+		return entity
+	}
+	return publicEntity(entity, public)
+}
+
+// PublicEntityJSON rewrites a serialised entity to use public prefixes
+func (namespaceManager *NamespaceManager) PublicEntityJSON(jsonData []byte) ([]byte, error) {
+	if !namespaceManager.HasPublicPrefixes() {
+		return jsonData, nil
+	}
+	entity := &Entity{}
+	err := json.Unmarshal(jsonData, entity)
+	if err != nil {
+		return nil, err
+	}
+	return json.Marshal(namespaceManager.PublicEntity(entity))
+}
+
+func publicEntity(entity *Entity, public map[string]string) *Entity {
+	result := *entity
+	result.ID = publicCurie(entity.ID, public)
+	result.Properties = make(map[string]any, len(entity.Properties))
+	for k, v := range entity.Properties {
+		result.Properties[publicCurie(k, public)] = publicPropertyValue(v, public)
+	}
+	result.References = make(map[string]any, len(entity.References))
+	for k, v := range entity.References {
+		switch refs := v.(type) {
+		case string:
+			v = publicCurie(refs, public)
+		case []string:
+			l := make([]string, len(refs))
+			for i, ref := range refs {
+				l[i] = publicCurie(ref, public)
+			}
+			v = l
+		case []any:
+			l := make([]any, len(refs))
+			for i, ref := range refs {
+				if s, ok := ref.(string); ok {
+					l[i] = publicCurie(s, public)
+				} else {
+					l[i] = ref
+				}
+			}
+			v = l
+		}
+		result.References[publicCurie(k, public)] = v
+	}
+	return &result
+}
+
+// publicPropertyValue rewrites nested entities in property values
+func publicPropertyValue(value any, public map[string]string) any {
+	switch v := value.(type) {
+	case *Entity:
+		return publicEntity(v, public)
+	case []any:
+		l := make([]any, len(v))
+		for i, item := range v {
+			l[i] = publicPropertyValue(item, public)
+		}
+		return l
+	case map[string]any:
+		if _, isEntity := v["id"]; !isEntity {
+			return v
+		}
+		nested := &Entity{}
+		jsonData, err := json.Marshal(v)
+		if err != nil || json.Unmarshal(jsonData, nested) != nil {
+			return v
+		}
+		return publicEntity(nested, public)
+	}
+	return value
+}
+
+func publicCurie(curie string, public map[string]string) string {
+	idx := strings.Index(curie, ":")
+	if idx == -1 {
+		return curie
+	}
+	if p, ok := public[curie[:idx]]; ok {
+		return p + curie[idx:]
+	}
+	return curie
+}
+
+// NamespaceUsage lists all namespace mappings with the number of entity and predicate
+// identifiers stored using them, and the datasets that expose them as public namespaces
+func (s *Store) NamespaceUsage() ([]*NamespaceUsage, error) {
+	nsm := s.NamespaceManager
+	nsm.lock.Lock()
+	usages := make(map[string]*NamespaceUsage, len(nsm.prefixToExpansionMapping))
+	for prefix, expansion := range nsm.prefixToExpansionMapping {
+		public := prefix
+		if p, ok := nsm.publicPrefixes[prefix]; ok {
+			public = p
+		}
+		usages[prefix] = &NamespaceUsage{Prefix: public, StoragePrefix: prefix, Expansion: expansion}
+	}
+	nsm.lock.Unlock()
+
+	uriIndex := make([]byte, 2)
+	binary.BigEndian.PutUint16(uriIndex, URIToIDIndexID)
+	err := s.database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = uriIndex
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(uriIndex); it.ValidForPrefix(uriIndex); it.Next() {
+			uri := it.Item().Key()[2:]
+			if idx := bytes.IndexByte(uri, ':'); idx != -1 {
+				if usage, ok := usages[string(uri[:idx])]; ok {
+					usage.Identifiers++
+				}
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	s.datasets.Range(func(_, value any) bool {
+		ds := value.(*Dataset)
+		for _, expansion := range ds.PublicNamespaces {
+			for _, usage := range usages {
+				if usage.Expansion == expansion {
+					usage.PublicNamespaces = append(usage.PublicNamespaces, ds.ID)
+				}
+			}
+		}
+		return true
+	})
+
+	result := make([]*NamespaceUsage, 0, len(usages))
+	for _, usage := range usages {
+		sort.Strings(usage.PublicNamespaces)
+		result = append(result, usage)
+	}
+	sort.Slice(result, func(i, j int) bool { return result[i].Expansion < result[j].Expansion })
+	return result, nil
+}
+
+// RemoveNamespace removes the mapping for a public or storage prefix. Mappings that are used in
+// stored entities or as a public namespace of a dataset cannot be removed. Property names and nested
+// entities are not in the identifier index, so the stored entities are read to find them. That read
+// runs without the lock and stops when ctx is done; entities written while it ran are read again,
+// with the lock held, before the mapping is removed.
+func (s *Store) RemoveNamespace(ctx context.Context, prefix string) error {
+	nsm := s.NamespaceManager
+	nsm.lock.Lock()
+	storage, err := s.checkNamespaceRemovable(prefix)
+	nsm.lock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	used, readTs, err := s.isPrefixUsedInEntities(ctx, storage, 0)
+	if err != nil {
+		return err
+	}
+	if used {
+		return fmt.Errorf("prefix %s is used in stored entities", prefix)
+	}
+
+	nsm.lock.Lock()
+	defer nsm.lock.Unlock()
+	if current, err := s.checkNamespaceRemovable(prefix); err != nil {
+		return err
+	} else if current != storage {
+		return fmt.Errorf("prefix %s was changed while it was removed", prefix)
+	}
+	used, _, err = s.isPrefixUsedInEntities(ctx, storage, readTs)
+	if err != nil {
+		return err
+	}
+	if used {
+		return fmt.Errorf("prefix %s is used in stored entities", prefix)
+	}
+
+	expansion := nsm.prefixToExpansionMapping[storage]
+	delete(nsm.expansionToPrefixMapping, expansion)
+	delete(nsm.prefixToExpansionMapping, storage)
+	delete(nsm.publicPrefixes, storage)
+	return nsm.storeState()
+}
+
+// checkNamespaceRemovable resolves the storage prefix and checks the identifier index and the public
+// namespaces of datasets. The caller must hold the lock.
+func (s *Store) checkNamespaceRemovable(prefix string) (string, error) {
+	nsm := s.NamespaceManager
+	storage, ok := nsm.storagePrefix(prefix)
+	if !ok {
+		return "", fmt.Errorf("unknown prefix %s", prefix)
+	}
+	used, err := s.isPrefixUsedInIdentifiers(storage)
+	if err != nil {
+		return "", err
+	}
+	if used {
+		return "", fmt.Errorf("prefix %s is used in stored entities", prefix)
+	}
+	expansion := nsm.prefixToExpansionMapping[storage]
+	var datasets []string
+	s.datasets.Range(func(_, value any) bool {
+		ds := value.(*Dataset)
+		for _, e := range ds.PublicNamespaces {
+			if e == expansion {
+				datasets = append(datasets, ds.ID)
+			}
+		}
+		return true
+	})
+	if len(datasets) > 0 {
+		sort.Strings(datasets)
+		return "", fmt.Errorf("prefix %s is a public namespace of %s", prefix, strings.Join(datasets, ", "))
+	}
+	return storage, nil
+}
+
+// isPrefixUsedInIdentifiers looks for the first entity or predicate identifier stored with the prefix
+func (s *Store) isPrefixUsedInIdentifiers(storagePrefix string) (bool, error) {
+	prefix := make([]byte, 2, 2+len(storagePrefix)+1)
+	binary.BigEndian.PutUint16(prefix, URIToIDIndexID)
+	prefix = append(prefix, storagePrefix+":"...)
+	used := false
+	err := s.database.View(func(txn *badger.Txn) error {
+		opts := badger.DefaultIteratorOptions
+		opts.PrefetchValues = false
+		opts.Prefix = prefix
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		it.Seek(prefix)
+		used = it.ValidForPrefix(prefix)
+		return nil
+	})
+	return used, err
+}
+
+// isPrefixUsedInEntities reads the stored entities written after sinceTs (all of them when it is 0), and
+// returns true at the first one with a CURIE using the storage prefix. The read timestamp is returned so
+// that a later call only reads what was written since.
+func (s *Store) isPrefixUsedInEntities(ctx context.Context, storagePrefix string, sinceTs uint64) (bool, uint64, error) {
+	// entities without the prefix anywhere in their json are skipped without parsing them
+	quoted := []byte(`"` + storagePrefix + ":")
+	entityIndex := make([]byte, 2)
+	binary.BigEndian.PutUint16(entityIndex, EntityIDToJSONIndexID)
+	used := false
+	var readTs uint64
+	err := s.database.View(func(txn *badger.Txn) error {
+		readTs = txn.ReadTs()
+		opts := badger.DefaultIteratorOptions
+		opts.Prefix = entityIndex
+		opts.SinceTs = sinceTs
+		it := txn.NewIterator(opts)
+		defer it.Close()
+		for it.Seek(entityIndex); it.ValidForPrefix(entityIndex) && !used; it.Next() {
+			if err := ctx.Err(); err != nil {
+				return err
+			}
+			err := it.Item().Value(func(val []byte) error {
+				if !bytes.Contains(val, quoted) {
+					return nil
+				}
+				e := &Entity{}
+				if err := json.Unmarshal(val, e); err != nil {
+					return err
+				}
+				prefixes := make(map[string]bool)
+				collectPropertyPrefixes(e, false, prefixes)
+				used = prefixes[storagePrefix]
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	return used, readTs, err
+}
+
+// collectPropertyPrefixes adds the prefixes of the property names of an entity. Nested entities are
+// not in the identifier index, so all their CURIEs are added.
+func collectPropertyPrefixes(entity *Entity, nested bool, prefixes map[string]bool) {
+	if nested {
+		addCuriePrefix(entity.ID, prefixes)
+		for k, v := range entity.References {
+			addCuriePrefix(k, prefixes)
+			switch refs := v.(type) {
+			case string:
+				addCuriePrefix(refs, prefixes)
+			case []string:
+				for _, ref := range refs {
+					addCuriePrefix(ref, prefixes)
+				}
+			case []any:
+				for _, ref := range refs {
+					if s, ok := ref.(string); ok {
+						addCuriePrefix(s, prefixes)
+					}
+				}
+			}
+		}
+	}
+	for k, v := range entity.Properties {
+		addCuriePrefix(k, prefixes)
+		collectNestedPrefixes(v, prefixes)
+	}
+}
+
+func collectNestedPrefixes(value any, prefixes map[string]bool) {
+	switch v := value.(type) {
+	case *Entity:
+		collectPropertyPrefixes(v, true, prefixes)
+	case []any:
+		for _, item := range v {
+			collectNestedPrefixes(item, prefixes)
+		}
+	case map[string]any:
+		if _, isEntity := v["id"]; !isEntity {
+			return
+		}
+		nested := &Entity{}
+		jsonData, err := json.Marshal(v)
+		if err != nil || json.Unmarshal(jsonData, nested) != nil {
+			return
+		}
+		collectPropertyPrefixes(nested, true, prefixes)
+	}
+}
+
+func addCuriePrefix(curie string, prefixes map[string]bool) {
+	if idx := strings.Index(curie, ":"); idx > 0 {
+		prefixes[curie[:idx]] = true
+	}
+}
@@ -0,0 +1,174 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("The namespace manager", func() {
+	testCnt := 0
+	var dsm *DsManager
+	var store *Store
+	var storeLocation string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_namespaces_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{
+			Logger:        zap.NewNop().Sugar(),
+			StoreLocation: storeLocation,
+		}
+		store = NewStore(e, &statsd.NoOpClient{})
+		dsm = NewDsManager(e, store, NoOpBus())
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	ginkgo.It("should use public prefixes in output and accept them as input", func() {
+		nsm := store.NamespaceManager
+		ds, _ := dsm.CreateDataset("people", nil)
+		prefix, _ := nsm.AssertPrefixMappingForExpansion("http://data.mimiro.io/people/")
+		entity := NewEntity(prefix+":homer", 0)
+		entity.Properties[prefix+":name"] = "homer"
+		entity.References[prefix+":friend"] = prefix + ":marge"
+		Expect(ds.StoreEntities([]*Entity{entity})).To(Succeed())
+
+		Expect(nsm.RenamePrefix(prefix, "people")).To(Succeed())
+		Expect(nsm.RenamePrefix(prefix, "ns0")).NotTo(Succeed(), "prefix in use")
+		Expect(nsm.RenamePrefix(prefix, "1nvalid")).NotTo(Succeed())
+
+		public := nsm.PublicEntity(entity)
+		Expect(public.ID).To(Equal("people:homer"))
+		Expect(public.Properties["people:name"]).To(Equal("homer"))
+		Expect(public.References["people:friend"]).To(Equal("people:marge"))
+		Expect(entity.ID).To(Equal(prefix+":homer"), "original entity must not change")
+
+		jsonData, _ := json.Marshal(entity)
+		publicJSON, err := nsm.PublicEntityJSON(jsonData)
+		Expect(err).To(BeNil())
+		Expect(string(publicJSON)).To(ContainSubstring(`"id":"people:homer"`))
+
+		Expect(nsm.PublicContext(ds.GetContext()).Namespaces["people"]).To(Equal("http://data.mimiro.io/people/"))
+
+		found, err := store.GetEntity("people:homer", nil, true)
+		Expect(err).To(BeNil())
+		Expect(found).NotTo(BeNil())
+		Expect(found.ID).To(Equal(prefix + ":homer"))
+		expanded, _ := nsm.ExpandCurie("people:homer")
+		Expect(expanded).To(Equal("http://data.mimiro.io/people/homer"))
+
+		// survives restart
+		_ = store.Close()
+		Expect(store.Open()).To(Succeed())
+		Expect(store.NamespaceManager.PublicPrefix(prefix)).To(Equal("people"))
+
+		// renaming back to the storage prefix removes the public prefix
+		Expect(store.NamespaceManager.RenamePrefix("people", prefix)).To(Succeed())
+		Expect(store.NamespaceManager.HasPublicPrefixes()).To(BeFalse())
+	})
+
+	ginkgo.It("should assign prefixes to new expansions", func() {
+		nsm := store.NamespaceManager
+		Expect(nsm.AssignPrefix("http://example.com/places/", "places")).To(Succeed())
+		storage, err := nsm.GetPrefixMappingForExpansion("http://example.com/places/")
+		Expect(err).To(BeNil())
+		Expect(nsm.PublicPrefix(storage)).To(Equal("places"))
+		Expect(nsm.AssignPrefix("http://example.com/other/", "places")).NotTo(Succeed())
+		Expect(nsm.AssignPrefix("http://example.com/other/", "urn")).NotTo(Succeed(), "reserved uri scheme")
+		Expect(nsm.AssignPrefix("http://example.com/other/", "Mailto")).NotTo(Succeed(), "reserved uri scheme")
+	})
+
+	ginkgo.It("should count usage and only remove unused mappings", func() {
+		nsm := store.NamespaceManager
+		ds, _ := dsm.CreateDataset("people", &CreateDatasetConfig{PublicNamespaces: []string{"http://example.com/exposed/"}})
+		used, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/used/")
+		propertyOnly, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/props/")
+		unused, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/unused/")
+		_, _ = nsm.AssertPrefixMappingForExpansion("http://example.com/exposed/")
+		entity := NewEntity(used+":homer", 0)
+		entity.Properties[propertyOnly+":name"] = "homer"
+		Expect(ds.StoreEntities([]*Entity{entity})).To(Succeed())
+
+		usages, err := store.NamespaceUsage()
+		Expect(err).To(BeNil())
+		byExpansion := map[string]*NamespaceUsage{}
+		for _, u := range usages {
+			byExpansion[u.Expansion] = u
+		}
+		Expect(byExpansion["http://example.com/used/"].Identifiers).To(Equal(1))
+		Expect(byExpansion["http://example.com/unused/"].Identifiers).To(Equal(0))
+		Expect(byExpansion["http://example.com/exposed/"].PublicNamespaces).To(Equal([]string{"people"}))
+
+		Expect(store.RemoveNamespace(context.Background(), used)).NotTo(Succeed())
+		Expect(store.RemoveNamespace(context.Background(), propertyOnly)).NotTo(Succeed())
+		Expect(store.RemoveNamespace(context.Background(), "http://example.com/exposed/")).NotTo(Succeed())
+		exposed, _ := nsm.GetPrefixMappingForExpansion("http://example.com/exposed/")
+		Expect(store.RemoveNamespace(context.Background(), exposed)).NotTo(Succeed())
+		Expect(store.RemoveNamespace(context.Background(), unused)).To(Succeed())
+		_, err = nsm.GetPrefixMappingForExpansion("http://example.com/unused/")
+		Expect(err).NotTo(BeNil())
+
+		// new mappings must not reuse a prefix that is taken or was removed, also after a restart
+		last, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/last/")
+		Expect(store.RemoveNamespace(context.Background(), last)).To(Succeed())
+		next, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/next/")
+		Expect(next).NotTo(BeElementOf(used, propertyOnly, exposed, unused, last))
+		_ = store.Close()
+		Expect(store.Open()).To(Succeed())
+		after, _ := store.NamespaceManager.AssertPrefixMappingForExpansion("http://example.com/after/")
+		Expect(after).NotTo(BeElementOf(used, propertyOnly, exposed, unused, last, next))
+	})
+
+	ginkgo.It("should find prefixes in nested entities, and stop reading entities when cancelled", func() {
+		nsm := store.NamespaceManager
+		ds, _ := dsm.CreateDataset("people", nil)
+		people, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/people/")
+		nestedID, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/addresses/")
+		nestedProp, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/address-props/")
+		unused, _ := nsm.AssertPrefixMappingForExpansion("http://example.com/unused/")
+
+		address := NewEntity(nestedID+":1", 0)
+		address.Properties[nestedProp+":street"] = "evergreen terrace"
+		entity := NewEntity(people+":homer", 0)
+		entity.Properties[people+":address"] = address
+		Expect(ds.StoreEntities([]*Entity{entity})).To(Succeed())
+
+		_ = store.Close()
+		Expect(store.Open()).To(Succeed())
+		Expect(store.RemoveNamespace(context.Background(), nestedID)).NotTo(Succeed())
+		Expect(store.RemoveNamespace(context.Background(), nestedProp)).NotTo(Succeed())
+
+		cancelled, cancel := context.WithCancel(context.Background())
+		cancel()
+		Expect(store.RemoveNamespace(cancelled, unused)).To(MatchError(context.Canceled))
+		_, err := nsm.GetPrefixMappingForExpansion("http://example.com/unused/")
+		Expect(err).To(BeNil(), "not removed when the read was cancelled")
+		Expect(store.RemoveNamespace(context.Background(), unused)).To(Succeed())
+	})
+})
@@ -33,6 +33,7 @@ type ProxyDataset struct {
 	RemoteChangesURL  string
 	RemoteEntitiesURL string
 	auth              func(req *http.Request)
+	limiter           *RateLimiter
 }
 
 func (ds *Dataset) IsProxy() bool {
@@ -44,9 +45,28 @@ func (ds *Dataset) AsProxy(auth func(req *http.Request)) *ProxyDataset {
 	res.RemoteChangesURL, _ = URLJoin(ds.ProxyConfig.RemoteURL, "/changes")
 	res.RemoteEntitiesURL, _ = URLJoin(ds.ProxyConfig.RemoteURL, "/entities")
 	res.auth = auth
+	// entities are not counted for proxy requests, they are only limited in requests and concurrent requests
+	res.limiter = ds.store.RateLimiters.For(ds.ProxyConfig.RateLimit, ds.ProxyConfig.RemoteURL, ds.ProxyConfig.AuthProviderName)
 	return res
 }
 
+func rateLimitOwner(dataset string) string {
+	return "dataset:" + dataset
+}
+
+// configureRateLimit sets the limit that a proxy dataset puts on the requests to its remote dataset
+func (ds *Dataset) configureRateLimit() {
+	if !ds.IsProxy() {
+		ds.store.RateLimiters.Remove(rateLimitOwner(ds.ID))
+		return
+	}
+	ds.store.RateLimiters.Configure(rateLimitOwner(ds.ID), []RateLimitUse{{
+		Limit:         ds.ProxyConfig.RateLimit,
+		URL:           ds.ProxyConfig.RemoteURL,
+		LoginProvider: ds.ProxyConfig.AuthProviderName,
+	}})
+}
+
 func URLJoin(baseURL string, elem ...string) (result string, err error) {
 	u, err := url.Parse(baseURL)
 	if err != nil {
@@ -86,10 +106,16 @@ func (d *ProxyDataset) StreamEntitiesRaw(
 		return "", err
 	}
 	d.auth(req)
-	res, err := http.DefaultClient.Do(req)
+	AcceptCompressedResponses(req)
+	res, err := d.limiter.Do(http.DefaultClient, req, 0)
 	if err != nil {
 		return "", err
 	}
+	if err = DecodeResponse(res); err != nil {
+		res.Body.Close()
+		return "", err
+	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return "", errors.New("Proxy target responded with status " + res.Status)
@@ -147,10 +173,16 @@ func (d *ProxyDataset) StreamEntities(from string, limit int, f func(*Entity) er
 		return "", err
 	}
 	d.auth(req)
-	res, err := http.DefaultClient.Do(req)
+	AcceptCompressedResponses(req)
+	res, err := d.limiter.Do(http.DefaultClient, req, 0)
 	if err != nil {
 		return "", err
 	}
+	if err = DecodeResponse(res); err != nil {
+		res.Body.Close()
+		return "", err
+	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return "", errors.New("Proxy target responded with status " + res.Status)
@@ -223,10 +255,16 @@ func (d *ProxyDataset) StreamChangesRaw(
 		return "", err
 	}
 	d.auth(req)
-	res, err := http.DefaultClient.Do(req)
+	AcceptCompressedResponses(req)
+	res, err := d.limiter.Do(http.DefaultClient, req, 0)
 	if err != nil {
 		return "", err
 	}
+	if err = DecodeResponse(res); err != nil {
+		res.Body.Close()
+		return "", err
+	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return "", errors.New("Proxy target responded with status " + res.Status)
@@ -291,10 +329,16 @@ func (d *ProxyDataset) StreamChanges(since string, limit int, latestOnly bool, r
 		return "", err
 	}
 	d.auth(req)
-	res, err := http.DefaultClient.Do(req)
+	AcceptCompressedResponses(req)
+	res, err := d.limiter.Do(http.DefaultClient, req, 0)
 	if err != nil {
 		return "", err
 	}
+	if err = DecodeResponse(res); err != nil {
+		res.Body.Close()
+		return "", err
+	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return "", errors.New("Proxy target responded with status " + res.Status)
@@ -327,18 +371,35 @@ func (d *ProxyDataset) StreamChanges(since string, limit int, latestOnly bool, r
 func (d *ProxyDataset) ForwardEntities(sourceBody io.ReadCloser, sourceHeader http.Header) error {
 	ctx, cancel := context.WithTimeout(context.Background(), 1000*time.Millisecond)
 	defer cancel()
-	req, _ := http.NewRequestWithContext(ctx, "POST", d.RemoteEntitiesURL, sourceBody)
-	for k, v := range sourceHeader {
-		if strings.HasPrefix(strings.ToLower(k), "universal-data-api") {
-			for _, val := range v {
-				req.Header.Add(k, val)
+	// the body is kept, so that it can be sent again uncompressed if the remote turns compression down
+	body, err := io.ReadAll(sourceBody)
+	if err != nil {
+		return err
+	}
+	res, err := SendCompressed(d.RemoteEntitiesURL, body, func(req *http.Request) (*http.Response, error) {
+		return d.limiter.Do(http.DefaultClient, req, 0)
+	}, func(r io.Reader) (*http.Request, error) {
+		req, err := http.NewRequestWithContext(ctx, "POST", d.RemoteEntitiesURL, r)
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range sourceHeader {
+			if strings.HasPrefix(strings.ToLower(k), "universal-data-api") {
+				for _, val := range v {
+					req.Header.Add(k, val)
+				}
 			}
 		}
-	}
-	res, err := http.DefaultClient.Do(req)
+		// entities may be posted as json, json-ld, csv or rdf, the remote parses them by their content type
+		if contentType := sourceHeader.Get("Content-Type"); contentType != "" {
+			req.Header.Set("Content-Type", contentType)
+		}
+		return req, nil
+	})
 	if err != nil {
 		return err
 	}
+	defer res.Body.Close()
 
 	if res.StatusCode != 200 {
 		return errors.New("Proxy target responded with status " + res.Status)
@@ -0,0 +1,363 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"errors"
+	"io"
+	"math"
+	"net/http"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	RateLimitPerHost          = "host"
+	RateLimitPerLoginProvider = "loginProvider"
+)
+
+// RateLimit limits the requests sent to a remote service. Zero values mean no limit.
+type RateLimit struct {
+	RequestsPerSecond  float64 `json:"requestsPerSecond,omitempty"`
+	EntitiesPerSecond  float64 `json:"entitiesPerSecond,omitempty"`
+	ConcurrentRequests int     `json:"concurrentRequests,omitempty"`
+	Per                string  `json:"per,omitempty"` // host (default) or loginProvider
+}
+
+// Validate returns an error for negative limits, and for limits that are not per host or login provider
+func (l *RateLimit) Validate() error {
+	if l.RequestsPerSecond < 0 || l.EntitiesPerSecond < 0 || l.ConcurrentRequests < 0 {
+		return errors.New("rate limits can not be negative")
+	}
+	if l.Per != "" && l.Per != RateLimitPerHost && l.Per != RateLimitPerLoginProvider {
+		return errors.New("rate limit must be per " + RateLimitPerHost + " or " + RateLimitPerLoginProvider)
+	}
+	return nil
+}
+
+// RateLimiterState is the limit and current use of a shared rate limiter
+type RateLimiterState struct {
+	Key      string    `json:"key"`
+	Limit    RateLimit `json:"limit"`
+	InFlight int       `json:"inFlight"`
+}
+
+// RateLimitUse is a limit that a job or proxy dataset puts on the requests it sends to a url
+type RateLimitUse struct {
+	Limit         *RateLimit
+	URL           string
+	LoginProvider string
+}
+
+// RateLimiters holds the limiters shared by the jobs and proxy datasets of a data hub, keyed on the host or the
+// login provider they limit. The limit of a key is the most restrictive of the limits that the jobs and datasets
+// configure for it right now, so a limit is loosened again when the job or dataset that set it changes or goes away.
+type RateLimiters struct {
+	lock     sync.Mutex
+	owners   map[string]map[string]RateLimit // job or dataset => key => limit
+	limiters map[string]*RateLimiter
+}
+
+func NewRateLimiters() *RateLimiters {
+	return &RateLimiters{owners: make(map[string]map[string]RateLimit), limiters: make(map[string]*RateLimiter)}
+}
+
+// rateLimitKey returns the host of rawURL, or the login provider when the limit is per login provider. A limit
+// per login provider without a login provider falls back to the host.
+func rateLimitKey(limit *RateLimit, rawURL string, loginProvider string) (string, bool) {
+	if limit.Per == RateLimitPerLoginProvider && loginProvider != "" {
+		return RateLimitPerLoginProvider + ":" + strings.ToLower(loginProvider), true
+	}
+	u, err := url.Parse(rawURL)
+	if err != nil || u.Host == "" {
+		return "", false
+	}
+	return RateLimitPerHost + ":" + u.Host, true
+}
+
+// Configure replaces the limits set by a job or proxy dataset. Uses without a limit are left out.
+func (r *RateLimiters) Configure(owner string, uses []RateLimitUse) {
+	if r == nil {
+		return
+	}
+	owned := make(map[string]RateLimit)
+	for _, use := range uses {
+		if use.Limit == nil {
+			continue
+		}
+		key, ok := rateLimitKey(use.Limit, use.URL, use.LoginProvider)
+		if !ok {
+			continue
+		}
+		if limit, ok := owned[key]; ok {
+			owned[key] = strictestLimit(limit, *use.Limit)
+		} else {
+			owned[key] = *use.Limit
+		}
+	}
+
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	changed := make(map[string]bool)
+	for key := range r.owners[owner] {
+		changed[key] = true
+	}
+	for key := range owned {
+		changed[key] = true
+	}
+	if len(owned) == 0 {
+		delete(r.owners, owner)
+	} else {
+		r.owners[owner] = owned
+	}
+	for key := range changed {
+		limit := RateLimit{Per: strings.SplitN(key, ":", 2)[0]}
+		for _, o := range r.owners {
+			if l, ok := o[key]; ok {
+				limit = strictestLimit(limit, l)
+			}
+		}
+		r.limiter(key).setLimit(limit)
+	}
+}
+
+// Remove drops the limits set by a job or proxy dataset
+func (r *RateLimiters) Remove(owner string) {
+	r.Configure(owner, nil)
+}
+
+// For returns the limiter shared by all requests to the host of rawURL, or by all requests that log in with
+// loginProvider when limit is per login provider. It does not change any limit, the limiter enforces what the jobs
+// and datasets have configured for its host or login provider. It returns nil when limit is nil, which lets all
+// requests through.
+func (r *RateLimiters) For(limit *RateLimit, rawURL string, loginProvider string) *RateLimiter {
+	if r == nil || limit == nil {
+		return nil
+	}
+	key, ok := rateLimitKey(limit, rawURL, loginProvider)
+	if !ok {
+		return nil
+	}
+	r.lock.Lock()
+	defer r.lock.Unlock()
+	return r.limiter(key)
+}
+
+// limiter returns the limiter of a key, making an unlimited one if there is none. The caller must hold the lock.
+func (r *RateLimiters) limiter(key string) *RateLimiter {
+	l, ok := r.limiters[key]
+	if !ok {
+		l = &RateLimiter{key: key, released: make(chan struct{})}
+		r.limiters[key] = l
+	}
+	return l
+}
+
+// States returns the limiters that are limited or have requests underway, sorted by key
+func (r *RateLimiters) States() []RateLimiterState {
+	states := make([]RateLimiterState, 0)
+	if r == nil {
+		return states
+	}
+	r.lock.Lock()
+	limiters := make([]*RateLimiter, 0, len(r.limiters))
+	for _, l := range r.limiters {
+		limiters = append(limiters, l)
+	}
+	r.lock.Unlock()
+
+	for _, l := range limiters {
+		l.lock.Lock()
+		state := RateLimiterState{Key: l.key, Limit: l.limit, InFlight: l.inFlight}
+		l.lock.Unlock()
+		if state.InFlight > 0 || state.Limit != (RateLimit{Per: state.Limit.Per}) {
+			states = append(states, state)
+		}
+	}
+	sort.Slice(states, func(i, j int) bool { return states[i].Key < states[j].Key })
+	return states
+}
+
+// RateLimiter limits requests per second, entities per second and concurrent requests. A nil
+// RateLimiter lets everything through.
+type RateLimiter struct {
+	lock     sync.Mutex
+	key      string
+	limit    RateLimit // the most restrictive of the limits configured for the key
+	requests *rate.Limiter
+	entities *rate.Limiter
+	inFlight int
+	released chan struct{} // closed and replaced when a concurrent request is done
+}
+
+// setLimit changes the limit. The limiters already in use are adjusted rather than replaced, so the requests and
+// entities they have let through still count.
+func (l *RateLimiter) setLimit(limit RateLimit) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	l.limit = limit
+	// requests are spread evenly, entities may come in batches of up to a second's worth
+	l.requests = adjustLimiter(l.requests, limit.RequestsPerSecond, 1)
+	l.entities = adjustLimiter(l.entities, limit.EntitiesPerSecond, int(math.Ceil(limit.EntitiesPerSecond)))
+	// requests waiting for a concurrent request may go ahead if the limit was raised
+	close(l.released)
+	l.released = make(chan struct{})
+}
+
+// strictestLimit keeps the most restrictive value of each limit
+func strictestLimit(a RateLimit, b RateLimit) RateLimit {
+	return RateLimit{
+		RequestsPerSecond:  strictest(a.RequestsPerSecond, b.RequestsPerSecond),
+		EntitiesPerSecond:  strictest(a.EntitiesPerSecond, b.EntitiesPerSecond),
+		ConcurrentRequests: int(strictest(float64(a.ConcurrentRequests), float64(b.ConcurrentRequests))),
+		Per:                a.Per,
+	}
+}
+
+// strictest returns the lower of two limits, where 0 means no limit
+func strictest(a float64, b float64) float64 {
+	if a <= 0 || (b > 0 && b < a) {
+		return b
+	}
+	return a
+}
+
+func adjustLimiter(limiter *rate.Limiter, perSecond float64, burst int) *rate.Limiter {
+	if perSecond <= 0 {
+		return nil
+	}
+	if burst < 1 {
+		burst = 1
+	}
+	if limiter == nil {
+		return rate.NewLimiter(rate.Limit(perSecond), burst)
+	}
+	limiter.SetLimit(rate.Limit(perSecond))
+	limiter.SetBurst(burst)
+	return limiter
+}
+
+// Acquire waits until a request carrying the given number of entities can be sent. The returned
+// release func must be called when the response has been read.
+func (l *RateLimiter) Acquire(ctx context.Context, entities int) (func(), error) {
+	if l == nil {
+		return func() {}, nil
+	}
+	for {
+		l.lock.Lock()
+		if l.limit.ConcurrentRequests <= 0 || l.inFlight < l.limit.ConcurrentRequests {
+			l.inFlight++
+			requests := l.requests
+			l.lock.Unlock()
+			release := l.releaseOnce()
+			if requests != nil {
+				if err := requests.Wait(ctx); err != nil {
+					release()
+					return nil, err
+				}
+			}
+			if err := l.WaitEntities(ctx, entities); err != nil {
+				release()
+				return nil, err
+			}
+			return release, nil
+		}
+		released := l.released
+		l.lock.Unlock()
+		select {
+		case <-released:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (l *RateLimiter) releaseOnce() func() {
+	var once sync.Once
+	return func() {
+		once.Do(func() {
+			l.lock.Lock()
+			l.inFlight--
+			close(l.released)
+			l.released = make(chan struct{})
+			l.lock.Unlock()
+		})
+	}
+}
+
+// WaitEntities waits until the given number of entities can be sent or read
+func (l *RateLimiter) WaitEntities(ctx context.Context, n int) error {
+	if l == nil || n <= 0 {
+		return nil
+	}
+	l.lock.Lock()
+	entities := l.entities
+	l.lock.Unlock()
+	if entities == nil {
+		return nil
+	}
+	// batches larger than the burst are waited for a burst at a time
+	for n > 0 {
+		chunk := n
+		if chunk > entities.Burst() {
+			chunk = entities.Burst()
+		}
+		if err := entities.WaitN(ctx, chunk); err != nil {
+			return err
+		}
+		n -= chunk
+	}
+	return nil
+}
+
+// Doer sends http requests, like http.Client
+type Doer interface {
+	Do(req *http.Request) (*http.Response, error)
+}
+
+// Do sends req with client once the limiter lets it through. The concurrent request is counted until
+// the response body is closed.
+func (l *RateLimiter) Do(client Doer, req *http.Request, entities int) (*http.Response, error) {
+	if l == nil {
+		return client.Do(req)
+	}
+	release, err := l.Acquire(req.Context(), entities)
+	if err != nil {
+		return nil, err
+	}
+	res, err := client.Do(req)
+	if err != nil {
+		release()
+		return nil, err
+	}
+	res.Body = &releasingBody{ReadCloser: res.Body, release: release}
+	return res, nil
+}
+
+type releasingBody struct {
+	io.ReadCloser
+	release func()
+}
+
+func (b *releasingBody) Close() error {
+	err := b.ReadCloser.Close()
+	b.release()
+	return err
+}
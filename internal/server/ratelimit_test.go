@@ -0,0 +1,234 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("Rate limits", func() {
+	hostLimit := func(host string, limit RateLimit) []RateLimitUse {
+		return []RateLimitUse{{Limit: &limit, URL: host}}
+	}
+
+	ginkgo.It("Should share limiters per host, or per login provider", func() {
+		r := NewRateLimiters()
+		limit := &RateLimit{RequestsPerSecond: 10}
+		r.Configure("job:a", hostLimit("http://ratelimit-a.example.io/datasets/one/entities", *limit))
+		a := r.For(limit, "http://ratelimit-a.example.io/datasets/one/entities", "")
+		Expect(r.For(limit, "http://ratelimit-a.example.io/datasets/two/changes", "partner")).To(BeIdenticalTo(a))
+		Expect(r.For(limit, "http://ratelimit-b.example.io/", "")).NotTo(BeIdenticalTo(a))
+		Expect(r.For(nil, "http://ratelimit-a.example.io/", "")).To(BeNil())
+
+		perProvider := &RateLimit{ConcurrentRequests: 2, Per: RateLimitPerLoginProvider}
+		r.Configure("job:b", []RateLimitUse{{Limit: perProvider, URL: "http://ratelimit-a.example.io/", LoginProvider: "Partner"}})
+		p := r.For(perProvider, "http://ratelimit-a.example.io/", "Partner")
+		Expect(p).NotTo(BeIdenticalTo(a))
+		Expect(r.For(perProvider, "http://ratelimit-c.example.io/", "partner")).To(BeIdenticalTo(p))
+		Expect(r.For(perProvider, "http://ratelimit-a.example.io/", "")).To(BeIdenticalTo(a),
+			"without a login provider the host is limited")
+
+		keys := map[string]RateLimit{}
+		for _, s := range r.States() {
+			keys[s.Key] = s.Limit
+		}
+		Expect(keys).To(HaveKey("host:ratelimit-a.example.io"))
+		Expect(keys).NotTo(HaveKey("host:ratelimit-b.example.io"), "looking a limiter up does not limit it")
+		Expect(keys["loginProvider:partner"].ConcurrentRequests).To(Equal(2))
+
+		Expect((&RateLimit{Per: "dataset"}).Validate()).NotTo(BeNil())
+		Expect((&RateLimit{EntitiesPerSecond: -1}).Validate()).NotTo(BeNil())
+		Expect(perProvider.Validate()).To(BeNil())
+	})
+
+	ginkgo.It("Should keep the most restrictive of the configured limits, and loosen them again", func() {
+		r := NewRateLimiters()
+		host := "http://ratelimit-merge.example.io/"
+		r.Configure("job:a", hostLimit(host, RateLimit{RequestsPerSecond: 10, ConcurrentRequests: 2}))
+		l := r.For(&RateLimit{}, host, "")
+		requests := l.requests
+		Expect(l.entities).To(BeNil())
+
+		r.Configure("job:b", hostLimit(host, RateLimit{RequestsPerSecond: 5, EntitiesPerSecond: 100}))
+		r.Configure("job:c", hostLimit(host, RateLimit{ConcurrentRequests: 4}))
+		Expect(l.limit).To(Equal(RateLimit{RequestsPerSecond: 5, EntitiesPerSecond: 100, ConcurrentRequests: 2, Per: "host"}))
+		Expect(l.requests).To(BeIdenticalTo(requests), "the limiter is adjusted, not replaced")
+		Expect(float64(l.requests.Limit())).To(Equal(5.0))
+		Expect(l.entities.Burst()).To(Equal(100))
+
+		// an edited job no longer holds its old limit
+		r.Configure("job:b", hostLimit(host, RateLimit{RequestsPerSecond: 20}))
+		Expect(l.limit).To(Equal(RateLimit{RequestsPerSecond: 10, ConcurrentRequests: 2, Per: "host"}))
+		Expect(l.entities).To(BeNil())
+		r.Remove("job:a")
+		Expect(l.limit).To(Equal(RateLimit{RequestsPerSecond: 20, ConcurrentRequests: 4, Per: "host"}))
+		r.Remove("job:b")
+		r.Remove("job:c")
+		Expect(l.limit).To(Equal(RateLimit{Per: "host"}))
+		Expect(r.States()).To(BeEmpty())
+	})
+
+	ginkgo.It("Should limit concurrent requests until the response is closed", func() {
+		var inFlight, maxInFlight int32
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			n := atomic.AddInt32(&inFlight, 1)
+			for {
+				m := atomic.LoadInt32(&maxInFlight)
+				if n <= m || atomic.CompareAndSwapInt32(&maxInFlight, m, n) {
+					break
+				}
+			}
+			time.Sleep(20 * time.Millisecond)
+			atomic.AddInt32(&inFlight, -1)
+			_, _ = w.Write([]byte("[]"))
+		}))
+		defer srv.Close()
+
+		r := NewRateLimiters()
+		r.Configure("job:a", hostLimit(srv.URL, RateLimit{ConcurrentRequests: 2}))
+		l := r.For(&RateLimit{}, srv.URL, "")
+		var wg sync.WaitGroup
+		for i := 0; i < 6; i++ {
+			wg.Add(1)
+			go func() {
+				defer ginkgo.GinkgoRecover()
+				defer wg.Done()
+				req, _ := http.NewRequest("GET", srv.URL, nil)
+				res, err := l.Do(http.DefaultClient, req, 0)
+				Expect(err).To(BeNil())
+				_ = res.Body.Close()
+			}()
+		}
+		wg.Wait()
+		Expect(atomic.LoadInt32(&maxInFlight)).To(Equal(int32(2)))
+		Expect(r.States()).To(ContainElement(HaveField("InFlight", 0)))
+
+		// a waiting request gives up with its context
+		release, err := l.Acquire(context.Background(), 0)
+		Expect(err).To(BeNil())
+		_, _ = l.Acquire(context.Background(), 0)
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+		defer cancel()
+		_, err = l.Acquire(ctx, 0)
+		Expect(err).To(MatchError(context.DeadlineExceeded))
+		release()
+		release() // releasing twice is harmless
+		_, err = l.Acquire(context.Background(), 0)
+		Expect(err).To(BeNil())
+
+		// a waiting request goes ahead when the limit is raised
+		acquired := make(chan struct{})
+		go func() {
+			_, _ = l.Acquire(context.Background(), 0)
+			close(acquired)
+		}()
+		Consistently(acquired, "20ms").ShouldNot(BeClosed())
+		r.Configure("job:a", hostLimit(srv.URL, RateLimit{ConcurrentRequests: 3}))
+		Eventually(acquired, "1s").Should(BeClosed())
+	})
+
+	ginkgo.It("Should spread requests and entities over time", func() {
+		r := NewRateLimiters()
+		limit := RateLimit{RequestsPerSecond: 50, EntitiesPerSecond: 100}
+		r.Configure("job:a", hostLimit("http://ratelimit-d.example.io", limit))
+		l := r.For(&limit, "http://ratelimit-d.example.io", "")
+		start := time.Now()
+		for i := 0; i < 3; i++ {
+			release, err := l.Acquire(context.Background(), 0)
+			Expect(err).To(BeNil())
+			release()
+		}
+		Expect(time.Since(start)).To(BeNumerically(">=", 35*time.Millisecond), "3 requests at 50/s take 40ms")
+
+		start = time.Now()
+		Expect(l.WaitEntities(context.Background(), 150)).To(BeNil(), "batches larger than a second's worth are allowed")
+		Expect(time.Since(start)).To(BeNumerically(">=", 450*time.Millisecond))
+	})
+
+	ginkgo.It("Should let proxy datasets make more requests than the concurrent limit", func() {
+		storeLocation := "./test_ratelimit_proxy"
+		_ = os.RemoveAll(storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store := NewStore(e, &statsd.NoOpClient{})
+		defer func() {
+			_ = store.Close()
+			_ = os.RemoveAll(storeLocation)
+		}()
+		dsm := NewDsManager(e, store, NoOpBus())
+
+		var failing atomic.Bool
+		srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = io.Copy(io.Discard, r.Body)
+			if failing.Load() {
+				w.WriteHeader(http.StatusServiceUnavailable)
+				return
+			}
+			_, _ = w.Write([]byte(`[{"id":"@context","namespaces":{}},{"id":"http://data.example.io/a","props":{}},` +
+				`{"id":"@continuation","token":"next"}]`))
+		}))
+		defer srv.Close()
+
+		ds, err := dsm.CreateDataset("proxied", &CreateDatasetConfig{ProxyDatasetConfig: &ProxyDatasetConfig{
+			RemoteURL: srv.URL + "/datasets/proxied",
+			RateLimit: &RateLimit{ConcurrentRequests: 2},
+		}})
+		Expect(err).To(BeNil())
+		proxy := ds.AsProxy(func(req *http.Request) {})
+		noop := func(*Entity) error { return nil }
+		noopRaw := func([]byte) error { return nil }
+		for i := 0; i < 3; i++ {
+			token, err := proxy.StreamEntities("", 0, noop, nil)
+			Expect(err).To(BeNil())
+			Expect(token).To(Equal("next"))
+			_, err = proxy.StreamEntitiesRaw("", 0, noopRaw, nil)
+			Expect(err).To(BeNil())
+			_, err = proxy.StreamChanges("", 0, false, false, noop, nil)
+			Expect(err).To(BeNil())
+			_, err = proxy.StreamChangesRaw("", 0, false, false, noopRaw, nil)
+			Expect(err).To(BeNil())
+			Expect(proxy.ForwardEntities(io.NopCloser(strings.NewReader("[]")), http.Header{})).To(Succeed())
+		}
+
+		failing.Store(true)
+		for i := 0; i < 3; i++ {
+			_, err := proxy.StreamEntities("", 0, noop, nil)
+			Expect(err).To(MatchError(ContainSubstring("503")), fmt.Sprintf("request %v", i))
+			Expect(proxy.ForwardEntities(io.NopCloser(strings.NewReader("[]")), http.Header{})).
+				To(MatchError(ContainSubstring("503")))
+		}
+		key := "host:" + strings.TrimPrefix(srv.URL, "http://")
+		Expect(store.RateLimiters.States()).To(ContainElement(And(HaveField("Key", key), HaveField("InFlight", 0))))
+
+		// the limit goes away with the dataset
+		Expect(dsm.DeleteDataset("proxied")).To(Succeed())
+		Expect(store.RateLimiters.States()).NotTo(ContainElement(HaveField("Key", key)))
+	})
+})
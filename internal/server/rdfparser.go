@@ -0,0 +1,871 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"bufio"
+	"container/heap"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+
+	"github.com/google/uuid"
+)
+
+const (
+	xsdNamespace = "http://www.w3.org/2001/XMLSchema#"
+	// SkolemNamespace is used for the identifiers of blank nodes in parsed RDF
+	SkolemNamespace = "http://data.mimiro.io/.well-known/genid/"
+	// UdaDeletedURI marks an entity as deleted when given the value true in RDF
+	UdaDeletedURI = "http://data.mimiro.io/core/uda/deleted"
+)
+
+// skolemScope gives the blank nodes of one parsed document identifiers that are unique to the document, so
+// that blank nodes with the same label in different documents do not become the same entity
+type skolemScope string
+
+func newSkolemScope() skolemScope {
+	return skolemScope(SkolemNamespace + uuid.NewString())
+}
+
+// labelled returns the identifier of a blank node with a label in the document
+func (s skolemScope) labelled(label string) string {
+	return string(s) + "-" + url.PathEscape(label)
+}
+
+// generated returns the identifier of the nth node without identifier, which can not clash with labelled blank nodes
+func (s skolemScope) generated(n int) string {
+	return string(s) + "." + strconv.Itoa(n)
+}
+
+// DefaultRDFSubjectWindow is the number of subjects the RDF parser keeps in memory before it spills them to disk
+const DefaultRDFSubjectWindow = 10000
+
+// RDFStreamParser parses N-Triples and Turtle into entities. Triples are grouped by subject, IRI and blank node
+// objects become references and literals become properties. The triples of a subject may be anywhere in the
+// document. Up to window subjects are kept in memory; when a new one comes in after that, the entities so far are
+// written to a temporary file, sorted by identifier, and all of them are merged from the file when the document
+// has been read. Entities are emitted in the order their subjects first appear when nothing was spilled, and by
+// identifier otherwise. Blank node identifiers are scoped to the document. Blank node property lists and
+// collections are not supported.
+type RDFStreamParser struct {
+	store  *Store
+	window int
+}
+
+func NewRDFStreamParser(store *Store) *RDFStreamParser {
+	return &RDFStreamParser{store: store, window: DefaultRDFSubjectWindow}
+}
+
+type rdfTermKind int
+
+const (
+	rdfIRI rdfTermKind = iota
+	rdfBlank
+	rdfLiteral
+)
+
+type rdfTerm struct {
+	kind     rdfTermKind
+	value    string
+	datatype string
+}
+
+func (p *RDFStreamParser) ParseStream(reader io.Reader, emitEntity func(*Entity) error) error {
+	skolem := newSkolemScope()
+	open := make(map[string]*Entity)
+	order := make([]*Entity, 0) // the open entities, in the order their subjects first appeared
+	var spill *rdfSpill
+	var spillErr error
+	defer func() { spill.close() }()
+
+	err := parseTurtle(reader, func(s rdfTerm, pred string, o rdfTerm) error {
+		id, err := p.identifier(skolem, s)
+		if err != nil {
+			return err
+		}
+		entity, ok := open[id]
+		if !ok {
+			if len(order) == p.window {
+				if spill == nil {
+					if spill, spillErr = newRDFSpill(); spillErr != nil {
+						return spillErr
+					}
+				}
+				if spillErr = spill.write(order); spillErr != nil {
+					return spillErr
+				}
+				open = make(map[string]*Entity)
+				order = order[:0]
+			}
+			entity = NewEntity(id, 0)
+			open[id] = entity
+			order = append(order, entity)
+		}
+
+		if pred == UdaDeletedURI && o.kind == rdfLiteral {
+			entity.IsDeleted = o.value == "true" || o.value == "1"
+			return nil
+		}
+		predicate, err := p.store.GetNamespacedIdentifier(pred, nil)
+		if err != nil {
+			return err
+		}
+
+		if o.kind == rdfLiteral {
+			addPropertyValue(entity.Properties, predicate, literalValue(o))
+			return nil
+		}
+		ref, err := p.identifier(skolem, o)
+		if err != nil {
+			return err
+		}
+		addReferenceValue(entity.References, predicate, ref)
+		return nil
+	})
+	if spillErr != nil {
+		return spillErr
+	}
+	if err != nil {
+		return errors.New("parsing error: " + err.Error())
+	}
+
+	if spill == nil {
+		for _, entity := range order {
+			if err := emitEntity(entity); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+	if err := spill.write(order); err != nil {
+		return err
+	}
+	return spill.merge(emitEntity)
+}
+
+// rdfSpill keeps the entities of a parsed document on disk, in runs that are each sorted by identifier. An entity
+// can be in several runs, with the triples read between spills in each.
+type rdfSpill struct {
+	file *os.File
+	runs []*io.SectionReader
+	size int64
+}
+
+func newRDFSpill() (*rdfSpill, error) {
+	file, err := os.CreateTemp("", "datahub-rdf-*")
+	if err != nil {
+		return nil, err
+	}
+	return &rdfSpill{file: file}, nil
+}
+
+func (s *rdfSpill) close() {
+	if s == nil {
+		return
+	}
+	_ = s.file.Close()
+	_ = os.Remove(s.file.Name())
+}
+
+// write adds a run with the given entities
+func (s *rdfSpill) write(entities []*Entity) error {
+	sort.Slice(entities, func(i, j int) bool { return entities[i].ID < entities[j].ID })
+	w := bufio.NewWriter(s.file)
+	enc := json.NewEncoder(w)
+	for _, entity := range entities {
+		if err := enc.Encode(entity); err != nil {
+			return err
+		}
+	}
+	if err := w.Flush(); err != nil {
+		return err
+	}
+	end, err := s.file.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+	s.runs = append(s.runs, io.NewSectionReader(s.file, s.size, end-s.size))
+	s.size = end
+	return nil
+}
+
+// merge reads all runs side by side, and emits each entity once with the values of all runs, by identifier
+func (s *rdfSpill) merge(emitEntity func(*Entity) error) error {
+	runs := &rdfRunHeap{}
+	for i, section := range s.runs {
+		run := &rdfRun{index: i, decoder: json.NewDecoder(bufio.NewReader(section))}
+		if err := run.next(); err != nil {
+			return err
+		}
+		if run.entity != nil {
+			*runs = append(*runs, run)
+		}
+	}
+	heap.Init(runs)
+
+	var current *Entity
+	for runs.Len() > 0 {
+		run := (*runs)[0]
+		switch {
+		case current == nil:
+			current = run.entity
+		case current.ID == run.entity.ID:
+			mergeEntity(current, run.entity)
+		default:
+			if err := emitEntity(current); err != nil {
+				return err
+			}
+			current = run.entity
+		}
+		if err := run.next(); err != nil {
+			return err
+		}
+		if run.entity == nil {
+			heap.Pop(runs)
+		} else {
+			heap.Fix(runs, 0)
+		}
+	}
+	if current != nil {
+		return emitEntity(current)
+	}
+	return nil
+}
+
+// rdfRun reads the entities of one run, entity is nil when the run is done
+type rdfRun struct {
+	index   int
+	decoder *json.Decoder
+	entity  *Entity
+}
+
+func (r *rdfRun) next() error {
+	entity := &Entity{}
+	if err := r.decoder.Decode(entity); err != nil {
+		if err == io.EOF {
+			r.entity = nil
+			return nil
+		}
+		return err
+	}
+	r.entity = entity
+	return nil
+}
+
+// rdfRunHeap orders runs by the identifier of their next entity, and runs written earlier first, so that the
+// values of an entity keep the order of the document
+type rdfRunHeap []*rdfRun
+
+func (h rdfRunHeap) Len() int { return len(h) }
+func (h rdfRunHeap) Less(i, j int) bool {
+	if h[i].entity.ID != h[j].entity.ID {
+		return h[i].entity.ID < h[j].entity.ID
+	}
+	return h[i].index < h[j].index
+}
+func (h rdfRunHeap) Swap(i, j int) { h[i], h[j] = h[j], h[i] }
+func (h *rdfRunHeap) Push(x any)   { *h = append(*h, x.(*rdfRun)) }
+func (h *rdfRunHeap) Pop() any {
+	old := *h
+	run := old[len(old)-1]
+	*h = old[:len(old)-1]
+	return run
+}
+
+func (p *RDFStreamParser) identifier(skolem skolemScope, t rdfTerm) (string, error) {
+	if t.kind == rdfBlank {
+		return p.store.GetNamespacedIdentifier(skolem.labelled(t.value), nil)
+	}
+	if !strings.HasPrefix(t.value, "http://") && !strings.HasPrefix(t.value, "https://") {
+		return "", fmt.Errorf("only http and https IRIs are supported, got %s", t.value)
+	}
+	return p.store.GetNamespacedIdentifier(t.value, nil)
+}
+
+func addPropertyValue(props map[string]interface{}, key string, value interface{}) {
+	switch existing := props[key].(type) {
+	case nil:
+		props[key] = value
+	case []interface{}:
+		props[key] = append(existing, value)
+	default:
+		props[key] = []interface{}{existing, value}
+	}
+}
+
+func addReferenceValue(refs map[string]interface{}, key string, value string) {
+	switch existing := refs[key].(type) {
+	case nil:
+		refs[key] = value
+	case []string:
+		refs[key] = append(existing, value)
+	case []any:
+		refs[key] = append(existing, value)
+	case string:
+		refs[key] = []string{existing, value}
+	}
+}
+
+// literalValue converts numeric and boolean literals, and keeps all other literals as strings
+func literalValue(t rdfTerm) interface{} {
+	switch strings.TrimPrefix(t.datatype, xsdNamespace) {
+	case "integer", "int", "long", "short", "byte", "decimal", "double", "float",
+		"nonNegativeInteger", "positiveInteger", "negativeInteger", "nonPositiveInteger",
+		"unsignedInt", "unsignedLong", "unsignedShort", "unsignedByte":
+		if f, err := strconv.ParseFloat(t.value, 64); err == nil {
+			return f
+		}
+	case "boolean":
+		if b, err := strconv.ParseBool(t.value); err == nil {
+			return b
+		}
+	}
+	return t.value
+}
+
+// turtleLexer reads the tokens of a Turtle document. N-Triples is a subset of Turtle.
+type turtleLexer struct {
+	r       *bufio.Reader
+	pending []rune // runes pushed back by unread, read again before the reader
+	line    int
+}
+
+type turtleToken struct {
+	kind     string // iri, pname, blank, literal, keyword, punct, eof
+	value    string
+	datatype string // for literals, an iri prefixed with < or a pname
+}
+
+func (l *turtleLexer) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("line %d: %s", l.line, fmt.Sprintf(format, args...))
+}
+
+func (l *turtleLexer) read() (rune, error) {
+	var r rune
+	if n := len(l.pending); n > 0 {
+		r = l.pending[n-1]
+		l.pending = l.pending[:n-1]
+	} else {
+		var err error
+		if r, _, err = l.r.ReadRune(); err != nil {
+			return 0, err
+		}
+	}
+	if r == '\n' {
+		l.line++
+	}
+	return r, nil
+}
+
+func (l *turtleLexer) unread(r rune) {
+	l.pending = append(l.pending, r)
+	if r == '\n' {
+		l.line--
+	}
+}
+
+func (l *turtleLexer) peek() (rune, error) {
+	r, err := l.read()
+	if err == nil {
+		l.unread(r)
+	}
+	return r, err
+}
+
+func (l *turtleLexer) skipSpace() error {
+	for {
+		r, err := l.read()
+		if err != nil {
+			return err
+		}
+		if r == '#' {
+			for r != '\n' {
+				if r, err = l.read(); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		if !unicode.IsSpace(r) {
+			l.unread(r)
+			return nil
+		}
+	}
+}
+
+func isTurtleNameRune(r rune) bool {
+	return unicode.IsLetter(r) || unicode.IsDigit(r) || strings.ContainsRune("_-:.%\\", r)
+}
+
+func (l *turtleLexer) next() (turtleToken, error) {
+	if err := l.skipSpace(); err != nil {
+		if err == io.EOF {
+			return turtleToken{kind: "eof"}, nil
+		}
+		return turtleToken{}, err
+	}
+	r, err := l.read()
+	if err != nil {
+		return turtleToken{}, err
+	}
+	switch {
+	case r == '<':
+		iri, err := l.readIRI()
+		return turtleToken{kind: "iri", value: iri}, err
+	case r == '"' || r == '\'':
+		return l.readLiteral(r)
+	case r == '@':
+		name, err := l.readName()
+		return turtleToken{kind: "keyword", value: "@" + name}, err
+	case strings.ContainsRune(".;,", r):
+		// a dot followed by a digit starts a number
+		if next, err := l.peek(); r == '.' && err == nil && unicode.IsDigit(next) {
+			l.unread(r)
+			return l.readNumber()
+		}
+		return turtleToken{kind: "punct", value: string(r)}, nil
+	case strings.ContainsRune("[]()", r):
+		return turtleToken{}, l.errorf("blank node property lists and collections are not supported")
+	case unicode.IsDigit(r) || r == '+' || r == '-':
+		l.unread(r)
+		return l.readNumber()
+	}
+
+	l.unread(r)
+	name, err := l.readName()
+	if err != nil {
+		return turtleToken{}, err
+	}
+	if name == "" {
+		return turtleToken{}, l.errorf("unexpected character %q", r)
+	}
+	switch {
+	case strings.HasPrefix(name, "_:"):
+		return turtleToken{kind: "blank", value: name[2:]}, nil
+	case strings.Contains(name, ":"):
+		return turtleToken{kind: "pname", value: name}, nil
+	}
+	return turtleToken{kind: "keyword", value: name}, nil
+}
+
+// readName reads a prefixed name or keyword. A trailing dot ends the statement and is not part of the name.
+func (l *turtleLexer) readName() (string, error) {
+	var sb strings.Builder
+	for {
+		r, err := l.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return "", err
+		}
+		if !isTurtleNameRune(r) {
+			l.unread(r)
+			break
+		}
+		if r == '\\' {
+			// escaped characters in local names
+			if r, err = l.read(); err != nil {
+				return "", err
+			}
+		}
+		sb.WriteRune(r)
+	}
+	name := sb.String()
+	for strings.HasSuffix(name, ".") {
+		name = name[:len(name)-1]
+		l.unread('.')
+	}
+	return name, nil
+}
+
+func (l *turtleLexer) readNumber() (turtleToken, error) {
+	var sb strings.Builder
+	for {
+		r, err := l.read()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return turtleToken{}, err
+		}
+		if !(unicode.IsDigit(r) || strings.ContainsRune("+-.eE", r)) {
+			l.unread(r)
+			break
+		}
+		sb.WriteRune(r)
+	}
+	number := sb.String()
+	if strings.HasSuffix(number, ".") {
+		number = number[:len(number)-1]
+		l.unread('.')
+	}
+	datatype := xsdNamespace + "integer"
+	if strings.ContainsAny(number, "eE") {
+		datatype = xsdNamespace + "double"
+	} else if strings.Contains(number, ".") {
+		datatype = xsdNamespace + "decimal"
+	}
+	if _, err := strconv.ParseFloat(number, 64); err != nil {
+		return turtleToken{}, l.errorf("invalid number %s", number)
+	}
+	return turtleToken{kind: "literal", value: number, datatype: "<" + datatype}, nil
+}
+
+func (l *turtleLexer) readIRI() (string, error) {
+	var sb strings.Builder
+	for {
+		r, err := l.read()
+		if err != nil {
+			return "", l.errorf("unterminated IRI")
+		}
+		switch r {
+		case '>':
+			return sb.String(), nil
+		case '\\':
+			u, err := l.readUnicodeEscape()
+			if err != nil {
+				return "", err
+			}
+			sb.WriteRune(u)
+		default:
+			sb.WriteRune(r)
+		}
+	}
+}
+
+func (l *turtleLexer) readUnicodeEscape() (rune, error) {
+	r, err := l.read()
+	if err != nil {
+		return 0, err
+	}
+	size := 4
+	if r == 'U' {
+		size = 8
+	} else if r != 'u' {
+		return 0, l.errorf("invalid escape \\%c", r)
+	}
+	hex := make([]rune, size)
+	for i := range hex {
+		if hex[i], err = l.read(); err != nil {
+			return 0, err
+		}
+	}
+	code, err := strconv.ParseUint(string(hex), 16, 32)
+	if err != nil {
+		return 0, l.errorf("invalid unicode escape %s", string(hex))
+	}
+	return rune(code), nil
+}
+
+func (l *turtleLexer) readLiteral(quote rune) (turtleToken, error) {
+	long := false
+	if r, err := l.read(); err == nil {
+		if r == quote {
+			if r2, err := l.read(); err == nil && r2 == quote {
+				long = true
+			} else {
+				// empty string
+				if err == nil {
+					l.unread(r2)
+				}
+				return l.readLiteralSuffix("")
+			}
+		} else {
+			l.unread(r)
+		}
+	}
+
+	var sb strings.Builder
+	quotes := 0
+	for {
+		r, err := l.read()
+		if err != nil {
+			return turtleToken{}, l.errorf("unterminated string")
+		}
+		if r == quote {
+			if !long {
+				break
+			}
+			quotes++
+			if quotes == 3 {
+				break
+			}
+			continue
+		}
+		for ; quotes > 0; quotes-- {
+			sb.WriteRune(quote)
+		}
+		if r == '\n' && !long {
+			return turtleToken{}, l.errorf("newline in string")
+		}
+		if r == '\\' {
+			e, err := l.read()
+			if err != nil {
+				return turtleToken{}, err
+			}
+			switch e {
+			case 't':
+				sb.WriteRune('\t')
+			case 'b':
+				sb.WriteRune('\b')
+			case 'n':
+				sb.WriteRune('\n')
+			case 'r':
+				sb.WriteRune('\r')
+			case 'f':
+				sb.WriteRune('\f')
+			case '"', '\'', '\\':
+				sb.WriteRune(e)
+			case 'u', 'U':
+				l.unread(e)
+				u, err := l.readUnicodeEscape()
+				if err != nil {
+					return turtleToken{}, err
+				}
+				sb.WriteRune(u)
+			default:
+				return turtleToken{}, l.errorf("invalid escape \\%c", e)
+			}
+			continue
+		}
+		sb.WriteRune(r)
+	}
+	return l.readLiteralSuffix(sb.String())
+}
+
+// readLiteralSuffix reads an optional language tag or datatype after a string
+func (l *turtleLexer) readLiteralSuffix(value string) (turtleToken, error) {
+	token := turtleToken{kind: "literal", value: value}
+	r, err := l.read()
+	if err != nil {
+		return token, nil
+	}
+	switch r {
+	case '@':
+		// language tags are accepted, but not kept
+		_, err = l.readName()
+		return token, err
+	case '^':
+		if r2, err := l.read(); err != nil || r2 != '^' {
+			return token, l.errorf("expected ^^ before datatype")
+		}
+		r3, err := l.read()
+		if err != nil {
+			return token, err
+		}
+		if r3 == '<' {
+			iri, err := l.readIRI()
+			token.datatype = "<" + iri
+			return token, err
+		}
+		l.unread(r3)
+		name, err := l.readName()
+		token.datatype = name
+		return token, err
+	}
+	l.unread(r)
+	return token, nil
+}
+
+// parseTurtle parses a Turtle or N-Triples document, and calls emit for each triple with the predicate as a full IRI
+func parseTurtle(reader io.Reader, emit func(s rdfTerm, p string, o rdfTerm) error) error {
+	l := &turtleLexer{r: bufio.NewReader(reader), line: 1}
+	prefixes := make(map[string]string)
+	base := ""
+
+	resolve := func(iri string) string {
+		if base == "" || strings.Contains(iri, "://") || strings.HasPrefix(iri, "urn:") {
+			return iri
+		}
+		b, err := url.Parse(base)
+		if err != nil {
+			return iri
+		}
+		ref, err := url.Parse(iri)
+		if err != nil {
+			return iri
+		}
+		return b.ResolveReference(ref).String()
+	}
+	expand := func(pname string) (string, error) {
+		prefix, local, _ := strings.Cut(pname, ":")
+		expansion, ok := prefixes[prefix]
+		if !ok {
+			return "", l.errorf("unknown prefix %s", prefix)
+		}
+		return expansion + local, nil
+	}
+	toTerm := func(t turtleToken) (rdfTerm, error) {
+		switch t.kind {
+		case "iri":
+			return rdfTerm{kind: rdfIRI, value: resolve(t.value)}, nil
+		case "pname":
+			iri, err := expand(t.value)
+			return rdfTerm{kind: rdfIRI, value: iri}, err
+		case "blank":
+			return rdfTerm{kind: rdfBlank, value: t.value}, nil
+		case "literal":
+			term := rdfTerm{kind: rdfLiteral, value: t.value}
+			if strings.HasPrefix(t.datatype, "<") {
+				term.datatype = resolve(t.datatype[1:])
+			} else if t.datatype != "" {
+				iri, err := expand(t.datatype)
+				if err != nil {
+					return term, err
+				}
+				term.datatype = iri
+			}
+			return term, nil
+		case "keyword":
+			if t.value == "true" || t.value == "false" {
+				return rdfTerm{kind: rdfLiteral, value: t.value, datatype: xsdNamespace + "boolean"}, nil
+			}
+		}
+		return rdfTerm{}, l.errorf("unexpected %s %q", t.kind, t.value)
+	}
+	// turtle directives end with a dot, the SPARQL style PREFIX and BASE do not
+	expectDot := func(directive string) error {
+		if !strings.HasPrefix(directive, "@") {
+			return nil
+		}
+		t, err := l.next()
+		if err != nil {
+			return err
+		}
+		if t.kind != "punct" || t.value != "." {
+			return l.errorf("expected . but got %q", t.value)
+		}
+		return nil
+	}
+
+	for {
+		t, err := l.next()
+		if err != nil {
+			return err
+		}
+		if t.kind == "eof" {
+			return nil
+		}
+
+		if t.kind == "keyword" {
+			directive := strings.ToLower(strings.TrimPrefix(t.value, "@"))
+			switch directive {
+			case "prefix":
+				name, err := l.next()
+				if err != nil {
+					return err
+				}
+				iri, err := l.next()
+				if err != nil {
+					return err
+				}
+				if !strings.HasSuffix(name.value, ":") || iri.kind != "iri" {
+					return l.errorf("invalid prefix declaration")
+				}
+				prefixes[strings.TrimSuffix(name.value, ":")] = resolve(iri.value)
+				if err := expectDot(t.value); err != nil {
+					return err
+				}
+				continue
+			case "base":
+				iri, err := l.next()
+				if err != nil {
+					return err
+				}
+				if iri.kind != "iri" {
+					return l.errorf("invalid base declaration")
+				}
+				base = resolve(iri.value)
+				if err := expectDot(t.value); err != nil {
+					return err
+				}
+				continue
+			}
+		}
+
+		subject, err := toTerm(t)
+		if err != nil {
+			return err
+		}
+		if subject.kind == rdfLiteral {
+			return l.errorf("a literal cannot be a subject")
+		}
+
+		// predicate object lists, ending with a dot
+		for done := false; !done; {
+			pt, err := l.next()
+			if err != nil {
+				return err
+			}
+			if pt.kind == "punct" && pt.value == "." {
+				// a trailing ; before the dot
+				break
+			}
+			if pt.kind == "punct" && pt.value == ";" {
+				continue
+			}
+			var predicate string
+			if pt.kind == "keyword" && pt.value == "a" {
+				predicate = RdfTypeURI
+			} else {
+				pterm, err := toTerm(pt)
+				if err != nil {
+					return err
+				}
+				if pterm.kind != rdfIRI {
+					return l.errorf("a predicate must be an IRI")
+				}
+				predicate = pterm.value
+			}
+
+			for {
+				ot, err := l.next()
+				if err != nil {
+					return err
+				}
+				object, err := toTerm(ot)
+				if err != nil {
+					return err
+				}
+				if err := emit(subject, predicate, object); err != nil {
+					return err
+				}
+				sep, err := l.next()
+				if err != nil {
+					return err
+				}
+				if sep.kind != "punct" {
+					return l.errorf("expected , ; or . but got %q", sep.value)
+				}
+				if sep.value == "," {
+					continue
+				}
+				if sep.value == "." {
+					done = true
+				}
+				break
+			}
+		}
+	}
+}
@@ -0,0 +1,177 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("The RDF stream parser", func() {
+	testCnt := 0
+	var storeLocation string
+	var store *Store
+	var ex string
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_rdf_parser_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = NewStore(e, &statsd.NoOpClient{})
+		ex, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://example.com/")
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	parse := func(doc string) ([]*Entity, error) {
+		var result []*Entity
+		err := NewRDFStreamParser(store).ParseStream(strings.NewReader(doc), func(e *Entity) error {
+			result = append(result, e)
+			return nil
+		})
+		return result, err
+	}
+
+	ginkgo.It("should group N-Triples by subject", func() {
+		entities, err := parse(`
+<http://example.com/bob> <http://example.com/name> "Bob \"B\"" .
+<http://example.com/alice> <http://example.com/name> "Alice"@en .
+<http://example.com/bob> <http://example.com/age> "42"^^<http://www.w3.org/2001/XMLSchema#integer> .
+<http://example.com/bob> <http://example.com/knows> <http://example.com/alice> .
+<http://example.com/bob> <http://example.com/knows> _:someone .
+# a comment
+<http://example.com/carl> <http://data.mimiro.io/core/uda/deleted> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .
+`)
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(3))
+		bob := entities[0]
+		Expect(bob.ID).To(Equal(ex + ":bob"))
+		Expect(bob.Properties[ex+":name"]).To(Equal(`Bob "B"`))
+		Expect(bob.Properties[ex+":age"]).To(Equal(float64(42)))
+		knows := bob.References[ex+":knows"].([]string)
+		Expect(knows).To(HaveLen(2))
+		Expect(knows[0]).To(Equal(ex + ":alice"))
+		Expect(store.NamespaceManager.ExpandCurie(knows[1])).To(HavePrefix(SkolemNamespace))
+		Expect(store.NamespaceManager.ExpandCurie(knows[1])).To(HaveSuffix("-someone"))
+		Expect(entities[1].Properties[ex+":name"]).To(Equal("Alice"))
+		Expect(entities[2].IsDeleted).To(BeTrue())
+		Expect(entities[2].Properties).To(BeEmpty())
+	})
+
+	ginkgo.It("should parse Turtle with prefixes, lists of objects and literals", func() {
+		entities, err := parse(`
+@prefix ex: <http://example.com/> .
+PREFIX xsd: <http://www.w3.org/2001/XMLSchema#>
+@base <http://example.com/> .
+
+ex:bob a ex:Person ;
+    ex:name "Bob", 'Robert' ;
+    ex:height 1.85 ;
+    ex:active true ;
+    ex:bio """multi
+line""" ;
+    ex:count "7"^^xsd:int ;
+    ex:friend <alice> .
+`)
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(1))
+		bob := entities[0]
+		rdfType, _ := store.NamespaceManager.GetPrefixMappingForExpansion(RdfNamespaceExpansion)
+		Expect(bob.References[rdfType+":type"]).To(Equal(ex + ":Person"))
+		Expect(bob.Properties[ex+":name"]).To(Equal([]interface{}{"Bob", "Robert"}))
+		Expect(bob.Properties[ex+":height"]).To(Equal(1.85))
+		Expect(bob.Properties[ex+":active"]).To(Equal(true))
+		Expect(bob.Properties[ex+":bio"]).To(Equal("multi\nline"))
+		Expect(bob.Properties[ex+":count"]).To(Equal(float64(7)))
+		Expect(bob.References[ex+":friend"]).To(Equal(ex + ":alice"))
+	})
+
+	ginkgo.It("should scope blank node identifiers to the document", func() {
+		doc := "_:b0 <http://example.com/name> \"Bob\" .\n<http://example.com/alice> <http://example.com/knows> _:b0 ."
+		first, err := parse(doc)
+		Expect(err).To(BeNil())
+		second, err := parse(doc)
+		Expect(err).To(BeNil())
+		Expect(first[0].ID).To(Equal(first[1].References[ex+":knows"]), "the same label is the same node in a document")
+		Expect(second[0].ID).NotTo(Equal(first[0].ID), "uploads must not merge blank nodes")
+		Expect(second[1].References[ex+":knows"]).To(Equal(second[0].ID))
+	})
+
+	ginkgo.It("should merge subjects that come back after they were spilled to disk", func() {
+		tmp := storeLocation + "-tmp"
+		Expect(os.MkdirAll(tmp, 0o755)).To(Succeed())
+		defer func() { _ = os.RemoveAll(tmp) }()
+		tmpDir, hadTmpDir := os.LookupEnv("TMPDIR")
+		_ = os.Setenv("TMPDIR", tmp)
+		defer func() {
+			if hadTmpDir {
+				_ = os.Setenv("TMPDIR", tmpDir)
+			} else {
+				_ = os.Unsetenv("TMPDIR")
+			}
+		}()
+
+		p := NewRDFStreamParser(store)
+		p.window = 2
+		var entities []*Entity
+		err := p.ParseStream(strings.NewReader(`
+<http://example.com/c> <http://example.com/name> "C" .
+<http://example.com/a> <http://example.com/name> "A" .
+<http://example.com/b> <http://example.com/name> "B" .
+<http://example.com/a> <http://example.com/knows> <http://example.com/b> .
+<http://example.com/c> <http://example.com/knows> <http://example.com/a> .
+<http://example.com/a> <http://example.com/name> "A2" .
+<http://example.com/a> <http://example.com/knows> <http://example.com/c> .
+<http://example.com/b> <http://data.mimiro.io/core/uda/deleted> "true" .
+`), func(e *Entity) error {
+			entities = append(entities, e)
+			return nil
+		})
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(3))
+		Expect(entities[0].ID).To(Equal(ex+":a"), "ordered by identifier once spilled")
+		Expect(entities[0].Properties[ex+":name"]).To(Equal([]any{"A", "A2"}))
+		Expect(entities[0].References[ex+":knows"]).To(HaveExactElements(ex+":b", ex+":c"))
+		Expect(entities[1].ID).To(Equal(ex + ":b"))
+		Expect(entities[1].IsDeleted).To(BeTrue())
+		Expect(entities[2].ID).To(Equal(ex + ":c"))
+		Expect(entities[2].Properties[ex+":name"]).To(Equal("C"))
+		Expect(entities[2].References[ex+":knows"]).To(Equal(ex + ":a"))
+
+		files, _ := os.ReadDir(tmp)
+		Expect(files).To(BeEmpty(), "the spill file is removed")
+	})
+
+	ginkgo.It("should report the line of syntax errors", func() {
+		_, err := parse("<http://example.com/a> <http://example.com/b> \"c\" .\n<http://example.com/a> ex:b \"c\" .")
+		Expect(err).NotTo(BeNil())
+		Expect(err.Error()).To(ContainSubstring("line 2"))
+		Expect(err.Error()).To(ContainSubstring("unknown prefix ex"))
+
+		_, err = parse("<http://example.com/a> <http://example.com/b> [ <http://example.com/c> 1 ] .")
+		Expect(err).NotTo(BeNil())
+	})
+})
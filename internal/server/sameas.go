@@ -0,0 +1,216 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"sort"
+	"strings"
+	"time"
+)
+
+// MaxSameAsClassSize limits how many entities are resolved into one owl:sameAs equivalence class
+const MaxSameAsClassSize = 1000
+
+// sameAsPredicateID returns the internal id of owl:sameAs, or 0 if no entity has used it
+func (s *Store) sameAsPredicateID() (uint64, error) {
+	curie := resolveIdentifier(s.NamespaceManager, OwlSameAsURI)
+	if curie == unresolvable {
+		return 0, nil
+	}
+	txn := s.database.NewTransaction(false)
+	defer txn.Discard()
+	pid, _, err := s.getIDForURI(txn, curie)
+	return pid, err
+}
+
+// EquivalentIDs returns the internal ids of the equivalence class of an entity, the entities linked to it with
+// owl:sameAs in either direction, directly or through others. owl:sameAs references are kept in the incoming and
+// outgoing reference indexes like any other reference, so the classes follow updates, deletes and time.
+// The entity itself comes first.
+func (s *Store) EquivalentIDs(internalID uint64, datasets []uint32, at int64) ([]uint64, error) {
+	class := []uint64{internalID}
+	pid, err := s.sameAsPredicateID()
+	if err != nil || pid == 0 {
+		return class, err
+	}
+	seen := map[uint64]bool{internalID: true}
+	for i := 0; i < len(class) && len(class) < MaxSameAsClassSize; i++ {
+		for _, inverse := range []bool{false, true} {
+			searchBuffer := make([]byte, 10)
+			if inverse {
+				binary.BigEndian.PutUint16(searchBuffer, IncomingRefIndex)
+			} else {
+				binary.BigEndian.PutUint16(searchBuffer, OutgoingRefIndex)
+			}
+			binary.BigEndian.PutUint64(searchBuffer[2:], class[i])
+			relations, _, err := s.GetRelatedAtTime(&RelatedFrom{
+				RelationIndexFromKey: searchBuffer,
+				Predicate:            pid,
+				Inverse:              inverse,
+				Datasets:             datasets,
+				At:                   at,
+			}, 0)
+			if err != nil {
+				return nil, err
+			}
+			for _, r := range relations {
+				if len(class) >= MaxSameAsClassSize {
+					break
+				}
+				if !seen[r.EntityID] {
+					seen[r.EntityID] = true
+					class = append(class, r.EntityID)
+				}
+			}
+		}
+	}
+	return class, nil
+}
+
+// GetEntityWithSameAs returns an entity merged with all entities in its owl:sameAs equivalence class.
+// The result has the id that was asked for.
+func (s *Store) GetEntityWithSameAs(uri string, datasets []string, mergePartials bool) (*Entity, error) {
+	var curie string
+	var err error
+	uri = s.NamespaceManager.StorageCurie(uri)
+	if strings.HasPrefix(uri, "ns") {
+		curie = uri
+	} else {
+		curie, err = s.GetNamespacedIdentifierFromURI(uri)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	rtxn := s.database.NewTransaction(false)
+	internalID, exists, err := s.getIDForURI(rtxn, curie)
+	rtxn.Discard()
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, nil
+	}
+	scope := s.DatasetsToInternalIDs(datasets)
+	now := time.Now().UnixNano()
+	class, err := s.EquivalentIDs(internalID, scope, now)
+	if err != nil {
+		return nil, err
+	}
+	return s.getEntityAtPointInTime(class, now, scope, mergePartials)
+}
+
+// GetManyRelatedEntitiesWithSameAs works like GetManyRelatedEntitiesBatch, but follows relations of every entity in
+// the equivalence class of each start point, and returns each related class once, merged into one entity.
+// Continuations of the result keep resolving classes.
+func (s *Store) GetManyRelatedEntitiesWithSameAs(
+	startPoints []string,
+	predicate string,
+	inverse bool,
+	datasets []string,
+	limit int, mergePartials bool,
+) (RelatedEntitiesQueryResult, error) {
+	queryTime := time.Now().UnixNano()
+	from, err := s.ToRelatedFrom(startPoints, predicate, inverse, datasets, queryTime)
+	if err != nil {
+		return RelatedEntitiesQueryResult{}, err
+	}
+	expanded := make([]*RelatedFrom, 0, len(from))
+	for _, f := range from {
+		if f == nil {
+			continue
+		}
+		startID := binary.BigEndian.Uint64(f.RelationIndexFromKey[2:10])
+		class, err := s.EquivalentIDs(startID, f.Datasets, queryTime)
+		if err != nil {
+			return RelatedEntitiesQueryResult{}, err
+		}
+		for _, id := range class {
+			member := *f
+			member.RelationIndexFromKey = make([]byte, 10)
+			copy(member.RelationIndexFromKey, f.RelationIndexFromKey[:2])
+			binary.BigEndian.PutUint64(member.RelationIndexFromKey[2:], id)
+			member.SameAs = true
+			member.StartID = startID
+			expanded = append(expanded, &member)
+		}
+	}
+	return s.GetManyRelatedEntitiesAtTime(expanded, limit, mergePartials)
+}
+
+// ReturnedClass is an owl:sameAs class that a query has returned, with the predicate it was related by
+type ReturnedClass struct {
+	Predicate uint64
+	Class     uint64 // lowest internal id in the class
+}
+
+// returnedClasses holds the classes returned per start point, over all pages of a query
+type returnedClasses map[uint64]map[ReturnedClass]bool
+
+func newReturnedClasses(from []*RelatedFrom) returnedClasses {
+	returned := make(returnedClasses)
+	for _, f := range from {
+		if f == nil {
+			continue
+		}
+		for _, c := range f.Returned {
+			returned.add(f.StartID, c)
+		}
+	}
+	return returned
+}
+
+// add records a class as returned for a start point. It returns false if it already was.
+func (returned returnedClasses) add(startID uint64, c ReturnedClass) bool {
+	if returned == nil {
+		return true
+	}
+	classes, ok := returned[startID]
+	if !ok {
+		classes = make(map[ReturnedClass]bool)
+		returned[startID] = classes
+	}
+	if classes[c] {
+		return false
+	}
+	classes[c] = true
+	return true
+}
+
+// of returns the classes returned for a start point, in a stable order
+func (returned returnedClasses) of(startID uint64) []ReturnedClass {
+	result := make([]ReturnedClass, 0, len(returned[startID]))
+	for c := range returned[startID] {
+		result = append(result, c)
+	}
+	sort.Slice(result, func(i, j int) bool {
+		if result[i].Predicate != result[j].Predicate {
+			return result[i].Predicate < result[j].Predicate
+		}
+		return result[i].Class < result[j].Class
+	})
+	return result
+}
+
+func lowestID(ids []uint64) uint64 {
+	lowest := ids[0]
+	for _, id := range ids[1:] {
+		if id < lowest {
+			lowest = id
+		}
+	}
+	return lowest
+}
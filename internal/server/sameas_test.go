@@ -0,0 +1,198 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package server
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+)
+
+var _ = ginkgo.Describe("owl:sameAs resolution", func() {
+	testCnt := 0
+	var dsm *DsManager
+	var store *Store
+	var storeLocation string
+	var people, owl string
+	var hr *Dataset
+	ginkgo.BeforeEach(func() {
+		testCnt += 1
+		storeLocation = fmt.Sprintf("./test_same_as_%v", testCnt)
+		err := os.RemoveAll(storeLocation)
+		Expect(err).To(BeNil(), "should be allowed to clean testfiles in "+storeLocation)
+		env := &conf.Config{
+			Logger:        zap.NewNop().Sugar(),
+			StoreLocation: storeLocation,
+		}
+		store = NewStore(env, &statsd.NoOpClient{})
+		dsm = NewDsManager(env, store, NoOpBus())
+		people, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://data.mimiro.io/people/")
+		owl, _ = store.NamespaceManager.AssertPrefixMappingForExpansion("http://www.w3.org/2002/07/owl#")
+
+		crm, _ := dsm.CreateDataset("crm", nil)
+		Expect(crm.StoreEntities([]*Entity{
+			NewEntityFromMap(map[string]interface{}{
+				"id":    people + ":person-1",
+				"props": map[string]interface{}{people + ":Name": "Lisa"},
+				"refs":  map[string]interface{}{people + ":Friend": people + ":person-3"},
+			}),
+			NewEntityFromMap(map[string]interface{}{
+				"id":    people + ":person-2",
+				"props": map[string]interface{}{people + ":Name": "Bob"},
+				"refs": map[string]interface{}{
+					people + ":Friend": []string{people + ":person-1", people + ":employee-9"},
+				},
+			}),
+			NewEntityFromMap(map[string]interface{}{
+				"id":    people + ":person-3",
+				"props": map[string]interface{}{people + ":Name": "Kim"},
+				"refs":  map[string]interface{}{},
+			}),
+		})).To(BeNil())
+		hr, _ = dsm.CreateDataset("hr", nil)
+		Expect(hr.StoreEntities([]*Entity{
+			NewEntityFromMap(map[string]interface{}{
+				"id":    people + ":employee-9",
+				"props": map[string]interface{}{people + ":Title": "Engineer"},
+				"refs": map[string]interface{}{
+					owl + ":sameAs":     people + ":person-1",
+					people + ":Manager": people + ":person-2",
+				},
+			}),
+			NewEntityFromMap(map[string]interface{}{
+				"id":    people + ":external-5",
+				"props": map[string]interface{}{people + ":Email": "lisa@example.com"},
+				"refs":  map[string]interface{}{owl + ":sameAs": people + ":employee-9"},
+			}),
+		})).To(BeNil())
+	})
+	ginkgo.AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	ginkgo.It("Should merge the whole equivalence class into the requested entity", func() {
+		e, err := store.GetEntityWithSameAs(people+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.ID).To(Equal(people + ":person-1"))
+		Expect(e.Properties[people+":Name"]).To(Equal("Lisa"))
+		Expect(e.Properties[people+":Title"]).To(Equal("Engineer"))
+		Expect(e.Properties[people+":Email"]).To(Equal("lisa@example.com"))
+
+		e, err = store.GetEntityWithSameAs("http://data.mimiro.io/people/external-5", nil, false)
+		Expect(err).To(BeNil())
+		Expect(e.ID).To(Equal(people + ":external-5"))
+		Expect(e.Properties[PartialsURI]).To(HaveLen(3))
+
+		e, err = store.GetEntity(people+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties).NotTo(HaveKey(people + ":Title"))
+	})
+
+	ginkgo.It("Should follow relations of all entities in the class", func() {
+		result, err := store.GetManyRelatedEntitiesWithSameAs(
+			[]string{people + ":external-5"}, "*", false, nil, 0, true)
+		Expect(err).To(BeNil())
+		related := map[string]string{}
+		for _, r := range result.Relations {
+			Expect(r.StartURI).To(Equal(people + ":external-5"))
+			related[r.PredicateURI] = r.RelatedEntity.ID
+		}
+		Expect(related).To(Equal(map[string]string{
+			people + ":Friend":  people + ":person-3",
+			people + ":Manager": people + ":person-2",
+		}), "owl:sameAs links are not returned as relations")
+	})
+
+	ginkgo.It("Should return a related class once", func() {
+		result, err := store.GetManyRelatedEntitiesBatch(
+			[]string{people + ":person-2"}, "*", false, nil, 0, true)
+		Expect(err).To(BeNil())
+		Expect(result.Relations).To(HaveLen(2))
+
+		result, err = store.GetManyRelatedEntitiesWithSameAs(
+			[]string{people + ":person-2"}, "*", false, nil, 0, true)
+		Expect(err).To(BeNil())
+		Expect(result.Relations).To(HaveLen(1))
+		Expect(result.Relations[0].RelatedEntity.Properties[people+":Name"]).To(Equal("Lisa"))
+		Expect(result.Relations[0].RelatedEntity.Properties[people+":Title"]).To(Equal("Engineer"))
+
+		result, err = store.GetManyRelatedEntitiesWithSameAs(
+			[]string{people + ":person-2"}, "*", true, nil, 0, true)
+		Expect(err).To(BeNil())
+		Expect(result.Relations).To(HaveLen(1), "employee-9 is the manager")
+		Expect(result.Relations[0].RelatedEntity.Properties[people+":Email"]).To(Equal("lisa@example.com"))
+	})
+
+	ginkgo.It("Should return a related class once over all pages", func() {
+		result, err := store.GetManyRelatedEntitiesWithSameAs(
+			[]string{people + ":person-2"}, people+":Friend", false, nil, 1, true)
+		Expect(err).To(BeNil())
+		relations := result.Relations
+		for pages := 0; len(result.Cont) > 0; pages++ {
+			Expect(pages).To(BeNumerically("<", 5))
+			// continuations go to clients as json
+			jsonData, err := json.Marshal(result.Cont)
+			Expect(err).To(BeNil())
+			var cont []*RelatedFrom
+			Expect(json.Unmarshal(jsonData, &cont)).To(Succeed())
+			result, err = store.GetManyRelatedEntitiesAtTime(cont, 1, true)
+			Expect(err).To(BeNil())
+			relations = append(relations, result.Relations...)
+		}
+		Expect(relations).To(HaveLen(1), "person-1 and employee-9 are one class")
+	})
+
+	ginkgo.It("Should resolve related classes at the time of the query", func() {
+		queryTime := time.Now().UnixNano()
+		Expect(hr.StoreEntities([]*Entity{NewEntityFromMap(map[string]interface{}{
+			"id":    people + ":employee-9",
+			"props": map[string]interface{}{people + ":Title": "Manager"},
+			"refs":  map[string]interface{}{owl + ":sameAs": people + ":person-1"},
+		})})).To(BeNil())
+
+		from, err := store.ToRelatedFrom([]string{people + ":person-2"}, people+":Friend", false, nil, queryTime)
+		Expect(err).To(BeNil())
+		from[0].SameAs = true
+		from[0].StartID = binary.BigEndian.Uint64(from[0].RelationIndexFromKey[2:10])
+		result, err := store.GetManyRelatedEntitiesAtTime(from, 0, true)
+		Expect(err).To(BeNil())
+		Expect(result.Relations).To(HaveLen(1))
+		Expect(result.Relations[0].RelatedEntity.Properties[people+":Title"]).To(Equal("Engineer"))
+	})
+
+	ginkgo.It("Should split the class when a link is removed", func() {
+		Expect(hr.StoreEntities([]*Entity{NewEntityFromMap(map[string]interface{}{
+			"id":    people + ":employee-9",
+			"props": map[string]interface{}{people + ":Title": "Engineer"},
+			"refs":  map[string]interface{}{},
+		})})).To(BeNil())
+		e, err := store.GetEntityWithSameAs(people+":person-1", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties).NotTo(HaveKey(people + ":Title"))
+		e, err = store.GetEntityWithSameAs(people+":external-5", nil, true)
+		Expect(err).To(BeNil())
+		Expect(e.Properties[people+":Title"]).To(Equal("Engineer"))
+	})
+})
@@ -28,6 +28,7 @@ import (
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/DataDog/datadog-go/v5/statsd"
@@ -63,6 +64,8 @@ type Store struct {
 	valueLogFileSize     int64
 	maxCompactionLevels  int
 	SlowLogThreshold     time.Duration
+	mergePolicy          atomic.Pointer[MergePolicy] // merge policy used when partials are merged, if any
+	RateLimiters         *RateLimiters               // limits on requests to remote hosts, shared by jobs and proxy datasets
 }
 
 type BadgerLogger struct { // we use this to implement the Badger Logger interface
@@ -102,6 +105,7 @@ func NewStore(env *conf.Config, statsdClient statsd.ClientInterface) *Store {
 		valueLogFileSize:     env.ValueLogFileSize,
 		maxCompactionLevels:  env.MaxCompactionLevels,
 		SlowLogThreshold:     env.SlowLogThreshold,
+		RateLimiters:         NewRateLimiters(),
 	}
 	store.NamespaceManager = NewNamespaceManager(store)
 
@@ -158,6 +162,7 @@ func NewNamespaceManager(store *Store) *NamespaceManager {
 	nsm.store = store
 	nsm.expansionToPrefixMapping = make(map[string]string)
 	nsm.prefixToExpansionMapping = make(map[string]string)
+	nsm.publicPrefixes = make(map[string]string)
 	return nsm
 }
 
@@ -165,12 +170,16 @@ type NamespaceManager struct {
 	lock                     sync.Mutex
 	prefixToExpansionMapping map[string]string
 	expansionToPrefixMapping map[string]string
+	publicPrefixes           map[string]string // storage prefix => prefix shown to api consumers
+	nextPrefix               int               // number of the next storage prefix, removed ones are never reused
 	store                    *Store
 }
 
 type NamespacesState struct {
 	PrefixToExpansionMapping map[string]string
 	ExpansionToPrefixMapping map[string]string
+	PublicPrefixes           map[string]string
+	NextPrefix               int
 }
 
 type Context struct {
@@ -204,6 +213,9 @@ func (namespaceManager *NamespaceManager) ExpandCurie(curie string) (string, err
 	prefix := curie[:splitOffset]
 	postfix := curie[splitOffset+1:]
 	namespaceManager.lock.Lock()
+	if storage, found := namespaceManager.storagePrefix(prefix); found {
+		prefix = storage
+	}
 	expansion, ok := namespaceManager.prefixToExpansionMapping[prefix]
 	namespaceManager.lock.Unlock()
 	if ok {
@@ -235,13 +247,17 @@ func (namespaceManager *NamespaceManager) AssertPrefixMappingForExpansion(uriExp
 
 	prefix := namespaceManager.expansionToPrefixMapping[uriExpansion]
 	if prefix == "" {
-		prefix = "ns" + strconv.Itoa(len(namespaceManager.prefixToExpansionMapping))
+		// entities stored with a removed mapping keep its prefix, so a prefix is never handed out twice
+		for prefix == "" {
+			candidate := "ns" + strconv.Itoa(namespaceManager.nextPrefix)
+			namespaceManager.nextPrefix++
+			if !namespaceManager.isPrefixTaken(candidate) {
+				prefix = candidate
+			}
+		}
 		namespaceManager.prefixToExpansionMapping[prefix] = uriExpansion
 		namespaceManager.expansionToPrefixMapping[uriExpansion] = prefix
-		state := &NamespacesState{}
-		state.PrefixToExpansionMapping = namespaceManager.prefixToExpansionMapping
-		state.ExpansionToPrefixMapping = namespaceManager.expansionToPrefixMapping
-		err := namespaceManager.store.StoreObject(NamespacesIndex, "namespacestate", state)
+		err := namespaceManager.storeState()
 		if err != nil {
 			return "", err
 		}
@@ -249,6 +265,16 @@ func (namespaceManager *NamespaceManager) AssertPrefixMappingForExpansion(uriExp
 	return prefix, nil
 }
 
+// storeState persists the namespace mappings. The caller must hold the lock.
+func (namespaceManager *NamespaceManager) storeState() error {
+	state := &NamespacesState{}
+	state.PrefixToExpansionMapping = namespaceManager.prefixToExpansionMapping
+	state.ExpansionToPrefixMapping = namespaceManager.expansionToPrefixMapping
+	state.PublicPrefixes = namespaceManager.publicPrefixes
+	state.NextPrefix = namespaceManager.nextPrefix
+	return namespaceManager.store.StoreObject(NamespacesIndex, "namespacestate", state)
+}
+
 type DsNsInfo struct {
 	DatasetPrefix       string
 	PublicNamespacesKey string
@@ -459,12 +485,34 @@ func (s *Store) Open() error {
 		s.NamespaceManager.lock.Unlock()
 	}
 
+	if nsState.PublicPrefixes != nil {
+		s.NamespaceManager.lock.Lock()
+		s.NamespaceManager.publicPrefixes = nsState.PublicPrefixes
+		s.NamespaceManager.lock.Unlock()
+	}
+
+	s.NamespaceManager.lock.Lock()
+	s.NamespaceManager.nextPrefix = nsState.NextPrefix
+	if s.NamespaceManager.nextPrefix == 0 {
+		// stores written before the counter was kept had no removed mappings, so it follows the highest prefix
+		for prefix := range s.NamespaceManager.prefixToExpansionMapping {
+			if n, err := strconv.Atoi(strings.TrimPrefix(prefix, "ns")); err == nil && n >= s.NamespaceManager.nextPrefix {
+				s.NamespaceManager.nextPrefix = n + 1
+			}
+		}
+	}
+	s.NamespaceManager.lock.Unlock()
+
 	// load deleted datasets
 	err = s.GetObject(StoreMetaIndex, "deleteddatasets", &s.deletedDatasets)
 	if err != nil {
 		return err
 	}
 
+	if err = s.loadMergePolicy(); err != nil {
+		return err
+	}
+
 	// initialise idseq
 	key := []byte("uriids")
 	numEntities := uint64(1000)
@@ -492,6 +540,7 @@ func (s *Store) loadDatasets() error {
 		ds.store = s
 		s.datasets.Store(ds.ID, ds)
 		s.datasetsByInternalID.Store(ds.InternalID, ds)
+		ds.configureRateLimit()
 		return nil
 	})
 }
@@ -581,7 +630,7 @@ func (s *Store) createMultiOriginEntity(partials []*Entity) *Entity {
 	result.ID = partials[0].ID
 	result.Properties = make(map[string]interface{})
 	result.References = make(map[string]interface{})
-	propKey := "http://data.mimiro.io/core/partials"
+	propKey := PartialsURI
 	result.Properties[propKey] = make([]interface{}, 0)
 
 	for _, partial := range partials {
@@ -598,6 +647,7 @@ func (s *Store) IsCurie(uri string) bool {
 func (s *Store) GetEntity(uri string, datasets []string, mergePartials bool) (*Entity, error) {
 	var curie string
 	var err error
+	uri = s.NamespaceManager.StorageCurie(uri)
 	if strings.HasPrefix(uri, "ns") {
 		curie = uri
 	} else {
@@ -630,6 +680,73 @@ func (s *Store) GetEntityAtPointInTimeWithInternalID(
 	targetDatasetIds []uint32,
 	mergePartials bool,
 ) (*Entity, error) {
+	return s.getEntityAtPointInTime([]uint64{internalID}, at, targetDatasetIds, mergePartials)
+}
+
+// getEntityAtPointInTime combines the versions of all the given entities into one entity, with the id of the first
+func (s *Store) getEntityAtPointInTime(
+	internalIDs []uint64,
+	at int64,
+	targetDatasetIds []uint32,
+	mergePartials bool,
+) (*Entity, error) {
+	// open read txn
+	rtxn := s.database.NewTransaction(false)
+	defer rtxn.Discard()
+
+	partials := make([]*Entity, 0) // there may be more one representation that is valid
+	partialDatasets := make([]string, 0)
+	var hasDeleted bool
+	for _, internalID := range internalIDs {
+		p, ds, deleted, err := s.entityPartials(rtxn, internalID, at, targetDatasetIds, !mergePartials)
+		if err != nil {
+			return nil, err
+		}
+		partials = append(partials, p...)
+		partialDatasets = append(partialDatasets, ds...)
+		hasDeleted = hasDeleted || deleted
+	}
+
+	// merge partials
+	var resultEntity *Entity
+	if mergePartials {
+		if policy := s.MergePolicy(); policy != nil && len(partials) > 1 {
+			resultEntity = policy.Merge(s.NamespaceManager, partials, partialDatasets)
+		} else {
+			resultEntity = s.mergePartials(partials)
+		}
+	} else if len(partials) > 0 {
+		resultEntity = s.createMultiOriginEntity(partials)
+	}
+
+	// if no entity for this id then return the empty object
+	if resultEntity == nil {
+		resultEntity = &Entity{}
+		resultEntity.Properties = make(map[string]interface{})
+		resultEntity.References = make(map[string]interface{})
+		resultEntity.IsDeleted = hasDeleted
+	}
+	if resultEntity.ID == "" || len(internalIDs) > 1 {
+		resultEntity.InternalID = internalIDs[0]
+		uri, err := s.getURIForID(internalIDs[0])
+		if err != nil {
+			return nil, err
+		}
+		resultEntity.ID = uri
+	}
+
+	return resultEntity, nil
+}
+
+// entityPartials returns the latest version of an entity in each dataset at a point in time, and the names of the
+// datasets. Deleted versions are left out, and hasDeleted tells if there were any.
+func (s *Store) entityPartials(
+	rtxn *badger.Txn,
+	internalID uint64,
+	at int64,
+	targetDatasetIds []uint32,
+	addDatasetName bool,
+) (partials []*Entity, datasets []string, hasDeleted bool, err error) {
 	/*
 		binary.BigEndian.PutUint16(entityIdBuffer, ENTITY_ID_TO_JSON_INDEX_ID)
 		binary.BigEndian.PutUint64(entityIdBuffer[2:], rid)
@@ -637,11 +754,6 @@ func (s *Store) GetEntityAtPointInTimeWithInternalID(
 		binary.BigEndian.PutUint64(entityIdBuffer[14:], uint64(txnTime))
 		binary.BigEndian.PutUint16(entityIdBuffer[22:], uint16(jsonLength))
 	*/
-
-	// open read txn
-	rtxn := s.database.NewTransaction(false)
-	defer rtxn.Discard()
-
 	entityLocatorPrefixBuffer := make([]byte, 10)
 	binary.BigEndian.PutUint16(entityLocatorPrefixBuffer, EntityIDToJSONIndexID)
 	binary.BigEndian.PutUint64(entityLocatorPrefixBuffer[2:], internalID)
@@ -653,12 +765,38 @@ func (s *Store) GetEntityAtPointInTimeWithInternalID(
 	entityLocatorIterator := rtxn.NewIterator(opts1)
 	defer entityLocatorIterator.Close()
 
-	partials := make([]*Entity, 0) // there may be more one representation that is valid
+	// addVersion adds the latest version of the entity in a dataset
+	addVersion := func(valueBytes []byte, datasetID uint32) error {
+		e := &Entity{}
+		if err := json.Unmarshal(valueBytes, e); err != nil {
+			return err
+		}
+		if e.Properties == nil {
+			e.Properties = make(map[string]interface{})
+		}
+		if e.References == nil {
+			e.References = make(map[string]interface{})
+		}
+		if e.IsDeleted {
+			hasDeleted = true
+			return nil
+		}
+		ds, ok := s.datasetsByInternalID.Load(datasetID)
+		if !ok {
+			return errors.New("dataset not found")
+		}
+		if addDatasetName {
+			// add dataset to entity
+			e.Properties[DatasetNameURI] = (ds.(*Dataset)).ID
+		}
+		partials = append(partials, e)
+		datasets = append(datasets, (ds.(*Dataset)).ID)
+		return nil
+	}
 
 	var prevValueBytes []byte
 	var previousDatasetID uint32 = 0
 	var currentDatasetID uint32 = 0
-	var hasDeleted bool
 	for entityLocatorIterator.Seek(entityLocatorPrefixBuffer); entityLocatorIterator.ValidForPrefix(entityLocatorPrefixBuffer); entityLocatorIterator.Next() {
 		item := entityLocatorIterator.Item()
 		key := item.Key()
@@ -684,29 +822,9 @@ func (s *Store) GetEntityAtPointInTimeWithInternalID(
 			continue
 		}
 
-		if previousDatasetID != 0 {
-			if currentDatasetID != previousDatasetID {
-				e := &Entity{}
-				e.Properties = make(map[string]interface{})
-				e.References = make(map[string]interface{})
-				err := json.Unmarshal(prevValueBytes, e)
-				if err != nil {
-					return nil, err
-				}
-				if !e.IsDeleted {
-					if !mergePartials {
-						// add dataset to entity
-						ds, ok := s.datasetsByInternalID.Load(previousDatasetID)
-						if ok {
-							e.Properties["http://data.mimiro.io/core/datasetname"] = (ds.(*Dataset)).ID
-						} else {
-							return nil, errors.New("dataset not found")
-						}
-					}
-					partials = append(partials, e)
-				} else {
-					hasDeleted = true
-				}
+		if previousDatasetID != 0 && currentDatasetID != previousDatasetID {
+			if err = addVersion(prevValueBytes, previousDatasetID); err != nil {
+				return nil, nil, false, err
 			}
 		}
 
@@ -717,57 +835,11 @@ func (s *Store) GetEntityAtPointInTimeWithInternalID(
 	}
 
 	if previousDatasetID != 0 {
-		e := &Entity{}
-		err := json.Unmarshal(prevValueBytes, e)
-		if err != nil {
-			return nil, err
-		}
-		if e.Properties == nil {
-			e.Properties = make(map[string]interface{})
-		}
-		if e.References == nil {
-			e.References = make(map[string]interface{})
-		}
-		if !e.IsDeleted {
-			if !mergePartials {
-				// add dataset to entity
-				ds, ok := s.datasetsByInternalID.Load(previousDatasetID)
-				if ok {
-					e.Properties["http://data.mimiro.io/core/datasetname"] = (ds.(*Dataset)).ID
-				} else {
-					return nil, errors.New("dataset not found")
-				}
-			}
-
-			partials = append(partials, e)
-		} else {
-			hasDeleted = true
+		if err = addVersion(prevValueBytes, previousDatasetID); err != nil {
+			return nil, nil, false, err
 		}
 	}
-	// merge partials
-	var resultEntity *Entity
-	if mergePartials {
-		resultEntity = s.mergePartials(partials)
-	} else if len(partials) > 0 {
-		resultEntity = s.createMultiOriginEntity(partials)
-	}
-
-	// if no entity for this id then return the empty object
-	if resultEntity == nil {
-		resultEntity = &Entity{}
-		resultEntity.Properties = make(map[string]interface{})
-		resultEntity.References = make(map[string]interface{})
-
-		resultEntity.InternalID = internalID
-		resultEntity.IsDeleted = hasDeleted
-		uri, err := s.getURIForID(internalID)
-		if err != nil {
-			return nil, err
-		}
-		resultEntity.ID = uri
-	}
-
-	return resultEntity, nil
+	return partials, datasets, hasDeleted, nil
 }
 
 func (s *Store) GetEntityWithInternalID(internalID uint64, targetDatasetIds []uint32, mergePartials bool) (*Entity, error) {
@@ -790,6 +862,9 @@ type RelatedFrom struct {
 	Inverse              bool
 	Datasets             []uint32
 	At                   int64
+	SameAs               bool            // resolve owl:sameAs classes of related entities
+	StartID              uint64          // the start point the query was made for, when it differs from the one in the index key
+	Returned             []ReturnedClass // owl:sameAs classes already returned for StartID
 }
 type RelatedEntitiesQueryResult struct {
 	Cont      []*RelatedFrom
@@ -857,6 +932,7 @@ func (s *Store) ToRelatedFrom(
 		return nil, err
 	}
 	for i, uri := range startPoints {
+		uri = s.NamespaceManager.StorageCurie(uri)
 		if strings.HasPrefix(uri, "ns") {
 			resourceCurie = uri
 		} else {
@@ -900,6 +976,7 @@ func (s *Store) GetPredicateID(predicate string, txn *badger.Txn) (uint64, error
 	var predCurie string
 	var err error
 	if predicate != "*" {
+		predicate = s.NamespaceManager.StorageCurie(predicate)
 		if strings.HasPrefix(predicate, "ns") {
 			predCurie = predicate
 		} else {
@@ -927,10 +1004,14 @@ func (s *Store) GetPredicateID(predicate string, txn *badger.Txn) (uint64, error
 func (s *Store) GetManyRelatedEntitiesAtTime(from []*RelatedFrom, limit int, mergePartials bool) (RelatedEntitiesQueryResult, error) {
 	result := RelatedEntitiesQueryResult{}
 	unlimited := limit == 0
+	var returned returnedClasses
+	if len(from) > 0 && from[0].SameAs {
+		returned = newReturnedClasses(from)
+	}
 	var relatedFroms []*RelatedFrom
 	for _, startPoint := range from {
 		if (limit > 0) || unlimited {
-			relatedEntities, err := s.getRelatedEntitiesAtTime(startPoint, limit, mergePartials)
+			relatedEntities, err := s.getRelatedEntitiesAtTime(startPoint, limit, mergePartials, returned)
 			if err != nil {
 				return RelatedEntitiesQueryResult{}, err
 			}
@@ -943,38 +1024,79 @@ func (s *Store) GetManyRelatedEntitiesAtTime(from []*RelatedFrom, limit int, mer
 			relatedFroms = append(relatedFroms, startPoint)
 		}
 	}
+	// the continuations carry the classes returned so far, so that later pages do not return them again
+	if returned != nil {
+		for i, cont := range relatedFroms {
+			c := *cont
+			c.Returned = returned.of(c.StartID)
+			relatedFroms[i] = &c
+		}
+	}
 	result.Cont = relatedFroms
 	return result, nil
 }
 
-func (s *Store) getRelatedEntitiesAtTime(from *RelatedFrom, limit int, mergePartials bool) (RelatedEntitiesResult, error) {
+func (s *Store) getRelatedEntitiesAtTime(
+	from *RelatedFrom,
+	limit int,
+	mergePartials bool,
+	returned returnedClasses,
+) (RelatedEntitiesResult, error) {
 	relations, cont, err := s.GetRelatedAtTime(from, limit)
 	if err != nil {
 		return RelatedEntitiesResult{}, err
 	}
-	result := make([]RelatedEntityResult, len(relations))
-	startURI, err := s.getURIForID(binary.BigEndian.Uint64(from.RelationIndexFromKey[2:10]))
+	result := make([]RelatedEntityResult, 0, len(relations))
+	startID := binary.BigEndian.Uint64(from.RelationIndexFromKey[2:10])
+	if from.StartID != 0 {
+		startID = from.StartID
+	}
+	startURI, err := s.getURIForID(startID)
 	if err != nil {
 		return RelatedEntitiesResult{}, err
 	}
-	for i, r := range relations {
-		predicateURI, err := s.getURIForID(r.PredicateID)
+	var sameAsID uint64
+	if from.SameAs {
+		sameAsID, err = s.sameAsPredicateID()
 		if err != nil {
 			return RelatedEntitiesResult{}, err
 		}
-
-		relatedEntity, err := s.GetEntityWithInternalID(r.EntityID, from.Datasets, mergePartials)
+	}
+	for _, r := range relations {
+		if from.SameAs && r.PredicateID == sameAsID {
+			// links within a class are resolved, not returned
+			continue
+		}
+		predicateURI, err := s.getURIForID(r.PredicateID)
 		if err != nil {
 			return RelatedEntitiesResult{}, err
 		}
 
-		r := RelatedEntityResult{
+		var relatedEntity *Entity
+		if from.SameAs {
+			class, err := s.EquivalentIDs(r.EntityID, from.Datasets, from.At)
+			if err != nil {
+				return RelatedEntitiesResult{}, err
+			}
+			if !returned.add(startID, ReturnedClass{Predicate: r.PredicateID, Class: lowestID(class)}) {
+				continue
+			}
+			relatedEntity, err = s.getEntityAtPointInTime(class, from.At, from.Datasets, mergePartials)
+			if err != nil {
+				return RelatedEntitiesResult{}, err
+			}
+		} else {
+			relatedEntity, err = s.GetEntityWithInternalID(r.EntityID, from.Datasets, mergePartials)
+			if err != nil {
+				return RelatedEntitiesResult{}, err
+			}
+		}
+
+		result = append(result, RelatedEntityResult{
 			StartURI:      startURI,
 			PredicateURI:  predicateURI,
 			RelatedEntity: relatedEntity,
-		}
-
-		result[i] = r
+		})
 	}
 	return RelatedEntitiesResult{Relations: result, Continuation: cont}, nil
 }
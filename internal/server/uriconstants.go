@@ -22,4 +22,7 @@ const (
 
 	RdfsClassURI string = "http://www.w3.org/2000/01/rdf-schema#Class"
 	RdfsLabelURI string = "http://www.w3.org/2000/01/rdf-schema#label"
+
+	// owl:sameAs links entities that describe the same thing
+	OwlSameAsURI string = "http://www.w3.org/2002/07/owl#sameAs"
 )
@@ -37,6 +37,10 @@ const (
 	CONTENT_INDEX         uint16 = 15
 	STORE_NEXT_DATASET_ID uint16 = 16
 	LOGIN_PROVIDER_INDEX  uint16 = 17
+	JOB_RUN_INDEX         uint16 = 18
+	JOB_RUN_LOG_INDEX     uint16 = 19
+	JOB_VERSION_INDEX     uint16 = 20
+	DEAD_LETTER_INDEX     uint16 = 21
 )
 
 func NewStatisticsUpdater(logger *zap.SugaredLogger, store store.BadgerStore) schedulable {
@@ -274,6 +278,14 @@ func idxToStr(idx uint16) string {
 		return "sys:STORE_NEXT_DATASET_ID"
 	case LOGIN_PROVIDER_INDEX:
 		return "sys:LOGIN_PROVIDER_INDEX"
+	case JOB_RUN_INDEX:
+		return "sys:JOB_RUN_INDEX"
+	case JOB_RUN_LOG_INDEX:
+		return "sys:JOB_RUN_LOG_INDEX"
+	case JOB_VERSION_INDEX:
+		return "sys:JOB_VERSION_INDEX"
+	case DEAD_LETTER_INDEX:
+		return "sys:DEAD_LETTER_INDEX"
 	default:
 		return "unknown:other"
 	}
@@ -0,0 +1,130 @@
+// Copyright 2023 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"io"
+	"net/http"
+	"net/http/httptest"
+
+	"github.com/labstack/echo/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+
+	"github.com/mimiro-io/datahub/internal/server"
+	"github.com/mimiro-io/datahub/internal/web/middlewares"
+)
+
+var _ = Describe("The compression middleware", func() {
+	payload := `[{"id":"@context","namespaces":{}},{"id":"ns0:1","props":{}}]`
+	var srv *httptest.Server
+
+	BeforeEach(func() {
+		e := echo.New()
+		// echoes the request body back, with a trailer like the formatted entity streams
+		e.POST("/echo", func(c echo.Context) error {
+			body, err := io.ReadAll(c.Request().Body)
+			if err != nil {
+				return err
+			}
+			c.Response().Header().Set("Trailer", continuationTrailer)
+			c.Response().WriteHeader(http.StatusOK)
+			_, _ = c.Response().Write(body)
+			c.Response().Header().Set(continuationTrailer, "token-1")
+			return nil
+		}, middlewares.Compression(1024))
+		// turns read errors into 400, like the entity handlers do
+		e.POST("/parse", func(c echo.Context) error {
+			if _, err := io.ReadAll(c.Request().Body); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+			}
+			return c.NoContent(http.StatusOK)
+		}, middlewares.Compression(1024))
+		e.GET("/fail", func(c echo.Context) error {
+			return echo.NewHTTPError(http.StatusNotFound, "no such dataset")
+		}, middlewares.Compression(1024))
+		srv = httptest.NewServer(e)
+	})
+	AfterEach(func() {
+		srv.Close()
+	})
+
+	postTo := func(path string, encoding string, body []byte, acceptEncoding string) *http.Response {
+		req, _ := http.NewRequest(http.MethodPost, srv.URL+path, bytes.NewReader(body))
+		if encoding != "" {
+			req.Header.Set("Content-Encoding", encoding)
+		}
+		req.Header.Set("Accept-Encoding", acceptEncoding)
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		return res
+	}
+	post := func(encoding string, body []byte, acceptEncoding string) *http.Response {
+		return postTo("/echo", encoding, body, acceptEncoding)
+	}
+
+	It("Should decode compressed requests and compress responses", func() {
+		for _, encoding := range []string{server.EncodingGzip, server.EncodingZstd} {
+			compressed, err := server.Encode(encoding, []byte(payload))
+			Expect(err).NotTo(HaveOccurred())
+			res := post(encoding, compressed, server.SupportedEncodings)
+			Expect(res.StatusCode).To(Equal(http.StatusOK))
+			Expect(res.Header.Get("Content-Encoding")).To(Equal(server.EncodingZstd))
+			Expect(res.Header.Get("Accept-Encoding")).To(Equal(server.SupportedEncodings))
+			Expect(server.DecodeResponse(res)).To(Succeed())
+			body, err := io.ReadAll(res.Body)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(string(body)).To(Equal(payload))
+			Expect(res.Trailer.Get(continuationTrailer)).To(Equal("token-1"))
+		}
+		Expect(server.RequestEncodingFor(srv.URL + "/datasets/people/entities")).To(Equal(server.EncodingZstd))
+	})
+
+	It("Should leave responses uncompressed unless asked", func() {
+		res := post("", []byte(payload), "identity")
+		Expect(res.Header.Get("Content-Encoding")).To(Equal(""))
+		body, _ := io.ReadAll(res.Body)
+		Expect(string(body)).To(Equal(payload))
+	})
+
+	It("Should turn unknown request encodings down with 415", func() {
+		res := post("br", []byte(payload), "")
+		Expect(res.StatusCode).To(Equal(http.StatusUnsupportedMediaType))
+	})
+
+	It("Should turn requests down with 413 when they decode to more than the limit", func() {
+		large := bytes.Repeat([]byte("x"), 4096)
+		compressed, err := server.Encode(server.EncodingZstd, large)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(len(compressed)).To(BeNumerically("<", 1024))
+		for _, path := range []string{"/echo", "/parse"} {
+			res := postTo(path, server.EncodingZstd, compressed, "")
+			Expect(res.StatusCode).To(Equal(http.StatusRequestEntityTooLarge), path)
+		}
+		Expect(post("", large, "").StatusCode).To(Equal(http.StatusOK), "only decoded bodies are limited")
+	})
+
+	It("Should send errors uncompressed", func() {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/fail", nil)
+		req.Header.Set("Accept-Encoding", server.SupportedEncodings)
+		res, err := http.DefaultClient.Do(req)
+		Expect(err).NotTo(HaveOccurred())
+		Expect(res.StatusCode).To(Equal(http.StatusNotFound))
+		Expect(res.Header.Get("Content-Encoding")).To(Equal(""))
+		body, _ := io.ReadAll(res.Body)
+		Expect(string(body)).To(ContainSubstring("no such dataset"))
+	})
+})
@@ -15,17 +15,20 @@
 package web
 
 import (
+	"bytes"
 	"context"
 	"encoding/base64"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"math"
 	"net/http"
 	"net/url"
 	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/mimiro-io/datahub/internal/jobs"
 
@@ -64,9 +67,11 @@ func RegisterDatasetHandler(
 	}
 
 	e.GET("/datasets", handler.datasetList, mw.authorizer(log, datahubRead))
-	e.GET("/datasets/:dataset/entities", handler.getEntitiesHandler, mw.authorizer(log, datahubRead))
-	e.GET("/datasets/:dataset/changes", handler.getChangesHandler, mw.authorizer(log, datahubRead))
-	e.POST("/datasets/:dataset/entities", handler.storeEntitiesHandler, mw.authorizer(log, datahubWrite))
+	e.GET("/datasets/:dataset/entities", handler.getEntitiesHandler, mw.authorizer(log, datahubRead), mw.compress)
+	e.GET("/datasets/:dataset/changes", handler.getChangesHandler, mw.authorizer(log, datahubRead), mw.compress)
+	e.GET("/datasets/:dataset/diff", handler.getDiffHandler, mw.authorizer(log, datahubRead))
+	e.GET("/changes", handler.getMergedChangesHandler, mw.authorizer(log, datahubRead), mw.compress)
+	e.POST("/datasets/:dataset/entities", handler.storeEntitiesHandler, mw.authorizer(log, datahubWrite), mw.compress)
 
 	e.GET("/datasets/:dataset", handler.datasetGet, mw.authorizer(log, datahubRead))
 	e.POST("/datasets/:dataset", handler.datasetCreate, mw.authorizer(log, datahubWrite))
@@ -77,12 +82,27 @@ func RegisterDatasetHandler(
 
 // datasetList
 func (handler *datasetHandler) datasetList(c echo.Context) error {
-	var err error
+	datasets, err := handler.accessibleDatasets(c, handler.datasetManager.GetDatasetNames())
+	if err != nil {
+		return err
+	}
 
-	datasets := make([]server.DatasetName, 0)
+	datasets = handler.datasetManager.FilterDatasetNames(datasets, server.DatasetMetadataFilter{
+		Tag:            c.QueryParam("tag"),
+		Owner:          c.QueryParam("owner"),
+		Classification: c.QueryParam("classification"),
+		Query:          c.QueryParam("q"),
+	})
 
-	datasets = handler.datasetManager.GetDatasetNames()
+	sort.Slice(datasets, func(i, j int) bool {
+		return datasets[i].Name < datasets[j].Name
+	})
+	return c.JSON(http.StatusOK, datasets)
+}
 
+// accessibleDatasets returns the datasets the calling user has read access to, by node security ACL or OPA
+func (handler *datasetHandler) accessibleDatasets(c echo.Context, datasets []server.DatasetName) ([]server.DatasetName, error) {
+	var err error
 	user := c.Get("user")
 	if user != nil {
 		// check node security ACL
@@ -99,9 +119,10 @@ func (handler *datasetHandler) datasetList(c echo.Context) error {
 		}
 
 		if !isAdmin {
-			datasets, err = handler.tokenProviders.ServiceCore.FilterDatasets(datasets, claims.Subject)
+			all := datasets
+			datasets, err = handler.tokenProviders.ServiceCore.FilterDatasets(all, claims.Subject)
 			if err != nil {
-				return err
+				return nil, err
 			}
 			// also check OPA
 			// this is only set by OPA auth
@@ -110,19 +131,15 @@ func (handler *datasetHandler) datasetList(c echo.Context) error {
 				whitelist := accessible.([]string)
 				if len(whitelist) > 0 { // an empty list here doesn't need to do anything
 					if whitelist[0] == "*" { // this is a catch all, the user has access to all datasets
-						datasets = append(datasets, handler.datasetManager.GetDatasetNames()...)
+						datasets = append(datasets, all...)
 					} else { // we need to do some filtering
-						datasets = append(datasets, whitelistDatasets(handler.datasetManager.GetDatasetNames(), whitelist)...)
+						datasets = append(datasets, whitelistDatasets(all, whitelist)...)
 					}
 				}
 			}
 		}
 	}
-
-	sort.Slice(datasets, func(i, j int) bool {
-		return datasets[i].Name < datasets[j].Name
-	})
-	return c.JSON(http.StatusOK, datasets)
+	return datasets, nil
 }
 
 func whitelistDatasets(datasets []server.DatasetName, whitelist []string) []server.DatasetName {
@@ -157,6 +174,11 @@ func (handler *datasetHandler) datasetCreate(c echo.Context) error {
 			createDatasetConfig.ProxyDatasetConfig.RemoteURL == "" {
 			return echo.NewHTTPError(http.StatusBadRequest, "invalid proxy configuration provided")
 		}
+		if rateLimit := createDatasetConfig.ProxyDatasetConfig.RateLimit; rateLimit != nil {
+			if err := rateLimit.Validate(); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, "invalid proxy configuration provided: "+err.Error())
+			}
+		}
 		_, err = handler.datasetManager.CreateDataset(datasetName, createDatasetConfig)
 	} else if createDatasetConfig.VirtualDatasetConfig != nil {
 		if createDatasetConfig.VirtualDatasetConfig.Transform == "" {
@@ -242,20 +264,6 @@ func (handler *datasetHandler) deleteAllDatasets(c echo.Context) error {
 	return c.NoContent(http.StatusOK)
 }
 
-// convert context to JSON-LD context
-func convertContextToJSONLD(context *server.Context) map[string]interface{} {
-	namespaces := make(map[string]string, len(context.Namespaces)+2)
-	for k, v := range context.Namespaces {
-		namespaces[k] = v
-	}
-	namespaces["core"] = "http://data.mimiro.io/core/uda/"
-	namespaces["rdf"] = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
-
-	jsonLdContext := make(map[string]interface{})
-	jsonLdContext["@context"] = namespaces
-	return jsonLdContext
-}
-
 // getEntitiesHandler
 // path param dataset
 // query param continuationToken
@@ -297,20 +305,12 @@ func (handler *datasetHandler) getEntitiesHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusNotImplemented, "virtual datasets only support /changes")
 	}
 
-	// check if we need to return JSON-LD
-	asJsonLd := false
-	acceptHeader := c.Request().Header.Get("Accept")
-	if strings.Contains(acceptHeader, "application/ld+json") {
-		asJsonLd = true
+	if writer := entityStreamWriterFor(c); writer != nil {
+		return handler.streamEntitiesAs(c, writer, dataset, f, l)
 	}
 
 	preStream := func() error {
-		if asJsonLd {
-			c.Response().Header().Set(echo.HeaderContentType, "application/ld+json")
-		} else {
-			c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
-		}
-
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		c.Response().WriteHeader(http.StatusOK)
 
 		_, err = c.Response().Write([]byte("["))
@@ -319,23 +319,9 @@ func (handler *datasetHandler) getEntitiesHandler(c echo.Context) error {
 		}
 
 		// write context
-		if asJsonLd {
-			ctx := dataset.GetContext()
-
-			jsonContext, _ := json.Marshal(convertContextToJSONLD(ctx))
-			_, err = c.Response().Write(jsonContext)
-			if err != nil {
-				return err
-			}
-		} else {
-			jsonContext, _ := json.Marshal(dataset.GetContext())
-			_, err = c.Response().Write(jsonContext)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
+		jsonContext, _ := json.Marshal(handler.store.NamespaceManager.PublicContext(dataset.GetContext()))
+		_, err = c.Response().Write(jsonContext)
+		return err
 	}
 	var continuationToken string
 	if dataset.IsProxy() {
@@ -344,31 +330,18 @@ func (handler *datasetHandler) getEntitiesHandler(c echo.Context) error {
 			handler.lookupAuth(dataset.ProxyConfig.AuthProviderName),
 		)
 
-		if asJsonLd {
-			continuationToken, err = proxyDataset.StreamEntities(f, l, func(entity *server.Entity) error {
-				_, _ = c.Response().Write([]byte(","))
-				jsonLdBytes, _ := json.Marshal(toJSONLD(entity))
-				_, _ = c.Response().Write(jsonLdBytes)
-				return nil
-			}, preStream)
-		} else {
-			continuationToken, err = proxyDataset.StreamEntitiesRaw(f, l, func(jsonData []byte) error {
-				_, _ = c.Response().Write([]byte(","))
-				_, _ = c.Response().Write(jsonData)
-				return nil
-			}, preStream)
-		}
+		continuationToken, err = proxyDataset.StreamEntitiesRaw(f, l, func(jsonData []byte) error {
+			_, _ = c.Response().Write([]byte(","))
+			_, _ = c.Response().Write(jsonData)
+			return nil
+		}, preStream)
 
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 		if continuationToken != "" {
 			// write the continuation token and end the array of entities
-			if asJsonLd {
-				_, _ = c.Response().Write([]byte(", " + makeJsonLdContinuationToken(continuationToken) + "]"))
-			} else {
-				_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
-			}
+			_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
 		} else {
 			// write only array closing bracket
 			_, _ = c.Response().Write([]byte("]"))
@@ -385,39 +358,24 @@ func (handler *datasetHandler) getEntitiesHandler(c echo.Context) error {
 			return err
 		}
 
-		if asJsonLd {
-			continuationToken, err = dataset.MapEntities(f, l, func(entity *server.Entity) error {
-				_, err2 := c.Response().Write([]byte(","))
-				if err2 != nil {
-					return err2
-				}
-				jsonLdBytes, _ := json.Marshal(toJSONLD(entity))
-				_, err2 = c.Response().Write(jsonLdBytes)
+		continuationToken, err = dataset.MapEntitiesRaw(f, l, func(jsonData []byte) error {
+			jsonData, err2 := handler.store.NamespaceManager.PublicEntityJSON(jsonData)
+			if err2 != nil {
 				return err2
-			})
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 			}
-		} else {
-			continuationToken, err = dataset.MapEntitiesRaw(f, l, func(jsonData []byte) error {
-				_, err2 := c.Response().Write([]byte(","))
-				if err2 != nil {
-					return err2
-				}
-				_, err2 = c.Response().Write(jsonData)
+			_, err2 = c.Response().Write([]byte(","))
+			if err2 != nil {
 				return err2
-			})
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 			}
+			_, err2 = c.Response().Write(jsonData)
+			return err2
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 
 		// write the continuation token and end the array of entities
-		if asJsonLd {
-			_, _ = c.Response().Write([]byte(", " + makeJsonLdContinuationToken(continuationToken) + "]"))
-		} else {
-			_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
-		}
+		_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
 	}
 
 	c.Response().Flush()
@@ -425,113 +383,6 @@ func (handler *datasetHandler) getEntitiesHandler(c echo.Context) error {
 	return nil
 }
 
-func toJsonLdFromMap(entityMap map[string]interface{}) map[string]interface{} {
-	jsonLd := make(map[string]interface{})
-
-	// add id
-	if entityMap["id"] != nil {
-		jsonLd["@id"] = entityMap["id"]
-	}
-
-	if entityMap["props"] != nil {
-		for key, value := range entityMap["props"].(map[string]interface{}) {
-			// check the type of value
-			switch v := value.(type) {
-			case []interface{}:
-				// array of entities
-				jsonLd[key] = toJsonLdFromArray(v)
-			case map[string]interface{}:
-				// entity as json
-				jsonLd[key] = toJsonLdFromMap(v)
-			default:
-				// assume we can just put out the value
-				jsonLd[key] = v
-			}
-		}
-	}
-
-	// if references
-	if entityMap["refs"] != nil {
-		for key, value := range entityMap["refs"].(map[string]interface{}) {
-			// check the type of value
-			switch v := value.(type) {
-			case []string:
-				refs := make([]JsonLdRef, len(v))
-				for _, ref := range v {
-					refs = append(refs, JsonLdRef{ID: ref})
-				}
-				jsonLd[key] = refs
-			case string:
-				jsonLd[key] = JsonLdRef{ID: v}
-			}
-		}
-	}
-
-	return jsonLd
-}
-
-func toJsonLdFromArray(entityArray []interface{}) []interface{} {
-	jsonLd := make([]interface{}, len(entityArray))
-
-	for i, value := range entityArray {
-		switch value.(type) {
-		case []interface{}:
-			jsonLd[i] = toJsonLdFromArray(value.([]interface{}))
-		case map[string]interface{}:
-			jsonLd[i] = toJsonLdFromMap(value.(map[string]interface{}))
-		default:
-			jsonLd[i] = value
-		}
-	}
-
-	return jsonLd
-}
-
-// Convert Entity JSON-LD representation
-func toJSONLD(entity *server.Entity) map[string]interface{} {
-	jsonLd := make(map[string]interface{})
-
-	// get the id and add that
-	jsonLd["@id"] = entity.ID
-
-	// get props
-	for key, value := range entity.Properties {
-		// check the type of value
-		switch v := value.(type) {
-		case []interface{}:
-			// array of values
-			jsonLd[key] = toJsonLdFromArray(v)
-		case map[string]interface{}:
-			// entity as json
-			jsonLd[key] = toJsonLdFromMap(v)
-		default:
-			// assume we can just put out the value
-			jsonLd[key] = v
-		}
-	}
-
-	// get the refs
-	for key, value := range entity.References {
-		// check the type of value
-		switch v := value.(type) {
-		case []string:
-			refs := make([]JsonLdRef, len(v))
-			for _, ref := range v {
-				refs = append(refs, JsonLdRef{ID: ref})
-			}
-			jsonLd[key] = refs
-		case string:
-			jsonLd[key] = JsonLdRef{ID: v}
-		}
-	}
-
-	return jsonLd
-}
-
-type JsonLdRef struct {
-	ID string `json:"@id"`
-}
-
 func (handler *datasetHandler) lookupAuth(authProviderName string) func(req *http.Request) {
 	if provider, ok := handler.tokenProviders.Get(strings.ToLower(authProviderName)); ok {
 		return provider.Authorize
@@ -549,11 +400,6 @@ func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
 	since := c.QueryParam("since")
 	reverse := c.QueryParam("reverse") == "true"
 	latestOnly := c.QueryParam("latestOnly") == "true"
-	asJsonLd := false
-	acceptHeader := c.Request().Header.Get("Accept")
-	if strings.Contains(acceptHeader, "application/ld+json") {
-		asJsonLd = true
-	}
 
 	var l int
 	if limit != "" {
@@ -570,34 +416,49 @@ func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	preStream := func() error {
-		if asJsonLd {
-			c.Response().Header().Set(echo.HeaderContentType, "application/ld+json")
-		} else {
-			c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	if sinceTime := c.QueryParam("sinceTime"); sinceTime != "" {
+		if since != "" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				server.HTTPQueryParamErr(errors.New("since and sinceTime cannot be combined")).Error())
+		}
+		if dataset.IsProxy() || dataset.IsVirtual() {
+			return echo.NewHTTPError(http.StatusNotImplemented, "sinceTime is only supported for local datasets")
+		}
+		t, err := time.Parse(time.RFC3339, sinceTime)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+		offset, err := dataset.OffsetAtTime(t)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+		since = encodeSince(types.DatasetOffset(offset))
+	}
+
+	filter := changesFilterFromQuery(c)
+	if !filter.IsEmpty() {
+		if dataset.IsProxy() || dataset.IsVirtual() {
+			return echo.NewHTTPError(http.StatusNotImplemented, "changes filters are only supported for local datasets")
 		}
+		if err := filter.Resolve(handler.store.NamespaceManager); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+	}
+
+	if writer := entityStreamWriterFor(c); writer != nil {
+		return handler.streamChangesAs(c, writer, dataset, since, l, latestOnly, reverse, filter)
+	}
+
+	preStream := func() error {
+		c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
 		c.Response().WriteHeader(http.StatusOK)
 
 		_, _ = c.Response().Write([]byte("["))
 
 		// write context
-		if asJsonLd {
-			ctx := dataset.GetContext()
-
-			jsonContext, err := json.Marshal(convertContextToJSONLD(ctx))
-			_, err = c.Response().Write(jsonContext)
-			if err != nil {
-				return err
-			}
-		} else {
-			jsonContext, _ := json.Marshal(dataset.GetContext())
-			_, err := c.Response().Write(jsonContext)
-			if err != nil {
-				return err
-			}
-		}
-
-		return nil
+		jsonContext, _ := json.Marshal(handler.store.NamespaceManager.PublicContext(dataset.GetContext()))
+		_, err := c.Response().Write(jsonContext)
+		return err
 	}
 
 	if dataset.IsProxy() {
@@ -605,170 +466,403 @@ func (handler *datasetHandler) getChangesHandler(c echo.Context) error {
 		proxyDataset := dataset.AsProxy(
 			handler.lookupAuth(dataset.ProxyConfig.AuthProviderName))
 
-		// check if we are streaming json-ld
-		continuationToken := ""
-		var err error
-		if asJsonLd {
-			continuationToken, err = proxyDataset.StreamChanges(since, l, latestOnly, reverse, func(entity *server.Entity) error {
-				_, _ = c.Response().Write([]byte(","))
-				jsonData, _ := json.Marshal(toJSONLD(entity))
-				_, _ = c.Response().Write(jsonData)
-				return nil
-			},
-				preStream,
-			)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-			}
-		} else {
-			continuationToken, err = proxyDataset.StreamChangesRaw(since, l, latestOnly, reverse, func(jsonData []byte) error {
-				_, _ = c.Response().Write([]byte(","))
-				_, _ = c.Response().Write(jsonData)
-				return nil
-			}, preStream)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-			}
+		continuationToken, err := proxyDataset.StreamChangesRaw(since, l, latestOnly, reverse, func(jsonData []byte) error {
+			_, _ = c.Response().Write([]byte(","))
+			_, _ = c.Response().Write(jsonData)
+			return nil
+		}, preStream)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
 
 		if continuationToken != "" {
-			if asJsonLd {
-				_, _ = c.Response().Write([]byte(", " + makeJsonLdContinuationToken(continuationToken) + "]"))
-			} else {
-				_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
-			}
+			_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
 		} else {
 			// write only array closing bracket
 			_, _ = c.Response().Write([]byte("]"))
 		}
 	} else if dataset.IsVirtual() {
-		virtualDataset := dataset.AsVirtualDataset(
-			handler.datasetManager,
-			func(d *server.VirtualDataset, params map[string]any, since string,
-				f func(entity *server.Entity) error,
-			) (string, error) {
-				log := d.Logger
-				jsQuery, err := jobs.NewJavascriptTransform(log, d.Transform, d.Store, d.DsManager)
-				if err != nil {
-					log.Warn("Unable to parse javascript query " + err.Error())
-					return "", err
-				}
+		virtualDataset := handler.asVirtualDataset(dataset, l)
+		preStream()
+		continuationToken, err := virtualDataset.StreamChanges(since, c.Request().Body, func(entity *server.Entity) error {
+			_, _ = c.Response().Write([]byte(","))
+			jsonData, _ := json.Marshal(handler.store.NamespaceManager.PublicEntity(entity))
+			_, _ = c.Response().Write(jsonData)
+			return nil
+		})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
 
-				return jsQuery.BuildEntities(params, since, l, f)
-			})
+		if continuationToken != "" {
+			_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
+		} else {
+			// write only array closing bracket
+			_, _ = c.Response().Write([]byte("]"))
+		}
+	} else {
+		sinceNum, err := decodeSince(since)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.SinceParseErr(err).Error())
+		}
 		preStream()
-		// check if we are streaming json-ld
-		continuationToken := ""
-		var err error
-		if asJsonLd {
-			continuationToken, err = virtualDataset.StreamChanges(since, c.Request().Body, func(entity *server.Entity) error {
+		if reverse {
+			continuationToken, err := handler.reverseChanges(dataset, sinceNum, l, filter, func(jsonData []byte) error {
+				jsonData, err := handler.store.NamespaceManager.PublicEntityJSON(jsonData)
+				if err != nil {
+					return err
+				}
 				_, _ = c.Response().Write([]byte(","))
-				jsonData, _ := json.Marshal(toJSONLD(entity))
 				_, _ = c.Response().Write(jsonData)
 				return nil
 			})
 			if err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 			}
+			if continuationToken == "" {
+				_, _ = c.Response().Write([]byte("]"))
+			} else {
+				_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
+			}
 		} else {
-			continuationToken, err = virtualDataset.StreamChanges(since, c.Request().Body, func(entity *server.Entity) error {
+			continuationToken, err := dataset.ProcessFilteredChangesRaw(uint64(sinceNum), l, latestOnly, filter, func(jsonData []byte) error {
+				jsonData, err := handler.store.NamespaceManager.PublicEntityJSON(jsonData)
+				if err != nil {
+					return err
+				}
 				_, _ = c.Response().Write([]byte(","))
-				jsonData, _ := json.Marshal(entity)
 				_, _ = c.Response().Write(jsonData)
 				return nil
 			})
 			if err != nil {
 				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 			}
+			_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + encodeSince(types.DatasetOffset(continuationToken)) + "\"}]"))
 		}
+	}
+	// write the continuation token and end the array of entities
+	c.Response().Flush()
 
-		if continuationToken != "" {
-			if asJsonLd {
-				_, _ = c.Response().Write([]byte(", " + makeJsonLdContinuationToken(continuationToken) + "]"))
-			} else {
-				_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + continuationToken + "\"}]"))
-			}
-		} else {
-			// write only array closing bracket
-			_, _ = c.Response().Write([]byte("]"))
-		}
-	} else {
-		sinceNum, err := decodeSince(since)
+	return nil
+}
+
+// reverseChanges passes the changes of a local dataset to fn, newest first, starting at the since offset.
+// It returns the continuation token, which is empty when the start of the dataset is reached.
+func (handler *datasetHandler) reverseChanges(
+	dataset *server.Dataset,
+	since types.DatasetOffset,
+	limit int,
+	filter *server.ChangesFilter,
+	fn func(jsonData []byte) error,
+) (string, error) {
+	of, err := ds.Of(server.NewBadgerAccess(handler.store, handler.datasetManager), dataset.ID)
+	if err != nil {
+		return "", err
+	}
+	it, err := of.At(since)
+	if err != nil {
+		return "", err
+	}
+	it = it.Inverse()
+	defer it.Close()
+	cnt := 0
+	for it.Next() {
+		jsonData, ok, err := filter.Apply(it.Item())
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, server.SinceParseErr(err).Error())
+			return "", err
 		}
-		preStream()
-		if reverse {
-			continuationToken := sinceNum
-			of, err := ds.Of(server.NewBadgerAccess(handler.store, handler.datasetManager), dataset.ID)
+		if !ok {
+			continue
+		}
+		if err := fn(jsonData); err != nil {
+			return "", err
+		}
+		cnt++
+		if cnt == limit {
+			break
+		}
+	}
+	continuationToken := it.NextOffset()
+	if it.Error() != nil {
+		return "", it.Error()
+	}
+	if continuationToken == 0 {
+		return "", nil
+	}
+	return encodeSince(continuationToken), nil
+}
+
+// asVirtualDataset wraps a dataset as a virtual dataset, which builds its entities with the javascript transform
+func (handler *datasetHandler) asVirtualDataset(dataset *server.Dataset, limit int) *server.VirtualDataset {
+	return dataset.AsVirtualDataset(
+		handler.datasetManager,
+		func(d *server.VirtualDataset, params map[string]any, since string,
+			f func(entity *server.Entity) error,
+		) (string, error) {
+			log := d.Logger
+			limits, err := jobs.NewJavascriptLimits(d.TimeLimit, d.QueryLimit)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+				return "", err
 			}
-			it, err := of.At(types.DatasetOffset(sinceNum))
+			jsQuery, err := jobs.NewJavascriptTransformWithLimits(log, d.Transform, d.Store, d.DsManager, limits)
 			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-			}
-			it = it.Inverse()
-			defer it.Close()
-			cnt := 0
-			for it.Next() {
-				jsonData := it.Item()
-				_, _ = c.Response().Write([]byte(","))
-				_, _ = c.Response().Write(jsonData)
-				cnt++
-				if cnt == l {
-					break
-				}
-			}
-			continuationToken = it.NextOffset()
-			if it.Error() != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, it.Error().Error())
+				log.Warn("Unable to parse javascript query " + err.Error())
+				return "", err
 			}
-			if reverse && continuationToken == 0 {
-				_, _ = c.Response().Write([]byte("]"))
-			} else {
-				_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + encodeSince(continuationToken) + "\"}]"))
+
+			return jsQuery.BuildEntities(params, since, limit, f)
+		})
+}
+
+// changesFilterFromQuery reads the type, hasProperty, deleted, where and properties query params.
+// All except deleted can be repeated, and properties can also be given as a comma separated list.
+func changesFilterFromQuery(c echo.Context) *server.ChangesFilter {
+	params := c.QueryParams()
+	var properties []string
+	for _, p := range params["properties"] {
+		for _, name := range strings.Split(p, ",") {
+			if name = strings.TrimSpace(name); name != "" {
+				properties = append(properties, name)
 			}
-		} else {
-			if asJsonLd {
-				continuationToken, err := dataset.ProcessChanges(uint64(sinceNum), l, latestOnly, func(entity *server.Entity) {
-					_, _ = c.Response().Write([]byte(","))
-					jsonData, _ := json.Marshal(toJSONLD(entity))
-					_, _ = c.Response().Write(jsonData)
-				})
-				if err != nil {
-					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-				}
+		}
+	}
+	return &server.ChangesFilter{
+		Types:         params["type"],
+		HasProperties: params["hasProperty"],
+		Deleted:       c.QueryParam("deleted"),
+		Where:         params["where"],
+		Properties:    properties,
+	}
+}
 
-				// encode continuation token as
+// getMergedChangesHandler
+// query param datasets, a comma separated list of local datasets
+// query param since, a continuation token from a previous response for the same datasets
+// query param sinceTime, an RFC3339 timestamp to start from instead of since
+// query param limit, and the same filter params as the changes of a single dataset
+func (handler *datasetHandler) getMergedChangesHandler(c echo.Context) error {
+	names := make([]string, 0)
+	seen := make(map[string]bool)
+	for _, name := range strings.Split(c.QueryParam("datasets"), ",") {
+		name = strings.TrimSpace(name)
+		if name == "" {
+			continue
+		}
+		if seen[name] {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				server.HTTPQueryParamErr(fmt.Errorf("dataset %s is listed more than once", name)).Error())
+		}
+		seen[name] = true
+		names = append(names, name)
+	}
+	if len(names) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			server.HTTPQueryParamErr(errors.New("datasets must list at least one dataset")).Error())
+	}
 
-				_, _ = c.Response().Write([]byte(", " + makeJsonLdContinuationToken(encodeSince(types.DatasetOffset(continuationToken))) + "]"))
+	var l int
+	if limit := c.QueryParam("limit"); limit != "" {
+		f, err := strconv.ParseInt(limit, 10, 64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+		l = int(f)
+	}
 
-			} else {
-				continuationToken, err := dataset.ProcessChangesRaw(uint64(sinceNum), l, latestOnly, func(jsonData []byte) error {
-					_, _ = c.Response().Write([]byte(","))
-					_, _ = c.Response().Write(jsonData)
-					return nil
-				})
-				if err != nil {
-					return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
-				}
-				_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + encodeSince(types.DatasetOffset(continuationToken)) + "\"}]"))
-			}
+	datasetNames := make([]server.DatasetName, 0, len(names))
+	for _, name := range names {
+		datasetNames = append(datasetNames, server.DatasetName{Name: name})
+	}
+	accessible, err := handler.accessibleDatasets(c, datasetNames)
+	if err != nil {
+		return err
+	}
+	allowed := make(map[string]bool, len(accessible))
+	for _, ds := range accessible {
+		allowed[ds.Name] = true
+	}
+
+	datasets := make([]*server.Dataset, 0, len(names))
+	var publicNamespaces []string
+	allNamespaces := false
+	for _, name := range names {
+		if !allowed[name] {
+			return echo.NewHTTPError(http.StatusForbidden, "user does not have permission")
 		}
+		dataset := handler.datasetManager.GetDataset(name)
+		if dataset == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "dataset not found: "+name)
+		}
+		if dataset.IsProxy() || dataset.IsVirtual() {
+			return echo.NewHTTPError(http.StatusNotImplemented, "merged changes are only supported for local datasets")
+		}
+		if len(dataset.PublicNamespaces) == 0 {
+			allNamespaces = true
+		}
+		publicNamespaces = append(publicNamespaces, dataset.PublicNamespaces...)
+		datasets = append(datasets, dataset)
 	}
-	// write the continuation token and end the array of entities
+	if allNamespaces {
+		publicNamespaces = nil
+	}
+
+	var cont *server.MergedChangesContinuation
+	if sinceTime := c.QueryParam("sinceTime"); sinceTime != "" {
+		if c.QueryParam("since") != "" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				server.HTTPQueryParamErr(errors.New("since and sinceTime cannot be combined")).Error())
+		}
+		t, err := time.Parse(time.RFC3339, sinceTime)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+		cont, err = server.MergedChangesContinuationAtTime(datasets, t)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+		}
+	} else {
+		cont, err = server.DecodeMergedChangesContinuation(c.QueryParam("since"), names)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.SinceParseErr(err).Error())
+		}
+	}
+
+	filter := changesFilterFromQuery(c)
+	if !filter.IsEmpty() {
+		if err := filter.Resolve(handler.store.NamespaceManager); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+	}
+
+	c.Response().Header().Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	c.Response().WriteHeader(http.StatusOK)
+	_, _ = c.Response().Write([]byte("["))
+	ctx := handler.store.NamespaceManager.PublicContext(handler.store.NamespaceManager.GetContext(publicNamespaces))
+	jsonContext, _ := json.Marshal(ctx)
+	_, _ = c.Response().Write(jsonContext)
+
+	err = handler.store.ProcessMergedChangesRaw(datasets, cont, l, filter, func(dataset string, jsonData []byte) error {
+		jsonData, err := handler.store.NamespaceManager.PublicEntityJSON(jsonData)
+		if err != nil {
+			return err
+		}
+		_, _ = c.Response().Write([]byte(","))
+		_, _ = c.Response().Write(tagWithDataset(jsonData, dataset))
+		return nil
+	})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+
+	token, err := cont.Encode()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	_, _ = c.Response().Write([]byte(", {\"id\":\"@continuation\",\"token\":\"" + token + "\"}]"))
 	c.Response().Flush()
+	return nil
+}
 
+// tagWithDataset adds a top level dataset property to the json of an entity
+func tagWithDataset(jsonData []byte, dataset string) []byte {
+	name, _ := json.Marshal(dataset)
+	tagged := make([]byte, 0, len(jsonData)+len(name)+12)
+	tagged = append(tagged, `{"dataset":`...)
+	tagged = append(tagged, name...)
+	tagged = append(tagged, ',')
+	// skip the opening brace of the entity object
+	return append(tagged, bytes.TrimSpace(jsonData)[1:]...)
+}
+
+// getDiffHandler
+// path param dataset
+// query param from and to, given as since tokens or RFC3339 timestamps
+// query param with, the name of a dataset to compare against instead
+func (handler *datasetHandler) getDiffHandler(c echo.Context) error {
+	datasetName := c.Param("dataset")
+	dataset := handler.datasetManager.GetDataset(datasetName)
+	if dataset == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if dataset.IsProxy() || dataset.IsVirtual() {
+		return echo.NewHTTPError(http.StatusNotImplemented, "diff is only supported for local datasets")
+	}
+
+	var diff func(processDiff func(diff *server.EntityDiff) error) error
+	if with := c.QueryParam("with"); with != "" {
+		// the authorizer only checks the dataset in the path, so access to the other one is checked here
+		accessible, err := handler.accessibleDatasets(c, []server.DatasetName{{Name: with}})
+		if err != nil {
+			return err
+		}
+		if len(accessible) == 0 {
+			return echo.NewHTTPError(http.StatusForbidden, "user does not have permission")
+		}
+		other := handler.datasetManager.GetDataset(with)
+		if other == nil {
+			return echo.NewHTTPError(http.StatusNotFound, "dataset "+with+" does not exist")
+		}
+		if other.IsProxy() || other.IsVirtual() {
+			return echo.NewHTTPError(http.StatusNotImplemented, "diff is only supported for local datasets")
+		}
+		diff = func(processDiff func(diff *server.EntityDiff) error) error {
+			return dataset.DiffDataset(other, processDiff)
+		}
+	} else {
+		from, err := resolveOffset(dataset, c.QueryParam("from"), 0)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+		to, err := resolveOffset(dataset, c.QueryParam("to"), math.MaxUint64)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+		diff = func(processDiff func(diff *server.EntityDiff) error) error {
+			return dataset.Diff(from, to, processDiff)
+		}
+	}
+
+	return writeDiffs(c, diff)
+}
+
+// writeDiffs streams entity diffs as newline delimited JSON. An error before the first diff is returned as an http
+// error, later errors are written as a last line with an error field, since the status has already been sent.
+func writeDiffs(c echo.Context, diff func(processDiff func(diff *server.EntityDiff) error) error) error {
+	enc := json.NewEncoder(c.Response())
+	begin := func() {
+		if !c.Response().Committed {
+			c.Response().Header().Set(echo.HeaderContentType, "application/x-ndjson")
+			c.Response().WriteHeader(http.StatusOK)
+		}
+	}
+	err := diff(func(diff *server.EntityDiff) error {
+		begin()
+		return enc.Encode(diff)
+	})
+	if err != nil {
+		if !c.Response().Committed {
+			return echo.NewHTTPError(http.StatusInternalServerError, server.HTTPGenericErr(err).Error())
+		}
+		_ = enc.Encode(map[string]string{"error": server.HTTPGenericErr(err).Error()})
+	}
+	begin()
+	c.Response().Flush()
 	return nil
 }
 
-func makeJsonLdContinuationToken(token string) string {
-	contToken := make(map[string]interface{})
-	contToken["rdf:type"] = map[string]string{"@id": "core:continuation"}
-	contToken["core:token"] = token
-	jsonData, _ := json.Marshal(contToken)
-	return string(jsonData)
+// resolveOffset converts a since token or an RFC3339 timestamp into a change log offset
+func resolveOffset(dataset *server.Dataset, value string, defaultOffset uint64) (uint64, error) {
+	if value == "" {
+		return defaultOffset, nil
+	}
+	if t, err := time.Parse(time.RFC3339, value); err == nil {
+		return dataset.OffsetAtTime(t)
+	}
+	offset, err := decodeSince(value)
+	if err != nil {
+		return 0, err
+	}
+	return uint64(offset), nil
 }
 
 // storeEntitiesHandler
@@ -807,6 +901,11 @@ func (handler *datasetHandler) processEntities(
 		return echo.NewHTTPError(http.StatusNotImplemented, "virtual datasets are read-only")
 	}
 
+	parse, body, err := handler.entityParserFor(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.AttemptStoreEntitiesErr(err).Error())
+	}
+
 	// start new fullsync if requested
 	if fullSyncStart {
 		err2 := dataset.StartFullSyncWithLease(fullSyncID)
@@ -822,10 +921,9 @@ func (handler *datasetHandler) processEntities(
 
 	batchSize := 10
 	entities := make([]*server.Entity, 0)
-	esp := server.NewEntityStreamParser(handler.store)
 	count := 0
 	// this should be returning an error
-	err = esp.ParseStream(c.Request().Body, func(e *server.Entity) error {
+	err = parse(body, func(e *server.Entity) error {
 		entities = append(entities, e)
 		count++
 		if count == batchSize {
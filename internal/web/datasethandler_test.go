@@ -0,0 +1,123 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/golang-jwt/jwt/v4"
+	"github.com/labstack/echo/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+	"github.com/mimiro-io/datahub/internal/security"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("The dataset diff handler", func() {
+	writeWith := func(diff func(processDiff func(diff *server.EntityDiff) error) error) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/datasets/people/diff", nil), rec)
+		return rec, writeDiffs(c, diff)
+	}
+
+	It("Should write errors in the stream once diffs have been written", func() {
+		rec, err := writeWith(func(processDiff func(diff *server.EntityDiff) error) error {
+			Expect(processDiff(&server.EntityDiff{ID: "ex:1", Change: server.DiffAdded})).To(Succeed())
+			return errors.New("boom")
+		})
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(strings.Split(strings.TrimSpace(rec.Body.String()), "\n")).To(Equal([]string{
+			`{"id":"ex:1","change":"added"}`,
+			`{"error":"internal failure: boom"}`,
+		}))
+	})
+
+	It("Should return errors before the first diff as http errors", func() {
+		rec, err := writeWith(func(processDiff func(diff *server.EntityDiff) error) error {
+			return errors.New("boom")
+		})
+		Expect(err).To(MatchError(ContainSubstring("boom")))
+		Expect(rec.Body.String()).To(BeEmpty())
+
+		rec, err = writeWith(func(processDiff func(diff *server.EntityDiff) error) error { return nil })
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+		Expect(rec.Header().Get(echo.HeaderContentType)).To(Equal("application/x-ndjson"))
+	})
+})
+
+var _ = Describe("The dataset diff handler access", func() {
+	var store *server.Store
+	var handler *datasetHandler
+	var serviceCore *security.ServiceCore
+	storeLocation := "./test_diff_access"
+	BeforeEach(func() {
+		_ = os.RemoveAll(storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = server.NewStore(e, &statsd.NoOpClient{})
+		serviceCore = &security.ServiceCore{Location: storeLocation}
+		handler = &datasetHandler{
+			datasetManager: server.NewDsManager(e, store, server.NoOpBus()),
+			store:          store,
+			tokenProviders: &security.TokenProviders{ServiceCore: serviceCore},
+		}
+		for _, name := range []string{"a", "b"} {
+			_, err := handler.datasetManager.CreateDataset(name, nil)
+			Expect(err).To(BeNil())
+		}
+	})
+	AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+
+	diffWith := func(with string) (*httptest.ResponseRecorder, error) {
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(httptest.NewRequest(http.MethodGet, "/datasets/a/diff?with="+with, nil), rec)
+		c.SetParamNames("dataset")
+		c.SetParamValues("a")
+		c.Set("user", &jwt.Token{Claims: &security.CustomClaims{
+			RegisteredClaims: jwt.RegisteredClaims{Subject: "client"},
+		}})
+		return rec, handler.getDiffHandler(c)
+	}
+
+	It("Should only diff with datasets the user can read", func() {
+		serviceCore.SetClientAccessControls("client", []*security.AccessControl{
+			{Resource: "/datasets/a*", Action: "read"},
+			{Resource: "/datasets/b", Action: "read", Deny: true},
+		})
+		_, err := diffWith("b")
+		var httpErr *echo.HTTPError
+		Expect(errors.As(err, &httpErr)).To(BeTrue())
+		Expect(httpErr.Code).To(Equal(http.StatusForbidden))
+
+		serviceCore.SetClientAccessControls("client", []*security.AccessControl{
+			{Resource: "/datasets/*", Action: "read"},
+		})
+		rec, err := diffWith("b")
+		Expect(err).To(BeNil())
+		Expect(rec.Code).To(Equal(http.StatusOK))
+	})
+})
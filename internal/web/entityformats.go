@@ -0,0 +1,572 @@
+// Copyright 2023 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/base64"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"math"
+	"mime"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mimiro-io/datahub/internal/server"
+	"github.com/mimiro-io/datahub/internal/service/types"
+)
+
+const (
+	mimeJSONLD    = "application/ld+json"
+	mimeNDJSON    = "application/x-ndjson"
+	mimeCSV       = "text/csv"
+	mimeNTriples  = "application/n-triples"
+	mimeTurtle    = "text/turtle"
+	xsdNamespace  = "http://www.w3.org/2001/XMLSchema#"
+	rdfJSON       = "http://www.w3.org/1999/02/22-rdf-syntax-ns#JSON"
+	udaDeletedURI = "http://data.mimiro.io/core/uda/deleted"
+
+	// continuationTrailer carries the continuation token for formats that have no place for it in the body
+	continuationTrailer = "X-Continuation-Token"
+	// errorTrailer carries an error that happened after the response was started
+	errorTrailer = "X-Stream-Error"
+)
+
+// entityStreamWriter writes a stream of entities in a format other than the UDA JSON array
+type entityStreamWriter interface {
+	contentType() string
+	begin(w io.Writer, context *server.Context) error
+	writeEntity(w io.Writer, entity *server.Entity) error
+	// end is given the continuation token, for formats that can write it in the body
+	end(w io.Writer, continuationToken string) error
+}
+
+// entityStreamWriterFor picks a writer for the most preferred type in the Accept header, or returns nil for UDA JSON
+func entityStreamWriterFor(c echo.Context) entityStreamWriter {
+	for _, mediaType := range acceptedMediaTypes(c.Request().Header.Get("Accept")) {
+		switch mediaType {
+		case echo.MIMEApplicationJSON, "application/*", "*/*":
+			return nil
+		case mimeJSONLD:
+			return &jsonLDWriter{frame: listQueryParam(c, "frame")}
+		case mimeNDJSON:
+			return &ndjsonWriter{}
+		case mimeCSV:
+			return &csvWriter{columns: listQueryParam(c, "columns")}
+		case mimeNTriples:
+			return &nTriplesWriter{mime: mimeNTriples}
+		case mimeTurtle:
+			// n-triples is a subset of turtle
+			return &nTriplesWriter{mime: mimeTurtle}
+		}
+	}
+	return nil
+}
+
+// acceptedMediaTypes lists the media types of an Accept header by their q value, highest first. Types with
+// the same q value keep their order, and types with q=0 are left out.
+func acceptedMediaTypes(accept string) []string {
+	type mediaRange struct {
+		mediaType string
+		q         float64
+	}
+	var ranges []mediaRange
+	for _, part := range strings.Split(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(part)
+		if err != nil {
+			continue
+		}
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			if q, err = strconv.ParseFloat(v, 64); err != nil {
+				continue
+			}
+		}
+		if q > 0 {
+			ranges = append(ranges, mediaRange{mediaType: mediaType, q: q})
+		}
+	}
+	sort.SliceStable(ranges, func(i, j int) bool { return ranges[i].q > ranges[j].q })
+	mediaTypes := make([]string, len(ranges))
+	for i, r := range ranges {
+		mediaTypes[i] = r.mediaType
+	}
+	return mediaTypes
+}
+
+// listQueryParam reads a comma separated list from a query parameter
+func listQueryParam(c echo.Context, name string) []string {
+	var values []string
+	for _, v := range strings.Split(c.QueryParam(name), ",") {
+		if v = strings.TrimSpace(v); v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// entityParserFor picks a parser for the request body from its content type. CSV is posted as
+// multipart/form-data, with a mapping part followed by a data part.
+func (handler *datasetHandler) entityParserFor(c echo.Context) (
+	func(reader io.Reader, emitEntity func(*server.Entity) error) error, io.Reader, error,
+) {
+	mediaType, _, _ := mime.ParseMediaType(c.Request().Header.Get(echo.HeaderContentType))
+	switch mediaType {
+	case mimeNTriples, mimeTurtle:
+		return server.NewRDFStreamParser(handler.store).ParseStream, c.Request().Body, nil
+	case mimeJSONLD:
+		return server.NewJSONLDStreamParser(handler.store).ParseStream, c.Request().Body, nil
+	case echo.MIMEMultipartForm:
+		reader, err := c.Request().MultipartReader()
+		if err != nil {
+			return nil, nil, err
+		}
+		part, err := reader.NextPart()
+		if err != nil || part.FormName() != "mapping" {
+			return nil, nil, errors.New("expected a mapping part first in multipart body")
+		}
+		mapping := &server.CSVMapping{}
+		if err := json.NewDecoder(part).Decode(mapping); err != nil {
+			return nil, nil, fmt.Errorf("invalid csv mapping: %w", err)
+		}
+		parser, err := server.NewCSVStreamParser(handler.store, mapping)
+		if err != nil {
+			return nil, nil, err
+		}
+		part, err = reader.NextPart()
+		if err != nil || part.FormName() != "data" {
+			return nil, nil, errors.New("expected a data part after the mapping in multipart body")
+		}
+		return parser.ParseStream, part, nil
+	}
+	return server.NewEntityStreamParser(handler.store).ParseStream, c.Request().Body, nil
+}
+
+// formattedStream wraps a response with a writer. The continuation token is sent as a trailer,
+// since it is only known when all entities are written.
+type formattedStream struct {
+	c       echo.Context
+	writer  entityStreamWriter
+	context *server.Context
+	// newContext makes the context when the stream begins, if it is not given
+	newContext func() *server.Context
+	started    bool
+}
+
+func (s *formattedStream) begin() error {
+	if s.started {
+		return nil
+	}
+	s.started = true
+	if s.context == nil {
+		s.context = s.newContext()
+	}
+	header := s.c.Response().Header()
+	header.Set(echo.HeaderContentType, s.writer.contentType())
+	header.Set("Trailer", continuationTrailer+", "+errorTrailer)
+	s.c.Response().WriteHeader(http.StatusOK)
+	return s.writer.begin(s.c.Response(), s.context)
+}
+
+func (s *formattedStream) write(entity *server.Entity) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	return s.writer.writeEntity(s.c.Response(), entity)
+}
+
+func (s *formattedStream) end(continuationToken string) error {
+	if err := s.begin(); err != nil {
+		return err
+	}
+	if err := s.writer.end(s.c.Response(), continuationToken); err != nil {
+		return err
+	}
+	if continuationToken != "" {
+		s.c.Response().Header().Set(continuationTrailer, continuationToken)
+	}
+	s.c.Response().Flush()
+	return nil
+}
+
+// fail reports an error of the stream. Before the stream has begun it is returned as the response, after
+// that the status is already sent, so the error is sent in the X-Stream-Error trailer instead.
+func (s *formattedStream) fail(status int, err error) error {
+	if !s.started {
+		return echo.NewHTTPError(status, err.Error())
+	}
+	s.c.Response().Header().Set(errorTrailer, server.HTTPGenericErr(err).Error())
+	s.c.Response().Flush()
+	return nil
+}
+
+// ndjsonWriter writes the context and then each entity on a line of its own
+type ndjsonWriter struct{}
+
+func (n *ndjsonWriter) contentType() string { return mimeNDJSON }
+
+func (n *ndjsonWriter) begin(w io.Writer, context *server.Context) error {
+	return writeJSONLine(w, context)
+}
+
+func (n *ndjsonWriter) writeEntity(w io.Writer, entity *server.Entity) error {
+	return writeJSONLine(w, entity)
+}
+
+func (n *ndjsonWriter) end(w io.Writer, continuationToken string) error { return nil }
+
+func writeJSONLine(w io.Writer, v any) error {
+	data, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(data, '\n'))
+	return err
+}
+
+// csvWriter writes one row per entity. The first column is the entity id, followed by the requested columns.
+// Without requested columns, they are taken from the first entity: deleted, its properties and then its references.
+// The rows are streamed, so values of later entities that are not in these columns are left out.
+// Lists are joined with |, and nested entities are written as JSON.
+type csvWriter struct {
+	columns []string
+	keys    []string // the entity key of each column, as a CURIE
+	context *server.Context
+	out     *csv.Writer
+}
+
+func (cw *csvWriter) contentType() string { return mimeCSV }
+
+func (cw *csvWriter) begin(w io.Writer, context *server.Context) error {
+	cw.context = context
+	cw.out = csv.NewWriter(w)
+	if len(cw.columns) > 0 {
+		return cw.writeHeader()
+	}
+	return nil
+}
+
+func (cw *csvWriter) writeHeader() error {
+	cw.keys = make([]string, len(cw.columns))
+	for i, col := range cw.columns {
+		cw.keys[i] = compactURI(cw.context, col)
+	}
+	return cw.out.Write(append([]string{"id"}, cw.columns...))
+}
+
+func (cw *csvWriter) writeEntity(w io.Writer, entity *server.Entity) error {
+	if cw.keys == nil {
+		cw.columns = defaultCSVColumns(entity)
+		if err := cw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	row := make([]string, 0, len(cw.keys)+1)
+	row = append(row, entity.ID)
+	for _, key := range cw.keys {
+		row = append(row, csvCell(entity, key))
+	}
+	return cw.out.Write(row)
+}
+
+func (cw *csvWriter) end(w io.Writer, continuationToken string) error {
+	if cw.keys == nil {
+		cw.columns = []string{"deleted"}
+		if err := cw.writeHeader(); err != nil {
+			return err
+		}
+	}
+	cw.out.Flush()
+	return cw.out.Error()
+}
+
+func defaultCSVColumns(entity *server.Entity) []string {
+	props := make([]string, 0, len(entity.Properties))
+	for k := range entity.Properties {
+		props = append(props, k)
+	}
+	sort.Strings(props)
+	refs := make([]string, 0, len(entity.References))
+	for k := range entity.References {
+		if _, isProp := entity.Properties[k]; !isProp {
+			refs = append(refs, k)
+		}
+	}
+	sort.Strings(refs)
+	return append(append([]string{"deleted"}, props...), refs...)
+}
+
+func csvCell(entity *server.Entity, key string) string {
+	switch key {
+	case "deleted":
+		return fmt.Sprint(entity.IsDeleted)
+	case "recorded":
+		return fmt.Sprint(entity.Recorded)
+	}
+	values := flattenValues(entity.Properties[key])
+	values = append(values, flattenValues(entity.References[key])...)
+	return strings.Join(values, "|")
+}
+
+func flattenValues(value any) []string {
+	switch v := value.(type) {
+	case nil:
+		return nil
+	case string:
+		return []string{v}
+	case []string:
+		return v
+	case []any:
+		result := make([]string, 0, len(v))
+		for _, item := range v {
+			result = append(result, flattenValues(item)...)
+		}
+		return result
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		return []string{fmt.Sprint(value)}
+	}
+	return []string{string(data)}
+}
+
+// nTriplesWriter writes each property and reference value as a triple, with CURIEs expanded using the context
+type nTriplesWriter struct {
+	mime    string
+	context *server.Context
+}
+
+func (nt *nTriplesWriter) contentType() string { return nt.mime }
+
+func (nt *nTriplesWriter) begin(w io.Writer, context *server.Context) error {
+	nt.context = context
+	return nil
+}
+
+func (nt *nTriplesWriter) writeEntity(w io.Writer, entity *server.Entity) error {
+	subject := nTriplesIRI(expandCURIE(nt.context, entity.ID))
+	var sb strings.Builder
+	if entity.IsDeleted {
+		sb.WriteString(subject + " " + nTriplesIRI(udaDeletedURI) + " " + nTriplesLiteral(true) + " .\n")
+	}
+	for _, key := range sortedKeys(entity.Properties) {
+		predicate := nTriplesIRI(expandCURIE(nt.context, key))
+		for _, value := range listValues(entity.Properties[key]) {
+			if value == nil {
+				continue
+			}
+			sb.WriteString(subject + " " + predicate + " " + nTriplesLiteral(value) + " .\n")
+		}
+	}
+	for _, key := range sortedKeys(entity.References) {
+		predicate := nTriplesIRI(expandCURIE(nt.context, key))
+		for _, ref := range flattenValues(entity.References[key]) {
+			sb.WriteString(subject + " " + predicate + " " + nTriplesIRI(expandCURIE(nt.context, ref)) + " .\n")
+		}
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+func (nt *nTriplesWriter) end(w io.Writer, continuationToken string) error { return nil }
+
+func sortedKeys(m map[string]any) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func listValues(value any) []any {
+	switch v := value.(type) {
+	case []any:
+		return v
+	case []string:
+		result := make([]any, len(v))
+		for i, s := range v {
+			result[i] = s
+		}
+		return result
+	}
+	return []any{value}
+}
+
+var (
+	literalEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`)
+	iriEscaper     = strings.NewReplacer(" ", "%20", "<", "%3C", ">", "%3E", `"`, "%22", "{", "%7B", "}", "%7D",
+		"|", "%7C", "^", "%5E", "`", "%60", `\`, "%5C")
+)
+
+func nTriplesIRI(iri string) string {
+	return "<" + iriEscaper.Replace(iri) + ">"
+}
+
+func nTriplesLiteral(value any) string {
+	typed := func(lexical string, datatype string) string {
+		return `"` + literalEscaper.Replace(lexical) + `"^^` + nTriplesIRI(datatype)
+	}
+	switch v := value.(type) {
+	case string:
+		return `"` + literalEscaper.Replace(v) + `"`
+	case bool:
+		return typed(fmt.Sprint(v), xsdNamespace+"boolean")
+	case float64:
+		if v == math.Trunc(v) && math.Abs(v) < 1e15 {
+			return typed(fmt.Sprintf("%.0f", v), xsdNamespace+"integer")
+		}
+		return typed(fmt.Sprint(v), xsdNamespace+"double")
+	case float32:
+		return typed(fmt.Sprint(v), xsdNamespace+"double")
+	case int, int8, int16, int32, int64, uint, uint8, uint16, uint32, uint64:
+		return typed(fmt.Sprint(v), xsdNamespace+"integer")
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data = []byte(fmt.Sprint(value))
+	}
+	return typed(string(data), rdfJSON)
+}
+
+// expandCURIE returns the full URI for a CURIE in the context, or the identifier unchanged
+func expandCURIE(context *server.Context, identifier string) string {
+	if strings.Contains(identifier, "://") {
+		return identifier
+	}
+	prefix, local, found := strings.Cut(identifier, ":")
+	if !found || context == nil {
+		return identifier
+	}
+	if expansion, ok := context.Namespaces[prefix]; ok {
+		return expansion + local
+	}
+	return identifier
+}
+
+// compactURI returns the CURIE for a full URI in the context, using the longest matching expansion
+func compactURI(context *server.Context, identifier string) string {
+	if !strings.Contains(identifier, "://") || context == nil {
+		return identifier
+	}
+	bestPrefix, bestExpansion := "", ""
+	for prefix, expansion := range context.Namespaces {
+		if strings.HasPrefix(identifier, expansion) && len(expansion) > len(bestExpansion) {
+			bestPrefix, bestExpansion = prefix, expansion
+		}
+	}
+	if bestExpansion == "" {
+		return identifier
+	}
+	return bestPrefix + ":" + strings.TrimPrefix(identifier, bestExpansion)
+}
+
+// newPublicStream makes a stream for the entities of dataset. The context is made when the first entity is
+// written, since the entities of a proxy dataset can add namespaces as they are read.
+func (handler *datasetHandler) newPublicStream(
+	c echo.Context,
+	writer entityStreamWriter,
+	dataset *server.Dataset,
+) (*formattedStream, func(*server.Entity) error) {
+	nsm := handler.store.NamespaceManager
+	stream := &formattedStream{c: c, writer: writer, newContext: func() *server.Context {
+		return nsm.PublicContext(dataset.GetContext())
+	}}
+	return stream, func(entity *server.Entity) error {
+		return stream.write(nsm.PublicEntity(entity))
+	}
+}
+
+// streamEntitiesAs writes the entities of a local or proxy dataset with the given writer
+func (handler *datasetHandler) streamEntitiesAs(
+	c echo.Context,
+	writer entityStreamWriter,
+	dataset *server.Dataset,
+	from string,
+	limit int,
+) error {
+	stream, writePublic := handler.newPublicStream(c, writer, dataset)
+
+	var continuationToken string
+	var err error
+	if dataset.IsProxy() {
+		proxyDataset := dataset.AsProxy(handler.lookupAuth(dataset.ProxyConfig.AuthProviderName))
+		continuationToken, err = proxyDataset.StreamEntities(from, limit, writePublic, nil)
+	} else {
+		if from != "" {
+			if _, err = base64.StdEncoding.DecodeString(from); err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, server.SinceParseErr(err).Error())
+			}
+		}
+		continuationToken, err = dataset.MapEntities(from, limit, writePublic)
+	}
+	if err != nil {
+		return stream.fail(http.StatusInternalServerError, err)
+	}
+	return stream.end(continuationToken)
+}
+
+// streamChangesAs writes the changes of a dataset with the given writer
+func (handler *datasetHandler) streamChangesAs(
+	c echo.Context,
+	writer entityStreamWriter,
+	dataset *server.Dataset,
+	since string,
+	limit int,
+	latestOnly bool,
+	reverse bool,
+	filter *server.ChangesFilter,
+) error {
+	stream, writePublic := handler.newPublicStream(c, writer, dataset)
+
+	var continuationToken string
+	var err error
+	switch {
+	case dataset.IsProxy():
+		proxyDataset := dataset.AsProxy(handler.lookupAuth(dataset.ProxyConfig.AuthProviderName))
+		continuationToken, err = proxyDataset.StreamChanges(since, limit, latestOnly, reverse, writePublic, nil)
+	case dataset.IsVirtual():
+		continuationToken, err = handler.asVirtualDataset(dataset, limit).StreamChanges(since, c.Request().Body, writePublic)
+	default:
+		sinceNum, err2 := decodeSince(since)
+		if err2 != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.SinceParseErr(err2).Error())
+		}
+		writeJSON := func(jsonData []byte) error {
+			entity := &server.Entity{}
+			if err := json.Unmarshal(jsonData, entity); err != nil {
+				return err
+			}
+			return writePublic(entity)
+		}
+		if reverse {
+			continuationToken, err = handler.reverseChanges(dataset, sinceNum, limit, filter, writeJSON)
+		} else {
+			var next uint64
+			next, err = dataset.ProcessFilteredChangesRaw(uint64(sinceNum), limit, latestOnly, filter, writeJSON)
+			continuationToken = encodeSince(types.DatasetOffset(next))
+		}
+	}
+	if err != nil {
+		return stream.fail(http.StatusInternalServerError, err)
+	}
+	return stream.end(continuationToken)
+}
@@ -0,0 +1,358 @@
+// Copyright 2023 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"bytes"
+	"encoding/json"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+
+	"github.com/DataDog/datadog-go/v5/statsd"
+	"github.com/labstack/echo/v4"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/conf"
+	"github.com/mimiro-io/datahub/internal/security"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+var _ = Describe("The entity output formats", func() {
+	context := &server.Context{ID: "@context", Namespaces: map[string]string{
+		"ex":  "http://example.com/",
+		"rdf": "http://www.w3.org/1999/02/22-rdf-syntax-ns#",
+	}}
+	newEntity := func(id string) *server.Entity {
+		e := server.NewEntity(id, 0)
+		e.Properties["ex:name"] = "Jane \"JD\" Doe"
+		e.Properties["ex:age"] = float64(42)
+		e.Properties["ex:nicks"] = []any{"jd", "j"}
+		e.References["rdf:type"] = "ex:Person"
+		return e
+	}
+	stream := func(accept string, query string, entities ...*server.Entity) *http.Response {
+		e := echo.New()
+		req := httptest.NewRequest(http.MethodGet, "/datasets/people/entities"+query, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		c := e.NewContext(req, rec)
+		writer := entityStreamWriterFor(c)
+		Expect(writer).NotTo(BeNil())
+		s := &formattedStream{c: c, writer: writer, context: context}
+		for _, entity := range entities {
+			Expect(s.write(entity)).To(Succeed())
+		}
+		Expect(s.end("token-1")).To(Succeed())
+		return rec.Result()
+	}
+	body := func(res *http.Response) string {
+		data, _ := io.ReadAll(res.Body)
+		return string(data)
+	}
+
+	It("Should leave UDA JSON to the default handlers", func() {
+		for _, accept := range []string{
+			"", "application/json", "application/json;q=1, text/csv;q=0.1", "text/html, */*;q=0.8", "text/csv;q=0",
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept", accept)
+			Expect(entityStreamWriterFor(echo.New().NewContext(req, httptest.NewRecorder()))).To(BeNil(), accept)
+		}
+	})
+
+	It("Should pick the format with the highest q value", func() {
+		for accept, contentType := range map[string]string{
+			"text/csv":                                     mimeCSV,
+			"application/json;q=0.5, text/csv":             mimeCSV,
+			"text/turtle;q=0.2, application/n-triples":     mimeNTriples,
+			"text/csv;q=0.9, application/x-ndjson; q=0.95": mimeNDJSON,
+			"application/ld+json, application/json":        mimeJSONLD,
+		} {
+			req := httptest.NewRequest(http.MethodGet, "/", nil)
+			req.Header.Set("Accept", accept)
+			writer := entityStreamWriterFor(echo.New().NewContext(req, httptest.NewRecorder()))
+			Expect(writer).NotTo(BeNil(), accept)
+			Expect(writer.contentType()).To(Equal(contentType), accept)
+		}
+	})
+
+	It("Should write a JSON-LD document with the context and the entities in the graph", func() {
+		deleted := newEntity("http://example.com/2")
+		deleted.IsDeleted = true
+		deleted.References["ex:knows"] = []any{"ex:1", "http://other.example.com/3"}
+		res := stream("application/ld+json", "", newEntity("ex:1"), deleted)
+		Expect(res.Header.Get("Content-Type")).To(Equal("application/ld+json"))
+		doc := map[string]any{}
+		Expect(json.Unmarshal([]byte(body(res)), &doc)).To(Succeed())
+		Expect(doc["@context"]).To(HaveKeyWithValue("ex", "http://example.com/"))
+		Expect(doc["@context"]).To(HaveKeyWithValue("xsd", "http://www.w3.org/2001/XMLSchema#"))
+
+		graph := doc["@graph"].([]any)
+		Expect(graph).To(HaveLen(3))
+		first := graph[0].(map[string]any)
+		Expect(first["@id"]).To(Equal("ex:1"))
+		Expect(first["@type"]).To(Equal("ex:Person"))
+		Expect(first).NotTo(HaveKey("rdf:type"))
+		Expect(first["ex:age"]).To(Equal(float64(42)))
+		Expect(first).NotTo(HaveKey("core:deleted"))
+
+		second := graph[1].(map[string]any)
+		Expect(second["@id"]).To(Equal("ex:2"))
+		Expect(second["core:deleted"]).To(Equal(true))
+		Expect(second["ex:knows"]).To(Equal([]any{
+			map[string]any{"@id": "ex:1"},
+			map[string]any{"@id": "http://other.example.com/3"},
+		}))
+
+		Expect(graph[2]).To(Equal(map[string]any{"@type": "core:continuation", "core:token": "token-1"}))
+	})
+
+	It("Should frame JSON-LD by type", func() {
+		other := newEntity("ex:2")
+		other.References["rdf:type"] = "ex:Place"
+		res := stream("application/ld+json", "?frame=http://example.com/Place", newEntity("ex:1"), other)
+		doc := map[string]any{}
+		Expect(json.Unmarshal([]byte(body(res)), &doc)).To(Succeed())
+		graph := doc["@graph"].([]any)
+		Expect(graph).To(HaveLen(2))
+		Expect(graph[0].(map[string]any)["@id"]).To(Equal("ex:2"))
+	})
+
+	It("Should write NDJSON with the continuation token as trailer", func() {
+		res := stream("application/x-ndjson", "", newEntity("ex:1"), newEntity("ex:2"))
+		Expect(res.Header.Get("Content-Type")).To(Equal("application/x-ndjson"))
+		lines := strings.Split(strings.TrimSpace(body(res)), "\n")
+		Expect(lines).To(HaveLen(3))
+		Expect(lines[0]).To(ContainSubstring(`"namespaces"`))
+		Expect(lines[1]).To(ContainSubstring(`"id":"ex:1"`))
+		Expect(res.Trailer.Get(continuationTrailer)).To(Equal("token-1"))
+	})
+
+	It("Should write CSV with columns from the first entity", func() {
+		res := stream("text/csv", "", newEntity("ex:1"))
+		Expect(body(res)).To(Equal("id,deleted,ex:age,ex:name,ex:nicks,rdf:type\n" +
+			"ex:1,false,42,\"Jane \"\"JD\"\" Doe\",jd|j,ex:Person\n"))
+	})
+
+	It("Should write CSV with selected columns given as CURIEs or URIs", func() {
+		res := stream("text/csv", "?columns=http://example.com/name,ex:missing,rdf:type", newEntity("ex:1"))
+		Expect(body(res)).To(Equal("id,http://example.com/name,ex:missing,rdf:type\n" +
+			"ex:1,\"Jane \"\"JD\"\" Doe\",,ex:Person\n"))
+	})
+
+	It("Should write a CSV header when there are no entities", func() {
+		Expect(body(stream("text/csv", "?columns=ex:name"))).To(Equal("id,ex:name\n"))
+	})
+
+	It("Should write N-Triples with expanded URIs and typed literals", func() {
+		deleted := server.NewEntity("ex:2", 0)
+		deleted.IsDeleted = true
+		res := stream("application/n-triples", "", newEntity("ex:1"), deleted)
+		Expect(res.Header.Get("Content-Type")).To(Equal("application/n-triples"))
+		Expect(strings.Split(strings.TrimSpace(body(res)), "\n")).To(Equal([]string{
+			`<http://example.com/1> <http://example.com/age> "42"^^<http://www.w3.org/2001/XMLSchema#integer> .`,
+			`<http://example.com/1> <http://example.com/name> "Jane \"JD\" Doe" .`,
+			`<http://example.com/1> <http://example.com/nicks> "jd" .`,
+			`<http://example.com/1> <http://example.com/nicks> "j" .`,
+			`<http://example.com/1> <http://www.w3.org/1999/02/22-rdf-syntax-ns#type> <http://example.com/Person> .`,
+			`<http://example.com/2> <http://data.mimiro.io/core/uda/deleted> "true"^^<http://www.w3.org/2001/XMLSchema#boolean> .`,
+		}))
+		Expect(res.Trailer.Get(continuationTrailer)).To(Equal("token-1"))
+	})
+})
+
+var _ = Describe("The entity input formats", func() {
+	var store *server.Store
+	var handler *datasetHandler
+	storeLocation := "./test_entity_input_formats"
+	BeforeEach(func() {
+		_ = os.RemoveAll(storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = server.NewStore(e, &statsd.NoOpClient{})
+		handler = &datasetHandler{store: store}
+	})
+	AfterEach(func() {
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+	parse := func(contentType string, body io.Reader) ([]*server.Entity, error) {
+		req := httptest.NewRequest(http.MethodPost, "/datasets/people/entities", body)
+		req.Header.Set("Content-Type", contentType)
+		c := echo.New().NewContext(req, httptest.NewRecorder())
+		parse, reader, err := handler.entityParserFor(c)
+		if err != nil {
+			return nil, err
+		}
+		var entities []*server.Entity
+		err = parse(reader, func(entity *server.Entity) error {
+			entities = append(entities, entity)
+			return nil
+		})
+		return entities, err
+	}
+
+	It("Should parse UDA JSON by default and N-Triples by content type", func() {
+		entities, err := parse("application/json",
+			strings.NewReader(`[{"id":"@context","namespaces":{"ex":"http://example.com/"}},{"id":"ex:1"}]`))
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(1))
+
+		entities, err = parse("application/n-triples; charset=utf-8",
+			strings.NewReader("<http://example.com/1> <http://example.com/name> \"one\" .\n"))
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(1))
+	})
+
+	It("Should parse JSON-LD in the shape it is written", func() {
+		writer := &jsonLDWriter{}
+		var out bytes.Buffer
+		Expect(writer.begin(&out, &server.Context{Namespaces: map[string]string{"ex": "http://example.com/"}})).To(Succeed())
+		entity := server.NewEntity("ex:1", 0)
+		entity.Properties["ex:name"] = "one"
+		entity.References["rdf:type"] = "ex:Thing"
+		entity.References["ex:next"] = []string{"ex:2"}
+		Expect(writer.writeEntity(&out, entity)).To(Succeed())
+		Expect(writer.end(&out, "token-1")).To(Succeed())
+
+		entities, err := parse("application/ld+json", &out)
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(1))
+		ex, _ := store.NamespaceManager.GetPrefixMappingForExpansion("http://example.com/")
+		Expect(entities[0].ID).To(Equal(ex + ":1"))
+		Expect(entities[0].Properties[ex+":name"]).To(Equal("one"))
+		Expect(entities[0].References[ex+":next"]).To(Equal(ex + ":2"))
+		Expect(entities[0].References).To(HaveLen(2))
+	})
+
+	It("Should parse CSV from a multipart body with a mapping", func() {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField("mapping", `{"idTemplate":"http://example.com/{id}",
+			"columns":[{"column":"name","property":"http://example.com/name"}]}`)
+		_ = mw.WriteField("data", "id,name\n1,one\n2,two\n")
+		_ = mw.Close()
+
+		entities, err := parse(mw.FormDataContentType(), body)
+		Expect(err).To(BeNil())
+		Expect(entities).To(HaveLen(2))
+	})
+
+	It("Should require the mapping before the CSV data", func() {
+		body := &bytes.Buffer{}
+		mw := multipart.NewWriter(body)
+		_ = mw.WriteField("data", "id,name\n1,one\n")
+		_ = mw.Close()
+
+		_, err := parse(mw.FormDataContentType(), body)
+		Expect(err).To(MatchError(ContainSubstring("mapping part first")))
+	})
+})
+
+var _ = Describe("The entity output formats of proxy datasets", func() {
+	var store *server.Store
+	var handler *datasetHandler
+	var remote *httptest.Server
+	storeLocation := "./test_entity_output_formats_proxy"
+	BeforeEach(func() {
+		_ = os.RemoveAll(storeLocation)
+		e := &conf.Config{Logger: zap.NewNop().Sugar(), StoreLocation: storeLocation}
+		store = server.NewStore(e, &statsd.NoOpClient{})
+		handler = &datasetHandler{
+			datasetManager: server.NewDsManager(e, store, server.NoOpBus()),
+			store:          store,
+			tokenProviders: &security.TokenProviders{Providers: &map[string]security.Provider{}},
+		}
+		remote = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`[{"id":"@context","namespaces":{"r":"http://remote.example.com/",` +
+				`"n":"http://new.example.com/"}},{"id":"r:1","props":{"n:name":"one"}},` +
+				`{"id":"r:2","props":{"n:name":"two","n:age":2}},{"id":"@continuation","token":"next"}]`))
+		}))
+	})
+	AfterEach(func() {
+		remote.Close()
+		_ = store.Close()
+		_ = os.RemoveAll(storeLocation)
+	})
+	stream := func(changes bool, accept string, query string) string {
+		ds, err := handler.datasetManager.CreateDataset("proxied", &server.CreateDatasetConfig{
+			ProxyDatasetConfig: &server.ProxyDatasetConfig{RemoteURL: remote.URL + "/datasets/remote"},
+		})
+		Expect(err).To(BeNil())
+		req := httptest.NewRequest(http.MethodGet, "/datasets/proxied/entities"+query, nil)
+		req.Header.Set("Accept", accept)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		if changes {
+			Expect(handler.streamChangesAs(c, entityStreamWriterFor(c), ds, "", 0, false, false, nil)).To(Succeed())
+		} else {
+			Expect(handler.streamEntitiesAs(c, entityStreamWriterFor(c), ds, "", 0)).To(Succeed())
+		}
+		return rec.Body.String()
+	}
+
+	It("Should write proxied entities with public prefixes and the namespaces read from the remote", func() {
+		Expect(store.NamespaceManager.AssignPrefix("http://remote.example.com/", "remote")).To(Succeed())
+		for _, changes := range []bool{false, true} {
+			lines := strings.Split(strings.TrimSpace(stream(changes, "application/x-ndjson", "")), "\n")
+			Expect(lines).To(HaveLen(3))
+			context := &server.Context{}
+			Expect(json.Unmarshal([]byte(lines[0]), context)).To(Succeed())
+			Expect(context.Namespaces).To(HaveKeyWithValue("remote", "http://remote.example.com/"))
+			Expect(context.Namespaces).To(ContainElement("http://new.example.com/"),
+				"namespaces first seen in the remote response are in the context")
+			entity := &server.Entity{}
+			Expect(json.Unmarshal([]byte(lines[1]), entity)).To(Succeed())
+			Expect(entity.ID).To(Equal("remote:1"))
+		}
+	})
+
+	It("Should leave out CSV values that are not in the columns of the first entity", func() {
+		n, _ := store.NamespaceManager.AssertPrefixMappingForExpansion("http://new.example.com/")
+		r, _ := store.NamespaceManager.AssertPrefixMappingForExpansion("http://remote.example.com/")
+		Expect(stream(false, "text/csv", "")).To(Equal("id,deleted," + n + ":name\n" +
+			r + ":1,false,one\n" + r + ":2,false,two\n"))
+		Expect(stream(true, "text/csv", "?columns=http://new.example.com/name,http://new.example.com/age")).
+			To(Equal("id,http://new.example.com/name,http://new.example.com/age\n" +
+				r + ":1,one,\n" + r + ":2,two,2\n"))
+	})
+
+	It("Should send errors after the first entity in a trailer", func() {
+		broken := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte(`[{"id":"@context","namespaces":{}},{"id":"http://remote.example.com/1","props":{}},{"id":`))
+		}))
+		defer broken.Close()
+		ds, err := handler.datasetManager.CreateDataset("broken", &server.CreateDatasetConfig{
+			ProxyDatasetConfig: &server.ProxyDatasetConfig{RemoteURL: broken.URL + "/datasets/remote"},
+		})
+		Expect(err).To(BeNil())
+		req := httptest.NewRequest(http.MethodGet, "/datasets/broken/entities", nil)
+		req.Header.Set("Accept", mimeNDJSON)
+		rec := httptest.NewRecorder()
+		c := echo.New().NewContext(req, rec)
+		Expect(handler.streamEntitiesAs(c, entityStreamWriterFor(c), ds, "", 0)).To(Succeed())
+
+		res := rec.Result()
+		Expect(res.StatusCode).To(Equal(http.StatusOK))
+		Expect(strings.Split(strings.TrimSpace(rec.Body.String()), "\n")).To(HaveLen(2), "the context and the first entity")
+		Expect(res.Trailer.Get(errorTrailer)).To(HavePrefix("internal failure: "))
+		Expect(res.Trailer.Get(continuationTrailer)).To(Equal(""))
+	})
+})
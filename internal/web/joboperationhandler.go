@@ -15,12 +15,15 @@
 package web
 
 import (
+	"errors"
 	"net/http"
+	"time"
 
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 
 	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/server"
 )
 
 type jobOperationHandler struct {
@@ -90,6 +93,26 @@ func (handler *jobOperationHandler) jobsRun(c echo.Context) error {
 func (handler *jobOperationHandler) jobsReset(c echo.Context) error {
 	jobID := c.Param("jobid")
 	since := c.QueryParam("since")
+	sinceTime := c.QueryParam("sinceTime")
+
+	if sinceTime != "" {
+		if since != "" {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				server.HTTPQueryParamErr(errors.New("since and sinceTime cannot be combined")).Error())
+		}
+		t, err := time.Parse(time.RFC3339, sinceTime)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+		err = handler.jobScheduler.ResetJobToTime(jobID, t)
+		if errors.Is(err, jobs.ErrTimeResetNotSupported) {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		if err != nil {
+			return c.JSON(http.StatusInternalServerError, "internal error")
+		}
+		return c.JSON(http.StatusOK, &JobResponse{JobID: jobID})
+	}
 
 	err := handler.jobScheduler.ResetJob(jobID, since)
 	if err != nil {
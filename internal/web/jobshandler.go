@@ -15,14 +15,19 @@
 package web
 
 import (
+	"encoding/json"
+	"errors"
 	"io/ioutil"
 	"net/http"
 	"net/url"
+	"strconv"
 
+	"github.com/golang-jwt/jwt/v4"
 	"github.com/labstack/echo/v4"
 	"go.uber.org/zap"
 
 	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/security"
 	"github.com/mimiro-io/datahub/internal/server"
 )
 
@@ -51,14 +56,29 @@ func RegisterJobsHandler(e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware
 	e.GET("/jobs/_/schedules", handler.jobsListSchedules, mw.authorizer(log, datahubRead))
 	e.GET("/jobs/_/status", handler.jobsListStatus, mw.authorizer(log, datahubRead))
 	e.GET("/jobs/_/history", handler.jobsListHistory, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/_/dag", handler.jobsGraph, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/_/circuits", handler.jobsListCircuits, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/_/ratelimits", handler.jobsListRateLimits, mw.authorizer(log, datahubRead))
 
 	e.GET(
 		"/jobs/:jobid",
 		handler.jobsGetDefinition,
 		mw.authorizer(log, datahubRead),
 	) // the json used to define it
+	e.GET("/jobs/:jobid/runs", handler.jobsListRuns, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/:jobid/runs/:runid", handler.jobsGetRun, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/:jobid/runs/:runid/logs", handler.jobsGetRunLog, mw.authorizer(log, datahubRead))
 	e.DELETE("/jobs/:jobid", handler.jobsDelete, mw.authorizer(log, datahubWrite)) // remove an existing job
 	e.POST("/jobs", handler.jobsAdd, mw.authorizer(log, datahubWrite))
+	e.POST("/jobs/:jobid/preview", handler.jobsPreview, mw.authorizer(log, datahubWrite))
+	e.GET("/jobs/:jobid/versions", handler.jobsListVersions, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/:jobid/versions/:version", handler.jobsGetVersion, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/:jobid/versions/:version/diff", handler.jobsDiffVersions, mw.authorizer(log, datahubRead))
+	e.PUT("/jobs/:jobid/rollback/:version", handler.jobsRollback, mw.authorizer(log, datahubWrite))
+	e.GET("/jobs/:jobid/deadletters", handler.jobsListDeadLetters, mw.authorizer(log, datahubRead))
+	e.GET("/jobs/:jobid/deadletters/:entityid", handler.jobsGetDeadLetter, mw.authorizer(log, datahubRead))
+	e.POST("/jobs/:jobid/deadletters/replay", handler.jobsReplayDeadLetters, mw.authorizer(log, datahubWrite))
+	e.POST("/jobs/:jobid/deadletters/discard", handler.jobsDiscardDeadLetters, mw.authorizer(log, datahubWrite))
 }
 
 func (handler *jobsHandler) jobsList(c echo.Context) error {
@@ -77,7 +97,7 @@ func (handler *jobsHandler) jobsAdd(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJobParsingErr(err).Error())
 	}
 
-	err = handler.jobScheduler.AddJob(config)
+	err = handler.jobScheduler.AddJobVersion(config, requestSubject(c), c.QueryParam("comment"))
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
@@ -85,6 +105,125 @@ func (handler *jobsHandler) jobsAdd(c echo.Context) error {
 	return c.JSON(http.StatusCreated, &JobResponse{JobID: config.ID})
 }
 
+// requestSubject returns the subject of the jwt token of the request, or an empty string if security is off
+func requestSubject(c echo.Context) string {
+	if token, ok := c.Get("user").(*jwt.Token); ok {
+		if claims, ok := token.Claims.(*security.CustomClaims); ok {
+			return claims.Subject
+		}
+	}
+	return ""
+}
+
+func (handler *jobsHandler) jobsListVersions(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	versions, err := handler.jobScheduler.GetJobVersions(jobID)
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, versions)
+}
+
+func (handler *jobsHandler) jobsGetVersion(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+	}
+	jobVersion, err := handler.jobScheduler.GetJobVersion(jobID, version)
+	if errors.Is(err, jobs.ErrJobVersionNotFound) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, jobVersion)
+}
+
+// jobsDiffVersions returns the changes from a version of a job to the version given by the to query parameter,
+// or to the latest version
+func (handler *jobsHandler) jobsDiffVersions(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	from, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+	}
+	to := 0
+	if v := c.QueryParam("to"); v != "" {
+		to, err = strconv.Atoi(v)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+		}
+	}
+	diff, err := handler.jobScheduler.DiffJobVersions(jobID, from, to)
+	if errors.Is(err, jobs.ErrJobVersionNotFound) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	return c.JSON(http.StatusOK, diff)
+}
+
+func (handler *jobsHandler) jobsRollback(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	version, err := strconv.Atoi(c.Param("version"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+	}
+	jobVersion, err := handler.jobScheduler.RollbackJob(jobID, version, requestSubject(c))
+	if errors.Is(err, jobs.ErrJobVersionNotFound) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, jobVersion)
+}
+
+// jobsPreview does a dry run of a job. If a job definition is posted, that is used instead of the saved job, so
+// jobs can be previewed before they are saved.
+func (handler *jobsHandler) jobsPreview(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPBodyMissingErr(err).Error())
+	}
+
+	var config *jobs.JobConfiguration
+	if len(body) > 0 {
+		config, err = handler.jobScheduler.Parse(body)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJobParsingErr(err).Error())
+		}
+		if config.ID == "" {
+			config.ID = jobID
+		}
+	} else {
+		config, err = handler.jobScheduler.LoadJob(jobID)
+		if err != nil || config.ID == "" {
+			return c.NoContent(http.StatusNotFound)
+		}
+	}
+
+	options := jobs.PreviewOptions{JobType: c.QueryParam("jobType")}
+	for name, target := range map[string]*int{"batches": &options.Batches, "batchSize": &options.BatchSize} {
+		if v := c.QueryParam(name); v != "" {
+			f, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+			}
+			*target = int(f)
+		}
+	}
+
+	preview, err := handler.jobScheduler.PreviewJob(c.Request().Context(), config, options)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJobParsingErr(err).Error())
+	}
+	return c.JSON(http.StatusOK, preview)
+}
+
 func (handler *jobsHandler) jobsGetDefinition(c echo.Context) error {
 	jobID := c.Param("jobid")
 
@@ -114,6 +253,155 @@ func (handler *jobsHandler) jobsListHistory(c echo.Context) error {
 	return c.JSON(http.StatusOK, handler.jobScheduler.GetJobHistory())
 }
 
+func (handler *jobsHandler) jobsGraph(c echo.Context) error {
+	return c.JSON(http.StatusOK, handler.jobScheduler.GetJobGraph())
+}
+
+// jobsListCircuits returns the circuit breakers of the hosts jobs send to, and the jobs that are on hold
+func (handler *jobsHandler) jobsListCircuits(c echo.Context) error {
+	return c.JSON(http.StatusOK, handler.jobScheduler.GetCircuitStates())
+}
+
+// jobsListRateLimits returns the rate limits shared by jobs and proxy datasets, and how many requests are in flight
+func (handler *jobsHandler) jobsListRateLimits(c echo.Context) error {
+	return c.JSON(http.StatusOK, handler.jobScheduler.GetRateLimits())
+}
+
+// jobsListRuns returns the runs of a job, newest first. It is paged with the offset and limit query parameters.
+func (handler *jobsHandler) jobsListRuns(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	offset, limit := 0, 0
+	for name, target := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if v := c.QueryParam(name); v != "" {
+			f, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+			}
+			*target = int(f)
+		}
+	}
+	runs, err := handler.jobScheduler.GetJobRuns(jobID, offset, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+	}
+	return c.JSON(http.StatusOK, runs)
+}
+
+func (handler *jobsHandler) jobsGetRun(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	run, err := handler.jobScheduler.GetJobRun(jobID, c.Param("runid"))
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if run == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, run)
+}
+
+func (handler *jobsHandler) jobsGetRunLog(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	runLog, err := handler.jobScheduler.GetJobRunLog(jobID, c.Param("runid"))
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if runLog == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, runLog)
+}
+
+// jobsListDeadLetters returns the dead letters of a job, most recently failed first. It is paged with the offset and
+// limit query parameters.
+func (handler *jobsHandler) jobsListDeadLetters(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	offset, limit := 0, 0
+	for name, target := range map[string]*int{"offset": &offset, "limit": &limit} {
+		if v := c.QueryParam(name); v != "" {
+			f, err := strconv.ParseInt(v, 10, 64)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+			}
+			*target = int(f)
+		}
+	}
+	letters, err := handler.jobScheduler.GetDeadLetters(jobID, offset, limit)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPQueryParamErr(err).Error())
+	}
+	return c.JSON(http.StatusOK, letters)
+}
+
+func (handler *jobsHandler) jobsGetDeadLetter(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	entityID, _ := url.QueryUnescape(c.Param("entityid"))
+	letter, err := handler.jobScheduler.GetDeadLetter(jobID, entityID)
+	if err != nil {
+		return c.NoContent(http.StatusInternalServerError)
+	}
+	if letter == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, letter)
+}
+
+// DeadLettersRequest selects the dead letters to replay or discard. All dead letters of the job are selected when
+// it has no ids, or when there is no request body.
+type DeadLettersRequest struct {
+	IDs []string `json:"ids"`
+}
+
+func readDeadLettersRequest(c echo.Context) (*DeadLettersRequest, error) {
+	body, err := ioutil.ReadAll(c.Request().Body)
+	if err != nil {
+		return nil, err
+	}
+	request := &DeadLettersRequest{}
+	if len(body) > 0 {
+		if err := json.Unmarshal(body, request); err != nil {
+			return nil, err
+		}
+	}
+	return request, nil
+}
+
+// jobsReplayDeadLetters runs dead letters through the pipeline of the job again
+func (handler *jobsHandler) jobsReplayDeadLetters(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	request, err := readDeadLettersRequest(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPBodyMissingErr(err).Error())
+	}
+	result, err := handler.jobScheduler.ReplayDeadLetters(jobID, request.IDs)
+	if errors.Is(err, jobs.ErrJobNotFound) {
+		return c.NoContent(http.StatusNotFound)
+	}
+	if errors.Is(err, jobs.ErrJobRunning) {
+		return echo.NewHTTPError(http.StatusConflict, err.Error())
+	}
+	if errors.Is(err, jobs.ErrNoTickets) {
+		return echo.NewHTTPError(http.StatusServiceUnavailable, err.Error())
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, result)
+}
+
+// jobsDiscardDeadLetters removes dead letters without processing them
+func (handler *jobsHandler) jobsDiscardDeadLetters(c echo.Context) error {
+	jobID, _ := url.QueryUnescape(c.Param("jobid"))
+	request, err := readDeadLettersRequest(c)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPBodyMissingErr(err).Error())
+	}
+	discarded, err := handler.jobScheduler.DiscardDeadLetters(jobID, request.IDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.JSON(http.StatusOK, map[string]int{"discarded": discarded})
+}
+
 // jobsDelete will delete a job with the given jobid if it exists
 // it should return 200 OK when successful, but 404 if the job id
 // does not exists
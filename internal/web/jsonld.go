@@ -0,0 +1,271 @@
+// Copyright 2023 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"encoding/json"
+	"io"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+// jsonLDWriter writes a JSON-LD document with the namespaces of the dataset as @context, and the entities
+// in its @graph. Identifiers are compacted against the context, rdf:type references become @type and
+// other references are node references. When frame lists types, only entities of one of them are written.
+// The continuation token is the last node of the graph.
+type jsonLDWriter struct {
+	frame   []string
+	types   map[string]bool // the frame types, expanded
+	context *server.Context
+	count   int
+}
+
+func (jw *jsonLDWriter) contentType() string { return mimeJSONLD }
+
+func (jw *jsonLDWriter) begin(w io.Writer, context *server.Context) error {
+	jw.context = jsonLDContext(context)
+	if len(jw.frame) > 0 {
+		jw.types = make(map[string]bool, len(jw.frame))
+		for _, t := range jw.frame {
+			jw.types[expandCURIE(jw.context, t)] = true
+		}
+	}
+	header, err := json.Marshal(jw.context.Namespaces)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write([]byte(`{"@context":` + string(header) + `,"@graph":[`))
+	return err
+}
+
+func (jw *jsonLDWriter) writeEntity(w io.Writer, entity *server.Entity) error {
+	if jw.types != nil && !jw.matchesFrame(entity) {
+		return nil
+	}
+	return jw.writeNode(w, compactJSONLD(jw.context, toJSONLD(entity)))
+}
+
+func (jw *jsonLDWriter) end(w io.Writer, continuationToken string) error {
+	if continuationToken != "" {
+		err := jw.writeNode(w, map[string]interface{}{
+			"@type":      compactURI(jw.context, server.UdaContinuationURI),
+			"core:token": continuationToken,
+		})
+		if err != nil {
+			return err
+		}
+	}
+	_, err := w.Write([]byte("]}"))
+	return err
+}
+
+func (jw *jsonLDWriter) writeNode(w io.Writer, node map[string]interface{}) error {
+	data, err := json.Marshal(node)
+	if err != nil {
+		return err
+	}
+	if jw.count > 0 {
+		data = append([]byte(","), data...)
+	}
+	jw.count++
+	_, err = w.Write(data)
+	return err
+}
+
+func (jw *jsonLDWriter) matchesFrame(entity *server.Entity) bool {
+	for key, value := range entity.References {
+		if expandCURIE(jw.context, key) != server.RdfTypeURI {
+			continue
+		}
+		for _, t := range flattenValues(value) {
+			if jw.types[expandCURIE(jw.context, t)] {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// jsonLDContext adds the core, rdf and xsd prefixes to the namespaces of a dataset
+func jsonLDContext(context *server.Context) *server.Context {
+	namespaces := make(map[string]string, len(context.Namespaces)+3)
+	for k, v := range context.Namespaces {
+		namespaces[k] = v
+	}
+	namespaces["core"] = "http://data.mimiro.io/core/uda/"
+	namespaces["rdf"] = "http://www.w3.org/1999/02/22-rdf-syntax-ns#"
+	namespaces["xsd"] = xsdNamespace
+	return &server.Context{ID: context.ID, Namespaces: namespaces}
+}
+
+// compactJSONLD compacts the keys and identifiers of a node made by toJSONLD against the context,
+// and turns rdf:type references into @type
+func compactJSONLD(context *server.Context, node map[string]interface{}) map[string]interface{} {
+	compacted := make(map[string]interface{}, len(node))
+	for key, value := range node {
+		switch {
+		case key == "@id":
+			if id, ok := value.(string); ok {
+				value = compactURI(context, id)
+			}
+			compacted[key] = value
+		case expandCURIE(context, key) == server.RdfTypeURI && isJSONLDRef(value):
+			types := make([]string, 0)
+			for _, ref := range jsonLDRefs(value) {
+				types = append(types, compactURI(context, ref.ID))
+			}
+			if len(types) == 1 {
+				compacted["@type"] = types[0]
+			} else {
+				compacted["@type"] = types
+			}
+		default:
+			compacted[compactURI(context, key)] = compactJSONLDValue(context, value)
+		}
+	}
+	return compacted
+}
+
+func compactJSONLDValue(context *server.Context, value interface{}) interface{} {
+	switch v := value.(type) {
+	case JsonLdRef:
+		return JsonLdRef{ID: compactURI(context, v.ID)}
+	case []JsonLdRef:
+		refs := make([]JsonLdRef, len(v))
+		for i, ref := range v {
+			refs[i] = JsonLdRef{ID: compactURI(context, ref.ID)}
+		}
+		return refs
+	case map[string]interface{}:
+		return compactJSONLD(context, v)
+	case []interface{}:
+		values := make([]interface{}, len(v))
+		for i, item := range v {
+			values[i] = compactJSONLDValue(context, item)
+		}
+		return values
+	}
+	return value
+}
+
+func isJSONLDRef(value interface{}) bool {
+	switch value.(type) {
+	case JsonLdRef, []JsonLdRef:
+		return true
+	}
+	return false
+}
+
+func jsonLDRefs(value interface{}) []JsonLdRef {
+	switch v := value.(type) {
+	case JsonLdRef:
+		return []JsonLdRef{v}
+	case []JsonLdRef:
+		return v
+	}
+	return nil
+}
+
+func toJsonLdFromMap(entityMap map[string]interface{}) map[string]interface{} {
+	jsonLd := make(map[string]interface{})
+
+	// add id
+	if entityMap["id"] != nil {
+		jsonLd["@id"] = entityMap["id"]
+	}
+
+	if props, ok := entityMap["props"].(map[string]interface{}); ok {
+		for key, value := range props {
+			jsonLd[key] = toJsonLdValue(value)
+		}
+	}
+
+	// if references
+	if refs, ok := entityMap["refs"].(map[string]interface{}); ok {
+		addJsonLdRefs(jsonLd, refs)
+	}
+
+	return jsonLd
+}
+
+func toJsonLdFromArray(entityArray []interface{}) []interface{} {
+	jsonLd := make([]interface{}, len(entityArray))
+
+	for i, value := range entityArray {
+		jsonLd[i] = toJsonLdValue(value)
+	}
+
+	return jsonLd
+}
+
+func toJsonLdValue(value interface{}) interface{} {
+	// check the type of value
+	switch v := value.(type) {
+	case []interface{}:
+		// array of values
+		return toJsonLdFromArray(v)
+	case map[string]interface{}:
+		// entity as json
+		return toJsonLdFromMap(v)
+	case *server.Entity:
+		return toJSONLD(v)
+	}
+	// assume we can just put out the value, JSON numbers, booleans and strings are typed literals in JSON-LD
+	return value
+}
+
+// addJsonLdRefs adds references as node references. Lists of references are []string in entities made
+// by the datahub, and []interface{} in entities read from JSON.
+func addJsonLdRefs(jsonLd map[string]interface{}, refs map[string]interface{}) {
+	for key, value := range refs {
+		switch v := value.(type) {
+		case string:
+			jsonLd[key] = JsonLdRef{ID: v}
+		case []string, []interface{}:
+			ids := flattenValues(v)
+			nodeRefs := make([]JsonLdRef, 0, len(ids))
+			for _, id := range ids {
+				nodeRefs = append(nodeRefs, JsonLdRef{ID: id})
+			}
+			jsonLd[key] = nodeRefs
+		}
+	}
+}
+
+// Convert Entity JSON-LD representation
+func toJSONLD(entity *server.Entity) map[string]interface{} {
+	jsonLd := make(map[string]interface{})
+
+	// get the id and add that
+	jsonLd["@id"] = entity.ID
+
+	if entity.IsDeleted {
+		jsonLd[udaDeletedURI] = true
+	}
+
+	// get props
+	for key, value := range entity.Properties {
+		jsonLd[key] = toJsonLdValue(value)
+	}
+
+	// get the refs
+	addJsonLdRefs(jsonLd, entity.References)
+
+	return jsonLd
+}
+
+type JsonLdRef struct {
+	ID string `json:"@id"`
+}
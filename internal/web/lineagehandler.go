@@ -0,0 +1,69 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+type lineageHandler struct {
+	jobScheduler *jobs.Scheduler
+}
+
+func RegisterLineageHandler(e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware, js *jobs.Scheduler) {
+	handler := &lineageHandler{jobScheduler: js}
+	e.GET("/lineage", handler.getLineage, mw.authorizer(logger.Named("web"), datahubRead))
+}
+
+// getLineage returns the lineage graph for all jobs, or the upstream and downstream graph
+// of a single dataset or job when the dataset or job query param is given
+func (handler *lineageHandler) getLineage(c echo.Context) error {
+	datasetName := c.QueryParam("dataset")
+	jobID := c.QueryParam("job")
+	if datasetName != "" && jobID != "" {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			server.HTTPQueryParamErr(errors.New("only one of dataset and job can be given")).Error(),
+		)
+	}
+
+	direction := c.QueryParam("direction")
+	if direction != "" && direction != jobs.LineageDirectionUpstream && direction != jobs.LineageDirectionDownstream {
+		return echo.NewHTTPError(
+			http.StatusBadRequest,
+			server.HTTPQueryParamErr(errors.New("direction must be one of: upstream, downstream")).Error(),
+		)
+	}
+
+	nodeID := ""
+	if datasetName != "" {
+		nodeID = jobs.LineageNodeID(jobs.LineageNodeDataset, datasetName)
+	} else if jobID != "" {
+		nodeID = jobs.LineageNodeID(jobs.LineageNodeJob, jobID)
+	}
+
+	lineage, err := handler.jobScheduler.GetLineage(nodeID, direction)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return c.JSON(http.StatusOK, lineage)
+}
@@ -0,0 +1,61 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package web
+
+import (
+	"errors"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+	"go.uber.org/zap"
+
+	"github.com/mimiro-io/datahub/internal/manifests"
+)
+
+type manifestsHandler struct {
+	manifests *manifests.Service
+}
+
+func RegisterManifestsHandler(e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware, ms *manifests.Service) {
+	log := logger.Named("web")
+	handler := &manifestsHandler{manifests: ms}
+	e.GET("/manifests/plan", handler.plan, mw.authorizer(log, datahubRead))
+	e.POST("/manifests/apply", handler.apply, mw.authorizer(log, datahubWrite))
+}
+
+// plan lists what applying the manifests would change, without changing anything
+func (handler *manifestsHandler) plan(c echo.Context) error {
+	plan, err := handler.manifests.Plan()
+	if err != nil {
+		return manifestsError(err)
+	}
+	return c.JSON(http.StatusOK, plan)
+}
+
+// apply syncs the jobs and datasets with the manifests right away, instead of waiting for the next check
+func (handler *manifestsHandler) apply(c echo.Context) error {
+	plan, err := handler.manifests.Apply()
+	if err != nil {
+		return manifestsError(err)
+	}
+	return c.JSON(http.StatusOK, plan)
+}
+
+func manifestsError(err error) error {
+	if errors.Is(err, manifests.ErrManifestsDisabled) {
+		return echo.NewHTTPError(http.StatusNotFound, err.Error())
+	}
+	return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+}
@@ -32,6 +32,7 @@ type Middleware struct {
 	cors       echo.MiddlewareFunc
 	jwt        echo.MiddlewareFunc
 	recover    echo.MiddlewareFunc
+	compress   echo.MiddlewareFunc
 	authorizer func(logger *zap.SugaredLogger, scopes ...string) echo.MiddlewareFunc
 	// 	handler    *WebHandler
 	logger *zap.SugaredLogger
@@ -67,6 +68,7 @@ func NewMiddleware(env *conf.Config, e *echo.Echo, core *security.ServiceCore, l
 		cors:       setupCors(),
 		jwt:        setupJWT(env, core, skipper),
 		recover:    setupRecovery(logger),
+		compress:   middlewares.Compression(env.MaxDecodedRequestSize),
 		authorizer: NewAuthorizer(env, logger, core),
 		env:        env,
 		logger:     logger,
@@ -0,0 +1,184 @@
+// Copyright 2021 MIMIRO AS
+//
+// Licensed under the Apache License, Version 2.0 (the "License");
+// you may not use this file except in compliance with the License.
+// You may obtain a copy of the License at
+//
+//      http://www.apache.org/licenses/LICENSE-2.0
+//
+// Unless required by applicable law or agreed to in writing, software
+// distributed under the License is distributed on an "AS IS" BASIS,
+// WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+// See the License for the specific language governing permissions and
+// limitations under the License.
+
+package middlewares
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+
+	"github.com/labstack/echo/v4"
+
+	"github.com/mimiro-io/datahub/internal/server"
+)
+
+// Compression decodes gzip and zstd request bodies, and compresses responses for clients that send
+// a matching Accept-Encoding header. Responses advertise the accepted request encodings in an
+// Accept-Encoding header, so that clients know they can compress what they send. A decoded request body
+// larger than maxDecodedSize bytes is turned down with 413, maxDecodedSize 0 means no limit.
+func Compression(maxDecodedSize int64) echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			req := c.Request()
+			res := c.Response()
+			res.Header().Set(echo.HeaderAcceptEncoding, server.SupportedEncodings)
+
+			var limited *limitedBody
+			if encoding := req.Header.Get(echo.HeaderContentEncoding); encoding != "" {
+				body, err := server.DecodeBody(encoding, req.Body)
+				if err != nil {
+					if errors.Is(err, server.ErrUnsupportedEncoding) {
+						return echo.NewHTTPError(http.StatusUnsupportedMediaType, err.Error())
+					}
+					return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+				}
+				defer body.Close()
+				req.Body = body
+				if maxDecodedSize > 0 {
+					// a small compressed body can decode to far more than any upload
+					limited = &limitedBody{ReadCloser: body, limit: maxDecodedSize, remaining: maxDecodedSize}
+					req.Body = limited
+				}
+				req.ContentLength = -1
+				req.Header.Del(echo.HeaderContentEncoding)
+				req.Header.Del(echo.HeaderContentLength)
+			}
+
+			encoding := server.NegotiateEncoding(req.Header.Get(echo.HeaderAcceptEncoding))
+			if encoding == "" {
+				return limited.check(res, next(c))
+			}
+			res.Header().Add(echo.HeaderVary, echo.HeaderAcceptEncoding)
+			cw := &compressedWriter{ResponseWriter: res.Writer, encoding: encoding}
+			res.Writer = cw
+			defer func() {
+				res.Writer = cw.ResponseWriter
+				_ = cw.close()
+			}()
+			return limited.check(res, next(c))
+		}
+	}
+}
+
+var errDecodedBodyTooLarge = errors.New("decoded request body is too large")
+
+// limitedBody fails reads past the size limit, and remembers that it did, so that the request is
+// answered with 413 whatever error the handler made of it
+type limitedBody struct {
+	io.ReadCloser
+	limit     int64
+	remaining int64
+	exceeded  bool
+}
+
+func (b *limitedBody) Read(p []byte) (int, error) {
+	if b.exceeded {
+		return 0, errDecodedBodyTooLarge
+	}
+	if int64(len(p)) > b.remaining+1 {
+		p = p[:b.remaining+1]
+	}
+	n, err := b.ReadCloser.Read(p)
+	if int64(n) > b.remaining {
+		n = int(b.remaining)
+		b.remaining = 0
+		b.exceeded = true
+		return n, errDecodedBodyTooLarge
+	}
+	b.remaining -= int64(n)
+	return n, err
+}
+
+// check replaces the result of the handler with 413 if the body went over the limit and nothing was written yet
+func (b *limitedBody) check(res *echo.Response, err error) error {
+	if b == nil || !b.exceeded || res.Committed {
+		return err
+	}
+	return echo.NewHTTPError(http.StatusRequestEntityTooLarge,
+		fmt.Sprintf("decoded request body is larger than %d bytes", b.limit))
+}
+
+// compressedWriter starts compressing on the first write of a body, so that responses without
+// one, such as errors written before any output, are sent as they are.
+type compressedWriter struct {
+	http.ResponseWriter
+	encoding    string
+	status      int
+	wroteHeader bool
+	encoder     io.WriteCloser
+}
+
+func (w *compressedWriter) WriteHeader(status int) {
+	if w.wroteHeader {
+		return
+	}
+	w.wroteHeader = true
+	w.status = status
+	if status == http.StatusNoContent || status == http.StatusNotModified || status < 200 {
+		w.ResponseWriter.WriteHeader(status)
+		w.encoding = ""
+	}
+}
+
+func (w *compressedWriter) Write(b []byte) (int, error) {
+	if !w.wroteHeader {
+		w.WriteHeader(http.StatusOK)
+	}
+	if w.encoding == "" {
+		return w.ResponseWriter.Write(b)
+	}
+	if w.encoder == nil {
+		w.Header().Set(echo.HeaderContentEncoding, w.encoding)
+		w.Header().Del(echo.HeaderContentLength)
+		w.ResponseWriter.WriteHeader(w.status)
+		encoder, err := server.NewEncoder(w.encoding, w.ResponseWriter)
+		if err != nil {
+			return 0, err
+		}
+		w.encoder = encoder
+	}
+	return w.encoder.Write(b)
+}
+
+func (w *compressedWriter) Flush() {
+	if f, ok := w.encoder.(interface{ Flush() error }); ok {
+		_ = f.Flush()
+	}
+	if f, ok := w.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (w *compressedWriter) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return http.NewResponseController(w.ResponseWriter).Hijack()
+}
+
+func (w *compressedWriter) Unwrap() http.ResponseWriter {
+	return w.ResponseWriter
+}
+
+func (w *compressedWriter) close() error {
+	if w.encoder != nil {
+		return w.encoder.Close()
+	}
+	if w.wroteHeader && w.encoding != "" {
+		// a status without a body
+		w.ResponseWriter.WriteHeader(w.status)
+	}
+	return nil
+}
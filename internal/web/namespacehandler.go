@@ -15,6 +15,7 @@
 package web
 
 import (
+	"encoding/json"
 	"net/http"
 
 	"github.com/labstack/echo/v4"
@@ -27,18 +28,73 @@ type namespaceHandler struct {
 	store *server.Store
 }
 
+type namespaceUpdate struct {
+	Expansion string `json:"expansion"`
+	Prefix    string `json:"prefix"`
+}
+
 func RegisterNamespaceHandler(
 	e *echo.Echo,
 	logger *zap.SugaredLogger,
 	mw *Middleware,
 	store *server.Store,
 ) {
+	log := logger.Named("web")
 	handler := namespaceHandler{store: store}
-	e.GET("/namespaces", handler.getNamespaces, mw.authorizer(logger.Named("web"), datahubRead))
+	e.GET("/namespaces", handler.getNamespaces, mw.authorizer(log, datahubRead))
+	e.GET("/namespaces/usage", handler.getNamespaceUsage, mw.authorizer(log, datahubRead))
+	e.PUT("/namespaces/:prefix", handler.assignPrefix, mw.authorizer(log, datahubWrite))
+	e.POST("/namespaces/:prefix/rename", handler.renamePrefix, mw.authorizer(log, datahubWrite))
+	e.DELETE("/namespaces/:prefix", handler.deleteNamespace, mw.authorizer(log, datahubWrite))
 }
 
 func (handler *namespaceHandler) getNamespaces(c echo.Context) error {
-	v := handler.store.GetGlobalContext(false)
+	v := handler.store.NamespaceManager.PublicContext(handler.store.GetGlobalContext(false))
 
 	return c.JSON(http.StatusOK, v.Namespaces)
 }
+
+func (handler *namespaceHandler) getNamespaceUsage(c echo.Context) error {
+	usage, err := handler.store.NamespaceUsage()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, server.HTTPGenericErr(err).Error())
+	}
+	return c.JSON(http.StatusOK, usage)
+}
+
+// assignPrefix makes the prefix path param the public prefix of the expansion given in the body
+func (handler *namespaceHandler) assignPrefix(c echo.Context) error {
+	update := &namespaceUpdate{}
+	err := json.NewDecoder(c.Request().Body).Decode(update)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJsonParsingErr(err).Error())
+	}
+	err = handler.store.NamespaceManager.AssignPrefix(update.Expansion, c.Param("prefix"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// renamePrefix changes the public prefix of a mapping to the prefix given in the body
+func (handler *namespaceHandler) renamePrefix(c echo.Context) error {
+	update := &namespaceUpdate{}
+	err := json.NewDecoder(c.Request().Body).Decode(update)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJsonParsingErr(err).Error())
+	}
+	err = handler.store.NamespaceManager.RenamePrefix(c.Param("prefix"), update.Prefix)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
+
+// deleteNamespace removes a mapping that is not used by any stored entity or dataset
+func (handler *namespaceHandler) deleteNamespace(c echo.Context) error {
+	err := handler.store.RemoveNamespace(c.Request().Context(), c.Param("prefix"))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
+}
@@ -54,6 +54,28 @@ type Query struct {
 	Limit            int      `json:"limit"`
 	Continuations    []string `json:"continuations"`
 	NoPartialMerging bool     `json:"noPartialMerging"`
+	// SameAs resolves entities linked with owl:sameAs into one entity
+	SameAs bool `json:"sameAs"`
+	// MergePolicy overrides how entities found in several datasets are merged, for this query only
+	MergePolicy *server.MergePolicy `json:"mergePolicy"`
+}
+
+// PathQuery asks for the shortest paths between two entities
+type PathQuery struct {
+	From     string `json:"from"`
+	To       string `json:"to"`
+	MaxDepth int    `json:"maxDepth"`
+	Limit    int    `json:"limit"`
+	server.GraphFilter
+}
+
+// NeighbourhoodQuery asks for the entities and references around an entity
+type NeighbourhoodQuery struct {
+	EntityID         string `json:"entityId"`
+	Hops             int    `json:"hops"`
+	Limit            int    `json:"limit"`
+	NoPartialMerging bool   `json:"noPartialMerging"`
+	server.GraphFilter
 }
 
 type NamespacePrefix struct {
@@ -89,6 +111,106 @@ func RegisterQueryHandler(
 	e.GET("/query", handler.queryHandler, mw.authorizer(log, datahubRead))
 	e.POST("/query", handler.queryHandler, mw.authorizer(log, datahubRead))
 	e.GET("/query/namespace", handler.queryNamespacePrefix, mw.authorizer(log, datahubRead))
+	e.POST("/query/paths", handler.queryPaths, mw.authorizer(log, datahubRead))
+	e.POST("/query/neighbourhood", handler.queryNeighbourhood, mw.authorizer(log, datahubRead))
+	e.GET("/query/mergepolicy", handler.getMergePolicy, mw.authorizer(log, datahubRead))
+	e.PUT("/query/mergepolicy", handler.putMergePolicy, mw.authorizer(log, datahubWrite))
+	e.DELETE("/query/mergepolicy", handler.deleteMergePolicy, mw.authorizer(log, datahubWrite))
+}
+
+func (handler *queryHandler) queryPaths(c echo.Context) error {
+	query := &PathQuery{}
+	if err := handler.readJSON(c, query); err != nil {
+		return err
+	}
+	if query.From == "" || query.To == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "from and to are required")
+	}
+	if query.MaxDepth == 0 {
+		query.MaxDepth = 4
+	}
+	paths, err := handler.store.ShortestPaths(query.From, query.To, query.MaxDepth, query.Limit, query.GraphFilter)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	for _, path := range paths {
+		for i, e := range path {
+			path[i] = handler.publicEdge(e)
+		}
+	}
+
+	result := make([]interface{}, 2)
+	result[0] = handler.store.NamespaceManager.PublicContext(handler.store.GetGlobalContext(false))
+	result[1] = paths
+	return c.JSON(http.StatusOK, result)
+}
+
+func (handler *queryHandler) queryNeighbourhood(c echo.Context) error {
+	query := &NeighbourhoodQuery{}
+	if err := handler.readJSON(c, query); err != nil {
+		return err
+	}
+	if query.EntityID == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "entityId is required")
+	}
+	graph, err := handler.store.Neighbourhood(query.EntityID, query.Hops, query.Limit, query.GraphFilter, !query.NoPartialMerging)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	nsm := handler.store.NamespaceManager
+	for i, n := range graph.Nodes {
+		graph.Nodes[i] = nsm.PublicEntity(n)
+	}
+	for i, e := range graph.Edges {
+		graph.Edges[i] = handler.publicEdge(e)
+	}
+
+	result := make([]interface{}, 2)
+	result[0] = nsm.PublicContext(handler.store.GetGlobalContext(false))
+	result[1] = graph
+	return c.JSON(http.StatusOK, result)
+}
+
+func (handler *queryHandler) readJSON(c echo.Context, v interface{}) error {
+	body, err := io.ReadAll(c.Request().Body)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPBodyMissingErr(err).Error())
+	}
+	if err := json.Unmarshal(body, v); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJsonParsingErr(err).Error())
+	}
+	return nil
+}
+
+func (handler *queryHandler) publicEdge(e server.GraphEdge) server.GraphEdge {
+	nsm := handler.store.NamespaceManager
+	return server.GraphEdge{From: nsm.PublicCurie(e.From), Predicate: nsm.PublicCurie(e.Predicate), To: nsm.PublicCurie(e.To)}
+}
+
+func (handler *queryHandler) getMergePolicy(c echo.Context) error {
+	policy := handler.store.MergePolicy()
+	if policy == nil {
+		return c.NoContent(http.StatusNotFound)
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+func (handler *queryHandler) putMergePolicy(c echo.Context) error {
+	policy := &server.MergePolicy{}
+	if err := handler.readJSON(c, policy); err != nil {
+		return err
+	}
+	if err := handler.store.SetMergePolicy(policy); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+	return c.JSON(http.StatusOK, policy)
+}
+
+func (handler *queryHandler) deleteMergePolicy(c echo.Context) error {
+	if err := handler.store.SetMergePolicy(nil); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	return c.NoContent(http.StatusOK)
 }
 
 func (handler *queryHandler) queryNamespacePrefix(c echo.Context) error {
@@ -105,7 +227,7 @@ func (handler *queryHandler) queryNamespacePrefix(c echo.Context) error {
 		return c.NoContent(http.StatusNotFound)
 	}
 
-	return c.JSON(http.StatusOK, &NamespacePrefix{Prefix: prefix, Expansion: urlExpansion})
+	return c.JSON(http.StatusOK, &NamespacePrefix{Prefix: handler.store.NamespaceManager.PublicPrefix(prefix), Expansion: urlExpansion})
 }
 
 type JavascriptQuery struct {
@@ -190,6 +312,17 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 		handler.logger.Warn("Unable to parse json")
 		return echo.NewHTTPError(http.StatusBadRequest, server.HTTPJsonParsingErr(err).Error())
 	}
+	mergePartials := !query.NoPartialMerging
+	if query.MergePolicy != nil {
+		if query.NoPartialMerging {
+			return echo.NewHTTPError(http.StatusBadRequest, "mergePolicy can not be combined with noPartialMerging")
+		}
+		if err := query.MergePolicy.Resolve(handler.store.NamespaceManager); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+		}
+		// fetch the versions of each dataset, and merge them with the policy of the query
+		mergePartials = false
+	}
 	includeContinuation := true
 	// conservative default
 	if query.Limit == 0 {
@@ -198,7 +331,12 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 	}
 
 	if query.EntityID != "" {
-		entity, err := handler.store.GetEntity(query.EntityID, query.Datasets, !query.NoPartialMerging)
+		var entity *server.Entity
+		if query.SameAs {
+			entity, err = handler.store.GetEntityWithSameAs(query.EntityID, query.Datasets, mergePartials)
+		} else {
+			entity, err = handler.store.GetEntity(query.EntityID, query.Datasets, mergePartials)
+		}
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
@@ -207,19 +345,22 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 		// a returned Entity can be the product of multiple entities in multiple datasets with the same ID
 		// To get the correct namespace context, we'd have to use the supplied list of dataset names (query.Datasets)
 		// and merge their respective contexts to our result context here.
-		result[0] = handler.store.GetGlobalContext(false)
+		result[0] = handler.store.NamespaceManager.PublicContext(handler.store.GetGlobalContext(false))
 
 		if entity == nil {
 			entity := &EmptyEntity{}
 			entity.ID = query.EntityID
 			result[1] = entity
 		} else {
+			if query.MergePolicy != nil {
+				entity = query.MergePolicy.MergeMultiOriginEntity(handler.store.NamespaceManager, entity)
+			}
 			if query.Details {
 				l, _ := ent.NewLookup(server.NewBadgerAccess(handler.store, handler.datasetManager))
 				details, _ := l.Details(query.EntityID, query.Datasets)
 				entity.Properties["datahub_details"] = details
 			}
-			result[1] = entity
+			result[1] = handler.store.NamespaceManager.PublicEntity(entity)
 		}
 
 		// return result as JSON
@@ -229,7 +370,7 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
-		queryresult, err := handler.store.GetManyRelatedEntitiesAtTime(cont, query.Limit, !query.NoPartialMerging)
+		queryresult, err := handler.store.GetManyRelatedEntitiesAtTime(cont, query.Limit, mergePartials)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
@@ -237,8 +378,8 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 		result := make([]interface{}, 3)
 		// To get the correct namespace context, we'd have to use the supplied list of dataset names (query.Datasets)
 		// and merge their respective contexts to our result context here.
-		result[0] = handler.store.GetGlobalContext(false)
-		result[1] = server.ToLegacyQueryResult(queryresult)
+		result[0] = handler.store.NamespaceManager.PublicContext(handler.store.GetGlobalContext(false))
+		result[1] = server.ToLegacyQueryResult(handler.publicQueryResult(handler.mergeQueryResult(query, queryresult)))
 		result[2], err = encodeCont(queryresult.Cont)
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
@@ -246,7 +387,12 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 		return c.JSON(http.StatusOK, result)
 	} else {
 		// do query
-		queryresult, err := handler.store.GetManyRelatedEntitiesBatch(query.StartingEntities, query.Predicate, query.Inverse, query.Datasets, query.Limit, !query.NoPartialMerging)
+		var queryresult server.RelatedEntitiesQueryResult
+		if query.SameAs {
+			queryresult, err = handler.store.GetManyRelatedEntitiesWithSameAs(query.StartingEntities, query.Predicate, query.Inverse, query.Datasets, query.Limit, mergePartials)
+		} else {
+			queryresult, err = handler.store.GetManyRelatedEntitiesBatch(query.StartingEntities, query.Predicate, query.Inverse, query.Datasets, query.Limit, mergePartials)
+		}
 		if err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 		}
@@ -254,8 +400,8 @@ func (handler *queryHandler) queryHandler(c echo.Context) error {
 		result := make([]interface{}, 2)
 		// To get the correct namespace context, we'd have to use the supplied list of dataset names (query.Datasets)
 		// and merge their respective contexts to our result context here.
-		result[0] = handler.store.GetGlobalContext(false)
-		result[1] = server.ToLegacyQueryResult(queryresult)
+		result[0] = handler.store.NamespaceManager.PublicContext(handler.store.GetGlobalContext(false))
+		result[1] = server.ToLegacyQueryResult(handler.publicQueryResult(handler.mergeQueryResult(query, queryresult)))
 		// for compatibility with older clients, do not add new array elem when no limit parameter was given
 		if includeContinuation {
 			cont, err := encodeCont(queryresult.Cont)
@@ -302,3 +448,28 @@ func decodeCont(continuations []string) ([]*server.RelatedFrom, error) {
 	}
 	return relatedFroms, nil
 }
+
+// mergeQueryResult merges the related entities with the merge policy of the query, if it has one
+func (handler *queryHandler) mergeQueryResult(query *Query, res server.RelatedEntitiesQueryResult) server.RelatedEntitiesQueryResult {
+	if query.MergePolicy == nil {
+		return res
+	}
+	for i, r := range res.Relations {
+		res.Relations[i].RelatedEntity = query.MergePolicy.MergeMultiOriginEntity(handler.store.NamespaceManager, r.RelatedEntity)
+	}
+	return res
+}
+
+// publicQueryResult rewrites the CURIEs in a query result to use public namespace prefixes
+func (handler *queryHandler) publicQueryResult(res server.RelatedEntitiesQueryResult) server.RelatedEntitiesQueryResult {
+	nsm := handler.store.NamespaceManager
+	if !nsm.HasPublicPrefixes() {
+		return res
+	}
+	for i, r := range res.Relations {
+		res.Relations[i].StartURI = nsm.PublicCurie(r.StartURI)
+		res.Relations[i].PredicateURI = nsm.PublicCurie(r.PredicateURI)
+		res.Relations[i].RelatedEntity = nsm.PublicEntity(r.RelatedEntity)
+	}
+	return res
+}
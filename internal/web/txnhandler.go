@@ -30,7 +30,7 @@ func RegisterTxnHandler(e *echo.Echo, logger *zap.SugaredLogger, mw *Middleware,
 		logger: log,
 	}
 
-	e.POST("/transactions", handler.processTransaction, mw.authorizer(log, datahubWrite))
+	e.POST("/transactions", handler.processTransaction, mw.authorizer(log, datahubWrite), mw.compress)
 }
 
 type txnHandler struct {
@@ -28,6 +28,7 @@ import (
 	"github.com/mimiro-io/datahub/internal/conf"
 	"github.com/mimiro-io/datahub/internal/content"
 	"github.com/mimiro-io/datahub/internal/jobs"
+	"github.com/mimiro-io/datahub/internal/manifests"
 	"github.com/mimiro-io/datahub/internal/server"
 )
 
@@ -97,6 +98,7 @@ type ServiceContext struct {
 	EventBus       server.EventBus
 	TokenProviders *security.TokenProviders
 	JobsScheduler  *jobs.Scheduler
+	Manifests      *manifests.Service
 	Port           string
 }
 
@@ -123,10 +125,14 @@ func NewWebService(serviceContext *ServiceContext) (*WebService, error) {
 	RegisterQueryHandler(e, logger, mw, store, serviceContext.DatasetManager)
 	RegisterJobOperationHandler(e, logger, mw, serviceContext.JobsScheduler)
 	RegisterJobsHandler(e, logger, mw, serviceContext.JobsScheduler)
+	RegisterLineageHandler(e, logger, mw, serviceContext.JobsScheduler)
 	RegisterNamespaceHandler(e, logger, mw, store)
 	RegisterProviderHandler(e, logger, mw, serviceContext.TokenProviders)
 	RegisterSecurityHandler(e, logger, mw, serviceContext.SecurityCore)
 	RegisterStatisticsHandler(e, logger, mw, store)
+	if serviceContext.Manifests != nil {
+		RegisterManifestsHandler(e, logger, mw, serviceContext.Manifests)
+	}
 	return webService, nil
 }
 